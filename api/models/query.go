@@ -1,7 +1,14 @@
 package models
 
+// The statuses of the Prometheus API responses.
+const (
+	StatusSuccess = "success"
+	StatusError   = "error"
+)
+
 type Response struct {
 	Status string `json:"status"`
+	Error  string `json:"error"`
 	Data   Data   `json:"data"`
 }
 
@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"compress/gzip"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
+	"mime"
 	"net/http"
 	"strings"
 
@@ -14,54 +17,239 @@ import (
 
 type responseWriter struct {
 	http.ResponseWriter
-	statusCode int
-	body       *bytes.Buffer
+	statusCode  int
+	body        *bytes.Buffer
+	bodySize    int
+	maxBuffered int64
+	headerSize  int
+	wroteHeader bool
 }
 
-func NewResponseWriter(w http.ResponseWriter) *responseWriter {
-	return &responseWriter{w, http.StatusOK, &bytes.Buffer{}}
+// NewResponseWriter records the status, the headers size and the body of
+// the response written to w. Only the first maxBuffered bytes of the body
+// are kept to be parsed, a zero maxBuffered keeping the whole body.
+func NewResponseWriter(w http.ResponseWriter, maxBuffered int64) *responseWriter {
+	return &responseWriter{ResponseWriter: w, statusCode: http.StatusOK, body: &bytes.Buffer{}, maxBuffered: maxBuffered}
 }
 
-// WriteHeader to capture status code
+// WriteHeader to capture status code and header size
 func (rw *responseWriter) WriteHeader(statusCode int) {
+	if !rw.wroteHeader {
+		rw.wroteHeader = true
+		rw.headerSize = HeaderSize(rw.Header())
+	}
 	rw.statusCode = statusCode
 	rw.ResponseWriter.WriteHeader(statusCode)
 }
 
 // Write to capture body
 func (rw *responseWriter) Write(b []byte) (int, error) {
-	rw.body.Write(b)                  // Write to buffer
-	return rw.ResponseWriter.Write(b) // Write response to client
+	if !rw.wroteHeader {
+		rw.wroteHeader = true
+		rw.headerSize = HeaderSize(rw.Header())
+	}
+	buffered := b
+	if rw.maxBuffered > 0 {
+		buffered = b[:min(int64(len(b)), max(rw.maxBuffered-int64(rw.body.Len()), 0))]
+	}
+	rw.body.Write(buffered) // Write to buffer
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bodySize += n
+	return n, err // Write response to client
+}
+
+// truncated reports whether the body was only partly buffered.
+func (rw *responseWriter) truncated() bool {
+	return rw.body.Len() < rw.bodySize
+}
+
+// HeaderSize returns the approximate wire size of the given headers,
+// counting each "Key: Value\r\n" line.
+func HeaderSize(h http.Header) int {
+	size := 0
+	for key, values := range h {
+		for _, value := range values {
+			size += len(key) + len(": ") + len(value) + len("\r\n")
+		}
+	}
+	return size
 }
 
-func (recw *responseWriter) ParseQueryResponse(includeQueryStats bool) *models.Response {
-	if !includeQueryStats {
+// ParseQueryResponse extracts the status, error and stats of a query
+// response, the stats only when includeQueryStats is set. The status is
+// reported even with a 200 status code, as Prometheus compatible upstreams
+// may answer so with a status of error. At most maxBytes of the
+// decompressed body are read, a zero maxBytes meaning no limit. Responses
+// whose stats are beyond the limit or the buffered body, e.g. after a huge
+// result, are reported without stats, and not at all when their status is
+// beyond it as well.
+func (recw *responseWriter) ParseQueryResponse(includeQueryStats bool, maxBytes int64) *models.Response {
+	// Upstreams and the proxies in front of them may answer with non JSON
+	// bodies, e.g. HTML error pages, which carry no stats.
+	if mediaType, _, err := mime.ParseMediaType(recw.Header().Get("Content-Type")); err != nil || mediaType != "application/json" {
+		slog.Debug("skipping non JSON query response", "contentType", recw.Header().Get("Content-Type"), "statusCode", recw.statusCode)
 		return nil
 	}
 
-	var reader io.Reader = recw.body
+	// Read from a copy so the recorded body size is preserved.
+	var reader io.Reader = bytes.NewReader(recw.body.Bytes())
 	var err error
 
 	if strings.Contains(recw.Header().Get("Content-Encoding"), "gzip") {
-		reader, err = gzip.NewReader(recw.body)
+		reader, err = gzip.NewReader(reader)
 		if err != nil {
 			slog.Error("unable to create gzip reader", "err", err)
 			return nil
 		}
 	}
 
+	limited := &io.LimitedReader{R: reader, N: maxBytes}
+	if maxBytes > 0 {
+		reader = limited
+	}
+
+	response, err := decodeQueryResponse(reader, includeQueryStats)
+	if err != nil {
+		if (maxBytes == 0 || limited.N > 0) && !recw.truncated() {
+			slog.Error("unable to decode response body", "err", err)
+			return nil
+		}
+		slog.Debug("query stats beyond the parsed response size", "maxBytes", maxBytes, "bufferedBytes", recw.body.Len())
+		if response.Status == "" {
+			return nil
+		}
+		response.Data = models.Data{}
+	}
+
+	if response.Status != models.StatusSuccess {
+		slog.Debug("query did not succeed", "status", response.Status, "statusCode", recw.statusCode)
+		response.Data = models.Data{}
+	}
+
+	return response
+}
+
+// decodeQueryResponse streams the status, the error and the data stats out
+// of a query response, skipping over the result without buffering it and
+// stopping as soon as the ones the response may hold are known. On error,
+// the response holds what was decoded before it.
+func decodeQueryResponse(r io.Reader, includeQueryStats bool) (*models.Response, error) {
 	var response models.Response
-	if err = json.NewDecoder(reader).Decode(&response); err != nil {
-		slog.Error("unable to decode response body", "err", err)
-		return nil
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return &response, err
 	}
 
-	if response.Status != "success" {
-		slog.Debug("query did not succeed", "status", response.Status)
-		return nil
+	var hasStatus, hasError, hasStats bool
+	done := func() bool {
+		if !hasStatus {
+			return false
+		}
+		if response.Status == models.StatusError {
+			return hasError
+		}
+		return hasStats || !includeQueryStats
+	}
+	for dec.More() && !done() {
+		key, err := dec.Token()
+		if err != nil {
+			return &response, err
+		}
+
+		switch key {
+		case "status":
+			if err := dec.Decode(&response.Status); err != nil {
+				return &response, err
+			}
+			hasStatus = true
+		case "error":
+			if err := dec.Decode(&response.Error); err != nil {
+				return &response, err
+			}
+			hasError = true
+		case "data":
+			if !includeQueryStats {
+				if err := skipValue(dec); err != nil {
+					return &response, err
+				}
+				continue
+			}
+			if hasStats, err = decodeQueryData(dec, &response.Data); err != nil {
+				return &response, err
+			}
+		default:
+			if err := skipValue(dec); err != nil {
+				return &response, err
+			}
+		}
 	}
 
-	return &response
+	return &response, nil
+}
+
+// decodeQueryData decodes the result type and stats of the data object,
+// returning as soon as the stats are decoded.
+func decodeQueryData(dec *json.Decoder, data *models.Data) (bool, error) {
+	if err := expectDelim(dec, '{'); err != nil {
+		return false, err
+	}
+
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return false, err
+		}
+
+		switch key {
+		case "resultType":
+			if err := dec.Decode(&data.ResultType); err != nil {
+				return false, err
+			}
+		case "stats":
+			if err := dec.Decode(&data.Stats); err != nil {
+				return false, err
+			}
+			return true, nil
+		default:
+			if err := skipValue(dec); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	_, err := dec.Token()
+	return false, err
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != delim {
+		return fmt.Errorf("expected %q, got %v", delim, tok)
+	}
+	return nil
+}
+
+// skipValue consumes the next value token by token.
+func skipValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
 }
 
 func (recw *responseWriter) GetStatusCode() int {
@@ -69,5 +257,39 @@ func (recw *responseWriter) GetStatusCode() int {
 }
 
 func (recw *responseWriter) GetBodySize() int {
-	return recw.body.Len()
+	return recw.bodySize
+}
+
+// GetBody returns the buffered body, which is the whole body only when the
+// response writer buffers it without limit.
+func (recw *responseWriter) GetBody() []byte {
+	return recw.body.Bytes()
+}
+
+// GetErrorMessage returns the body of a failed response, decompressed and
+// truncated to maxSize bytes. It returns an empty string on success.
+func (recw *responseWriter) GetErrorMessage(maxSize int) string {
+	if recw.statusCode < http.StatusBadRequest {
+		return ""
+	}
+
+	var reader io.Reader = bytes.NewReader(recw.body.Bytes())
+	if strings.Contains(recw.Header().Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			slog.Error("unable to create gzip reader", "err", err)
+			return ""
+		}
+		reader = gz
+	}
+
+	message, err := io.ReadAll(io.LimitReader(reader, int64(maxSize)))
+	if err != nil && !(recw.truncated() && errors.Is(err, io.ErrUnexpectedEOF)) {
+		slog.Error("unable to read error response body", "err", err)
+	}
+	return strings.TrimSpace(string(message))
+}
+
+func (recw *responseWriter) GetHeaderSize() int {
+	return recw.headerSize
 }
@@ -0,0 +1,247 @@
+package response
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/nicolastakashi/prom-analytics-proxy/api/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseWriter_HeaderSize(t *testing.T) {
+	rec := httptest.NewRecorder()
+	recw := NewResponseWriter(rec, 0)
+
+	recw.Header().Set("Content-Type", "application/json")
+	recw.WriteHeader(http.StatusOK)
+	_, err := recw.Write([]byte(`{"status":"success"}`))
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+	req.Header.Set("Accept", "application/json")
+
+	// "Content-Type: application/json\r\n"
+	expectedResponseHeaderSize := len("Content-Type") + len(": ") + len("application/json") + len("\r\n")
+	// "Accept: application/json\r\n"
+	expectedRequestHeaderSize := len("Accept") + len(": ") + len("application/json") + len("\r\n")
+
+	assert.Equal(t, expectedResponseHeaderSize, recw.GetHeaderSize())
+	assert.Equal(t, expectedRequestHeaderSize, HeaderSize(req.Header))
+
+	bodySize := recw.GetBodySize()
+	totalBytes := bodySize + HeaderSize(req.Header) + recw.GetHeaderSize()
+	assert.Equal(t, expectedRequestHeaderSize+expectedResponseHeaderSize, totalBytes-bodySize)
+	assert.Greater(t, totalBytes, bodySize)
+}
+
+func TestResponseWriter_HeaderSizeImplicitWriteHeader(t *testing.T) {
+	rec := httptest.NewRecorder()
+	recw := NewResponseWriter(rec, 0)
+
+	recw.Header().Set("X-Test", "value")
+	_, err := recw.Write([]byte("body"))
+	assert.NoError(t, err)
+
+	assert.Equal(t, len("X-Test: value\r\n"), recw.GetHeaderSize())
+	assert.Equal(t, http.StatusOK, recw.GetStatusCode())
+}
+
+func TestResponseWriter_ParseQueryResponseNonJSON(t *testing.T) {
+	var logs bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelWarn})))
+	t.Cleanup(func() {
+		slog.SetDefault(defaultLogger)
+	})
+
+	body := "<html><head><title>502 Bad Gateway</title></head><body><center><h1>502 Bad Gateway</h1></center><hr><center>nginx</center></body></html>"
+
+	rec := httptest.NewRecorder()
+	recw := NewResponseWriter(rec, 0)
+	recw.Header().Set("Content-Type", "text/html")
+	recw.WriteHeader(http.StatusBadGateway)
+	_, err := recw.Write([]byte(body))
+	assert.NoError(t, err)
+
+	assert.Nil(t, recw.ParseQueryResponse(true, 0))
+	assert.Empty(t, logs.String())
+	assert.Equal(t, http.StatusBadGateway, recw.GetStatusCode())
+	assert.Equal(t, len(body), recw.GetBodySize())
+}
+
+func TestResponseWriter_ParseQueryResponseKeepsBodySize(t *testing.T) {
+	body := `{"status":"success","data":{"resultType":"vector","result":[],"stats":{"samples":{"totalQueryableSamples":10,"peakSamples":2}}}}`
+
+	rec := httptest.NewRecorder()
+	recw := NewResponseWriter(rec, 0)
+	recw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_, err := recw.Write([]byte(body))
+	assert.NoError(t, err)
+
+	response := recw.ParseQueryResponse(true, 0)
+	if assert.NotNil(t, response) {
+		assert.Equal(t, 10, response.Data.Stats.Samples.TotalQueryableSamples)
+	}
+	assert.Equal(t, len(body), recw.GetBodySize())
+}
+
+func TestResponseWriter_ParseQueryResponseMaxBytes(t *testing.T) {
+	// A range query result of several MiB, followed by its stats as
+	// Prometheus returns them.
+	var body bytes.Buffer
+	body.WriteString(`{"status":"success","data":{"resultType":"matrix","result":[`)
+	for i := range 50000 {
+		if i > 0 {
+			body.WriteString(",")
+		}
+		fmt.Fprintf(&body, `{"metric":{"__name__":"up","instance":"node-%d"},"values":[[1735689600,"1"],[1735689615,"1"]]}`, i)
+	}
+	body.WriteString(`],"stats":{"samples":{"totalQueryableSamples":100000,"peakSamples":50000}}}}`)
+
+	recw := NewResponseWriter(httptest.NewRecorder(), 0)
+	recw.Header().Set("Content-Type", "application/json")
+	_, err := recw.Write(body.Bytes())
+	require.NoError(t, err)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	response := recw.ParseQueryResponse(true, 1<<20)
+	runtime.ReadMemStats(&after)
+
+	if assert.NotNil(t, response, "the status is within the limit") {
+		assert.Equal(t, models.StatusSuccess, response.Status)
+		assert.Zero(t, response.Data, "the stats are beyond the limit")
+	}
+	assert.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(body.Len()), "the response must not be buffered")
+	assert.Equal(t, http.StatusOK, recw.GetStatusCode())
+	assert.Equal(t, body.Len(), recw.GetBodySize())
+
+	assert.Nil(t, recw.ParseQueryResponse(true, 4), "the status is beyond the limit")
+
+	response = recw.ParseQueryResponse(true, int64(body.Len()))
+	if assert.NotNil(t, response) {
+		assert.Equal(t, "matrix", response.Data.ResultType)
+		assert.Equal(t, 100000, response.Data.Stats.Samples.TotalQueryableSamples)
+		assert.Equal(t, 50000, response.Data.Stats.Samples.PeakSamples)
+	}
+}
+
+func TestResponseWriter_MaxBuffered(t *testing.T) {
+	body := `{"status":"success","data":{"resultType":"vector","result":[` + strings.Repeat(" ", 4096) + `],"stats":{"samples":{"peakSamples":3}}}}`
+
+	rec := httptest.NewRecorder()
+	recw := NewResponseWriter(rec, 1024)
+	recw.Header().Set("Content-Type", "application/json")
+	for chunk := range slices.Chunk([]byte(body), 512) {
+		_, err := recw.Write(chunk)
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, body, rec.Body.String(), "the whole body must reach the client")
+	assert.Len(t, recw.GetBody(), 1024)
+	assert.Equal(t, len(body), recw.GetBodySize())
+	if response := recw.ParseQueryResponse(true, 0); assert.NotNil(t, response) {
+		assert.Equal(t, models.StatusSuccess, response.Status)
+		assert.Zero(t, response.Data, "the stats are beyond the buffered body")
+	}
+
+	recw = NewResponseWriter(httptest.NewRecorder(), int64(len(body)))
+	recw.Header().Set("Content-Type", "application/json")
+	_, err := recw.Write([]byte(body))
+	require.NoError(t, err)
+	if response := recw.ParseQueryResponse(true, 0); assert.NotNil(t, response) {
+		assert.Equal(t, 3, response.Data.Stats.Samples.PeakSamples)
+	}
+}
+
+func TestResponseWriter_GetErrorMessageMaxBuffered(t *testing.T) {
+	message := strings.Repeat("too many samples ", 1024)
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	_, err := gz.Write([]byte(message))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	recw := NewResponseWriter(httptest.NewRecorder(), 64)
+	recw.Header().Set("Content-Encoding", "gzip")
+	recw.WriteHeader(http.StatusUnprocessableEntity)
+	_, err = recw.Write(body.Bytes())
+	require.NoError(t, err)
+
+	errorMessage := recw.GetErrorMessage(512)
+	assert.NotEmpty(t, errorMessage)
+	assert.True(t, strings.HasPrefix(message, errorMessage))
+}
+
+func TestResponseWriter_ParseQueryResponseStatsFirst(t *testing.T) {
+	// The result after the stats is never read.
+	body := `{"status":"success","data":{"stats":{"samples":{"totalQueryableSamples":3,"peakSamples":1}},"resultType":"vector","result":[` + strings.Repeat(" ", 1024)
+
+	recw := NewResponseWriter(httptest.NewRecorder(), 0)
+	recw.Header().Set("Content-Type", "application/json")
+	_, err := recw.Write([]byte(body))
+	require.NoError(t, err)
+
+	response := recw.ParseQueryResponse(true, 256)
+	if assert.NotNil(t, response) {
+		assert.Equal(t, 3, response.Data.Stats.Samples.TotalQueryableSamples)
+	}
+}
+
+func TestResponseWriter_ParseQueryResponseError(t *testing.T) {
+	recw := NewResponseWriter(httptest.NewRecorder(), 0)
+	recw.Header().Set("Content-Type", "application/json")
+	recw.WriteHeader(http.StatusUnprocessableEntity)
+	_, err := recw.Write([]byte(`{"status":"error","errorType":"execution","error":"query processing would load too many samples into memory"}`))
+	require.NoError(t, err)
+
+	response := recw.ParseQueryResponse(true, 1<<20)
+	if assert.NotNil(t, response) {
+		assert.Equal(t, models.StatusError, response.Status)
+		assert.Equal(t, "query processing would load too many samples into memory", response.Error)
+	}
+	assert.Equal(t, http.StatusUnprocessableEntity, recw.GetStatusCode())
+}
+
+func TestResponseWriter_ParseQueryResponseErrorWithOK(t *testing.T) {
+	recw := NewResponseWriter(httptest.NewRecorder(), 0)
+	recw.Header().Set("Content-Type", "application/json")
+	_, err := recw.Write([]byte(`{"status":"error","errorType":"timeout","error":"query timed out in expression evaluation","data":{"resultType":"vector","result":[],"stats":{"samples":{"peakSamples":7}}}}`))
+	require.NoError(t, err)
+
+	// The status is read even when the stats are not requested.
+	for _, includeQueryStats := range []bool{true, false} {
+		response := recw.ParseQueryResponse(includeQueryStats, 1<<20)
+		if assert.NotNil(t, response) {
+			assert.Equal(t, models.StatusError, response.Status)
+			assert.Equal(t, "query timed out in expression evaluation", response.Error)
+			assert.Zero(t, response.Data.Stats.Samples.PeakSamples)
+		}
+	}
+	assert.Equal(t, http.StatusOK, recw.GetStatusCode())
+}
+
+func TestResponseWriter_ParseQueryResponseWithoutStats(t *testing.T) {
+	// The result is never read when the stats are not requested.
+	body := `{"status":"success","data":{"resultType":"vector","result":[` + strings.Repeat(" ", 1024)
+
+	recw := NewResponseWriter(httptest.NewRecorder(), 0)
+	recw.Header().Set("Content-Type", "application/json")
+	_, err := recw.Write([]byte(body))
+	require.NoError(t, err)
+
+	response := recw.ParseQueryResponse(false, 256)
+	if assert.NotNil(t, response) {
+		assert.Equal(t, models.StatusSuccess, response.Status)
+	}
+}
@@ -0,0 +1,47 @@
+package routes
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/db"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// WithAccessLog logs a line for each proxied query once it is ingested. The
+// query text is replaced by its SHA-256 hash when redactQueries is set, as
+// it may contain sensitive label values.
+func WithAccessLog(enabled, redactQueries bool) Option {
+	return func(r *routes) {
+		r.accessLog = enabled
+		r.redactQueries = redactQueries
+	}
+}
+
+func (r *routes) logAccess(req *http.Request, query db.Query) {
+	if !r.accessLog {
+		return
+	}
+
+	queryParam := query.QueryParam
+	if r.redactQueries {
+		sum := sha256.Sum256([]byte(queryParam))
+		queryParam = "sha256:" + hex.EncodeToString(sum[:])
+	}
+
+	attrs := []slog.Attr{
+		slog.String("query", queryParam),
+		slog.String("type", string(query.Type)),
+		slog.Int64("durationMs", query.Duration.Milliseconds()),
+		slog.Int("statusCode", query.StatusCode),
+		slog.Int("bodySize", query.BodySize),
+		slog.Int("peakSamples", query.PeakSamples),
+		slog.String("remoteAddr", req.RemoteAddr),
+	}
+	if sc := trace.SpanContextFromContext(req.Context()); sc.HasTraceID() {
+		attrs = append(attrs, slog.String("traceId", sc.TraceID().String()))
+	}
+	slog.LogAttrs(req.Context(), slog.LevelInfo, "query access", attrs...)
+}
@@ -0,0 +1,100 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/ingester"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestAccessLog(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[],"stats":{"samples":{"totalQueryableSamples":10,"peakSamples":4}}}}`))
+	}))
+	defer upstream.Close()
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	queryIngester := ingester.NewQueryIngester(
+		&recordingProvider{},
+		ingester.WithBufferSize(10),
+		ingester.WithBatchSize(1),
+		ingester.WithIngestTimeout(time.Second),
+		ingester.WithBatchFlushInterval(10*time.Millisecond),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go queryIngester.Run(ctx)
+
+	traceID, err := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	require.NoError(t, err)
+	spanID, err := trace.SpanIDFromHex("00f067aa0ba902b7")
+	require.NoError(t, err)
+	spanCtx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: traceID,
+		SpanID:  spanID,
+	}))
+
+	for _, tc := range []struct {
+		name          string
+		enabled       bool
+		redactQueries bool
+		expectedQuery string
+	}{
+		{name: "disabled"},
+		{name: "enabled", enabled: true, expectedQuery: "up"},
+		// echo -n up | sha256sum
+		{name: "redacted", enabled: true, redactQueries: true, expectedQuery: "sha256:75a288c0d6898c5f7b054590845978a82a3ad79fcce3d43ff68a7501e5a91ee9"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			defaultLogger := slog.Default()
+			slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+			t.Cleanup(func() {
+				slog.SetDefault(defaultLogger)
+			})
+
+			r, err := NewRoutes(
+				WithProxy(upstreamURL),
+				WithQueryIngester(queryIngester),
+				WithIncludeQueryStats(true),
+				WithAccessLog(tc.enabled, tc.redactQueries),
+			)
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil).WithContext(spanCtx)
+			req.RemoteAddr = "192.0.2.1:1234"
+			r.query(httptest.NewRecorder(), req)
+
+			if !tc.enabled {
+				assert.NotContains(t, logs.String(), "query access")
+				return
+			}
+
+			var line map[string]any
+			require.NoError(t, json.Unmarshal(logs.Bytes(), &line))
+			assert.Equal(t, "query access", line["msg"])
+			assert.Equal(t, "INFO", line["level"])
+			assert.Equal(t, tc.expectedQuery, line["query"])
+			assert.Equal(t, "instant", line["type"])
+			assert.Equal(t, float64(http.StatusOK), line["statusCode"])
+			assert.Equal(t, float64(4), line["peakSamples"])
+			assert.Equal(t, "192.0.2.1:1234", line["remoteAddr"])
+			assert.Equal(t, traceID.String(), line["traceId"])
+			assert.Contains(t, line, "durationMs")
+			assert.Greater(t, line["bodySize"], float64(0))
+		})
+	}
+}
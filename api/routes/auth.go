@@ -0,0 +1,103 @@
+package routes
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bearerTokenRefreshInterval is how often the bearer token file is re-read,
+// so rotated tokens are picked up without a restart.
+const bearerTokenRefreshInterval = time.Minute
+
+type upstreamAuth struct {
+	username        string
+	password        string
+	bearerTokenFile string
+
+	mu       sync.Mutex
+	token    string
+	loadedAt time.Time
+	now      func() time.Time
+}
+
+// WithUpstreamAuth authenticates every request sent to the upstream, both
+// proxied ones and the ones made through the Prometheus API client. The
+// bearer token file takes precedence over basic auth when both are set.
+func WithUpstreamAuth(username, password, bearerTokenFile string) Option {
+	return func(r *routes) {
+		if username == "" && bearerTokenFile == "" {
+			return
+		}
+		r.upstreamAuth = &upstreamAuth{
+			username:        username,
+			password:        password,
+			bearerTokenFile: bearerTokenFile,
+			now:             time.Now,
+		}
+	}
+}
+
+func (a *upstreamAuth) apply(req *http.Request) error {
+	if a.bearerTokenFile == "" {
+		req.SetBasicAuth(a.username, a.password)
+		return nil
+	}
+
+	token, err := a.bearerToken()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// bearerToken returns the token read from the bearer token file, re-reading
+// it once the refresh interval elapsed. The last known token is kept when
+// the file can not be read.
+func (a *upstreamAuth) bearerToken() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.now()
+	if a.token != "" && now.Sub(a.loadedAt) < bearerTokenRefreshInterval {
+		return a.token, nil
+	}
+
+	b, err := os.ReadFile(a.bearerTokenFile)
+	if err != nil {
+		if a.token != "" {
+			slog.Error("unable to read bearer token file, using the previous token", "err", err)
+			return a.token, nil
+		}
+		return "", fmt.Errorf("unable to read bearer token file: %w", err)
+	}
+
+	a.token = strings.TrimSpace(string(b))
+	a.loadedAt = now
+	return a.token, nil
+}
+
+// upstreamTransport sets the upstream credentials on every request. It reads
+// them from the routes when the request is sent, so it does not depend on
+// the order the options are applied.
+type upstreamTransport struct {
+	r    *routes
+	next http.RoundTripper
+}
+
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.r.upstreamAuth == nil {
+		return t.next.RoundTrip(req)
+	}
+
+	req = req.Clone(req.Context())
+	if err := t.r.upstreamAuth.apply(req); err != nil {
+		return nil, err
+	}
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,102 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newAuthUpstream(t *testing.T) (*url.URL, func() []string) {
+	t.Helper()
+
+	var (
+		mu      sync.Mutex
+		headers []string
+	)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		headers = append(headers, req.Header.Get("Authorization"))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":[]}`))
+	}))
+	t.Cleanup(upstream.Close)
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	return upstreamURL, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), headers...)
+	}
+}
+
+func TestUpstreamAuth_BasicAuth(t *testing.T) {
+	upstreamURL, headers := newAuthUpstream(t)
+
+	r, err := NewRoutes(
+		WithProxy(upstreamURL),
+		WithPromAPI(upstreamURL),
+		WithUpstreamAuth("admin", "secret", ""),
+	)
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	r.passthrough(rec, httptest.NewRequest(http.MethodGet, "/api/v1/labels", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	_, _, err = r.promAPI.LabelNames(context.Background(), nil, time.Time{}, time.Time{})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.SetBasicAuth("admin", "secret")
+	expected := req.Header.Get("Authorization")
+	assert.Equal(t, []string{expected, expected}, headers())
+}
+
+func TestUpstreamAuth_BearerTokenFile(t *testing.T) {
+	upstreamURL, headers := newAuthUpstream(t)
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("first\n"), 0o600))
+
+	r, err := NewRoutes(
+		WithUpstreamAuth("", "", tokenFile),
+		WithProxy(upstreamURL),
+	)
+	require.NoError(t, err)
+
+	now := time.Now()
+	r.upstreamAuth.now = func() time.Time { return now }
+
+	proxy := func() {
+		rec := httptest.NewRecorder()
+		r.passthrough(rec, httptest.NewRequest(http.MethodGet, "/api/v1/labels", nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	proxy()
+
+	// The rotated token is only picked up once the refresh interval elapsed.
+	require.NoError(t, os.WriteFile(tokenFile, []byte("second\n"), 0o600))
+	proxy()
+	now = now.Add(bearerTokenRefreshInterval)
+	proxy()
+
+	// The previous token is kept when the file can not be read.
+	require.NoError(t, os.Remove(tokenFile))
+	now = now.Add(bearerTokenRefreshInterval)
+	proxy()
+
+	assert.Equal(t, []string{"Bearer first", "Bearer first", "Bearer second", "Bearer second"}, headers())
+}
@@ -0,0 +1,94 @@
+package routes
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+const (
+	defaultMetricCardinalityTopN = 10
+	// metricCardinalityCacheTTL keeps the label values counts of a metric
+	// for a short while, as counting them costs one upstream request per
+	// label.
+	metricCardinalityCacheTTL  = time.Minute
+	metricCardinalityCacheSize = 256
+)
+
+type labelCardinality struct {
+	Label      string `json:"label"`
+	ValueCount int    `json:"valueCount"`
+}
+
+// metricCardinality reports the number of values of each label of a metric,
+// highest first, to spot the labels driving its cardinality.
+func (r *routes) metricCardinality(w http.ResponseWriter, req *http.Request) {
+	name := req.PathValue("name")
+	if !model.IsValidMetricName(model.LabelValue(name)) {
+		http.Error(w, "name must be a valid metric name", http.StatusBadRequest)
+		return
+	}
+
+	topN, err := getQueryParamAsInt(req, "topN", defaultMetricCardinalityTopN)
+	if err != nil || topN <= 0 {
+		http.Error(w, "topN must be a positive number", http.StatusBadRequest)
+		return
+	}
+
+	cardinality, ok := r.cardinalityCache.Get(name)
+	if !ok {
+		cardinality, err = r.labelsCardinality(req.Context(), name)
+		if err != nil {
+			slog.Error("unable to retrieve metric cardinality", "err", err, "name", name)
+			http.Error(w, "unable to retrieve metric cardinality", http.StatusInternalServerError)
+			return
+		}
+		r.cardinalityCache.Set(name, cardinality)
+	}
+
+	writeJSONResponse(w, cardinality[:min(topN, len(cardinality))])
+}
+
+// labelsCardinality counts the values of every label of the metric over the
+// last minutes, sorted by decreasing count.
+func (r *routes) labelsCardinality(ctx context.Context, name string) ([]labelCardinality, error) {
+	end := time.Now()
+	start := end.Add(-5 * time.Minute)
+	matches := []string{fmt.Sprintf("{%s=%q}", model.MetricNameLabel, name)}
+
+	var opts []v1.Option
+	if r.seriesLimit != nil && *r.seriesLimit > 0 {
+		opts = append(opts, v1.WithLimit(*r.seriesLimit))
+	}
+
+	labels, _, err := r.promAPI.LabelNames(ctx, matches, start, end)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve label names: %w", err)
+	}
+
+	cardinality := make([]labelCardinality, 0, len(labels))
+	for _, label := range labels {
+		if label == model.MetricNameLabel {
+			continue
+		}
+		values, _, err := r.promAPI.LabelValues(ctx, label, matches, start, end, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("unable to retrieve values of label %q: %w", label, err)
+		}
+		cardinality = append(cardinality, labelCardinality{Label: label, ValueCount: len(values)})
+	}
+
+	sort.SliceStable(cardinality, func(i, j int) bool {
+		if cardinality[i].ValueCount != cardinality[j].ValueCount {
+			return cardinality[i].ValueCount > cardinality[j].ValueCount
+		}
+		return cardinality[i].Label < cardinality[j].Label
+	})
+	return cardinality, nil
+}
@@ -0,0 +1,93 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type labelsAPI struct {
+	v1.API
+	values      map[string]model.LabelValues
+	valuesCalls int
+	matches     []string
+}
+
+func (a *labelsAPI) LabelNames(ctx context.Context, matches []string, startTime, endTime time.Time, opts ...v1.Option) ([]string, v1.Warnings, error) {
+	a.matches = matches
+	names := []string{model.MetricNameLabel}
+	for name := range a.values {
+		names = append(names, name)
+	}
+	return names, nil, nil
+}
+
+func (a *labelsAPI) LabelValues(ctx context.Context, label string, matches []string, startTime, endTime time.Time, opts ...v1.Option) (model.LabelValues, v1.Warnings, error) {
+	a.valuesCalls++
+	if label == model.MetricNameLabel {
+		return nil, nil, errors.New("the metric name must not be counted")
+	}
+	return a.values[label], nil, nil
+}
+
+func TestMetricCardinality(t *testing.T) {
+	api := &labelsAPI{values: map[string]model.LabelValues{
+		"job":      {"api"},
+		"instance": {"a", "b", "c"},
+		"path":     {"/", "/login", "/logout", "/users", "/users/1"},
+		"method":   {"GET", "POST", "PUT"},
+	}}
+	r, err := NewRoutes(WithSeriesLimit(100))
+	require.NoError(t, err)
+	r.promAPI = api
+
+	get := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.SetPathValue("name", strings.TrimPrefix(strings.Split(target, "?")[0], "/api/v1/metricCardinality/"))
+		rec := httptest.NewRecorder()
+		r.metricCardinality(rec, req)
+		return rec
+	}
+
+	rec := get("/api/v1/metricCardinality/http_requests_total")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var cardinality []labelCardinality
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &cardinality))
+	assert.Equal(t, []labelCardinality{
+		{Label: "path", ValueCount: 5},
+		{Label: "instance", ValueCount: 3},
+		{Label: "method", ValueCount: 3},
+		{Label: "job", ValueCount: 1},
+	}, cardinality)
+	assert.Equal(t, 4, api.valuesCalls)
+	assert.Equal(t, []string{`{__name__="http_requests_total"}`}, api.matches)
+
+	// The counts are served from the cache.
+	rec = get("/api/v1/metricCardinality/http_requests_total?topN=2")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &cardinality))
+	assert.Equal(t, []labelCardinality{
+		{Label: "path", ValueCount: 5},
+		{Label: "instance", ValueCount: 3},
+	}, cardinality)
+	assert.Equal(t, 4, api.valuesCalls)
+
+	for _, topN := range []string{"0", "-1", "many"} {
+		assert.Equal(t, http.StatusBadRequest, get("/api/v1/metricCardinality/http_requests_total?topN="+topN).Code, topN)
+	}
+
+	// The name must not inject another selector.
+	rec = get(`/api/v1/metricCardinality/up{job="api"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, 4, api.valuesCalls)
+}
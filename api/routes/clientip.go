@@ -0,0 +1,89 @@
+package routes
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ParseTrustedProxies parses a list of IPs and CIDRs of the proxies allowed
+// to set the X-Forwarded-For header.
+func ParseTrustedProxies(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if strings.Contains(value, "/") {
+			prefix, err := netip.ParsePrefix(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", value, err)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", value, err)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+	return prefixes, nil
+}
+
+// WithTrustedProxies sets the proxies whose X-Forwarded-For header is used
+// to find the source IP of the queries. Without trusted proxies the header
+// is ignored and the address of the connection is used.
+func WithTrustedProxies(prefixes []netip.Prefix) Option {
+	return func(r *routes) {
+		r.trustedProxies = prefixes
+	}
+}
+
+func (r *routes) isTrustedProxy(addr netip.Addr) bool {
+	for _, prefix := range r.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceIP returns the IP of the client sending the request. The
+// X-Forwarded-For header is walked from right to left, skipping trusted
+// proxies, as every other hop may have been forged by the client.
+func (r *routes) sourceIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	remote, err := netip.ParseAddr(host)
+	if err != nil {
+		return host
+	}
+	remote = remote.Unmap()
+	if !r.isTrustedProxy(remote) {
+		return remote.String()
+	}
+
+	hops := make([]string, 0)
+	for _, header := range req.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		client = addr.Unmap()
+		if !r.isTrustedProxy(client) {
+			break
+		}
+	}
+	return client.String()
+}
@@ -0,0 +1,98 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	prefixes, err := ParseTrustedProxies([]string{"10.0.0.0/8", " 192.168.1.1 ", "", "::1"})
+	require.NoError(t, err)
+	require.Len(t, prefixes, 3)
+	assert.Equal(t, "10.0.0.0/8", prefixes[0].String())
+	assert.Equal(t, "192.168.1.1/32", prefixes[1].String())
+	assert.Equal(t, "::1/128", prefixes[2].String())
+
+	_, err = ParseTrustedProxies([]string{"not-an-ip"})
+	assert.Error(t, err)
+}
+
+func TestSourceIP(t *testing.T) {
+	trusted, err := ParseTrustedProxies([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name       string
+		trusted    bool
+		remoteAddr string
+		xff        []string
+		expected   string
+	}{
+		{
+			name:       "no forwarded header",
+			trusted:    true,
+			remoteAddr: "192.0.2.1:1234",
+			expected:   "192.0.2.1",
+		},
+		{
+			name:       "untrusted remote ignores the header",
+			trusted:    true,
+			remoteAddr: "192.0.2.1:1234",
+			xff:        []string{"203.0.113.7"},
+			expected:   "192.0.2.1",
+		},
+		{
+			name:       "no trusted proxies ignores the header",
+			remoteAddr: "10.0.0.1:1234",
+			xff:        []string{"203.0.113.7"},
+			expected:   "10.0.0.1",
+		},
+		{
+			name:       "trusted remote uses the header",
+			trusted:    true,
+			remoteAddr: "10.0.0.1:1234",
+			xff:        []string{"203.0.113.7"},
+			expected:   "203.0.113.7",
+		},
+		{
+			name:       "trusted hops are skipped",
+			trusted:    true,
+			remoteAddr: "10.0.0.1:1234",
+			xff:        []string{"198.51.100.1, 203.0.113.7, 10.1.1.1", "10.2.2.2"},
+			expected:   "203.0.113.7",
+		},
+		{
+			name:       "every hop trusted uses the leftmost",
+			trusted:    true,
+			remoteAddr: "10.0.0.1:1234",
+			xff:        []string{"10.3.3.3, 10.1.1.1"},
+			expected:   "10.3.3.3",
+		},
+		{
+			name:       "invalid hop stops the walk",
+			trusted:    true,
+			remoteAddr: "10.0.0.1:1234",
+			xff:        []string{"203.0.113.7, garbage, 10.1.1.1"},
+			expected:   "10.1.1.1",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &routes{}
+			if tc.trusted {
+				r.trustedProxies = trusted
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+			req.RemoteAddr = tc.remoteAddr
+			for _, value := range tc.xff {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+
+			assert.Equal(t, tc.expected, r.sourceIP(req))
+		})
+	}
+}
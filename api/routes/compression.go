@@ -0,0 +1,110 @@
+package routes
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// minCompressSize is the size under which analytics responses are sent
+// uncompressed, as compressing them saves little.
+const minCompressSize = 1024
+
+// WithCompression gzips the analytics API responses for the clients
+// accepting it. The proxied Prometheus API and /metrics are left as is.
+func WithCompression(enabled bool) Option {
+	return func(r *routes) {
+		r.compression = enabled
+	}
+}
+
+func (r *routes) withCompression(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !r.compression {
+			h(w, req)
+			return
+		}
+
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
+			h(w, req)
+			return
+		}
+
+		cw := &compressResponseWriter{ResponseWriter: w}
+		defer cw.close()
+		h(cw, req)
+	}
+}
+
+// compressResponseWriter buffers the beginning of a response and gzips it
+// once it reaches minCompressSize. Smaller responses are written as is.
+type compressResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	buf        []byte
+	gz         *gzip.Writer
+	plain      bool
+}
+
+func (cw *compressResponseWriter) WriteHeader(statusCode int) {
+	if cw.statusCode == 0 {
+		cw.statusCode = statusCode
+	}
+}
+
+func (cw *compressResponseWriter) Write(b []byte) (int, error) {
+	switch {
+	case cw.gz != nil:
+		return cw.gz.Write(b)
+	case cw.plain:
+		return cw.ResponseWriter.Write(b)
+	}
+
+	cw.buf = append(cw.buf, b...)
+	if len(cw.buf) < minCompressSize {
+		return len(b), nil
+	}
+
+	buf := cw.buf
+	cw.buf = nil
+	if cw.Header().Get("Content-Encoding") != "" {
+		// Already encoded by the handler.
+		cw.plain = true
+		cw.ResponseWriter.WriteHeader(cw.status())
+		if _, err := cw.ResponseWriter.Write(buf); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	cw.Header().Set("Content-Encoding", "gzip")
+	cw.Header().Del("Content-Length")
+	cw.ResponseWriter.WriteHeader(cw.status())
+	cw.gz = gzip.NewWriter(cw.ResponseWriter)
+	if _, err := cw.gz.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (cw *compressResponseWriter) status() int {
+	if cw.statusCode == 0 {
+		return http.StatusOK
+	}
+	return cw.statusCode
+}
+
+// close flushes the compressed stream, or writes the buffered response when
+// it was too small to be compressed.
+func (cw *compressResponseWriter) close() {
+	if cw.gz != nil {
+		_ = cw.gz.Close()
+		return
+	}
+	if cw.plain {
+		return
+	}
+	cw.ResponseWriter.WriteHeader(cw.status())
+	_, _ = cw.ResponseWriter.Write(cw.buf)
+}
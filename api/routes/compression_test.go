@@ -0,0 +1,67 @@
+package routes
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithCompression(t *testing.T) {
+	large := `{"data":"` + strings.Repeat("up", minCompressSize) + `"}`
+	small := `{"data":"up"}`
+
+	serve := func(enabled bool, body, acceptEncoding string) *httptest.ResponseRecorder {
+		r, err := NewRoutes(WithCompression(enabled))
+		require.NoError(t, err)
+
+		h := r.withCompression(func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			// Written in chunks, as the threshold may be crossed mid-response.
+			for len(body) > 0 {
+				n := min(len(body), 100)
+				_, _ = io.WriteString(w, body[:n])
+				body = body[n:]
+			}
+		})
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/queries", nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec
+	}
+
+	rec := serve(true, large, "gzip, deflate")
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"))
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	gz, err := gzip.NewReader(rec.Body)
+	require.NoError(t, err)
+	body, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	assert.Equal(t, large, string(body))
+
+	// Small responses are not worth compressing.
+	rec = serve(true, small, "gzip")
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	assert.Empty(t, rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, small, rec.Body.String())
+
+	for name, rec := range map[string]*httptest.ResponseRecorder{
+		"not accepted": serve(true, large, ""),
+		"disabled":     serve(false, large, "gzip"),
+	} {
+		assert.Equal(t, http.StatusAccepted, rec.Code, name)
+		assert.Empty(t, rec.Header().Get("Content-Encoding"), name)
+		assert.Equal(t, large, rec.Body.String(), name)
+	}
+}
@@ -0,0 +1,37 @@
+package routes
+
+import (
+	"net/http"
+
+	"github.com/rs/cors"
+)
+
+// WithCORS lets the pages of the given origins call the analytics API, e.g.
+// to embed its charts in another portal. Preflight requests are answered
+// for the allowed methods, GET, POST and HEAD when none is given. The
+// proxied Prometheus API never sends CORS headers, nor does the analytics
+// API without allowed origins.
+func WithCORS(allowedOrigins, allowedMethods []string, allowCredentials bool) Option {
+	return func(r *routes) {
+		if len(allowedOrigins) == 0 {
+			r.cors = nil
+			return
+		}
+		r.cors = cors.New(cors.Options{
+			AllowedOrigins:   allowedOrigins,
+			AllowedMethods:   allowedMethods,
+			AllowedHeaders:   []string{"Content-Type", "Authorization"},
+			AllowCredentials: allowCredentials,
+		})
+	}
+}
+
+func (r *routes) withCORS(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if r.cors == nil {
+			h(w, req)
+			return
+		}
+		r.cors.ServeHTTP(w, req, h)
+	}
+}
@@ -0,0 +1,83 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"testing/fstest"
+
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/db"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithCORS(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	newRoutes := func(opts ...Option) *routes {
+		r, err := NewRoutes(append([]Option{
+			WithProxy(upstreamURL),
+			WithDBProvider(&db.NoopProvider{}),
+			WithHandlers(fstest.MapFS{"index.html": {Data: []byte("<html></html>")}}, prometheus.NewRegistry(), false),
+		}, opts...)...)
+		require.NoError(t, err)
+		return r
+	}
+	serve := func(r *routes, method, target, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("Origin", origin)
+		if method == http.MethodOptions {
+			req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("preflight", func(t *testing.T) {
+		r := newRoutes(WithCORS([]string{"https://portal.example.com"}, nil, true))
+
+		rec := serve(r, http.MethodOptions, "/api/v1/query/slowest", "https://portal.example.com")
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+		assert.Equal(t, "https://portal.example.com", rec.Header().Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, http.MethodGet, rec.Header().Get("Access-Control-Allow-Methods"))
+		assert.Equal(t, "true", rec.Header().Get("Access-Control-Allow-Credentials"))
+
+		rec = serve(r, http.MethodOptions, "/api/v1/query/slowest", "https://other.example.com")
+		assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+	})
+
+	t.Run("cross-origin get", func(t *testing.T) {
+		r := newRoutes(WithCORS([]string{"https://portal.example.com"}, []string{http.MethodGet}, false))
+
+		rec := serve(r, http.MethodGet, "/api/v1/query/slowest", "https://portal.example.com")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "https://portal.example.com", rec.Header().Get("Access-Control-Allow-Origin"))
+		assert.Empty(t, rec.Header().Get("Access-Control-Allow-Credentials"))
+
+		rec = serve(r, http.MethodGet, "/api/v1/query/slowest", "https://other.example.com")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+
+		// The proxied Prometheus API never sends CORS headers.
+		rec = serve(r, http.MethodGet, "/api/v1/labels", "https://portal.example.com")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		r := newRoutes(WithCORS(nil, nil, false))
+
+		rec := serve(r, http.MethodGet, "/api/v1/query/slowest", "https://portal.example.com")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+	})
+}
@@ -0,0 +1,119 @@
+package routes
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// failoverTransport sends each request to the first upstream and, when it
+// can not be reached or answers with a 5xx, retries the request on the next
+// upstreams in order. Requests are built for the first upstream; the other
+// ones only differ by their scheme, host and path prefix.
+type failoverTransport struct {
+	upstreams []*url.URL
+	next      http.RoundTripper
+}
+
+func newFailoverTransport(upstreams []*url.URL, next http.RoundTripper) http.RoundTripper {
+	if len(upstreams) < 2 {
+		return next
+	}
+	return &failoverTransport{upstreams: upstreams, next: next}
+}
+
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := bufferBody(req); err != nil {
+		return nil, err
+	}
+
+	primary := t.upstreams[0]
+	var (
+		resp *http.Response
+		err  error
+	)
+	for i, upstream := range t.upstreams {
+		attempt := req
+		if i > 0 {
+			attempt, err = retarget(req, primary, upstream)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err = t.next.RoundTrip(attempt)
+		if i == len(t.upstreams)-1 || req.Context().Err() != nil {
+			break
+		}
+		if err == nil && resp.StatusCode < http.StatusInternalServerError {
+			break
+		}
+
+		if err == nil {
+			slog.Warn("upstream failed, trying the next one", "upstream", upstream.Host, "status", resp.StatusCode)
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		} else {
+			slog.Warn("upstream unreachable, trying the next one", "upstream", upstream.Host, "err", err)
+		}
+	}
+	return resp, err
+}
+
+// bufferBody reads the request body in memory so it can be sent again to
+// another upstream.
+func bufferBody(req *http.Request) error {
+	if req.Body == nil || req.Body == http.NoBody || req.GetBody != nil {
+		return nil
+	}
+
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return fmt.Errorf("unable to read request body: %w", err)
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	return nil
+}
+
+// retarget returns a copy of the request built for the primary upstream,
+// sent to the given upstream instead.
+func retarget(req *http.Request, primary, upstream *url.URL) (*http.Request, error) {
+	out := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, fmt.Errorf("unable to replay request body: %w", err)
+		}
+		out.Body = body
+	}
+
+	out.URL.Scheme = upstream.Scheme
+	out.URL.Host = upstream.Host
+	out.URL.Path = singleJoiningSlash(upstream.Path, strings.TrimPrefix(req.URL.Path, primary.Path))
+	out.URL.RawPath = ""
+	if out.Host == primary.Host {
+		out.Host = upstream.Host
+	}
+	return out, nil
+}
+
+// singleJoiningSlash joins two URL paths the way httputil.ReverseProxy does.
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
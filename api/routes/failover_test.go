@@ -0,0 +1,148 @@
+package routes
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/ingester"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// refusingURL returns the URL of an address nothing listens on.
+func refusingURL(t *testing.T) *url.URL {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+	return &url.URL{Scheme: "http", Host: addr}
+}
+
+func TestQuery_UpstreamFailover(t *testing.T) {
+	var secondaryHits atomic.Int32
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		secondaryHits.Add(1)
+		assert.Equal(t, "/prom/api/v1/query", req.URL.Path)
+		assert.NoError(t, req.ParseForm())
+		assert.Equal(t, "up", req.Form.Get("query"))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	defer secondary.Close()
+
+	secondaryURL, err := url.Parse(secondary.URL + "/prom")
+	require.NoError(t, err)
+
+	provider := &recordingProvider{}
+	queryIngester := ingester.NewQueryIngester(
+		provider,
+		ingester.WithBufferSize(10),
+		ingester.WithBatchSize(1),
+		ingester.WithIngestTimeout(time.Second),
+		ingester.WithBatchFlushInterval(10*time.Millisecond),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go queryIngester.Run(ctx)
+
+	r, err := NewRoutes(
+		WithProxy(refusingURL(t), secondaryURL),
+		WithQueryIngester(queryIngester),
+	)
+	require.NoError(t, err)
+
+	// A POST body must be replayed to the secondary.
+	form := url.Values{"query": {"up"}}
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/query", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	r.query(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, int32(1), secondaryHits.Load())
+
+	require.Eventually(t, func() bool {
+		return len(provider.recorded()) == 1
+	}, time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	require.Len(t, provider.recorded(), 1, "the query must be recorded once")
+	assert.Equal(t, http.StatusOK, provider.recorded()[0].StatusCode)
+}
+
+func TestFailoverTransport(t *testing.T) {
+	var primaryHits, secondaryHits atomic.Int32
+	primaryStatus := atomic.Int32{}
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		primaryHits.Add(1)
+		w.WriteHeader(int(primaryStatus.Load()))
+		_, _ = w.Write([]byte("primary"))
+	}))
+	defer primary.Close()
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		secondaryHits.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("secondary"))
+	}))
+	defer secondary.Close()
+
+	primaryURL, err := url.Parse(primary.URL)
+	require.NoError(t, err)
+	secondaryURL, err := url.Parse(secondary.URL)
+	require.NoError(t, err)
+
+	client := &http.Client{Transport: newFailoverTransport([]*url.URL{primaryURL, secondaryURL}, http.DefaultTransport)}
+	get := func() (int, string) {
+		resp, err := client.Get(primary.URL + "/-/ready")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	for _, tc := range []struct {
+		name           string
+		primaryStatus  int
+		expectedStatus int
+		expectedBody   string
+		secondaryHits  int32
+	}{
+		{name: "healthy primary", primaryStatus: http.StatusOK, expectedStatus: http.StatusOK, expectedBody: "primary"},
+		{name: "client errors are not retried", primaryStatus: http.StatusBadRequest, expectedStatus: http.StatusBadRequest, expectedBody: "primary"},
+		{name: "last upstream response is returned", primaryStatus: http.StatusBadGateway, expectedStatus: http.StatusServiceUnavailable, expectedBody: "secondary", secondaryHits: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			primaryHits.Store(0)
+			secondaryHits.Store(0)
+			primaryStatus.Store(int32(tc.primaryStatus))
+
+			status, body := get()
+			assert.Equal(t, tc.expectedStatus, status)
+			assert.Equal(t, tc.expectedBody, body)
+			assert.Equal(t, int32(1), primaryHits.Load())
+			assert.Equal(t, tc.secondaryHits, secondaryHits.Load())
+		})
+	}
+
+	// A single upstream is used as is.
+	assert.Equal(t, http.DefaultTransport, newFailoverTransport([]*url.URL{primaryURL}, http.DefaultTransport))
+}
+
+func TestWithProxy_NoUpstream(t *testing.T) {
+	_, err := NewRoutes(WithProxy())
+	assert.ErrorContains(t, err, "at least one upstream is required")
+}
+
+func TestWithPromAPI_NoUpstream(t *testing.T) {
+	_, err := NewRoutes(WithPromAPI())
+	assert.ErrorContains(t, err, "at least one upstream is required for the prometheus API")
+}
@@ -0,0 +1,75 @@
+package routes
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// readinessTimeout bounds the time spent checking every dependency.
+const readinessTimeout = 5 * time.Second
+
+type dependencyStatus struct {
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+type readinessResponse struct {
+	Status string             `json:"status"`
+	Failed []dependencyStatus `json:"failed,omitempty"`
+}
+
+// healthy reports the process is up. It does not check any dependency so a
+// failing database never gets the proxy restarted.
+func (r *routes) healthy(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("OK\n"))
+}
+
+// ready reports whether the database and the upstream can serve requests.
+func (r *routes) ready(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithTimeout(req.Context(), readinessTimeout)
+	defer cancel()
+
+	resp := readinessResponse{Status: "ready"}
+	if r.dbProvider != nil {
+		if err := r.dbProvider.Ping(ctx); err != nil {
+			resp.Failed = append(resp.Failed, dependencyStatus{Name: "database", Error: err.Error()})
+		}
+	}
+	if r.upstream != nil {
+		if err := r.checkUpstream(ctx); err != nil {
+			resp.Failed = append(resp.Failed, dependencyStatus{Name: "upstream", Error: err.Error()})
+		}
+	}
+
+	if len(resp.Failed) > 0 {
+		resp.Status = "not ready"
+		slog.Warn("readiness check failed", "failed", resp.Failed)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSONResponse(w, resp)
+}
+
+func (r *routes) checkUpstream(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.upstream.JoinPath("-/ready").String(), nil)
+	if err != nil {
+		return fmt.Errorf("unable to create upstream readiness request: %w", err)
+	}
+
+	client := &http.Client{Transport: &upstreamTransport{r: r, next: newFailoverTransport(r.upstreams, http.DefaultTransport)}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to reach upstream: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("upstream is not ready: %s", resp.Status)
+	}
+	return nil
+}
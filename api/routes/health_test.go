@@ -0,0 +1,90 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type pingProvider struct {
+	db.Provider
+	err error
+}
+
+func (p *pingProvider) Ping(ctx context.Context) error {
+	return p.err
+}
+
+func newReadinessRoutes(t *testing.T, provider db.Provider, upstreamStatus int) *routes {
+	t.Helper()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "/-/ready", req.URL.Path)
+		w.WriteHeader(upstreamStatus)
+	}))
+	t.Cleanup(upstream.Close)
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	r, err := NewRoutes(WithProxy(upstreamURL), WithDBProvider(provider))
+	require.NoError(t, err)
+	return r
+}
+
+func TestHealthy(t *testing.T) {
+	r := newReadinessRoutes(t, &pingProvider{err: errors.New("connection refused")}, http.StatusServiceUnavailable)
+
+	rec := httptest.NewRecorder()
+	r.healthy(rec, httptest.NewRequest(http.MethodGet, "/-/healthy", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestReady(t *testing.T) {
+	r := newReadinessRoutes(t, &pingProvider{}, http.StatusOK)
+
+	rec := httptest.NewRecorder()
+	r.ready(rec, httptest.NewRequest(http.MethodGet, "/-/ready", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var resp readinessResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, "ready", resp.Status)
+	assert.Empty(t, resp.Failed)
+}
+
+func TestReady_DatabaseDown(t *testing.T) {
+	r := newReadinessRoutes(t, &pingProvider{err: errors.New("connection refused")}, http.StatusOK)
+
+	rec := httptest.NewRecorder()
+	r.ready(rec, httptest.NewRequest(http.MethodGet, "/-/ready", nil))
+
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var resp readinessResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(t, "not ready", resp.Status)
+	assert.Equal(t, []dependencyStatus{{Name: "database", Error: "connection refused"}}, resp.Failed)
+}
+
+func TestReady_UpstreamNotReady(t *testing.T) {
+	r := newReadinessRoutes(t, &pingProvider{}, http.StatusServiceUnavailable)
+
+	rec := httptest.NewRecorder()
+	r.ready(rec, httptest.NewRequest(http.MethodGet, "/-/ready", nil))
+
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	var resp readinessResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+	require.Len(t, resp.Failed, 1)
+	assert.Equal(t, "upstream", resp.Failed[0].Name)
+}
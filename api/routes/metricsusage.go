@@ -0,0 +1,277 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/db"
+	metricsUsageV1 "github.com/perses/metrics-usage/pkg/api/v1"
+	"github.com/prometheus/common/model"
+)
+
+// maxMetricsUsageImportSize bounds the size of an uploaded metrics usage
+// export.
+const maxMetricsUsageImportSize = 32 << 20
+
+// maxMetricsUsedNames bounds the number of metrics looked up by a single
+// /api/v1/metrics/used or /api/v1/metricStatistics request.
+const maxMetricsUsedNames = 100
+
+// maxMetricStatisticsRequestSize bounds the size of the list of names posted
+// to /api/v1/metricStatistics.
+const maxMetricStatisticsRequestSize = 1 << 20
+
+type metricsUsageImportResponse struct {
+	RulesInserted      int `json:"rulesInserted"`
+	DashboardsInserted int `json:"dashboardsInserted"`
+	Skipped            int `json:"skipped"`
+}
+
+// ruleUsageKey identifies a rule usage record by the fields stored for it.
+type ruleUsageKey struct {
+	serie, groupName, name, expression, kind string
+}
+
+// metricsUsageRecords converts a metrics usage export into the rules and
+// dashboards usage records. Entries of invalid metric names, incomplete
+// entries and entries identical once stored are skipped.
+func metricsUsageRecords(usage map[string]*metricsUsageV1.MetricUsage) ([]db.RulesUsage, []db.DashboardUsage, int) {
+	rulesUsage := make([]db.RulesUsage, 0)
+	dashboardUsage := make([]db.DashboardUsage, 0)
+	seenRules := make(map[ruleUsageKey]struct{})
+	seenDashboards := make(map[db.DashboardUsage]struct{})
+	skipped := 0
+
+	addRules := func(name string, rules metricsUsageV1.Set[metricsUsageV1.RuleUsage], kind db.RuleUsageKind) {
+		for rule := range rules {
+			record := db.RulesUsage{
+				Serie:      name,
+				GroupName:  rule.GroupName,
+				Name:       rule.Name,
+				Expression: rule.Expression,
+				Kind:       string(kind),
+			}
+			key := ruleUsageKey{record.Serie, record.GroupName, record.Name, record.Expression, record.Kind}
+			if _, ok := seenRules[key]; ok || rule.Name == "" || rule.Expression == "" {
+				skipped++
+				continue
+			}
+			seenRules[key] = struct{}{}
+			rulesUsage = append(rulesUsage, record)
+		}
+	}
+
+	for name, metricUsage := range usage {
+		if metricUsage == nil {
+			continue
+		}
+		if !model.IsValidMetricName(model.LabelValue(name)) {
+			skipped += len(metricUsage.AlertRules) + len(metricUsage.RecordingRules) + len(metricUsage.Dashboards)
+			continue
+		}
+
+		addRules(name, metricUsage.AlertRules, db.RuleUsageKindAlert)
+		addRules(name, metricUsage.RecordingRules, db.RuleUsageKindRecord)
+
+		for dashboard := range metricUsage.Dashboards {
+			record := db.DashboardUsage{
+				Serie: name,
+				Id:    dashboard.ID,
+				Name:  dashboard.Name,
+				URL:   dashboard.URL,
+			}
+			if _, ok := seenDashboards[record]; ok || dashboard.ID == "" {
+				skipped++
+				continue
+			}
+			seenDashboards[record] = struct{}{}
+			dashboardUsage = append(dashboardUsage, record)
+		}
+	}
+
+	return rulesUsage, dashboardUsage, skipped
+}
+
+// importMetricsUsage seeds the rules and dashboards usage from a metrics
+// usage export uploaded as the "file" field of a multipart form, e.g.
+//
+//	curl -F file=@usage.json http://localhost:9091/api/v1/metrics/import
+func (r *routes) importMetricsUsage(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req.Body = http.MaxBytesReader(w, req.Body, maxMetricsUsageImportSize)
+	file, _, err := req.FormFile("file")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unable to read the uploaded file: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	var usage map[string]*metricsUsageV1.MetricUsage
+	if err := json.NewDecoder(file).Decode(&usage); err != nil {
+		http.Error(w, fmt.Sprintf("unable to decode metrics usage: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	rulesUsage, dashboardUsage, skipped := metricsUsageRecords(usage)
+
+	if err := r.dbProvider.InsertRulesUsage(req.Context(), rulesUsage); err != nil {
+		slog.Error("unable to insert rules usage", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := r.dbProvider.InsertDashboardUsage(req.Context(), dashboardUsage); err != nil {
+		slog.Error("unable to insert dashboard usage", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("imported metrics usage", "rules", len(rulesUsage), "dashboards", len(dashboardUsage), "skipped", skipped)
+	writeJSONResponse(w, metricsUsageImportResponse{
+		RulesInserted:      len(rulesUsage),
+		DashboardsInserted: len(dashboardUsage),
+		Skipped:            skipped,
+	})
+}
+
+type metricUsed struct {
+	Name       string `json:"name"`
+	Alerts     int    `json:"alerts"`
+	Records    int    `json:"records"`
+	Dashboards int    `json:"dashboards"`
+	Queries    int    `json:"queries"`
+	Used       bool   `json:"used"`
+}
+
+// parseMetricNames parses a comma separated list of metric names, dropping
+// empty entries and duplicates.
+func parseMetricNames(value string) ([]string, error) {
+	return uniqueMetricNames(strings.Split(value, ","))
+}
+
+// uniqueMetricNames drops the empty entries and the duplicates of the metric
+// names, failing when none or too many are left.
+func uniqueMetricNames(values []string) ([]string, error) {
+	names := make([]string, 0)
+	seen := make(map[string]struct{})
+	for _, name := range values {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		names = append(names, name)
+	}
+
+	if len(names) == 0 {
+		return nil, fmt.Errorf("missing metric names")
+	}
+	if len(names) > maxMetricsUsedNames {
+		return nil, fmt.Errorf("at most %d names can be requested at once", maxMetricsUsedNames)
+	}
+	return names, nil
+}
+
+// metricsUsed reports, for each of the comma separated metric names, how many
+// alerts, recording rules, dashboards and queries use it.
+func (r *routes) metricsUsed(w http.ResponseWriter, req *http.Request) {
+	names, err := parseMetricNames(req.URL.Query().Get("names"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := req.Context()
+	data := make([]metricUsed, 0, len(names))
+	for _, name := range names {
+		alerts, err := r.dbProvider.GetRulesUsage(ctx, name, string(db.RuleUsageKindAlert), 1, 1)
+		if err != nil {
+			slog.Error("unable to retrieve alerts usage", "err", err, "name", name)
+			writeQueryError(w, req, "unable to retrieve alerts usage")
+			return
+		}
+		records, err := r.dbProvider.GetRulesUsage(ctx, name, string(db.RuleUsageKindRecord), 1, 1)
+		if err != nil {
+			slog.Error("unable to retrieve recording rules usage", "err", err, "name", name)
+			writeQueryError(w, req, "unable to retrieve recording rules usage")
+			return
+		}
+		dashboards, err := r.dbProvider.GetDashboardUsage(ctx, name, 1, 1)
+		if err != nil {
+			slog.Error("unable to retrieve dashboards usage", "err", err, "name", name)
+			writeQueryError(w, req, "unable to retrieve dashboards usage")
+			return
+		}
+		queries, err := r.dbProvider.GetQueriesBySerieName(ctx, name, 0, 1, db.DefaultSerieQueriesSortBy, "desc")
+		if err != nil {
+			slog.Error("unable to retrieve series expressions", "err", err, "name", name)
+			writeQueryError(w, req, "unable to retrieve series expressions")
+			return
+		}
+
+		usage := metricUsed{
+			Name:       name,
+			Alerts:     alerts.Total,
+			Records:    records.Total,
+			Dashboards: dashboards.Total,
+			Queries:    queries.Total,
+		}
+		usage.Used = usage.Alerts+usage.Records+usage.Dashboards+usage.Queries > 0
+		data = append(data, usage)
+	}
+
+	writeJSONResponse(w, data)
+}
+
+// metricStatistics reports the usage statistics of each of the metric names
+// posted as a JSON list, keyed by metric, so a page listing many metrics
+// needs a single request.
+func (r *routes) metricStatistics(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tr, err := r.getTimeRange(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var values []string
+	req.Body = http.MaxBytesReader(w, req.Body, maxMetricStatisticsRequestSize)
+	if err := json.NewDecoder(req.Body).Decode(&values); err != nil {
+		http.Error(w, fmt.Sprintf("unable to decode metric names: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	names, err := uniqueMetricNames(values)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	stats, err := r.dbProvider.GetMetricStatisticsBatch(req.Context(), names, tr)
+	switch {
+	case errors.Is(err, db.ErrNotSupported):
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	case err != nil:
+		slog.Error("unable to retrieve metric statistics", "err", err, "names", len(names))
+		writeQueryError(w, req, "unable to retrieve metric statistics")
+		return
+	}
+
+	writeJSONResponse(w, stats)
+}
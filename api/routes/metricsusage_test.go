@@ -0,0 +1,251 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type usageProvider struct {
+	db.Provider
+	rules      []db.RulesUsage
+	dashboards []db.DashboardUsage
+}
+
+func (p *usageProvider) InsertRulesUsage(ctx context.Context, rulesUsage []db.RulesUsage) error {
+	p.rules = append(p.rules, rulesUsage...)
+	return nil
+}
+
+func (p *usageProvider) InsertDashboardUsage(ctx context.Context, dashboardUsage []db.DashboardUsage) error {
+	p.dashboards = append(p.dashboards, dashboardUsage...)
+	return nil
+}
+
+const sampleMetricsUsage = `{
+	"http_requests_total": {
+		"alertRules": [
+			{"prom_link": "http://prometheus-a", "group_name": "api", "name": "HighErrorRate", "expression": "rate(http_requests_total{code=\"500\"}[5m]) > 1"},
+			{"prom_link": "http://prometheus-b", "group_name": "api", "name": "HighErrorRate", "expression": "rate(http_requests_total{code=\"500\"}[5m]) > 1"}
+		],
+		"recordingRules": [
+			{"group_name": "api", "name": "job:http_requests:rate5m", "expression": "sum by (job) (rate(http_requests_total[5m]))"},
+			{"group_name": "api", "name": "", "expression": "up"}
+		],
+		"dashboards": [
+			{"uid": "abc", "title": "API", "url": "/d/abc"},
+			{"uid": "", "title": "Missing uid", "url": "/d/"}
+		]
+	},
+	"node_load1": {
+		"dashboards": [{"uid": "def", "title": "Nodes", "url": "/d/def"}]
+	},
+	"": {
+		"dashboards": [{"uid": "ghi", "title": "Broken", "url": "/d/ghi"}]
+	}
+}`
+
+func newImportRequest(t *testing.T, field, content string) *http.Request {
+	t.Helper()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile(field, "usage.json")
+	require.NoError(t, err)
+	_, err = fw.Write([]byte(content))
+	require.NoError(t, err)
+	require.NoError(t, mw.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/metrics/import", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func TestImportMetricsUsage(t *testing.T) {
+	provider := &usageProvider{}
+	r, err := NewRoutes(WithDBProvider(provider))
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	r.importMetricsUsage(rec, newImportRequest(t, "file", sampleMetricsUsage))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var resp metricsUsageImportResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Equal(t, metricsUsageImportResponse{RulesInserted: 2, DashboardsInserted: 2, Skipped: 4}, resp)
+
+	assert.ElementsMatch(t, []db.RulesUsage{
+		{
+			Serie:      "http_requests_total",
+			GroupName:  "api",
+			Name:       "HighErrorRate",
+			Expression: `rate(http_requests_total{code="500"}[5m]) > 1`,
+			Kind:       string(db.RuleUsageKindAlert),
+		},
+		{
+			Serie:      "http_requests_total",
+			GroupName:  "api",
+			Name:       "job:http_requests:rate5m",
+			Expression: "sum by (job) (rate(http_requests_total[5m]))",
+			Kind:       string(db.RuleUsageKindRecord),
+		},
+	}, provider.rules)
+	assert.ElementsMatch(t, []db.DashboardUsage{
+		{Serie: "http_requests_total", Id: "abc", Name: "API", URL: "/d/abc"},
+		{Serie: "node_load1", Id: "def", Name: "Nodes", URL: "/d/def"},
+	}, provider.dashboards)
+}
+
+func TestImportMetricsUsage_Invalid(t *testing.T) {
+	r, err := NewRoutes(WithDBProvider(&usageProvider{}))
+	require.NoError(t, err)
+
+	for name, req := range map[string]*http.Request{
+		"not multipart":  httptest.NewRequest(http.MethodPost, "/api/v1/metrics/import", bytes.NewBufferString(sampleMetricsUsage)),
+		"missing file":   newImportRequest(t, "upload", sampleMetricsUsage),
+		"malformed json": newImportRequest(t, "file", `{"up": [`),
+	} {
+		t.Run(name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			r.importMetricsUsage(rec, req)
+			assert.Equal(t, http.StatusBadRequest, rec.Code)
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	r.importMetricsUsage(rec, httptest.NewRequest(http.MethodGet, "/api/v1/metrics/import", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+type usedProvider struct {
+	db.Provider
+	rules      map[string]int
+	dashboards map[string]int
+	queries    map[string]int
+}
+
+func (p *usedProvider) GetRulesUsage(ctx context.Context, serie string, kind string, page int, pageSize int) (*db.PagedResult, error) {
+	return &db.PagedResult{Total: p.rules[serie+"/"+kind]}, nil
+}
+
+func (p *usedProvider) GetDashboardUsage(ctx context.Context, serie string, page int, pageSize int) (*db.PagedResult, error) {
+	return &db.PagedResult{Total: p.dashboards[serie]}, nil
+}
+
+func (p *usedProvider) GetQueriesBySerieName(ctx context.Context, serie string, page int, pageSize int, sortBy string, sortOrder string) (*db.PagedResult, error) {
+	return &db.PagedResult{Total: p.queries[serie]}, nil
+}
+
+func TestMetricsUsed(t *testing.T) {
+	r, err := NewRoutes(WithDBProvider(&usedProvider{
+		rules:      map[string]int{"up/alert": 2, "node_load1/record": 1},
+		dashboards: map[string]int{"up": 3},
+		queries:    map[string]int{"http_requests_total": 5},
+	}))
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	r.metricsUsed(rec, httptest.NewRequest(http.MethodGet, "/api/v1/metrics/used?names=up,node_load1,,http_requests_total,unused_total,up", nil))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var data []metricUsed
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&data))
+	assert.Equal(t, []metricUsed{
+		{Name: "up", Alerts: 2, Dashboards: 3, Used: true},
+		{Name: "node_load1", Records: 1, Used: true},
+		{Name: "http_requests_total", Queries: 5, Used: true},
+		{Name: "unused_total"},
+	}, data)
+}
+
+func TestMetricsUsed_InvalidNames(t *testing.T) {
+	r, err := NewRoutes(WithDBProvider(&usedProvider{}))
+	require.NoError(t, err)
+
+	tooMany := make([]string, 0, maxMetricsUsedNames+1)
+	for i := range maxMetricsUsedNames + 1 {
+		tooMany = append(tooMany, fmt.Sprintf("metric_%d", i))
+	}
+
+	for _, names := range []string{"", " , ", strings.Join(tooMany, ",")} {
+		rec := httptest.NewRecorder()
+		r.metricsUsed(rec, httptest.NewRequest(http.MethodGet, "/api/v1/metrics/used?names="+url.QueryEscape(names), nil))
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	}
+}
+
+type statisticsProvider struct {
+	db.Provider
+	names []string
+	err   error
+}
+
+func (p *statisticsProvider) GetMetricStatisticsBatch(ctx context.Context, names []string, tr db.TimeRange) (map[string]db.MetricUsageStatistics, error) {
+	p.names = names
+	if p.err != nil {
+		return nil, p.err
+	}
+	data := make(map[string]db.MetricUsageStatistics, len(names))
+	for i, name := range names {
+		data[name] = db.MetricUsageStatistics{Queries: i}
+	}
+	return data, nil
+}
+
+func TestMetricStatistics(t *testing.T) {
+	provider := &statisticsProvider{}
+	r, err := NewRoutes(WithDBProvider(provider))
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	r.metricStatistics(rec, httptest.NewRequest(http.MethodPost, "/api/v1/metricStatistics", strings.NewReader(`["up", "", "node_load1", "up"]`)))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var data map[string]db.MetricUsageStatistics
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&data))
+	assert.Equal(t, map[string]db.MetricUsageStatistics{
+		"up":         {Queries: 0},
+		"node_load1": {Queries: 1},
+	}, data)
+	assert.Equal(t, []string{"up", "node_load1"}, provider.names)
+}
+
+func TestMetricStatistics_Invalid(t *testing.T) {
+	provider := &statisticsProvider{}
+	r, err := NewRoutes(WithDBProvider(provider))
+	require.NoError(t, err)
+
+	tooMany := make([]string, 0, maxMetricsUsedNames+1)
+	for i := range maxMetricsUsedNames + 1 {
+		tooMany = append(tooMany, fmt.Sprintf("metric_%d", i))
+	}
+	tooManyJSON, err := json.Marshal(tooMany)
+	require.NoError(t, err)
+
+	for _, body := range []string{"", "[]", `[""]`, `{"names":["up"]}`, string(tooManyJSON)} {
+		rec := httptest.NewRecorder()
+		r.metricStatistics(rec, httptest.NewRequest(http.MethodPost, "/api/v1/metricStatistics", strings.NewReader(body)))
+		assert.Equal(t, http.StatusBadRequest, rec.Code, body)
+	}
+
+	rec := httptest.NewRecorder()
+	r.metricStatistics(rec, httptest.NewRequest(http.MethodGet, "/api/v1/metricStatistics", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.Equal(t, "POST", rec.Header().Get("Allow"))
+
+	provider.err = db.ErrNotSupported
+	rec = httptest.NewRecorder()
+	r.metricStatistics(rec, httptest.NewRequest(http.MethodPost, "/api/v1/metricStatistics", strings.NewReader(`["up"]`)))
+	assert.Equal(t, http.StatusNotImplemented, rec.Code)
+}
@@ -0,0 +1,101 @@
+package routes
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/cache"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// rateLimiterIdleTTL is how long the limiter of a client is kept once
+	// it stops sending requests, by then its bucket is full again.
+	rateLimiterIdleTTL = 10 * time.Minute
+	// maxRateLimitedClients bounds the number of per client limiters.
+	maxRateLimitedClients = 10000
+)
+
+// analyticsRateLimiter limits the rate of the analytics API requests, either
+// globally or per client IP.
+type analyticsRateLimiter struct {
+	limit rate.Limit
+	burst int
+
+	global *rate.Limiter
+
+	mu      sync.Mutex
+	clients *cache.Cache[*rate.Limiter]
+}
+
+// WithAnalyticsRateLimit limits the analytics API to limit requests per
+// second with bursts of up to burst requests, answering 429 beyond it. The
+// limit applies to each client IP when perIP is set, and to all the clients
+// together otherwise. The proxied Prometheus API is never limited.
+func WithAnalyticsRateLimit(limit float64, burst int, perIP bool) Option {
+	return func(r *routes) {
+		if limit <= 0 {
+			return
+		}
+		l := &analyticsRateLimiter{
+			limit: rate.Limit(limit),
+			burst: burst,
+		}
+		if perIP {
+			l.clients = cache.New[*rate.Limiter](rateLimiterIdleTTL, maxRateLimitedClients)
+		} else {
+			l.global = rate.NewLimiter(l.limit, l.burst)
+		}
+		r.analyticsRateLimiter = l
+	}
+}
+
+// limiter returns the limiter of the client.
+func (l *analyticsRateLimiter) limiter(client string) *rate.Limiter {
+	if l.clients == nil {
+		return l.global
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limiter, ok := l.clients.Get(client)
+	if !ok {
+		limiter = rate.NewLimiter(l.limit, l.burst)
+	}
+	// Set again to extend the TTL of the active clients.
+	l.clients.Set(client, limiter)
+	return limiter
+}
+
+// reserve takes a token for the client, returning how long it must wait for
+// one when none is available.
+func (l *analyticsRateLimiter) reserve(client string) time.Duration {
+	reservation := l.limiter(client).Reserve()
+	if !reservation.OK() {
+		return time.Second
+	}
+	delay := reservation.Delay()
+	if delay > 0 {
+		reservation.Cancel()
+	}
+	return delay
+}
+
+func (r *routes) withRateLimit(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if r.analyticsRateLimiter == nil {
+			h(w, req)
+			return
+		}
+
+		if delay := r.analyticsRateLimiter.reserve(r.sourceIP(req)); delay > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		h(w, req)
+	}
+}
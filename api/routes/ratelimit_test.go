@@ -0,0 +1,77 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"testing/fstest"
+
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/db"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithAnalyticsRateLimit(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	newRoutes := func(perIP bool) *routes {
+		r, err := NewRoutes(
+			WithProxy(upstreamURL),
+			WithDBProvider(&db.NoopProvider{}),
+			WithAnalyticsRateLimit(0.001, 2, perIP),
+			WithHandlers(fstest.MapFS{"index.html": {Data: []byte("<html></html>")}}, prometheus.NewRegistry(), false),
+		)
+		require.NoError(t, err)
+		return r
+	}
+	serve := func(r *routes, target, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("global", func(t *testing.T) {
+		r := newRoutes(false)
+
+		for range 2 {
+			require.Equal(t, http.StatusOK, serve(r, "/api/v1/query/slowest", "10.0.0.1:1234").Code)
+		}
+		rec := serve(r, "/api/v1/query/error_breakdown", "10.0.0.2:1234")
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+		retryAfter, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+		require.NoError(t, err)
+		assert.Positive(t, retryAfter)
+
+		// The proxied Prometheus API is never limited.
+		for range 3 {
+			assert.Equal(t, http.StatusOK, serve(r, "/api/v1/labels", "10.0.0.1:1234").Code)
+		}
+	})
+
+	t.Run("per ip", func(t *testing.T) {
+		r := newRoutes(true)
+
+		for range 2 {
+			require.Equal(t, http.StatusOK, serve(r, "/api/v1/query/slowest", "10.0.0.1:1234").Code)
+		}
+		assert.Equal(t, http.StatusTooManyRequests, serve(r, "/api/v1/query/slowest", "10.0.0.1:1234").Code)
+		assert.Equal(t, http.StatusOK, serve(r, "/api/v1/query/slowest", "10.0.0.2:1234").Code)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		r := &routes{}
+		WithAnalyticsRateLimit(0, 0, false)(r)
+		assert.Nil(t, r.analyticsRateLimiter)
+	})
+}
@@ -0,0 +1,44 @@
+package routes
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// WithConfigReload enables /api/v1/config/reload, reloading the
+// configuration with the given function, which returns the changed settings
+// requiring a restart to apply.
+func WithConfigReload(reload func() ([]string, error)) Option {
+	return func(r *routes) {
+		r.reloadConfig = reload
+	}
+}
+
+type configReloadResponse struct {
+	RequiresRestart []string `json:"requiresRestart"`
+}
+
+func (r *routes) configReload(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !r.isAdmin(req) {
+		http.Error(w, "reloading the configuration requires admin authentication", http.StatusForbidden)
+		return
+	}
+	if r.reloadConfig == nil {
+		http.Error(w, "no configuration file to reload", http.StatusNotImplemented)
+		return
+	}
+
+	requiresRestart, err := r.reloadConfig()
+	if err != nil {
+		slog.Error("unable to reload the configuration", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSONResponse(w, configReloadResponse{RequiresRestart: requiresRestart})
+}
@@ -0,0 +1,66 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigReload(t *testing.T) {
+	reloads := 0
+	r := &routes{adminToken: "secret"}
+	WithConfigReload(func() ([]string, error) {
+		reloads++
+		return []string{"upstream.url"}, nil
+	})(r)
+
+	serve := func(r *routes, method, authorization string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/v1/config/reload", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rec := httptest.NewRecorder()
+		r.configReload(rec, req)
+		return rec
+	}
+
+	t.Run("requires POST", func(t *testing.T) {
+		rec := serve(r, http.MethodGet, "Bearer secret")
+		assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+		assert.Equal(t, "POST", rec.Header().Get("Allow"))
+	})
+
+	t.Run("requires admin token", func(t *testing.T) {
+		for _, authorization := range []string{"", "Bearer wrong"} {
+			assert.Equal(t, http.StatusForbidden, serve(r, http.MethodPost, authorization).Code)
+		}
+		assert.Zero(t, reloads)
+	})
+
+	t.Run("reloads", func(t *testing.T) {
+		rec := serve(r, http.MethodPost, "Bearer secret")
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, 1, reloads)
+
+		var resp configReloadResponse
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+		assert.Equal(t, []string{"upstream.url"}, resp.RequiresRestart)
+	})
+
+	t.Run("reload error", func(t *testing.T) {
+		failing := &routes{adminToken: "secret"}
+		WithConfigReload(func() ([]string, error) {
+			return nil, errors.New("invalid configuration")
+		})(failing)
+		assert.Equal(t, http.StatusInternalServerError, serve(failing, http.MethodPost, "Bearer secret").Code)
+	})
+
+	t.Run("no configuration file", func(t *testing.T) {
+		assert.Equal(t, http.StatusNotImplemented, serve(&routes{adminToken: "secret"}, http.MethodPost, "Bearer secret").Code)
+	})
+}
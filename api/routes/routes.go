@@ -2,20 +2,33 @@ package routes
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"log/slog"
+	"mime"
 	"net/http"
 	"net/http/httputil"
+	"net/netip"
 	"net/url"
+	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/metalmatze/signal/server/signalhttp"
 	"github.com/nicolastakashi/prom-analytics-proxy/api/models"
 	"github.com/nicolastakashi/prom-analytics-proxy/api/response"
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/cache"
 	"github.com/nicolastakashi/prom-analytics-proxy/internal/db"
 	"github.com/nicolastakashi/prom-analytics-proxy/internal/ingester"
 	metricsUsageV1 "github.com/perses/metrics-usage/pkg/api/v1"
@@ -23,19 +36,138 @@ import (
 	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/cors"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"golang.org/x/sync/singleflight"
+)
+
+// defaultSimilarDashboardsThreshold is the minimum Jaccard similarity of the
+// referenced series for two dashboards to be reported as similar.
+const defaultSimilarDashboardsThreshold = 0.8
+
+// maxErrorMessageSize bounds the size of the upstream error stored for a
+// failed query.
+const maxErrorMessageSize = 512
+
+const (
+	defaultSlowestQueriesLimit = 20
+	maxSlowestQueriesLimit     = 200
+	defaultTopIPsLimit         = 20
+	maxTopIPsLimit             = 200
+	defaultTopMetricsLimit     = 20
+	maxTopMetricsLimit         = 200
+	// defaultTimeRangeWindow is used when the from parameter is missing and
+	// no default lookback is configured.
+	defaultTimeRangeWindow = 7 * 24 * time.Hour
+)
+
+const (
+	// defaultThroughputBuckets is the number of buckets of the query
+	// throughput when no step is given.
+	defaultThroughputBuckets = 100
+	// maxThroughputBuckets bounds the number of buckets of the query
+	// throughput, as Prometheus bounds the points of a range query.
+	maxThroughputBuckets = 11000
+)
+
+const (
+	defaultRegressionCurrentWindow  = 24 * time.Hour
+	defaultRegressionBaselineWindow = 7 * 24 * time.Hour
+	defaultRegressionFactor         = 2.0
 )
 
 type routes struct {
-	handler http.Handler
-	mux     *http.ServeMux
+	handler  http.Handler
+	mux      *http.ServeMux
+	upstream *url.URL
+	// upstreams holds every upstream in failover order, the first one being
+	// upstream.
+	upstreams []*url.URL
+	// internalMux serves the operational endpoints, such as /metrics, on the
+	// internal listener when there is one.
+	internalMux      *http.ServeMux
+	internalListener bool
+
+	queryIngester         *ingester.QueryIngester
+	dbProvider            db.Provider
+	includeQueryStats     bool
+	includeHeadersSize    bool
+	promAPI               v1.API
+	metadataLimit         string
+	seriesLimit           *uint64
+	cardinalityCache      *cache.Cache[[]labelCardinality]
+	resultCache           *cache.Cache[bufferedResponse]
+	inflight              *singleflight.Group
+	inflightWaiting       atomic.Int64
+	splitInterval         time.Duration
+	splitCache            *cache.Cache[[]matrixSeries]
+	upstreamAuth          *upstreamAuth
+	tenantHeader          string
+	adminToken            string
+	stripHeaders          []string
+	stripParams           []string
+	cors                  *cors.Cors
+	trustedProxies        []netip.Prefix
+	setHeaders            map[string]string
+	queryTimeout          atomic.Int64
+	accessLog             bool
+	redactQueries         bool
+	maxResponseParseBytes int64
+	compression           bool
+	ruleEvalUserAgents    []string
+	defaultLookback       time.Duration
+	analyticsRateLimiter  *analyticsRateLimiter
+	reloadConfig          func() ([]string, error)
+	// optionErrs collects the errors of the invalid options, returned by
+	// NewRoutes.
+	optionErrs []error
+}
 
-	queryIngester     *ingester.QueryIngester
-	dbProvider        db.Provider
-	includeQueryStats bool
-	promAPI           v1.API
-	metadataLimit     string
-	seriesLimit       *uint64
+type bufferedResponse struct {
+	statusCode int
+	header     http.Header
+	body       []byte
+}
+
+// bufferedResponseWriter collects a response in memory so it can be
+// written to more than one client.
+type bufferedResponseWriter struct {
+	statusCode int
+	header     http.Header
+	body       bytes.Buffer
+}
+
+func newBufferedResponseWriter() *bufferedResponseWriter {
+	return &bufferedResponseWriter{header: make(http.Header)}
+}
+
+func (bw *bufferedResponseWriter) Header() http.Header {
+	return bw.header
+}
+
+func (bw *bufferedResponseWriter) WriteHeader(statusCode int) {
+	if bw.statusCode == 0 {
+		bw.statusCode = statusCode
+	}
+}
+
+func (bw *bufferedResponseWriter) Write(b []byte) (int, error) {
+	if bw.statusCode == 0 {
+		bw.statusCode = http.StatusOK
+	}
+	return bw.body.Write(b)
+}
+
+func (bw *bufferedResponseWriter) response() bufferedResponse {
+	statusCode := bw.statusCode
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	return bufferedResponse{
+		statusCode: statusCode,
+		header:     bw.header,
+		body:       bw.body.Bytes(),
+	}
 }
 
 type Option func(*routes)
@@ -56,8 +188,18 @@ func WithHandlers(uiFS fs.FS, registry *prometheus.Registry, isTracingEnabled bo
 	return func(r *routes) {
 		i := signalhttp.NewHandlerInstrumenter(registry, []string{"handler"})
 		mux := http.NewServeMux()
+		internalMux := http.NewServeMux()
+		// handleInternal registers the operational endpoints, which are only
+		// served by the internal listener when there is one.
+		handleInternal := func(pattern string, h http.Handler) {
+			internalMux.Handle(pattern, h)
+			mux.Handle(pattern, r.notOnInternalListener(h))
+		}
+
 		mux.Handle("/", r.ui(uiFS))
-		mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+		handleInternal("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+		handleInternal("/-/healthy", http.HandlerFunc(r.healthy))
+		handleInternal("/-/ready", http.HandlerFunc(r.ready))
 		mux.Handle("/api/", http.HandlerFunc(r.passthrough))
 		mux.Handle("/api/v1/query", i.NewHandler(
 			prometheus.Labels{"handler": "query"},
@@ -67,43 +209,149 @@ func WithHandlers(uiFS fs.FS, registry *prometheus.Registry, isTracingEnabled bo
 			prometheus.Labels{"handler": "query_range"},
 			otelhttp.NewHandler(http.HandlerFunc(r.query_range), "/api/v1/query_range"),
 		))
-		mux.Handle("/api/v1/queries", http.HandlerFunc(r.analytics))
-		mux.Handle("/api/v1/queryShortcuts", http.HandlerFunc(r.queryShortcuts))
-		mux.Handle("/api/v1/seriesMetadata", http.HandlerFunc(r.seriesMetadata))
-		mux.Handle("/api/v1/serieMetadata/{name}", http.HandlerFunc(r.serieMetadata))
-		mux.Handle("/api/v1/serieExpressions/{name}", http.HandlerFunc(r.serieExpressions))
-		mux.Handle("/api/v1/serieUsage/{name}", http.HandlerFunc(r.GetSerieUsage))
+
+		// The analytics endpoints are instrumented as well, as some of them
+		// run expensive database queries, and their responses compressed.
+		// The preflight requests of other origins are answered first.
+		instrument := func(handler string, h http.HandlerFunc) http.Handler {
+			return i.NewHandler(prometheus.Labels{"handler": handler}, r.withCORS(r.withCompression(r.withQueryTimeout(h))))
+		}
+		// The read endpoints are rate limited as well, to protect the
+		// database from clients refreshing too often.
+		analytics := func(handler string, h http.HandlerFunc) http.Handler {
+			return instrument(handler, r.withRateLimit(h))
+		}
+		mux.Handle("/api/v1/queries", analytics("queries", r.analytics))
+		mux.Handle("/api/v1/queryShortcuts", analytics("query_shortcuts", r.queryShortcuts))
+		mux.Handle("/api/v1/seriesMetadata", analytics("series_metadata", r.seriesMetadata))
+		mux.Handle("/api/v1/serieMetadata/{name}", analytics("serie_metadata", r.serieMetadata))
+		mux.Handle("/api/v1/metricCardinality/{name}", analytics("metric_cardinality", r.metricCardinality))
+		mux.Handle("/api/v1/serieExpressions/{name}", analytics("serie_expressions", r.serieExpressions))
+		mux.Handle("/api/v1/serieUsage/{name}", analytics("serie_usage", r.GetSerieUsage))
+		mux.Handle("/api/v1/dashboards/similar", analytics("dashboards_similar", r.similarDashboards))
+		mux.Handle("/api/v1/query/slowest", analytics("query_slowest", r.slowestQueries))
+		mux.Handle("/api/v1/query/execution/{id}", analytics("query_execution", r.queryExecutionDetail))
+		mux.Handle("/api/v1/query/regressions", analytics("query_regressions", r.latencyRegressions))
+		mux.Handle("/api/v1/query/error_breakdown", analytics("query_error_breakdown", r.queryErrorBreakdown))
+		mux.Handle("/api/v1/query/top_ips", analytics("query_top_ips", r.topIPs))
+		mux.Handle("/api/v1/query/top_metrics", analytics("query_top_metrics", r.topMetrics))
+		mux.Handle("/api/v1/query/throughput", analytics("query_throughput", r.queryThroughput))
+		mux.Handle("/api/v1/query/comparison", analytics("query_comparison", r.queryComparison))
+		handleInternal("/api/v1/admin/read_only", instrument("admin_read_only", r.readOnly))
+		handleInternal("/api/v1/admin/ingestion_lag", instrument("admin_ingestion_lag", r.ingestionLag))
+		handleInternal("/api/v1/config/reload", instrument("config_reload", r.configReload))
+		handleInternal("/api/v1/stats", instrument("stats", r.stats))
+		handleInternal("/api/v1/raw_query", instrument("raw_query", r.rawQuery))
 
 		// endpoint for perses metrics usage push from the client
-		mux.Handle("/api/v1/metrics", http.HandlerFunc(r.PushMetricsUsage))
+		mux.Handle("/api/v1/metrics", instrument("metrics_usage", r.PushMetricsUsage))
+		mux.Handle("/api/v1/metrics/import", instrument("metrics_usage_import", r.importMetricsUsage))
+		mux.Handle("/api/v1/metrics/used", analytics("metrics_used", r.metricsUsed))
+		mux.Handle("/api/v1/metricStatistics", analytics("metric_statistics", r.metricStatistics))
 		r.mux = mux
+		r.internalMux = internalMux
 	}
 }
 
-func WithProxy(upstream *url.URL) Option {
+// WithProxy proxies the requests to the first upstream, failing over to the
+// next ones in order when it is unreachable or answers with a 5xx.
+func WithProxy(upstreams ...*url.URL) Option {
 	return func(r *routes) {
+		if len(upstreams) == 0 {
+			r.optionErrs = append(r.optionErrs, errors.New("at least one upstream is required"))
+			return
+		}
+		upstream := upstreams[0]
 		proxy := httputil.NewSingleHostReverseProxy(upstream)
 		originalDirector := proxy.Director
 		proxy.Director = func(req *http.Request) {
 			originalDirector(req)
 			req.Host = upstream.Host // Set the Host header to the target host
-			if r.includeQueryStats {
-				query := req.URL.Query()
-				query.Add("stats", "true")
-				req.URL.RawQuery = query.Encode()
+			// Strip the parameters last, but not the injected stats one.
+			stats := r.queryStats(req)
+			if stats {
+				injectQueryStats(req)
 			}
+			r.stripRequestParams(req, stats)
+			req.Header.Del(noStatsHeader)
 		}
+		proxy.Transport = &upstreamTransport{r: r, next: newFailoverTransport(upstreams, http.DefaultTransport)}
+		proxy.ModifyResponse = r.modifyResponseHeaders
 		r.handler = proxy
+		r.upstream = upstream
+		r.upstreams = upstreams
+	}
+}
+
+// injectQueryStats asks the upstream for the query stats. Form-encoded POST
+// requests get the parameter in their body, since the upstream may not read
+// the URL parameters of those.
+func injectQueryStats(req *http.Request) {
+	if req.Method == http.MethodPost && req.Body != nil && isFormEncoded(req) {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			slog.Error("unable to read request body to inject query stats", "err", err)
+			req.Body = http.NoBody
+			req.ContentLength = 0
+			return
+		}
+
+		form, err := url.ParseQuery(string(body))
+		if err == nil {
+			form.Set("stats", "true")
+			body = []byte(form.Encode())
+		} else {
+			slog.Warn("unable to parse request form to inject query stats", "err", err)
+		}
+		setRequestBody(req, body)
+		if err == nil {
+			return
+		}
+	}
+
+	query := req.URL.Query()
+	query.Add("stats", "true")
+	req.URL.RawQuery = query.Encode()
+}
+
+func isFormEncoded(req *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/x-www-form-urlencoded"
+}
+
+// WithResponseHeaders removes the strip headers from the upstream responses
+// and adds or overrides the set headers before they reach the clients.
+func WithResponseHeaders(strip []string, set map[string]string) Option {
+	return func(r *routes) {
+		r.stripHeaders = strip
+		r.setHeaders = set
+	}
+}
+
+func (r *routes) modifyResponseHeaders(resp *http.Response) error {
+	for _, name := range r.stripHeaders {
+		resp.Header.Del(name)
 	}
+	for name, value := range r.setHeaders {
+		resp.Header.Set(name, value)
+	}
+	return nil
 }
 
-func WithPromAPI(upstream *url.URL) Option {
+func WithPromAPI(upstreams ...*url.URL) Option {
 	return func(r *routes) {
+		if len(upstreams) == 0 {
+			r.optionErrs = append(r.optionErrs, errors.New("at least one upstream is required for the prometheus API"))
+			return
+		}
 		c, err := api.NewClient(api.Config{
-			Address: upstream.String(),
+			Address:      upstreams[0].String(),
+			RoundTripper: &upstreamTransport{r: r, next: newFailoverTransport(upstreams, api.DefaultRoundTripper)},
 		})
 		if err != nil {
-			slog.Error("unable to create prometheus client", "err", err)
+			r.optionErrs = append(r.optionErrs, fmt.Errorf("unable to create prometheus client: %w", err))
+			return
 		}
 		r.promAPI = v1.NewAPI(c)
 	}
@@ -115,6 +363,119 @@ func WithIncludeQueryStats(includeQueryStats bool) Option {
 	}
 }
 
+// WithMaxResponseParseBytes bounds how much of each query response is
+// decoded looking for its stats. A zero limit decodes whole responses.
+func WithMaxResponseParseBytes(maxBytes int64) Option {
+	return func(r *routes) {
+		r.maxResponseParseBytes = maxBytes
+	}
+}
+
+// responseBufferSize returns how much of a query response is buffered to
+// be parsed, which is the whole response when it is cached. Buffering as
+// much as is parsed is enough as compressed responses only grow when
+// decompressed.
+func (r *routes) responseBufferSize(cached bool) int64 {
+	if cached || r.maxResponseParseBytes <= 0 {
+		return 0
+	}
+	return max(r.maxResponseParseBytes, maxErrorMessageSize)
+}
+
+// noStatsHeader lets clients opt out of the query stats for expensive
+// queries, which are then recorded without samples.
+const noStatsHeader = "X-Prom-Analytics-No-Stats"
+
+// queryStats reports whether the upstream is asked for the stats of the
+// request's query.
+func (r *routes) queryStats(req *http.Request) bool {
+	if !r.includeQueryStats {
+		return false
+	}
+	noStats, _ := strconv.ParseBool(req.Header.Get(noStatsHeader))
+	return !noStats
+}
+
+// WithAdminToken sets the bearer token required by the administrative
+// endpoints, such as the query plans of the analytics queries. Those are
+// disabled when no token is set.
+func WithAdminToken(token string) Option {
+	return func(r *routes) {
+		r.adminToken = token
+	}
+}
+
+// WithQueryTimeout bounds the duration of the analytics requests, so a
+// pathological database query can not hang them. A zero timeout disables it.
+func WithQueryTimeout(timeout time.Duration) Option {
+	return func(r *routes) {
+		r.SetQueryTimeout(timeout)
+	}
+}
+
+// SetQueryTimeout changes the timeout of the analytics requests, see
+// WithQueryTimeout.
+func (r *routes) SetQueryTimeout(timeout time.Duration) {
+	r.queryTimeout.Store(int64(timeout))
+}
+
+func (r *routes) withQueryTimeout(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		timeout := time.Duration(r.queryTimeout.Load())
+		if timeout <= 0 {
+			h(w, req)
+			return
+		}
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		defer cancel()
+		h(w, req.WithContext(ctx))
+	}
+}
+
+// writeQueryError reports a failed database query, answering with a 504 when
+// it failed because the request ran out of time.
+func writeQueryError(w http.ResponseWriter, req *http.Request, msg string) {
+	if errors.Is(req.Context().Err(), context.DeadlineExceeded) {
+		http.Error(w, "query timed out", http.StatusGatewayTimeout)
+		return
+	}
+	http.Error(w, msg, http.StatusInternalServerError)
+}
+
+// WithTenantHeader records the value of the given request header as the
+// tenant of each query, for multi-tenant upstreams such as Cortex or Mimir.
+func WithTenantHeader(header string) Option {
+	return func(r *routes) {
+		r.tenantHeader = header
+	}
+}
+
+func WithIncludeHeadersSize(includeHeadersSize bool) Option {
+	return func(r *routes) {
+		r.includeHeadersSize = includeHeadersSize
+	}
+}
+
+// WithResultCache enables caching of successful instant query responses for
+// the given TTL. A zero TTL or max size disables the cache.
+func WithResultCache(ttl time.Duration, maxSize int) Option {
+	return func(r *routes) {
+		if ttl > 0 && maxSize > 0 {
+			r.resultCache = cache.New[bufferedResponse](ttl, maxSize)
+		}
+	}
+}
+
+// WithQueryCoalescing makes concurrent identical queries share a single
+// upstream request.
+func WithQueryCoalescing(enabled bool) Option {
+	return func(r *routes) {
+		if enabled {
+			r.inflight = &singleflight.Group{}
+		}
+	}
+}
+
 func WithMetadataLimit(limit uint64) Option {
 	return func(r *routes) {
 		if limit > 0 {
@@ -131,12 +492,16 @@ func WithSeriesLimit(limit uint64) Option {
 
 func NewRoutes(opts ...Option) (*routes, error) {
 	r := &routes{
-		mux: http.NewServeMux(), // Initialize mux to avoid nil pointer dereference
+		mux:              http.NewServeMux(), // Initialize mux to avoid nil pointer dereference
+		cardinalityCache: cache.New[[]labelCardinality](metricCardinalityCacheTTL, metricCardinalityCacheSize),
 	}
 
 	for _, opt := range opts {
 		opt(r)
 	}
+	if err := errors.Join(r.optionErrs...); err != nil {
+		return nil, err
+	}
 
 	return r, nil
 }
@@ -145,6 +510,30 @@ func (r *routes) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	r.mux.ServeHTTP(w, req)
 }
 
+// WithInternalListener serves the operational endpoints, such as /metrics
+// and the health checks, only from InternalHandler instead of the main
+// handler.
+func WithInternalListener(enabled bool) Option {
+	return func(r *routes) {
+		r.internalListener = enabled
+	}
+}
+
+// InternalHandler serves the operational endpoints on the internal listener.
+func (r *routes) InternalHandler() http.Handler {
+	return r.internalMux
+}
+
+func (r *routes) notOnInternalListener(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if r.internalListener {
+			http.NotFound(w, req)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
 func getTimeParam(req *http.Request, param string) time.Time {
 	if timeParam := req.FormValue(param); timeParam != "" {
 		timeParamNormalized, err := time.Parse(time.RFC3339, timeParam)
@@ -156,10 +545,15 @@ func getTimeParam(req *http.Request, param string) time.Time {
 	return time.Now()
 }
 
+// getStepParam returns the step of a range query in seconds, accepting
+// both float seconds and Prometheus durations such as 1m.
 func getStepParam(req *http.Request) float64 {
 	if stepParam := req.FormValue("step"); stepParam != "" {
-		step, _ := strconv.ParseFloat(stepParam, 64)
-		return step
+		step, err := parsePromDuration(stepParam)
+		if err != nil {
+			slog.Error("unable to parse step parameter", "err", err)
+		}
+		return step.Seconds()
 	}
 	return 15
 }
@@ -187,8 +581,10 @@ func (r *routes) passthrough(w http.ResponseWriter, req *http.Request) {
 func (r *routes) query(w http.ResponseWriter, req *http.Request) {
 	start := time.Now()
 	query := db.Query{
-		TS:   start,
-		Type: db.QueryTypeInstant,
+		TS:     start,
+		Type:   db.QueryTypeInstant,
+		Method: req.Method,
+		Source: r.querySource(req),
 	}
 
 	if req.Method == http.MethodPost {
@@ -212,26 +608,48 @@ func (r *routes) query(w http.ResponseWriter, req *http.Request) {
 		query.TimeParam = getTimeParam(req, "time")
 	}
 
-	recw := response.NewResponseWriter(w)
-	r.handler.ServeHTTP(recw, req)
+	recw := response.NewResponseWriter(w, r.responseBufferSize(r.resultCache != nil))
+	if cached, ok := r.cachedResult(req); ok {
+		writeBufferedResponse(recw, cached)
+		query.Cached = true
+	} else {
+		upstreamStart := time.Now()
+		r.forward(recw, req)
+		query.UpstreamDuration = time.Since(upstreamStart)
+	}
 
-	if response := recw.ParseQueryResponse(r.includeQueryStats); response != nil {
-		query.TotalQueryableSamples = response.Data.Stats.Samples.TotalQueryableSamples
-		query.PeakSamples = response.Data.Stats.Samples.PeakSamples
+	// The response is parsed once, for both the result cache and the
+	// recorded query.
+	resp := recw.ParseQueryResponse(r.queryStats(req) && !query.Cached, r.maxResponseParseBytes)
+	if !query.Cached {
+		r.cacheResult(req, recw.GetStatusCode(), resp, recw.Header(), recw.GetBody())
 	}
 
+	query.Error = recw.GetErrorMessage(maxErrorMessageSize)
+	query.Tenant = r.tenant(req)
+	query.SourceIP = r.sourceIP(req)
+	query.DashboardUID = dashboardUID(req)
+	recordQueryResponse(&query, resp)
+
 	query.Duration = time.Since(start)
 	query.StatusCode = recw.GetStatusCode()
 	query.BodySize = recw.GetBodySize()
+	query.TotalBytes = query.BodySize
+	if r.includeHeadersSize {
+		query.TotalBytes += response.HeaderSize(req.Header) + recw.GetHeaderSize()
+	}
 
 	r.queryIngester.Ingest(query)
+	r.logAccess(req, query)
 }
 
 func (r *routes) query_range(w http.ResponseWriter, req *http.Request) {
 	start := time.Now()
 	query := db.Query{
-		TS:   start,
-		Type: db.QueryTypeRange,
+		TS:     start,
+		Type:   db.QueryTypeRange,
+		Method: req.Method,
+		Source: r.querySource(req),
 	}
 
 	if req.Method == http.MethodPost {
@@ -260,19 +678,211 @@ func (r *routes) query_range(w http.ResponseWriter, req *http.Request) {
 		query.End = getTimeParam(req, "end")
 	}
 
-	recw := response.NewResponseWriter(w)
-	r.handler.ServeHTTP(recw, req)
-
-	if response := recw.ParseQueryResponse(r.includeQueryStats); response != nil {
-		query.TotalQueryableSamples = response.Data.Stats.Samples.TotalQueryableSamples
-		query.PeakSamples = response.Data.Stats.Samples.PeakSamples
+	recw := response.NewResponseWriter(w, r.responseBufferSize(false))
+	split := r.splitInterval > 0 && r.splitQueryRange(recw, req, &query)
+	if !split {
+		upstreamStart := time.Now()
+		r.forward(recw, req)
+		query.UpstreamDuration = time.Since(upstreamStart)
 	}
 
+	query.Error = recw.GetErrorMessage(maxErrorMessageSize)
+	query.Tenant = r.tenant(req)
+	query.SourceIP = r.sourceIP(req)
+	query.DashboardUID = dashboardUID(req)
+	recordQueryResponse(&query, recw.ParseQueryResponse(r.queryStats(req) && !split, r.maxResponseParseBytes))
+
 	query.Duration = time.Since(start)
 	query.StatusCode = recw.GetStatusCode()
 	query.BodySize = recw.GetBodySize()
+	query.TotalBytes = query.BodySize
+	if r.includeHeadersSize {
+		query.TotalBytes += response.HeaderSize(req.Header) + recw.GetHeaderSize()
+	}
 
 	r.queryIngester.Ingest(query)
+	r.logAccess(req, query)
+}
+
+// recordQueryResponse records the stats and the status of the parsed query
+// response. The error of a response failing with a 200 status code is
+// recorded as well, as its body is not.
+func recordQueryResponse(query *db.Query, resp *models.Response) {
+	if resp == nil {
+		return
+	}
+
+	query.TotalQueryableSamples = resp.Data.Stats.Samples.TotalQueryableSamples
+	query.PeakSamples = resp.Data.Stats.Samples.PeakSamples
+	query.ResultStatus = resp.Status
+	if query.Error == "" && resp.Error != "" {
+		query.Error = resp.Error
+		if len(query.Error) > maxErrorMessageSize {
+			query.Error = strings.ToValidUTF8(query.Error[:maxErrorMessageSize], "")
+		}
+	}
+}
+
+func (r *routes) resultCacheKey(req *http.Request) string {
+	// Form holds both the URL and the POST form parameters, already parsed
+	// while extracting the query. The accepted encoding is part of the key
+	// because the upstream body is cached as is, and the tenant and the
+	// credentials because each tenant or user may see its own data. The
+	// credentials are hashed so they are not kept in memory. Whether the
+	// upstream is asked for the query stats is part of it as well, as only
+	// the responses of those requests carry them.
+	credentials := sha256.Sum256([]byte(req.Header.Get("Authorization")))
+	return r.tenant(req) + "|" + hex.EncodeToString(credentials[:]) + "|" + req.Header.Get("Accept-Encoding") + "|" + strconv.FormatBool(r.queryStats(req)) + "|" + req.Form.Encode()
+}
+
+func (r *routes) tenant(req *http.Request) string {
+	if r.tenantHeader == "" {
+		return ""
+	}
+	return req.Header.Get(r.tenantHeader)
+}
+
+// dashboardUID returns the UID of the Grafana dashboard the query was sent
+// from, read from the X-Dashboard-UID header Grafana sets or from the
+// dashboard_uid parameter.
+func dashboardUID(req *http.Request) string {
+	if uid := req.Header.Get("X-Dashboard-UID"); uid != "" {
+		return uid
+	}
+	return req.FormValue("dashboard_uid")
+}
+
+func (r *routes) cachedResult(req *http.Request) (bufferedResponse, bool) {
+	if r.resultCache == nil {
+		return bufferedResponse{}, false
+	}
+	return r.resultCache.Get(r.resultCacheKey(req))
+}
+
+// cacheResult caches a successful response. Prometheus compatible upstreams
+// may answer errors with a 200 status code, so the status of the parsed
+// response must be success as well.
+func (r *routes) cacheResult(req *http.Request, statusCode int, resp *models.Response, header http.Header, body []byte) {
+	if r.resultCache == nil || statusCode != http.StatusOK || resp == nil || resp.Status != models.StatusSuccess {
+		return
+	}
+
+	header = header.Clone()
+	header.Del("Date")
+
+	r.resultCache.Set(r.resultCacheKey(req), bufferedResponse{
+		statusCode: statusCode,
+		header:     header,
+		body:       bytes.Clone(body),
+	})
+}
+
+// forward sends the request to the upstream. With coalescing enabled,
+// concurrent identical requests wait for and share the response of the
+// first one instead of reaching the upstream themselves. The shared request
+// is not cancelled when the client of the first one goes away, as the
+// others still wait for it, and each request stops waiting when its own
+// client goes away.
+func (r *routes) forward(w http.ResponseWriter, req *http.Request) {
+	if r.inflight == nil {
+		r.handler.ServeHTTP(w, req)
+		return
+	}
+
+	key := req.URL.Path + "|" + r.resultCacheKey(req)
+	shared := req.WithContext(context.WithoutCancel(req.Context()))
+	ch := r.inflight.DoChan(key, func() (interface{}, error) {
+		bw := newBufferedResponseWriter()
+		r.handler.ServeHTTP(bw, shared)
+		return bw.response(), nil
+	})
+
+	r.inflightWaiting.Add(1)
+	defer r.inflightWaiting.Add(-1)
+	select {
+	case res := <-ch:
+		writeBufferedResponse(w, res.Val.(bufferedResponse))
+	case <-req.Context().Done():
+		// As the reverse proxy answers the requests cancelled by their
+		// client.
+		http.Error(w, req.Context().Err().Error(), http.StatusBadGateway)
+	}
+}
+
+func writeBufferedResponse(w http.ResponseWriter, buffered bufferedResponse) {
+	for key, values := range buffered.header {
+		w.Header()[key] = slices.Clone(values)
+	}
+	w.WriteHeader(buffered.statusCode)
+	if _, err := w.Write(buffered.body); err != nil {
+		slog.Error("unable to write buffered response", "err", err)
+	}
+}
+
+// isAdmin reports whether the request carries the admin bearer token.
+func (r *routes) isAdmin(req *http.Request) bool {
+	if r.adminToken == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(r.adminToken)) == 1
+}
+
+type readOnlyResponse struct {
+	ReadOnly bool `json:"readOnly"`
+}
+
+// readOnly reports whether the writes to the analytics store are suspended
+// and lets admins toggle it with the enabled parameter.
+func (r *routes) readOnly(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		if !r.isAdmin(req) {
+			http.Error(w, "changing the read-only mode requires admin authentication", http.StatusForbidden)
+			return
+		}
+		enabled, err := strconv.ParseBool(req.FormValue("enabled"))
+		if err != nil {
+			http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+			return
+		}
+		r.queryIngester.SetReadOnly(enabled)
+	default:
+		w.Header().Set("Allow", "GET, POST, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSONResponse(w, readOnlyResponse{ReadOnly: r.queryIngester.ReadOnly()})
+}
+
+type ingestionLagResponse struct {
+	LagSeconds     float64 `json:"lagSeconds"`
+	PendingQueries int     `json:"pendingQueries"`
+}
+
+// ingestionLag reports how long the oldest query waiting to be persisted has
+// been buffered, i.e. how fresh the analytics are.
+func (r *routes) ingestionLag(w http.ResponseWriter, req *http.Request) {
+	lag, pending := r.queryIngester.IngestionLag()
+	writeJSONResponse(w, ingestionLagResponse{
+		LagSeconds:     lag.Seconds(),
+		PendingQueries: pending,
+	})
+}
+
+// stats reports the row count of each table and the size of the analytics
+// database.
+func (r *routes) stats(w http.ResponseWriter, req *http.Request) {
+	stats, err := r.dbProvider.Stats(req.Context())
+	if err != nil {
+		slog.Error("unable to retrieve database stats", "err", err)
+		writeQueryError(w, req, "unable to retrieve database stats")
+		return
+	}
+
+	writeJSONResponse(w, stats)
 }
 
 func (r *routes) analytics(w http.ResponseWriter, req *http.Request) {
@@ -282,10 +892,56 @@ func (r *routes) analytics(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if req.FormValue("explain") == "true" {
+		if !r.isAdmin(req) {
+			http.Error(w, "explain requires admin authentication", http.StatusForbidden)
+			return
+		}
+
+		plan, err := r.dbProvider.Explain(req.Context(), query)
+		if err != nil {
+			slog.Error("unable to explain query", "err", err)
+			writeQueryError(w, req, fmt.Sprintf("unable to explain query: %s", err.Error()))
+			return
+		}
+
+		writeJSONResponse(w, plan)
+		return
+	}
+
 	data, err := r.dbProvider.Query(req.Context(), query)
 	if err != nil {
 		slog.Error("unable to execute query", "err", err)
-		http.Error(w, fmt.Sprintf("unable to execute query: %s", err.Error()), http.StatusInternalServerError)
+		writeQueryError(w, req, fmt.Sprintf("unable to execute query: %s", err.Error()))
+		return
+	}
+
+	writeJSONResponse(w, data)
+}
+
+// rawQuery runs the read-only SQL query given by admins against the
+// analytics database, returning its columns and rows.
+func (r *routes) rawQuery(w http.ResponseWriter, req *http.Request) {
+	if !r.isAdmin(req) {
+		http.Error(w, "raw queries require admin authentication", http.StatusForbidden)
+		return
+	}
+
+	query := req.FormValue("query")
+	if query == "" {
+		http.Error(w, "missing query parameter", http.StatusBadRequest)
+		return
+	}
+
+	if err := db.ValidateSQLQuery(query); err != nil {
+		http.Error(w, fmt.Sprintf("query not allowed: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	data, err := r.dbProvider.Query(req.Context(), query)
+	if err != nil {
+		slog.Error("unable to execute raw query", "err", err)
+		writeQueryError(w, req, fmt.Sprintf("unable to execute query: %s", err.Error()))
 		return
 	}
 
@@ -298,6 +954,12 @@ func (r *routes) queryShortcuts(w http.ResponseWriter, req *http.Request) {
 }
 
 func (r *routes) seriesMetadata(w http.ResponseWriter, req *http.Request) {
+	types, err := parseMetricTypes(req.URL.Query().Get("type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	metadata, err := r.promAPI.Metadata(req.Context(), "", r.metadataLimit)
 	if err != nil {
 		slog.Error("unable to retrieve series metadata", "err", err)
@@ -305,7 +967,56 @@ func (r *routes) seriesMetadata(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	writeJSONResponse(w, metadata)
+	writeJSONResponse(w, filterMetadataByType(metadata, types))
+}
+
+var knownMetricTypes = []v1.MetricType{
+	v1.MetricTypeCounter,
+	v1.MetricTypeGauge,
+	v1.MetricTypeHistogram,
+	v1.MetricTypeGaugeHistogram,
+	v1.MetricTypeSummary,
+	v1.MetricTypeInfo,
+	v1.MetricTypeStateset,
+	v1.MetricTypeUnknown,
+}
+
+// parseMetricTypes parses a comma separated list of metric types. It
+// returns nil, meaning every type, when the list is empty or contains all.
+func parseMetricTypes(value string) ([]v1.MetricType, error) {
+	types := make([]v1.MetricType, 0)
+	for _, t := range strings.Split(value, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		switch {
+		case t == "":
+			continue
+		case t == "all":
+			return nil, nil
+		case !slices.Contains(knownMetricTypes, v1.MetricType(t)):
+			return nil, fmt.Errorf("unknown metric type %q", t)
+		}
+		types = append(types, v1.MetricType(t))
+	}
+	if len(types) == 0 {
+		return nil, nil
+	}
+	return types, nil
+}
+
+func filterMetadataByType(metadata map[string][]v1.Metadata, types []v1.MetricType) map[string][]v1.Metadata {
+	if types == nil {
+		return metadata
+	}
+
+	filtered := make(map[string][]v1.Metadata)
+	for name, entries := range metadata {
+		for _, entry := range entries {
+			if slices.Contains(types, entry.Type) {
+				filtered[name] = append(filtered[name], entry)
+			}
+		}
+	}
+	return filtered
 }
 
 func (r *routes) serieMetadata(w http.ResponseWriter, req *http.Request) {
@@ -347,18 +1058,37 @@ func (r *routes) serieExpressions(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	data, err := r.dbProvider.GetQueriesBySerieName(req.Context(), name, page, pageSize)
+	sortBy := req.FormValue("sortBy")
+	if sortBy == "" {
+		sortBy = db.DefaultSerieQueriesSortBy
+	}
+	sortOrder := req.FormValue("sortOrder")
+	if sortOrder == "" {
+		sortOrder = "desc"
+	}
+	if !db.IsValidSerieQueriesSort(sortBy, sortOrder) {
+		http.Error(w, fmt.Sprintf("invalid sort %q %q", sortBy, sortOrder), http.StatusBadRequest)
+		return
+	}
+
+	data, err := r.dbProvider.GetQueriesBySerieName(req.Context(), name, page, pageSize, sortBy, sortOrder)
 	if err != nil {
 		slog.Error("unable to retrieve series expressions", "err", err)
-		http.Error(w, "unable to retrieve series expressions", http.StatusInternalServerError)
+		writeQueryError(w, req, "unable to retrieve series expressions")
 		return
 	}
 
 	writeJSONResponse(w, data)
 }
 
+// uiAssetsCacheControl is sent with the assets under assets/, whose names
+// are fingerprinted by the build so their content never changes.
+const uiAssetsCacheControl = "public, max-age=31536000, immutable"
+
+// ui serves the embedded ui files. Any other path, besides the API and
+// /metrics, serves index.html so the client side routes can be deep linked.
 func (r *routes) ui(uiFS fs.FS) http.HandlerFunc {
-	uiHandler := http.ServeMux{}
+	files := make(map[string]http.HandlerFunc)
 	err := fs.WalkDir(uiFS, ".", func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
@@ -378,16 +1108,36 @@ func (r *routes) ui(uiFS fs.FS) http.HandlerFunc {
 			return fmt.Errorf("failed to receive file info %s: %w", path, err)
 		}
 
-		paths := []string{fmt.Sprintf("/%s", path)}
+		gz, err := compressUIAsset(path, b)
+		if err != nil {
+			return fmt.Errorf("failed to compress ui file %s: %w", path, err)
+		}
 
-		if paths[0] == "/index.html" {
-			paths = append(paths, "/")
+		sum := sha256.Sum256(b)
+		etag := fmt.Sprintf("%q", hex.EncodeToString(sum[:8]))
+		cacheControl := "no-cache"
+		if strings.HasPrefix(path, "assets/") {
+			cacheControl = uiAssetsCacheControl
 		}
 
-		for _, path := range paths {
-			uiHandler.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		files["/"+path] = func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", cacheControl)
+			if gz == nil {
+				w.Header().Set("ETag", etag)
 				http.ServeContent(w, r, d.Name(), fi.ModTime(), bytes.NewReader(b))
-			})
+				return
+			}
+
+			w.Header().Add("Vary", "Accept-Encoding")
+			if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+				// The compressed representation needs its own ETag.
+				w.Header().Set("ETag", strings.TrimSuffix(etag, `"`)+`-gzip"`)
+				w.Header().Set("Content-Encoding", "gzip")
+				http.ServeContent(w, r, d.Name(), fi.ModTime(), bytes.NewReader(gz))
+				return
+			}
+			w.Header().Set("ETag", etag)
+			http.ServeContent(w, r, d.Name(), fi.ModTime(), bytes.NewReader(b))
 		}
 		return nil
 	})
@@ -396,61 +1146,87 @@ func (r *routes) ui(uiFS fs.FS) http.HandlerFunc {
 		return nil
 	}
 
-	return uiHandler.ServeHTTP
+	index := files["/index.html"]
+	return func(w http.ResponseWriter, req *http.Request) {
+		if serve, ok := files[req.URL.Path]; ok {
+			serve(w, req)
+			return
+		}
+		if index == nil || !isUIRoute(req.URL.Path) {
+			http.NotFound(w, req)
+			return
+		}
+		index(w, req)
+	}
+}
+
+// isUIRoute reports whether the path may be a client side route of the ui.
+func isUIRoute(path string) bool {
+	switch {
+	case path == "/api" || strings.HasPrefix(path, "/api/"):
+		return false
+	case path == "/metrics":
+		return false
+	}
+	return true
 }
 
-var usage = make(map[string]*metricsUsageV1.MetricUsage)
+var compressibleUIExtensions = map[string]bool{
+	".html": true,
+	".js":   true,
+	".css":  true,
+	".svg":  true,
+	".json": true,
+	".map":  true,
+	".txt":  true,
+}
+
+// compressUIAsset gzips text based ui assets once so they can be served
+// compressed without spending CPU on every request. It returns nil when the
+// asset should be served as is.
+func compressUIAsset(path string, b []byte) ([]byte, error) {
+	if !compressibleUIExtensions[filepath.Ext(path)] {
+		return nil, nil
+	}
+
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(b); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	if buf.Len() >= len(b) {
+		return nil, nil
+	}
+	return buf.Bytes(), nil
+}
 
 func (r *routes) PushMetricsUsage(w http.ResponseWriter, req *http.Request) {
+	var usage map[string]*metricsUsageV1.MetricUsage
 	if err := json.NewDecoder(req.Body).Decode(&usage); err != nil {
 		slog.Error("unable to decode request body", "err", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	for name, metricUsage := range usage {
-		rulesUsage := make([]db.RulesUsage, 0, len(metricUsage.AlertRules)+len(metricUsage.RecordingRules))
-		for usage := range metricUsage.AlertRules {
-			rulesUsage = append(rulesUsage, db.RulesUsage{
-				Serie:      name,
-				GroupName:  usage.GroupName,
-				Name:       usage.Name,
-				Expression: usage.Expression,
-				Kind:       string(db.RuleUsageKindAlert),
-			})
-		}
-
-		for usage := range metricUsage.RecordingRules {
-			rulesUsage = append(rulesUsage, db.RulesUsage{
-				Serie:      name,
-				GroupName:  usage.GroupName,
-				Name:       usage.Name,
-				Expression: usage.Expression,
-				Kind:       string(db.RuleUsageKindRecord),
-			})
-		}
-
-		if err := r.dbProvider.InsertRulesUsage(req.Context(), rulesUsage); err != nil {
-			slog.Error("unable to insert rules usage", "err", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	rulesUsage, dashboardUsage, _ := metricsUsageRecords(usage)
 
-		dashboardUsage := make([]db.DashboardUsage, 0, len(metricUsage.Dashboards))
-		for usage := range metricUsage.Dashboards {
-			dashboardUsage = append(dashboardUsage, db.DashboardUsage{
-				Serie: name,
-				Id:    usage.ID,
-				Name:  usage.Name,
-				URL:   usage.URL,
-			})
-		}
+	if err := r.dbProvider.InsertRulesUsage(req.Context(), rulesUsage); err != nil {
+		slog.Error("unable to insert rules usage", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-		if err := r.dbProvider.InsertDashboardUsage(req.Context(), dashboardUsage); err != nil {
-			slog.Error("unable to insert dashboard usage", "err", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	if err := r.dbProvider.InsertDashboardUsage(req.Context(), dashboardUsage); err != nil {
+		slog.Error("unable to insert dashboard usage", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 }
 
@@ -485,7 +1261,7 @@ func (r *routes) GetSerieUsage(w http.ResponseWriter, req *http.Request) {
 		dashboards, err := r.dbProvider.GetDashboardUsage(req.Context(), name, page, pageSize)
 		if err != nil {
 			slog.Error("unable to retrieve series dashboards", "err", err)
-			http.Error(w, "unable to retrieve series dashboards", http.StatusInternalServerError)
+			writeQueryError(w, req, "unable to retrieve series dashboards")
 			return
 		}
 		writeJSONResponse(w, dashboards)
@@ -495,9 +1271,334 @@ func (r *routes) GetSerieUsage(w http.ResponseWriter, req *http.Request) {
 	alerts, err := r.dbProvider.GetRulesUsage(req.Context(), name, kind, page, pageSize)
 	if err != nil {
 		slog.Error("unable to retrieve series expressions", "err", err)
-		http.Error(w, "unable to retrieve series expressions", http.StatusInternalServerError)
+		writeQueryError(w, req, "unable to retrieve series expressions")
 		return
 	}
 
 	writeJSONResponse(w, alerts)
 }
+
+func (r *routes) similarDashboards(w http.ResponseWriter, req *http.Request) {
+	threshold := defaultSimilarDashboardsThreshold
+	if value := req.URL.Query().Get("threshold"); value != "" {
+		var err error
+		threshold, err = strconv.ParseFloat(value, 64)
+		if err != nil || threshold < 0 || threshold > 1 {
+			http.Error(w, "threshold must be a number between 0 and 1", http.StatusBadRequest)
+			return
+		}
+	}
+
+	dashboards, err := r.dbProvider.GetSimilarDashboards(req.Context(), threshold)
+	if err != nil {
+		slog.Error("unable to retrieve similar dashboards", "err", err)
+		writeQueryError(w, req, "unable to retrieve similar dashboards")
+		return
+	}
+
+	writeJSONResponse(w, dashboards)
+}
+
+// WithDefaultLookback sets the time range considered by the analytics
+// endpoints when the from parameter is omitted.
+func WithDefaultLookback(lookback time.Duration) Option {
+	return func(r *routes) {
+		r.defaultLookback = lookback
+	}
+}
+
+// getTimeRange reads the from and to parameters of the request, defaulting
+// to the last default lookback.
+func (r *routes) getTimeRange(req *http.Request) (db.TimeRange, error) {
+	tr := db.TimeRange{To: time.Now()}
+	if value := req.URL.Query().Get("to"); value != "" {
+		to, err := parsePromTime(value)
+		if err != nil {
+			return tr, fmt.Errorf("unable to parse to parameter: %w", err)
+		}
+		tr.To = to
+	}
+
+	lookback := r.defaultLookback
+	if lookback <= 0 {
+		lookback = defaultTimeRangeWindow
+	}
+	tr.From = tr.To.Add(-lookback)
+	if value := req.URL.Query().Get("from"); value != "" {
+		from, err := parsePromTime(value)
+		if err != nil {
+			return tr, fmt.Errorf("unable to parse from parameter: %w", err)
+		}
+		tr.From = from
+	}
+
+	if tr.From.After(tr.To) {
+		return tr, fmt.Errorf("from must be before to")
+	}
+	return tr, nil
+}
+
+func (r *routes) slowestQueries(w http.ResponseWriter, req *http.Request) {
+	tr, err := r.getTimeRange(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limit, err := getQueryParamAsInt(req, "limit", defaultSlowestQueriesLimit)
+	if err != nil || limit <= 0 {
+		http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+		return
+	}
+	limit = min(limit, maxSlowestQueriesLimit)
+
+	source, err := getSourceParam(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	queries, err := r.dbProvider.GetSlowestQueries(req.Context(), tr, req.URL.Query().Get("tenant"), source, limit)
+	if err != nil {
+		slog.Error("unable to retrieve slowest queries", "err", err)
+		writeQueryError(w, req, "unable to retrieve slowest queries")
+		return
+	}
+
+	writeJSONResponse(w, queries)
+}
+
+func (r *routes) queryExecutionDetail(w http.ResponseWriter, req *http.Request) {
+	id, err := strconv.ParseInt(req.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "unable to parse id parameter", http.StatusBadRequest)
+		return
+	}
+
+	detail, err := r.dbProvider.GetQueryExecutionDetail(req.Context(), id)
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		http.Error(w, fmt.Sprintf("query execution %d not found", id), http.StatusNotFound)
+		return
+	case errors.Is(err, db.ErrNotSupported):
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	case err != nil:
+		slog.Error("unable to retrieve query execution", "err", err, "id", id)
+		writeQueryError(w, req, "unable to retrieve query execution")
+		return
+	}
+
+	writeJSONResponse(w, detail)
+}
+
+func (r *routes) topIPs(w http.ResponseWriter, req *http.Request) {
+	tr, err := r.getTimeRange(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limit, err := getQueryParamAsInt(req, "limit", defaultTopIPsLimit)
+	if err != nil || limit <= 0 {
+		http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+		return
+	}
+	limit = min(limit, maxTopIPsLimit)
+
+	source, err := getSourceParam(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	stats, err := r.dbProvider.GetQueriesByIP(req.Context(), tr, req.URL.Query().Get("tenant"), source, limit)
+	if err != nil {
+		slog.Error("unable to retrieve queries by source ip", "err", err)
+		writeQueryError(w, req, "unable to retrieve queries by source ip")
+		return
+	}
+
+	writeJSONResponse(w, stats)
+}
+
+// topMetrics ranks the metrics by the number of queries selecting them.
+func (r *routes) topMetrics(w http.ResponseWriter, req *http.Request) {
+	tr, err := r.getTimeRange(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limit, err := getQueryParamAsInt(req, "limit", defaultTopMetricsLimit)
+	if err != nil || limit <= 0 {
+		http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+		return
+	}
+	limit = min(limit, maxTopMetricsLimit)
+
+	source, err := getSourceParam(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	metrics, err := r.dbProvider.GetTopQueriedMetrics(req.Context(), tr, req.URL.Query().Get("tenant"), source, limit)
+	if err != nil {
+		slog.Error("unable to retrieve top queried metrics", "err", err)
+		writeQueryError(w, req, "unable to retrieve top queried metrics")
+		return
+	}
+
+	writeJSONResponse(w, metrics)
+}
+
+// queryThroughput counts the queries of each step of the time range, split
+// into one series per tenant, source or method with the groupBy parameter.
+func (r *routes) queryThroughput(w http.ResponseWriter, req *http.Request) {
+	tr, err := r.getTimeRange(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	groupBy, err := db.ParseThroughputGroupBy(req.URL.Query().Get("groupBy"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	step := max((tr.To.Sub(tr.From) / defaultThroughputBuckets).Truncate(time.Minute), time.Minute)
+	if value := req.URL.Query().Get("step"); value != "" {
+		d, err := parsePromDuration(value)
+		if err != nil || d < time.Second {
+			http.Error(w, "step must be a duration of at least one second", http.StatusBadRequest)
+			return
+		}
+		step = d.Truncate(time.Second)
+	}
+	if tr.To.Sub(tr.From)/step >= maxThroughputBuckets {
+		http.Error(w, fmt.Sprintf("exceeded maximum resolution of %d buckets, increase the step", maxThroughputBuckets), http.StatusBadRequest)
+		return
+	}
+
+	source, err := getSourceParam(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	throughput, err := r.dbProvider.GetQueryThroughput(req.Context(), tr, req.URL.Query().Get("tenant"), source, step, groupBy)
+	if err != nil {
+		slog.Error("unable to retrieve query throughput", "err", err)
+		writeQueryError(w, req, "unable to retrieve query throughput")
+		return
+	}
+
+	writeJSONResponse(w, throughput)
+}
+
+// queryComparison compares the queries of the from/to window with the
+// compareFrom/compareTo one, which defaults to the window of the same length
+// right before it.
+func (r *routes) queryComparison(w http.ResponseWriter, req *http.Request) {
+	current, err := r.getTimeRange(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	previous := current.Previous()
+	compareFrom, compareTo := req.URL.Query().Get("compareFrom"), req.URL.Query().Get("compareTo")
+	if (compareFrom == "") != (compareTo == "") {
+		http.Error(w, "compareFrom and compareTo must be set together", http.StatusBadRequest)
+		return
+	}
+	if compareFrom != "" {
+		if previous.From, err = parsePromTime(compareFrom); err != nil {
+			http.Error(w, "unable to parse compareFrom parameter", http.StatusBadRequest)
+			return
+		}
+		if previous.To, err = parsePromTime(compareTo); err != nil {
+			http.Error(w, "unable to parse compareTo parameter", http.StatusBadRequest)
+			return
+		}
+		if previous.From.After(previous.To) {
+			http.Error(w, "compareFrom must be before compareTo", http.StatusBadRequest)
+			return
+		}
+	}
+
+	comparison, err := db.GetWindowComparison(req.Context(), r.dbProvider, current, previous)
+	if err != nil {
+		slog.Error("unable to compare query windows", "err", err)
+		writeQueryError(w, req, "unable to compare query windows")
+		return
+	}
+
+	writeJSONResponse(w, comparison)
+}
+
+func (r *routes) latencyRegressions(w http.ResponseWriter, req *http.Request) {
+	currentWindow := defaultRegressionCurrentWindow
+	if value := req.URL.Query().Get("currentWindow"); value != "" {
+		d, err := parsePromDuration(value)
+		if err != nil || d <= 0 {
+			http.Error(w, "unable to parse currentWindow parameter", http.StatusBadRequest)
+			return
+		}
+		currentWindow = d
+	}
+
+	baselineWindow := defaultRegressionBaselineWindow
+	if value := req.URL.Query().Get("baselineWindow"); value != "" {
+		d, err := parsePromDuration(value)
+		if err != nil || d <= 0 {
+			http.Error(w, "unable to parse baselineWindow parameter", http.StatusBadRequest)
+			return
+		}
+		baselineWindow = d
+	}
+
+	factor := defaultRegressionFactor
+	if value := req.URL.Query().Get("factor"); value != "" {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || f <= 0 {
+			http.Error(w, "factor must be a positive number", http.StatusBadRequest)
+			return
+		}
+		factor = f
+	}
+
+	regressions, err := r.dbProvider.GetLatencyRegressions(req.Context(), currentWindow, baselineWindow, factor)
+	if err != nil {
+		slog.Error("unable to retrieve latency regressions", "err", err)
+		writeQueryError(w, req, "unable to retrieve latency regressions")
+		return
+	}
+
+	writeJSONResponse(w, regressions)
+}
+
+func (r *routes) queryErrorBreakdown(w http.ResponseWriter, req *http.Request) {
+	tr, err := r.getTimeRange(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	source, err := getSourceParam(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	breakdown, err := r.dbProvider.GetQueryErrorBreakdown(req.Context(), tr, req.URL.Query().Get("tenant"), source)
+	if err != nil {
+		slog.Error("unable to retrieve query error breakdown", "err", err)
+		writeQueryError(w, req, "unable to retrieve query error breakdown")
+		return
+	}
+
+	writeJSONResponse(w, breakdown)
+}
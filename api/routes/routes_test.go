@@ -0,0 +1,1472 @@
+package routes
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/config"
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/db"
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/ingester"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUI_ServesCompressedAssets(t *testing.T) {
+	script := strings.Repeat("console.log('prom-analytics-proxy');\n", 100)
+	uiFS := fstest.MapFS{
+		"index.html":      {Data: []byte("<html><body>" + strings.Repeat("<div></div>", 100) + "</body></html>")},
+		"assets/index.js": {Data: []byte(script)},
+		"favicon.png":     {Data: []byte{0x89, 0x50, 0x4e, 0x47}},
+	}
+
+	r := &routes{}
+	handler := r.ui(uiFS)
+	require.NotNil(t, handler)
+
+	t.Run("gzip accepted", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/assets/index.js", nil)
+		req.Header.Set("Accept-Encoding", "gzip, deflate, br")
+		rec := httptest.NewRecorder()
+
+		handler(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+		assert.Contains(t, rec.Header().Get("Content-Type"), "javascript")
+		assert.Less(t, rec.Body.Len(), len(script))
+
+		zr, err := gzip.NewReader(rec.Body)
+		require.NoError(t, err)
+		body, err := io.ReadAll(zr)
+		require.NoError(t, err)
+		assert.Equal(t, script, string(body))
+	})
+
+	t.Run("gzip not accepted", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/assets/index.js", nil)
+		rec := httptest.NewRecorder()
+
+		handler(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Empty(t, rec.Header().Get("Content-Encoding"))
+		assert.Equal(t, script, rec.Body.String())
+	})
+
+	t.Run("binary assets are not compressed", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/favicon.png", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+
+		handler(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Empty(t, rec.Header().Get("Content-Encoding"))
+	})
+}
+
+func TestUI_CacheHeadersAndFallback(t *testing.T) {
+	uiFS := fstest.MapFS{
+		"index.html":             {Data: []byte("<html><body>prom-analytics-proxy</body></html>")},
+		"assets/index-abc123.js": {Data: []byte("console.log('prom-analytics-proxy');")},
+	}
+
+	r := &routes{}
+	handler := r.ui(uiFS)
+	require.NotNil(t, handler)
+
+	serve := func(path string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	t.Run("fingerprinted asset", func(t *testing.T) {
+		rec := serve("/assets/index-abc123.js", nil)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, uiAssetsCacheControl, rec.Header().Get("Cache-Control"))
+		etag := rec.Header().Get("ETag")
+		require.NotEmpty(t, etag)
+
+		rec = serve("/assets/index-abc123.js", http.Header{"If-None-Match": {etag}})
+		assert.Equal(t, http.StatusNotModified, rec.Code)
+	})
+
+	for _, path := range []string{"/", "/index.html", "/metrics/up", "/queries/slowest"} {
+		t.Run("index "+path, func(t *testing.T) {
+			rec := serve(path, nil)
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, "no-cache", rec.Header().Get("Cache-Control"))
+			assert.Contains(t, rec.Header().Get("Content-Type"), "text/html")
+			assert.Contains(t, rec.Body.String(), "prom-analytics-proxy")
+		})
+	}
+
+	for _, path := range []string{"/api/v1/unknown", "/api", "/metrics"} {
+		t.Run("not found "+path, func(t *testing.T) {
+			assert.Equal(t, http.StatusNotFound, serve(path, nil).Code)
+		})
+	}
+}
+
+type recordingProvider struct {
+	db.Provider
+
+	mu      sync.Mutex
+	queries []db.Query
+}
+
+func (p *recordingProvider) Insert(ctx context.Context, queries []db.Query) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.queries = append(p.queries, queries...)
+	return nil
+}
+
+func (p *recordingProvider) recorded() []db.Query {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]db.Query(nil), p.queries...)
+}
+
+func TestQuery_ResultCache(t *testing.T) {
+	var upstreamHits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		upstreamHits.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	defer upstream.Close()
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	provider := &recordingProvider{}
+	queryIngester := ingester.NewQueryIngester(
+		provider,
+		ingester.WithBufferSize(10),
+		ingester.WithBatchSize(1),
+		ingester.WithIngestTimeout(time.Second),
+		ingester.WithBatchFlushInterval(10*time.Millisecond),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go queryIngester.Run(ctx)
+
+	r, err := NewRoutes(
+		WithProxy(upstreamURL),
+		WithQueryIngester(queryIngester),
+		WithResultCache(time.Minute, 10),
+	)
+	require.NoError(t, err)
+
+	bodies := make([]string, 0, 2)
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up&time=2025-01-01T00:00:00Z", nil)
+		rec := httptest.NewRecorder()
+		r.query(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+		bodies = append(bodies, rec.Body.String())
+	}
+
+	assert.Equal(t, int32(1), upstreamHits.Load())
+	assert.Equal(t, bodies[0], bodies[1])
+
+	require.Eventually(t, func() bool {
+		return len(provider.recorded()) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	recorded := provider.recorded()
+	assert.False(t, recorded[0].Cached)
+	assert.True(t, recorded[1].Cached)
+
+	// A different query must not be served from the cache.
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=down&time=2025-01-01T00:00:00Z", nil)
+	r.query(httptest.NewRecorder(), req)
+	assert.Equal(t, int32(2), upstreamHits.Load())
+}
+
+func TestQuery_ResultCacheKey(t *testing.T) {
+	var upstreamHits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		upstreamHits.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		if req.FormValue("query") == "bad" {
+			_, _ = w.Write([]byte(`{"status":"error","errorType":"execution","error":"query timed out"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	defer upstream.Close()
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	queryIngester := ingester.NewQueryIngester(&recordingProvider{}, ingester.WithBufferSize(10))
+	r, err := NewRoutes(
+		WithProxy(upstreamURL),
+		WithQueryIngester(queryIngester),
+		WithResultCache(time.Minute, 10),
+	)
+	require.NoError(t, err)
+
+	serve := func(query, authorization string) {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query="+query+"&time=2025-01-01T00:00:00Z", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		r.query(httptest.NewRecorder(), req)
+	}
+
+	// Errors answered with a 200 status code are not cached.
+	serve("bad", "")
+	serve("bad", "")
+	assert.Equal(t, int32(2), upstreamHits.Load())
+
+	// Results are never shared between users.
+	serve("up", "Bearer alice")
+	serve("up", "Bearer bob")
+	serve("up", "Bearer alice")
+	assert.Equal(t, int32(4), upstreamHits.Load())
+}
+
+func TestQuery_ResultCacheStatsBeyondLimit(t *testing.T) {
+	var upstreamHits atomic.Int32
+	body := `{"status":"success","data":{"resultType":"vector","result":[` + strings.Repeat(" ", 1024) + `],"stats":{"samples":{"peakSamples":7}}}}`
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		upstreamHits.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(body))
+	}))
+	defer upstream.Close()
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	provider := &recordingProvider{}
+	queryIngester := ingester.NewQueryIngester(
+		provider,
+		ingester.WithBufferSize(10),
+		ingester.WithBatchSize(1),
+		ingester.WithIngestTimeout(time.Second),
+		ingester.WithBatchFlushInterval(10*time.Millisecond),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go queryIngester.Run(ctx)
+
+	r, err := NewRoutes(
+		WithIncludeQueryStats(true),
+		WithMaxResponseParseBytes(128),
+		WithProxy(upstreamURL),
+		WithQueryIngester(queryIngester),
+		WithResultCache(time.Minute, 10),
+	)
+	require.NoError(t, err)
+
+	// The responses whose stats are beyond the parse limit are cached all
+	// the same, their status being within it.
+	for range 2 {
+		rec := httptest.NewRecorder()
+		r.query(rec, httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up&time=2025-01-01T00:00:00Z", nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, body, rec.Body.String())
+	}
+	assert.Equal(t, int32(1), upstreamHits.Load())
+
+	require.Eventually(t, func() bool {
+		return len(provider.recorded()) == 2
+	}, time.Second, 10*time.Millisecond)
+	recorded := provider.recorded()
+	assert.Equal(t, "success", recorded[0].ResultStatus)
+	assert.Zero(t, recorded[0].PeakSamples)
+	assert.True(t, recorded[1].Cached)
+}
+
+func TestQuery_Coalescing(t *testing.T) {
+	var upstreamHits atomic.Int32
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		upstreamHits.Add(1)
+		entered <- struct{}{}
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	defer upstream.Close()
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	provider := &recordingProvider{}
+	queryIngester := ingester.NewQueryIngester(
+		provider,
+		ingester.WithBufferSize(10),
+		ingester.WithBatchSize(1),
+		ingester.WithIngestTimeout(time.Second),
+		ingester.WithBatchFlushInterval(10*time.Millisecond),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go queryIngester.Run(ctx)
+
+	r, err := NewRoutes(
+		WithProxy(upstreamURL),
+		WithQueryIngester(queryIngester),
+		WithQueryCoalescing(true),
+	)
+	require.NoError(t, err)
+
+	const concurrency = 5
+	var wg sync.WaitGroup
+	serve := func(ctx context.Context, rec *httptest.ResponseRecorder) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up&time=2025-01-01T00:00:00Z", nil).WithContext(ctx)
+			r.query(rec, req)
+		}()
+	}
+
+	// The first request reaches the upstream, the others wait for it.
+	leaderCtx, leaderCancel := context.WithCancel(context.Background())
+	leader := httptest.NewRecorder()
+	serve(leaderCtx, leader)
+	<-entered
+	recorders := make([]*httptest.ResponseRecorder, concurrency-1)
+	for i := range recorders {
+		recorders[i] = httptest.NewRecorder()
+		serve(context.Background(), recorders[i])
+	}
+	require.Eventually(t, func() bool {
+		return r.inflightWaiting.Load() == concurrency
+	}, time.Second, time.Millisecond)
+
+	// The client of the first request going away does not fail the others.
+	leaderCancel()
+	require.Eventually(t, func() bool {
+		return r.inflightWaiting.Load() == concurrency-1
+	}, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), upstreamHits.Load())
+	assert.Equal(t, http.StatusBadGateway, leader.Code)
+	for _, rec := range recorders {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+		assert.Equal(t, recorders[0].Body.String(), rec.Body.String())
+	}
+	assert.JSONEq(t, `{"status":"success","data":{"resultType":"vector","result":[]}}`, recorders[0].Body.String())
+
+	require.Eventually(t, func() bool {
+		return len(provider.recorded()) == concurrency
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestQuery_CoalescingQueryStats(t *testing.T) {
+	var upstreamHits atomic.Int32
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		upstreamHits.Add(1)
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		if req.URL.Query().Get("stats") == "" {
+			_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[],"stats":{"samples":{"peakSamples":7}}}}`))
+	}))
+	defer upstream.Close()
+	var releaseOnce sync.Once
+	defer releaseOnce.Do(func() { close(release) })
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	queryIngester := ingester.NewQueryIngester(&recordingProvider{}, ingester.WithBufferSize(10))
+	r, err := NewRoutes(
+		WithIncludeQueryStats(true),
+		WithProxy(upstreamURL),
+		WithQueryIngester(queryIngester),
+		WithQueryCoalescing(true),
+	)
+	require.NoError(t, err)
+
+	// Concurrent identical queries, only some of them opting out of the
+	// stats, share the upstream request of the ones alike.
+	const concurrency = 4
+	var wg sync.WaitGroup
+	recorders := make([]*httptest.ResponseRecorder, concurrency)
+	for i := range recorders {
+		recorders[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up&time=2025-01-01T00:00:00Z", nil)
+			if i%2 == 1 {
+				req.Header.Set(noStatsHeader, "true")
+			}
+			r.query(recorders[i], req)
+		}()
+	}
+	require.Eventually(t, func() bool {
+		return r.inflightWaiting.Load() == concurrency
+	}, time.Second, time.Millisecond)
+	releaseOnce.Do(func() { close(release) })
+	wg.Wait()
+
+	assert.Equal(t, int32(2), upstreamHits.Load())
+	for i, rec := range recorders {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		if i%2 == 1 {
+			assert.NotContains(t, rec.Body.String(), "stats", "request %d opted out of the stats", i)
+		} else {
+			assert.Contains(t, rec.Body.String(), "stats", "request %d asked for the stats", i)
+		}
+	}
+}
+
+func TestQuery_StoresErrorMessage(t *testing.T) {
+	errorBody := `{"status":"error","errorType":"bad_data","error":"1:5: parse error: ` + strings.Repeat("x", 1024) + `"}`
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(errorBody))
+	}))
+	defer upstream.Close()
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	provider := &recordingProvider{}
+	queryIngester := ingester.NewQueryIngester(
+		provider,
+		ingester.WithBufferSize(10),
+		ingester.WithBatchSize(1),
+		ingester.WithIngestTimeout(time.Second),
+		ingester.WithBatchFlushInterval(10*time.Millisecond),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go queryIngester.Run(ctx)
+
+	r, err := NewRoutes(
+		WithProxy(upstreamURL),
+		WithQueryIngester(queryIngester),
+	)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up{", nil)
+	rec := httptest.NewRecorder()
+	r.query(rec, req)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, errorBody, rec.Body.String())
+
+	require.Eventually(t, func() bool {
+		return len(provider.recorded()) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	recorded := provider.recorded()[0]
+	assert.Equal(t, http.StatusBadRequest, recorded.StatusCode)
+	assert.Equal(t, errorBody[:maxErrorMessageSize], recorded.Error)
+}
+
+func TestQuery_Tenant(t *testing.T) {
+	var upstreamHits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		upstreamHits.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	defer upstream.Close()
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	provider := &recordingProvider{}
+	queryIngester := ingester.NewQueryIngester(
+		provider,
+		ingester.WithBufferSize(10),
+		ingester.WithBatchSize(1),
+		ingester.WithIngestTimeout(time.Second),
+		ingester.WithBatchFlushInterval(10*time.Millisecond),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go queryIngester.Run(ctx)
+
+	r, err := NewRoutes(
+		WithProxy(upstreamURL),
+		WithQueryIngester(queryIngester),
+		WithTenantHeader("X-Scope-OrgID"),
+		WithResultCache(time.Minute, 10),
+	)
+	require.NoError(t, err)
+
+	for _, tenant := range []string{"team-a", "team-b", ""} {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up&time=2025-01-01T00:00:00Z", nil)
+		if tenant != "" {
+			req.Header.Set("X-Scope-OrgID", tenant)
+		}
+		r.query(httptest.NewRecorder(), req)
+	}
+
+	// Results are never shared between tenants.
+	assert.Equal(t, int32(3), upstreamHits.Load())
+
+	require.Eventually(t, func() bool {
+		return len(provider.recorded()) == 3
+	}, time.Second, 10*time.Millisecond)
+
+	tenants := make([]string, 0, 3)
+	for _, q := range provider.recorded() {
+		tenants = append(tenants, q.Tenant)
+	}
+	assert.ElementsMatch(t, []string{"team-a", "team-b", ""}, tenants)
+}
+
+func TestAnalytics_Explain(t *testing.T) {
+	config.DefaultConfig.Database.SQLite.DatabasePath = filepath.Join(t.TempDir(), "explain.db")
+	provider, err := db.GetDbProvider(context.Background(), db.SQLite)
+	require.NoError(t, err)
+	defer provider.Close()
+
+	require.NoError(t, provider.Insert(context.Background(), []db.Query{{
+		TS:         time.Now(),
+		QueryParam: "up",
+		StatusCode: 200,
+		Type:       db.QueryTypeInstant,
+	}}))
+
+	r, err := NewRoutes(
+		WithDBProvider(provider),
+		WithAdminToken("secret"),
+	)
+	require.NoError(t, err)
+
+	target := "/api/v1/queries?explain=true&query=" + url.QueryEscape("SELECT queryParam FROM queries WHERE statusCode = 200")
+
+	t.Run("requires admin token", func(t *testing.T) {
+		for _, authorization := range []string{"", "Bearer wrong"} {
+			req := httptest.NewRequest(http.MethodGet, target, nil)
+			if authorization != "" {
+				req.Header.Set("Authorization", authorization)
+			}
+			rec := httptest.NewRecorder()
+			r.analytics(rec, req)
+			assert.Equal(t, http.StatusForbidden, rec.Code)
+		}
+	})
+
+	t.Run("returns the query plan", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		r.analytics(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var plan db.QueryResult
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&plan))
+		assert.Contains(t, plan.Columns, "detail")
+		require.NotEmpty(t, plan.Data)
+		assert.Contains(t, plan.Data[0]["detail"], "queries")
+	})
+}
+
+func TestRawQuery(t *testing.T) {
+	config.DefaultConfig.Database.SQLite.DatabasePath = filepath.Join(t.TempDir(), "raw_query.db")
+	provider, err := db.GetDbProvider(context.Background(), db.SQLite)
+	require.NoError(t, err)
+	defer provider.Close()
+
+	require.NoError(t, provider.Insert(context.Background(), []db.Query{{
+		TS:         time.Now(),
+		QueryParam: "up",
+		StatusCode: 200,
+		Type:       db.QueryTypeInstant,
+	}}))
+
+	r, err := NewRoutes(
+		WithDBProvider(provider),
+		WithAdminToken("secret"),
+	)
+	require.NoError(t, err)
+
+	rawQuery := func(query, authorization string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/raw_query", strings.NewReader(url.Values{"query": {query}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rec := httptest.NewRecorder()
+		r.rawQuery(rec, req)
+		return rec
+	}
+
+	for _, authorization := range []string{"", "Bearer wrong"} {
+		rec := rawQuery("SELECT queryParam FROM queries", authorization)
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+	}
+
+	rec := rawQuery("SELECT queryParam, statusCode FROM queries", "Bearer secret")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var result db.QueryResult
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&result))
+	assert.Equal(t, []string{"queryParam", "statusCode"}, result.Columns)
+	require.Len(t, result.Data, 1)
+	assert.Equal(t, "up", result.Data[0]["queryParam"])
+
+	rec = rawQuery("DELETE FROM queries", "Bearer secret")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "query not allowed")
+
+	rec = rawQuery("", "Bearer secret")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// The rejected query was not run.
+	rec = rawQuery("SELECT COUNT(*) AS total FROM queries", "Bearer secret")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"columns":["total"],"data":[{"total":1}]}`, rec.Body.String())
+}
+
+func TestProxy_ResponseHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Server", "prometheus")
+		w.Header().Set("X-Internal-Trace", "abc")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":[]}`))
+	}))
+	defer upstream.Close()
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	r, err := NewRoutes(
+		WithProxy(upstreamURL),
+		WithResponseHeaders(
+			[]string{"Server", "X-Internal-Trace"},
+			map[string]string{"Cache-Control": "max-age=60", "Access-Control-Allow-Origin": "*"},
+		),
+	)
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	r.passthrough(rec, httptest.NewRequest(http.MethodGet, "/api/v1/labels", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get("Server"))
+	assert.Empty(t, rec.Header().Get("X-Internal-Trace"))
+	assert.Equal(t, "max-age=60", rec.Header().Get("Cache-Control"))
+	assert.Equal(t, "*", rec.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+}
+
+func TestReadOnly_Toggle(t *testing.T) {
+	queryIngester := ingester.NewQueryIngester(&recordingProvider{}, ingester.WithBufferSize(10))
+	r, err := NewRoutes(
+		WithQueryIngester(queryIngester),
+		WithAdminToken("secret"),
+	)
+	require.NoError(t, err)
+
+	toggle := func(method, target, authorization string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rec := httptest.NewRecorder()
+		r.readOnly(rec, req)
+		return rec
+	}
+
+	rec := toggle(http.MethodGet, "/api/v1/admin/read_only", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"readOnly":false}`, rec.Body.String())
+
+	rec = toggle(http.MethodPost, "/api/v1/admin/read_only?enabled=true", "Bearer wrong")
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.False(t, queryIngester.ReadOnly())
+
+	rec = toggle(http.MethodPost, "/api/v1/admin/read_only?enabled=maybe", "Bearer secret")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = toggle(http.MethodPost, "/api/v1/admin/read_only?enabled=true", "Bearer secret")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"readOnly":true}`, rec.Body.String())
+	assert.True(t, queryIngester.ReadOnly())
+
+	rec = toggle(http.MethodPut, "/api/v1/admin/read_only?enabled=false", "Bearer secret")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.False(t, queryIngester.ReadOnly())
+
+	rec = toggle(http.MethodDelete, "/api/v1/admin/read_only", "Bearer secret")
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+func TestSeriesMetadata_TypeFilter(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "/api/v1/metadata", req.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{
+			"http_requests_total":[{"type":"counter","help":"","unit":""}],
+			"memory_bytes":[{"type":"gauge","help":"","unit":""}],
+			"request_duration_seconds":[{"type":"histogram","help":"","unit":""}],
+			"rpc_duration_seconds":[{"type":"summary","help":"","unit":""}]
+		}}`))
+	}))
+	defer upstream.Close()
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	r, err := NewRoutes(WithPromAPI(upstreamURL))
+	require.NoError(t, err)
+
+	get := func(target string) (*httptest.ResponseRecorder, map[string]json.RawMessage) {
+		rec := httptest.NewRecorder()
+		r.seriesMetadata(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		var metadata map[string]json.RawMessage
+		if rec.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &metadata))
+		}
+		return rec, metadata
+	}
+
+	rec, metadata := get("/api/v1/seriesMetadata?type=histogram,summary")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Len(t, metadata, 2)
+	assert.Contains(t, metadata, "request_duration_seconds")
+	assert.Contains(t, metadata, "rpc_duration_seconds")
+
+	for _, target := range []string{"/api/v1/seriesMetadata", "/api/v1/seriesMetadata?type=all", "/api/v1/seriesMetadata?type=gauge,all"} {
+		rec, metadata = get(target)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Len(t, metadata, 4, target)
+	}
+
+	rec, _ = get("/api/v1/seriesMetadata?type=histogram,bogus")
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+type summaryProvider struct {
+	db.Provider
+	windows []db.TimeRange
+}
+
+func (p *summaryProvider) GetQueriesSummary(ctx context.Context, startTime, endTime time.Time) (*db.QueriesSummary, error) {
+	p.windows = append(p.windows, db.TimeRange{From: startTime, To: endTime})
+	return &db.QueriesSummary{TotalQueries: 10 * len(p.windows)}, nil
+}
+
+func TestQueryComparison(t *testing.T) {
+	provider := &summaryProvider{}
+	r, err := NewRoutes(WithDBProvider(provider))
+	require.NoError(t, err)
+
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r.queryComparison(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+
+	rec := get("/api/v1/query/comparison?from=2000&to=3000")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, []db.TimeRange{
+		{From: time.Unix(2000, 0).UTC(), To: time.Unix(3000, 0).UTC()},
+		{From: time.Unix(1000, 0).UTC(), To: time.Unix(2000, 0).UTC().Add(-time.Microsecond)},
+	}, provider.windows)
+
+	var comparison db.ComparisonResult
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &comparison))
+	assert.Equal(t, 10.0, comparison.TotalQueries.Current)
+	assert.Equal(t, 20.0, comparison.TotalQueries.Previous)
+	assert.Equal(t, -10.0, comparison.TotalQueries.Delta)
+
+	provider.windows = nil
+	rec = get("/api/v1/query/comparison?from=2000&to=3000&compareFrom=0&compareTo=500")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, db.TimeRange{From: time.Unix(0, 0).UTC(), To: time.Unix(500, 0).UTC()}, provider.windows[1])
+
+	for _, target := range []string{
+		"/api/v1/query/comparison?from=2000&to=3000&compareFrom=0",
+		"/api/v1/query/comparison?from=2000&to=3000&compareFrom=bogus&compareTo=500",
+		"/api/v1/query/comparison?from=2000&to=3000&compareFrom=500&compareTo=0",
+	} {
+		assert.Equal(t, http.StatusBadRequest, get(target).Code, target)
+	}
+}
+
+type throughputProvider struct {
+	db.Provider
+	tenant  string
+	source  string
+	step    time.Duration
+	groupBy db.ThroughputGroupBy
+}
+
+func (p *throughputProvider) GetQueryThroughput(ctx context.Context, tr db.TimeRange, tenant string, source string, step time.Duration, groupBy db.ThroughputGroupBy) ([]db.ThroughputBucket, error) {
+	p.tenant, p.source, p.step, p.groupBy = tenant, source, step, groupBy
+	return []db.ThroughputBucket{{Time: tr.From, Series: map[string]int{"team-a": 1, "team-b": 2}}}, nil
+}
+
+func TestQueryThroughput(t *testing.T) {
+	provider := &throughputProvider{}
+	r, err := NewRoutes(WithDBProvider(provider))
+	require.NoError(t, err)
+
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		r.queryThroughput(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+
+	rec := get("/api/v1/query/throughput?from=0&to=36000&groupBy=tenant")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, db.ThroughputGroupByTenant, provider.groupBy)
+	assert.Equal(t, 6*time.Minute, provider.step, "the default step splits the time range in 100 buckets")
+
+	var throughput []db.ThroughputBucket
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &throughput))
+	require.Len(t, throughput, 1)
+	assert.Equal(t, map[string]int{"team-a": 1, "team-b": 2}, throughput[0].Series)
+
+	rec = get("/api/v1/query/throughput?from=0&to=600&step=30s&tenant=team-a&source=user")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, db.ThroughputGroupByNone, provider.groupBy)
+	assert.Equal(t, 30*time.Second, provider.step)
+	assert.Equal(t, "team-a", provider.tenant)
+	assert.Equal(t, string(db.QuerySourceUser), provider.source)
+
+	for _, target := range []string{
+		"/api/v1/query/throughput?from=0&to=600&groupBy=fingerprint",
+		"/api/v1/query/throughput?from=0&to=600&source=robot",
+		"/api/v1/query/throughput?from=0&to=600&step=bogus",
+		"/api/v1/query/throughput?from=0&to=600&step=500ms",
+		"/api/v1/query/throughput?from=0&to=36000&step=1s",
+	} {
+		assert.Equal(t, http.StatusBadRequest, get(target).Code, target)
+	}
+}
+
+func TestGetTimeRange_DefaultLookback(t *testing.T) {
+	r, err := NewRoutes()
+	require.NoError(t, err)
+
+	tr, err := r.getTimeRange(httptest.NewRequest(http.MethodGet, "/api/v1/query/slowest", nil))
+	require.NoError(t, err)
+	assert.Equal(t, defaultTimeRangeWindow, tr.To.Sub(tr.From))
+	assert.WithinDuration(t, time.Now(), tr.To, time.Second)
+
+	r, err = NewRoutes(WithDefaultLookback(48 * time.Hour))
+	require.NoError(t, err)
+
+	tr, err = r.getTimeRange(httptest.NewRequest(http.MethodGet, "/api/v1/query/slowest", nil))
+	require.NoError(t, err)
+	assert.Equal(t, 48*time.Hour, tr.To.Sub(tr.From))
+
+	// The lookback is counted back from the to parameter.
+	tr, err = r.getTimeRange(httptest.NewRequest(http.MethodGet, "/api/v1/query/slowest?to=1000000", nil))
+	require.NoError(t, err)
+	assert.Equal(t, time.Unix(1000000, 0).UTC(), tr.To)
+	assert.Equal(t, time.Unix(1000000, 0).UTC().Add(-48*time.Hour), tr.From)
+
+	// An explicit from parameter wins.
+	tr, err = r.getTimeRange(httptest.NewRequest(http.MethodGet, "/api/v1/query/slowest?from=0&to=1000000", nil))
+	require.NoError(t, err)
+	assert.Equal(t, time.Unix(0, 0).UTC(), tr.From)
+}
+
+type executionProvider struct {
+	db.Provider
+	err error
+}
+
+func (p *executionProvider) GetQueryExecutionDetail(ctx context.Context, id int64) (*db.QueryExecutionDetail, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	if id != 42 {
+		return nil, db.ErrNotFound
+	}
+	return &db.QueryExecutionDetail{ID: id, QueryParam: "up", Type: db.QueryTypeInstant}, nil
+}
+
+func TestQueryExecutionDetail(t *testing.T) {
+	provider := &executionProvider{}
+	r, err := NewRoutes(WithDBProvider(provider))
+	require.NoError(t, err)
+
+	get := func(id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query/execution/"+id, nil)
+		req.SetPathValue("id", id)
+		rec := httptest.NewRecorder()
+		r.queryExecutionDetail(rec, req)
+		return rec
+	}
+
+	rec := get("42")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	var detail db.QueryExecutionDetail
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &detail))
+	assert.Equal(t, int64(42), detail.ID)
+	assert.Equal(t, "up", detail.QueryParam)
+
+	assert.Equal(t, http.StatusNotFound, get("7").Code)
+	assert.Equal(t, http.StatusBadRequest, get("latest").Code)
+
+	provider.err = db.ErrNotSupported
+	assert.Equal(t, http.StatusNotImplemented, get("42").Code)
+}
+
+func TestParseMetricTypes(t *testing.T) {
+	types, err := parseMetricTypes(" Histogram , summary")
+	require.NoError(t, err)
+	assert.Equal(t, []v1.MetricType{v1.MetricTypeHistogram, v1.MetricTypeSummary}, types)
+
+	types, err = parseMetricTypes(",")
+	require.NoError(t, err)
+	assert.Nil(t, types)
+}
+
+func TestQuery_StatsInjectedInFormBody(t *testing.T) {
+	type received struct {
+		rawQuery      string
+		body          string
+		contentLength int64
+	}
+	upstreamReqs := make(chan received, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		assert.NoError(t, err)
+		upstreamReqs <- received{rawQuery: req.URL.RawQuery, body: string(body), contentLength: req.ContentLength}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[],"stats":{"samples":{"totalQueryableSamples":42,"peakSamples":7}}}}`))
+	}))
+	defer upstream.Close()
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	provider := &recordingProvider{}
+	queryIngester := ingester.NewQueryIngester(
+		provider,
+		ingester.WithBufferSize(10),
+		ingester.WithBatchSize(1),
+		ingester.WithIngestTimeout(time.Second),
+		ingester.WithBatchFlushInterval(10*time.Millisecond),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go queryIngester.Run(ctx)
+
+	r, err := NewRoutes(
+		WithIncludeQueryStats(true),
+		WithProxy(upstreamURL),
+		WithQueryIngester(queryIngester),
+	)
+	require.NoError(t, err)
+
+	form := url.Values{"query": {"up"}, "time": {"2025-01-01T00:00:00Z"}}
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/query", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	r.query(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	got := <-upstreamReqs
+	body, err := url.ParseQuery(got.body)
+	require.NoError(t, err)
+	assert.Equal(t, "true", body.Get("stats"))
+	assert.Equal(t, "up", body.Get("query"))
+	assert.Equal(t, int64(len(got.body)), got.contentLength)
+	assert.Empty(t, got.rawQuery)
+
+	require.Eventually(t, func() bool {
+		return len(provider.recorded()) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 42, provider.recorded()[0].TotalQueryableSamples)
+}
+
+func TestQuery_StripParams(t *testing.T) {
+	type received struct {
+		query url.Values
+		body  url.Values
+	}
+	upstreamReqs := make(chan received, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		assert.NoError(t, err)
+		form, err := url.ParseQuery(string(body))
+		assert.NoError(t, err)
+		upstreamReqs <- received{query: req.URL.Query(), body: form}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	defer upstream.Close()
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	queryIngester := ingester.NewQueryIngester(
+		&recordingProvider{},
+		ingester.WithBufferSize(10),
+		ingester.WithBatchSize(1),
+		ingester.WithIngestTimeout(time.Second),
+		ingester.WithBatchFlushInterval(10*time.Millisecond),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go queryIngester.Run(ctx)
+
+	r, err := NewRoutes(
+		WithIncludeQueryStats(true),
+		WithProxy(upstreamURL),
+		WithQueryIngester(queryIngester),
+		WithStripParams([]string{"org_id", "panel_id", "stats"}),
+	)
+	require.NoError(t, err)
+
+	t.Run("query", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up&org_id=1&panel_id=2", nil)
+		rec := httptest.NewRecorder()
+		r.query(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		got := <-upstreamReqs
+		assert.Equal(t, url.Values{"query": {"up"}, "stats": {"true"}}, got.query)
+	})
+
+	t.Run("form body", func(t *testing.T) {
+		form := url.Values{"query": {"up"}, "org_id": {"1"}, "panel_id": {"2"}}
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/query?org_id=1", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		r.query(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		got := <-upstreamReqs
+		assert.Empty(t, got.query)
+		assert.Equal(t, url.Values{"query": {"up"}, "stats": {"true"}}, got.body)
+	})
+}
+
+func TestQuery_ErrorStatusWithOK(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"error","errorType":"timeout","error":"query timed out in expression evaluation"}`))
+	}))
+	defer upstream.Close()
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	provider := &recordingProvider{}
+	queryIngester := ingester.NewQueryIngester(
+		provider,
+		ingester.WithBufferSize(10),
+		ingester.WithBatchSize(1),
+		ingester.WithIngestTimeout(time.Second),
+		ingester.WithBatchFlushInterval(10*time.Millisecond),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go queryIngester.Run(ctx)
+
+	r, err := NewRoutes(
+		WithProxy(upstreamURL),
+		WithQueryIngester(queryIngester),
+	)
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	r.query(rec, httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	require.Eventually(t, func() bool {
+		return len(provider.recorded()) == 1
+	}, time.Second, 10*time.Millisecond)
+	query := provider.recorded()[0]
+	assert.Equal(t, http.StatusOK, query.StatusCode)
+	assert.Equal(t, db.QueryResultStatusError, query.ResultStatus)
+	assert.Equal(t, "query timed out in expression evaluation", query.Error)
+	assert.True(t, query.Failed())
+}
+
+func TestQuery_NoStatsHeader(t *testing.T) {
+	type received struct {
+		stats    string
+		noStats  string
+		rawQuery string
+	}
+	upstreamReqs := make(chan received, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		upstreamReqs <- received{
+			stats:    req.URL.Query().Get("stats"),
+			noStats:  req.Header.Get(noStatsHeader),
+			rawQuery: req.URL.RawQuery,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[],"stats":{"samples":{"totalQueryableSamples":42,"peakSamples":7}}}}`))
+	}))
+	defer upstream.Close()
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	provider := &recordingProvider{}
+	queryIngester := ingester.NewQueryIngester(
+		provider,
+		ingester.WithBufferSize(10),
+		ingester.WithBatchSize(1),
+		ingester.WithIngestTimeout(time.Second),
+		ingester.WithBatchFlushInterval(10*time.Millisecond),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go queryIngester.Run(ctx)
+
+	r, err := NewRoutes(
+		WithIncludeQueryStats(true),
+		WithProxy(upstreamURL),
+		WithQueryIngester(queryIngester),
+	)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up&time=2025-01-01T00:00:00Z", nil)
+	req.Header.Set(noStatsHeader, "true")
+	rec := httptest.NewRecorder()
+	r.query(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	got := <-upstreamReqs
+	assert.Empty(t, got.stats)
+	assert.NotContains(t, got.rawQuery, "stats")
+	assert.Empty(t, got.noStats, "the header must not be forwarded upstream")
+
+	require.Eventually(t, func() bool {
+		return len(provider.recorded()) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Zero(t, provider.recorded()[0].TotalQueryableSamples)
+	assert.Zero(t, provider.recorded()[0].PeakSamples)
+
+	// Without the header the stats are still asked for.
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up&time=2025-01-01T00:00:00Z", nil)
+	r.query(httptest.NewRecorder(), req)
+	got = <-upstreamReqs
+	assert.Equal(t, "true", got.stats)
+}
+
+func TestQuery_UpstreamDuration(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	defer upstream.Close()
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	provider := &recordingProvider{}
+	queryIngester := ingester.NewQueryIngester(
+		provider,
+		ingester.WithBufferSize(10),
+		ingester.WithBatchSize(1),
+		ingester.WithIngestTimeout(time.Second),
+		ingester.WithBatchFlushInterval(10*time.Millisecond),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go queryIngester.Run(ctx)
+
+	r, err := NewRoutes(
+		WithProxy(upstreamURL),
+		WithQueryIngester(queryIngester),
+	)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+	r.query(httptest.NewRecorder(), req)
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/query_range?query=up&start=0&end=60&step=15", nil)
+	r.query_range(httptest.NewRecorder(), req)
+
+	require.Eventually(t, func() bool {
+		return len(provider.recorded()) == 2
+	}, time.Second, 10*time.Millisecond)
+	for _, q := range provider.recorded() {
+		assert.GreaterOrEqual(t, q.UpstreamDuration, 20*time.Millisecond, q.Type)
+		assert.LessOrEqual(t, q.UpstreamDuration, q.Duration, q.Type)
+	}
+}
+
+func TestQuery_Method(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	defer upstream.Close()
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	provider := &recordingProvider{}
+	queryIngester := ingester.NewQueryIngester(
+		provider,
+		ingester.WithBufferSize(10),
+		ingester.WithBatchSize(1),
+		ingester.WithIngestTimeout(time.Second),
+		ingester.WithBatchFlushInterval(10*time.Millisecond),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go queryIngester.Run(ctx)
+
+	r, err := NewRoutes(
+		WithProxy(upstreamURL),
+		WithQueryIngester(queryIngester),
+	)
+	require.NoError(t, err)
+
+	r.query(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil))
+	require.Eventually(t, func() bool {
+		return len(provider.recorded()) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/query_range", strings.NewReader("query=up&start=0&end=60&step=15"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.query_range(httptest.NewRecorder(), req)
+	require.Eventually(t, func() bool {
+		return len(provider.recorded()) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, http.MethodGet, provider.recorded()[0].Method)
+	assert.Equal(t, http.MethodPost, provider.recorded()[1].Method)
+}
+
+func TestQuery_DashboardUID(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	defer upstream.Close()
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	provider := &recordingProvider{}
+	queryIngester := ingester.NewQueryIngester(
+		provider,
+		ingester.WithBufferSize(10),
+		ingester.WithBatchSize(1),
+		ingester.WithIngestTimeout(time.Second),
+		ingester.WithBatchFlushInterval(10*time.Millisecond),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go queryIngester.Run(ctx)
+
+	r, err := NewRoutes(
+		WithProxy(upstreamURL),
+		WithQueryIngester(queryIngester),
+	)
+	require.NoError(t, err)
+
+	withHeader := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+	withHeader.Header.Set("X-Dashboard-Uid", "node-exporter")
+	withParam := httptest.NewRequest(http.MethodPost, "/api/v1/query_range", strings.NewReader("query=up&start=0&end=60&step=15&dashboard_uid=api"))
+	withParam.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	without := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+
+	r.query(httptest.NewRecorder(), withHeader)
+	r.query_range(httptest.NewRecorder(), withParam)
+	r.query(httptest.NewRecorder(), without)
+	require.Eventually(t, func() bool {
+		return len(provider.recorded()) == 3
+	}, time.Second, 10*time.Millisecond)
+
+	uids := make([]string, 0, 3)
+	for _, q := range provider.recorded() {
+		uids = append(uids, q.DashboardUID)
+	}
+	assert.ElementsMatch(t, []string{"node-exporter", "api", ""}, uids)
+}
+
+func TestWithHandlers_InstrumentsAnalyticsEndpoints(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	r, err := NewRoutes(
+		WithDBProvider(&db.NoopProvider{}),
+		WithHandlers(fstest.MapFS{"index.html": {Data: []byte("<html></html>")}}, registry, false),
+	)
+	require.NoError(t, err)
+
+	for _, target := range []string{
+		"/api/v1/query/slowest",
+		"/api/v1/query/error_breakdown",
+		"/api/v1/dashboards/similar",
+		"/metrics",
+		"/",
+	} {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		require.Equal(t, http.StatusOK, rec.Code, target)
+	}
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+
+	handlers := make(map[string]struct{})
+	for _, mf := range families {
+		if mf.GetName() != "http_request_duration_seconds" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "handler" {
+					handlers[label.GetValue()] = struct{}{}
+				}
+			}
+		}
+	}
+	assert.Equal(t, map[string]struct{}{
+		"query_slowest":         {},
+		"query_error_breakdown": {},
+		"dashboards_similar":    {},
+	}, handlers)
+}
+
+func TestWithInternalListener(t *testing.T) {
+	newServers := func(internalListener bool) (*httptest.Server, *httptest.Server) {
+		r, err := NewRoutes(
+			WithDBProvider(&db.NoopProvider{}),
+			WithHandlers(fstest.MapFS{"index.html": {Data: []byte("<html></html>")}}, prometheus.NewRegistry(), false),
+			WithInternalListener(internalListener),
+		)
+		require.NoError(t, err)
+
+		main := httptest.NewServer(r)
+		t.Cleanup(main.Close)
+		internal := httptest.NewServer(r.InternalHandler())
+		t.Cleanup(internal.Close)
+		return main, internal
+	}
+	status := func(srv *httptest.Server, path string) int {
+		resp, err := http.Get(srv.URL + path)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp.StatusCode
+	}
+
+	main, internal := newServers(true)
+	for _, path := range []string{"/metrics", "/-/healthy", "/api/v1/stats"} {
+		assert.Equal(t, http.StatusOK, status(internal, path), path)
+		assert.Equal(t, http.StatusNotFound, status(main, path), path)
+	}
+	// The admin endpoints reject the unauthenticated changes.
+	post := func(srv *httptest.Server, path string) int {
+		resp, err := http.Post(srv.URL+path, "", nil)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		return resp.StatusCode
+	}
+	for _, path := range []string{"/api/v1/admin/read_only", "/api/v1/config/reload", "/api/v1/raw_query"} {
+		assert.Equal(t, http.StatusForbidden, post(internal, path), path)
+		assert.Equal(t, http.StatusNotFound, post(main, path), path)
+	}
+	assert.Equal(t, http.StatusNotFound, status(main, "/api/v1/admin/ingestion_lag"))
+	assert.Equal(t, http.StatusOK, status(main, "/api/v1/query/slowest"))
+	assert.Equal(t, http.StatusNotFound, status(internal, "/api/v1/query/slowest"))
+
+	// Without internal listener, the main one serves every endpoint.
+	main, _ = newServers(false)
+	for _, path := range []string{"/metrics", "/-/healthy", "/api/v1/stats", "/api/v1/query/slowest"} {
+		assert.Equal(t, http.StatusOK, status(main, path), path)
+	}
+}
+
+type blockingProvider struct {
+	db.Provider
+	err error
+}
+
+func (p *blockingProvider) GetSlowestQueries(ctx context.Context, tr db.TimeRange, tenant string, source string, limit int) ([]db.SlowQueryRow, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestQueryTimeout(t *testing.T) {
+	t.Run("times out slow queries", func(t *testing.T) {
+		r, err := NewRoutes(
+			WithDBProvider(&blockingProvider{}),
+			WithQueryTimeout(time.Millisecond),
+		)
+		require.NoError(t, err)
+
+		rec := httptest.NewRecorder()
+		r.withQueryTimeout(r.slowestQueries)(rec, httptest.NewRequest(http.MethodGet, "/api/v1/query/slowest", nil))
+
+		assert.Equal(t, http.StatusGatewayTimeout, rec.Code)
+		assert.Contains(t, rec.Body.String(), "query timed out")
+	})
+
+	t.Run("keeps other errors", func(t *testing.T) {
+		r, err := NewRoutes(
+			WithDBProvider(&blockingProvider{err: errors.New("no such table")}),
+			WithQueryTimeout(time.Minute),
+		)
+		require.NoError(t, err)
+
+		rec := httptest.NewRecorder()
+		r.withQueryTimeout(r.slowestQueries)(rec, httptest.NewRequest(http.MethodGet, "/api/v1/query/slowest", nil))
+
+		assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	})
+}
+
+func TestGetStepParam(t *testing.T) {
+	for _, tc := range []struct {
+		step     string
+		expected float64
+	}{
+		{step: "", expected: 15},
+		{step: "15", expected: 15},
+		{step: "0.5", expected: 0.5},
+		{step: "15s", expected: 15},
+		{step: "1m", expected: 60},
+		{step: "1h30m", expected: 5400},
+		{step: "1d", expected: 86400},
+		{step: "invalid", expected: 0},
+	} {
+		t.Run(tc.step, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/query_range?query=up&step="+url.QueryEscape(tc.step), nil)
+			assert.Equal(t, tc.expected, getStepParam(req))
+		})
+	}
+}
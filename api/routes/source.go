@@ -0,0 +1,48 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/db"
+)
+
+// WithRuleEvalUserAgents attributes the queries whose User-Agent contains
+// one of the given values, compared case-insensitively, to rule evaluation
+// instead of users.
+func WithRuleEvalUserAgents(userAgents []string) Option {
+	return func(r *routes) {
+		r.ruleEvalUserAgents = make([]string, 0, len(userAgents))
+		for _, userAgent := range userAgents {
+			if userAgent = strings.ToLower(strings.TrimSpace(userAgent)); userAgent != "" {
+				r.ruleEvalUserAgents = append(r.ruleEvalUserAgents, userAgent)
+			}
+		}
+	}
+}
+
+// querySource tells whether the request was sent by a rule evaluator, based
+// on its User-Agent.
+func (r *routes) querySource(req *http.Request) db.QuerySource {
+	userAgent := strings.ToLower(req.UserAgent())
+	for _, ruleEvalUserAgent := range r.ruleEvalUserAgents {
+		if strings.Contains(userAgent, ruleEvalUserAgent) {
+			return db.QuerySourceRule
+		}
+	}
+	return db.QuerySourceUser
+}
+
+// getSourceParam reads the optional source filter of the request, empty
+// meaning every source.
+func getSourceParam(req *http.Request) (string, error) {
+	source := req.URL.Query().Get("source")
+	switch {
+	case source == "" || source == "all":
+		return "", nil
+	case !db.IsValidQuerySource(source):
+		return "", fmt.Errorf("unknown source %q, must be one of user, rule or all", source)
+	}
+	return source, nil
+}
@@ -0,0 +1,53 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuerySource(t *testing.T) {
+	r, err := NewRoutes(WithRuleEvalUserAgents([]string{"vmalert", " Thanos-Ruler ", ""}))
+	require.NoError(t, err)
+
+	for userAgent, expected := range map[string]db.QuerySource{
+		"":                      db.QuerySourceUser,
+		"Grafana/11.0.0":        db.QuerySourceUser,
+		"vmalert/v1.101.0":      db.QuerySourceRule,
+		"thanos-ruler/0.35.1":   db.QuerySourceRule,
+		"Go-http-client/1.1":    db.QuerySourceUser,
+		"Prometheus/2.53.0":     db.QuerySourceUser,
+		"custom VMAlert client": db.QuerySourceRule,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+		req.Header.Set("User-Agent", userAgent)
+		assert.Equal(t, expected, r.querySource(req), userAgent)
+	}
+
+	// Without user agents every query is attributed to users.
+	r, err = NewRoutes()
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+	req.Header.Set("User-Agent", "vmalert")
+	assert.Equal(t, db.QuerySourceUser, r.querySource(req))
+}
+
+func TestGetSourceParam(t *testing.T) {
+	for target, expected := range map[string]string{
+		"/api/v1/query/slowest":             "",
+		"/api/v1/query/slowest?source=all":  "",
+		"/api/v1/query/slowest?source=user": "user",
+		"/api/v1/query/slowest?source=rule": "rule",
+	} {
+		source, err := getSourceParam(httptest.NewRequest(http.MethodGet, target, nil))
+		require.NoError(t, err, target)
+		assert.Equal(t, expected, source, target)
+	}
+
+	_, err := getSourceParam(httptest.NewRequest(http.MethodGet, "/api/v1/query/slowest?source=bot", nil))
+	assert.Error(t, err)
+}
@@ -0,0 +1,265 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nicolastakashi/prom-analytics-proxy/api/models"
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/cache"
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/db"
+	"github.com/prometheus/common/model"
+)
+
+const (
+	// splitCacheTTL bounds how long a cached sub-range is kept. Sub-ranges
+	// are only cached once they are older than splitMaxFreshness, so their
+	// results are not expected to change.
+	splitCacheTTL = time.Hour
+	// splitMaxFreshness is how far in the past a sub-range must end before
+	// it is cached, to avoid caching data that is still being ingested.
+	splitMaxFreshness = 10 * time.Minute
+)
+
+type matrixSeries struct {
+	Metric     map[string]string `json:"metric"`
+	Values     []json.RawMessage `json:"values,omitempty"`
+	Histograms []json.RawMessage `json:"histograms,omitempty"`
+}
+
+type rangeQueryResponse struct {
+	Status   string          `json:"status"`
+	Data     rangeQueryData  `json:"data"`
+	Warnings []string        `json:"warnings,omitempty"`
+	Infos    []string        `json:"infos,omitempty"`
+	Error    json.RawMessage `json:"error,omitempty"`
+}
+
+type rangeQueryData struct {
+	ResultType string         `json:"resultType"`
+	Result     []matrixSeries `json:"result"`
+	Stats      *models.Stats  `json:"stats,omitempty"`
+}
+
+// timeRange is an inclusive range of milliseconds timestamps.
+type timeRange struct {
+	start int64
+	end   int64
+}
+
+// WithQuerySplitting splits range queries into sub-ranges aligned to the
+// given interval, caching each sub-range independently so only the missing
+// portions are fetched from the upstream. A zero interval disables it.
+func WithQuerySplitting(interval time.Duration, maxCachedSplits int) Option {
+	return func(r *routes) {
+		if interval > 0 && maxCachedSplits > 0 {
+			r.splitInterval = interval
+			r.splitCache = cache.New[[]matrixSeries](splitCacheTTL, maxCachedSplits)
+		}
+	}
+}
+
+// splitRange splits [start, end] into sub-ranges that do not cross interval
+// boundaries. Every sub-range starts on the original step grid so the
+// reassembled result matches the one of the unsplit query.
+func splitRange(start, end, step, interval int64) []timeRange {
+	ranges := make([]timeRange, 0)
+	for s := start; s <= end; {
+		boundary := (s/interval + 1) * interval
+		e := s + ((boundary-s-1)/step)*step
+		if e > end {
+			e = end
+		}
+		ranges = append(ranges, timeRange{start: s, end: e})
+		s = e + step
+	}
+	return ranges
+}
+
+// splitQueryRange serves a range query by splitting it into sub-ranges. It
+// returns false when the request can not be split, in which case the caller
+// must forward it as is.
+func (r *routes) splitQueryRange(w http.ResponseWriter, req *http.Request, query *db.Query) bool {
+	start, err := parsePromTime(req.Form.Get("start"))
+	if err != nil {
+		return false
+	}
+	end, err := parsePromTime(req.Form.Get("end"))
+	if err != nil {
+		return false
+	}
+	step, err := parsePromDuration(req.Form.Get("step"))
+	if err != nil || step <= 0 {
+		return false
+	}
+
+	ranges := splitRange(start.UnixMilli(), end.UnixMilli(), step.Milliseconds(), r.splitInterval.Milliseconds())
+	if len(ranges) <= 1 {
+		return false
+	}
+
+	freshnessLimit := time.Now().Add(-splitMaxFreshness).UnixMilli()
+	parts := make([][]matrixSeries, 0, len(ranges))
+	var warnings, infos []string
+	cachedParts := 0
+
+	for _, tr := range ranges {
+		params := cloneValues(req.Form)
+		params.Set("start", formatPromTime(tr.start))
+		params.Set("end", formatPromTime(tr.end))
+		key := r.tenant(req) + "|" + req.URL.Path + "|" + params.Encode()
+
+		if series, ok := r.splitCache.Get(key); ok {
+			parts = append(parts, series)
+			cachedParts++
+			continue
+		}
+
+		fetchStart := time.Now()
+		buffered := r.fetchSubRange(req, params)
+		query.UpstreamDuration += time.Since(fetchStart)
+		var resp rangeQueryResponse
+		if buffered.statusCode != http.StatusOK || json.Unmarshal(buffered.body, &resp) != nil ||
+			resp.Status != "success" || resp.Data.ResultType != "matrix" {
+			writeBufferedResponse(w, buffered)
+			return true
+		}
+
+		if resp.Data.Stats != nil {
+			query.TotalQueryableSamples += resp.Data.Stats.Samples.TotalQueryableSamples
+			query.PeakSamples = max(query.PeakSamples, resp.Data.Stats.Samples.PeakSamples)
+		}
+		warnings = append(warnings, resp.Warnings...)
+		infos = append(infos, resp.Infos...)
+
+		if tr.end < freshnessLimit {
+			r.splitCache.Set(key, resp.Data.Result)
+		}
+		parts = append(parts, resp.Data.Result)
+	}
+
+	query.Cached = cachedParts == len(ranges)
+	slog.Debug("served split range query", "splits", len(ranges), "cached", cachedParts)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rangeQueryResponse{
+		Status: "success",
+		Data: rangeQueryData{
+			ResultType: "matrix",
+			Result:     mergeMatrices(parts),
+		},
+		Warnings: warnings,
+		Infos:    infos,
+	}); err != nil {
+		slog.Error("unable to encode split range query response", "err", err)
+	}
+	return true
+}
+
+func (r *routes) fetchSubRange(req *http.Request, params url.Values) bufferedResponse {
+	subReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, req.URL.Path+"?"+params.Encode(), nil)
+	if err != nil {
+		return bufferedResponse{
+			statusCode: http.StatusInternalServerError,
+			header:     http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}},
+			body:       []byte(err.Error()),
+		}
+	}
+	subReq.Header = req.Header.Clone()
+	// Let the transport negotiate and transparently decode compression.
+	subReq.Header.Del("Accept-Encoding")
+	subReq.Header.Del("Content-Type")
+	subReq.Header.Del("Content-Length")
+
+	bw := newBufferedResponseWriter()
+	r.handler.ServeHTTP(bw, subReq)
+	return bw.response()
+}
+
+// mergeMatrices concatenates the samples of the same series across
+// consecutive, non overlapping sub-range results.
+func mergeMatrices(parts [][]matrixSeries) []matrixSeries {
+	merged := make([]matrixSeries, 0)
+	index := make(map[string]int)
+
+	for _, part := range parts {
+		for _, series := range part {
+			key := seriesKey(series.Metric)
+			i, ok := index[key]
+			if !ok {
+				index[key] = len(merged)
+				merged = append(merged, matrixSeries{Metric: series.Metric})
+				i = len(merged) - 1
+			}
+			merged[i].Values = append(merged[i].Values, series.Values...)
+			merged[i].Histograms = append(merged[i].Histograms, series.Histograms...)
+		}
+	}
+
+	return merged
+}
+
+func seriesKey(metric map[string]string) string {
+	names := make([]string, 0, len(metric))
+	for name := range metric {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		sb.WriteString(name)
+		sb.WriteByte(0xff)
+		sb.WriteString(metric[name])
+		sb.WriteByte(0xff)
+	}
+	return sb.String()
+}
+
+func cloneValues(v url.Values) url.Values {
+	c := make(url.Values, len(v))
+	for key, values := range v {
+		c[key] = append([]string(nil), values...)
+	}
+	return c
+}
+
+// parsePromTime parses a timestamp the way the Prometheus HTTP API does,
+// accepting both unix timestamps and RFC3339.
+func parsePromTime(s string) (time.Time, error) {
+	if t, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, frac := math.Modf(t)
+		return time.Unix(int64(sec), int64(math.Round(frac*1000))*int64(time.Millisecond)).UTC(), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+}
+
+// parsePromDuration parses a step either as float seconds or as a
+// Prometheus duration string, falling back to a Go duration string such as
+// 1.5m.
+func parsePromDuration(s string) (time.Duration, error) {
+	if d, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(d * float64(time.Second)), nil
+	}
+	if d, err := model.ParseDuration(s); err == nil {
+		return time.Duration(d), nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return d, nil
+	}
+	return 0, fmt.Errorf("cannot parse %q to a valid duration", s)
+}
+
+func formatPromTime(ms int64) string {
+	return strconv.FormatFloat(float64(ms)/1000, 'f', -1, 64)
+}
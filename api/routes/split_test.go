@@ -0,0 +1,150 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/ingester"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitRange(t *testing.T) {
+	// 00:30 to 02:30 with a 1h interval and 10m step.
+	ranges := splitRange(1800_000, 9000_000, 600_000, 3600_000)
+
+	assert.Equal(t, []timeRange{
+		{start: 1800_000, end: 3000_000},
+		{start: 3600_000, end: 6600_000},
+		{start: 7200_000, end: 9000_000},
+	}, ranges)
+}
+
+func TestQueryRange_SplitAndCache(t *testing.T) {
+	var upstreamHits atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		upstreamHits.Add(1)
+		start, _ := strconv.ParseFloat(req.FormValue("start"), 64)
+		end, _ := strconv.ParseFloat(req.FormValue("end"), 64)
+		step, _ := strconv.ParseFloat(req.FormValue("step"), 64)
+
+		values := make([]string, 0)
+		for ts := start; ts <= end; ts += step {
+			values = append(values, fmt.Sprintf(`[%g,"%g"]`, ts, ts))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"up","job":"prometheus"},"values":[%s]}]}}`, strings.Join(values, ","))
+	}))
+	defer upstream.Close()
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	queryIngester := ingester.NewQueryIngester(&recordingProvider{}, ingester.WithBufferSize(10))
+
+	r, err := NewRoutes(
+		WithProxy(upstreamURL),
+		WithQueryIngester(queryIngester),
+		WithQuerySplitting(time.Hour, 100),
+	)
+	require.NoError(t, err)
+
+	rangeQuery := func(start, end int) [][2]interface{} {
+		req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/v1/query_range?query=up&start=%d&end=%d&step=60", start, end), nil)
+		rec := httptest.NewRecorder()
+		r.query_range(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var resp struct {
+			Status string `json:"status"`
+			Data   struct {
+				ResultType string `json:"resultType"`
+				Result     []struct {
+					Metric map[string]string `json:"metric"`
+					Values [][2]interface{}  `json:"values"`
+				} `json:"result"`
+			} `json:"data"`
+		}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		require.Equal(t, "success", resp.Status)
+		require.Equal(t, "matrix", resp.Data.ResultType)
+		require.Len(t, resp.Data.Result, 1)
+		assert.Equal(t, map[string]string{"__name__": "up", "job": "prometheus"}, resp.Data.Result[0].Metric)
+		return resp.Data.Result[0].Values
+	}
+
+	// Two hours split in two sub-ranges.
+	values := rangeQuery(0, 7140)
+	assert.Equal(t, int32(2), upstreamHits.Load())
+	assertContiguous(t, values, 0, 7140, 60)
+
+	// Extending the window by one hour only fetches the new sub-range.
+	values = rangeQuery(0, 10740)
+	assert.Equal(t, int32(3), upstreamHits.Load())
+	assertContiguous(t, values, 0, 10740, 60)
+
+	// The same query is now fully served from the cache.
+	values = rangeQuery(0, 10740)
+	assert.Equal(t, int32(3), upstreamHits.Load())
+	assertContiguous(t, values, 0, 10740, 60)
+}
+
+func TestQueryRange_SplitForwardsErrors(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"status":"error","errorType":"bad_data","error":"parse error"}`))
+	}))
+	defer upstream.Close()
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	r, err := NewRoutes(
+		WithProxy(upstreamURL),
+		WithQueryIngester(ingester.NewQueryIngester(&recordingProvider{}, ingester.WithBufferSize(10))),
+		WithQuerySplitting(time.Hour, 100),
+	)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/query_range?query=up(&start=0&end=7140&step=60", nil)
+	rec := httptest.NewRecorder()
+	r.query_range(rec, req)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "parse error")
+}
+
+func assertContiguous(t *testing.T, values [][2]interface{}, start, end, step float64) {
+	t.Helper()
+	require.Len(t, values, int((end-start)/step)+1)
+	for i, v := range values {
+		assert.Equal(t, start+float64(i)*step, v[0])
+	}
+}
+
+func TestParsePromDuration(t *testing.T) {
+	for s, expected := range map[string]time.Duration{
+		"15":    15 * time.Second,
+		"0.5":   500 * time.Millisecond,
+		"1h30m": 90 * time.Minute,
+		"1d":    24 * time.Hour,
+		"1.5m":  90 * time.Second,
+	} {
+		d, err := parsePromDuration(s)
+		require.NoError(t, err, s)
+		assert.Equal(t, expected, d, s)
+	}
+
+	_, err := parsePromDuration("fast")
+	assert.Error(t, err)
+}
@@ -0,0 +1,76 @@
+package routes
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+)
+
+// WithStripParams removes the given parameters, such as tracking parameters
+// added by the clients, from the requests before they are proxied. They are
+// still seen by the proxy, e.g. dashboard_uid is recorded for each query.
+func WithStripParams(names []string) Option {
+	return func(r *routes) {
+		r.stripParams = names
+	}
+}
+
+// stripRequestParams removes the strip parameters from the URL and from
+// the body of form-encoded POST requests. The stats parameter is kept when
+// it was injected by the proxy.
+func (r *routes) stripRequestParams(req *http.Request, keepStats bool) {
+	if len(r.stripParams) == 0 {
+		return
+	}
+
+	query := req.URL.Query()
+	if removeParams(query, r.stripParams, keepStats) {
+		req.URL.RawQuery = query.Encode()
+	}
+
+	if req.Method != http.MethodPost || req.Body == nil || req.Body == http.NoBody || !isFormEncoded(req) {
+		return
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		slog.Error("unable to read request body to strip parameters", "err", err)
+		setRequestBody(req, nil)
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		slog.Warn("unable to parse request form to strip parameters", "err", err)
+	} else if removeParams(form, r.stripParams, keepStats) {
+		body = []byte(form.Encode())
+	}
+	setRequestBody(req, body)
+}
+
+// removeParams deletes the names from the values, reporting whether any was
+// set.
+func removeParams(values url.Values, names []string, keepStats bool) bool {
+	removed := false
+	for _, name := range names {
+		if keepStats && name == "stats" {
+			continue
+		}
+		if values.Has(name) {
+			values.Del(name)
+			removed = true
+		}
+	}
+	return removed
+}
+
+// setRequestBody replaces the body of the request, which may be sent again
+// on a retry.
+func setRequestBody(req *http.Request, body []byte) {
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+}
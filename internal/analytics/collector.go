@@ -0,0 +1,114 @@
+package analytics
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/db"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector periodically computes query analytics from the database and
+// exposes them as Prometheus gauges, so they can be scraped and alerted on.
+type Collector struct {
+	dbProvider db.Provider
+
+	refreshInterval time.Duration
+	window          time.Duration
+	timeout         time.Duration
+
+	totalQueries prometheus.Gauge
+	errorRate    prometheus.Gauge
+	p95Latency   prometheus.Gauge
+}
+
+type CollectorOption func(*Collector)
+
+func WithRefreshInterval(interval time.Duration) CollectorOption {
+	return func(c *Collector) {
+		c.refreshInterval = interval
+	}
+}
+
+func WithWindow(window time.Duration) CollectorOption {
+	return func(c *Collector) {
+		c.window = window
+	}
+}
+
+func WithTimeout(timeout time.Duration) CollectorOption {
+	return func(c *Collector) {
+		c.timeout = timeout
+	}
+}
+
+func NewCollector(dbProvider db.Provider, registry prometheus.Registerer, opts ...CollectorOption) *Collector {
+	c := &Collector{
+		dbProvider:      dbProvider,
+		refreshInterval: time.Minute,
+		window:          time.Hour,
+		timeout:         10 * time.Second,
+		totalQueries: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "prom_analytics_total_queries",
+			Help: "Number of queries recorded within the analytics window.",
+		}),
+		errorRate: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "prom_analytics_error_rate",
+			Help: "Ratio of queries that failed within the analytics window.",
+		}),
+		p95Latency: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "prom_analytics_p95_latency_seconds",
+			Help: "95th percentile of query duration within the analytics window.",
+		}),
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	registry.MustRegister(c.totalQueries, c.errorRate, c.p95Latency)
+
+	return c
+}
+
+func (c *Collector) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.Refresh(ctx); err != nil {
+			slog.Error("unable to refresh analytics metrics", "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Refresh recomputes the gauges from the queries recorded within the window.
+func (c *Collector) Refresh(ctx context.Context) error {
+	refreshCtx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	endTime := time.Now()
+	summary, err := c.dbProvider.GetQueriesSummary(refreshCtx, endTime.Add(-c.window), endTime)
+	if err != nil {
+		return fmt.Errorf("unable to get queries summary: %w", err)
+	}
+
+	errorRate := 0.0
+	if summary.TotalQueries > 0 {
+		errorRate = float64(summary.FailedQueries) / float64(summary.TotalQueries)
+	}
+
+	c.totalQueries.Set(float64(summary.TotalQueries))
+	c.errorRate.Set(errorRate)
+	c.p95Latency.Set(summary.P95Duration / 1000)
+
+	return nil
+}
@@ -0,0 +1,54 @@
+package analytics
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/config"
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/db"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollector_Refresh(t *testing.T) {
+	ctx := context.Background()
+
+	config.DefaultConfig.Database.SQLite.DatabasePath = filepath.Join(t.TempDir(), "analytics.db")
+	provider, err := db.GetDbProvider(ctx, db.SQLite)
+	require.NoError(t, err)
+	defer provider.Close()
+
+	now := time.Now()
+	queries := make([]db.Query, 0, 20)
+	for i := 1; i <= 20; i++ {
+		statusCode := 200
+		if i%5 == 0 {
+			statusCode = 500
+		}
+		queries = append(queries, db.Query{
+			TS:         now.Add(-time.Duration(i) * time.Minute),
+			QueryParam: "up",
+			Duration:   time.Duration(i*100) * time.Millisecond,
+			StatusCode: statusCode,
+			Type:       db.QueryTypeInstant,
+		})
+	}
+	require.NoError(t, provider.Insert(ctx, queries))
+
+	registry := prometheus.NewRegistry()
+	collector := NewCollector(provider, registry, WithWindow(time.Hour))
+	require.NoError(t, collector.Refresh(ctx))
+
+	assert.Equal(t, 20.0, testutil.ToFloat64(collector.totalQueries))
+	assert.Equal(t, 0.2, testutil.ToFloat64(collector.errorRate))
+	// 19th of 20 ordered durations.
+	assert.InDelta(t, 1.9, testutil.ToFloat64(collector.p95Latency), 0.001)
+
+	count, err := testutil.GatherAndCount(registry, "prom_analytics_total_queries", "prom_analytics_error_rate", "prom_analytics_p95_latency_seconds")
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+}
@@ -0,0 +1,90 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Cache is a size bounded, in-memory cache where every entry expires after
+// a fixed TTL. When the cache is full the least recently used entry is
+// evicted.
+type Cache[V any] struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	maxSize int
+	items   map[string]*list.Element
+	lru     *list.List
+	now     func() time.Time
+}
+
+type entry[V any] struct {
+	key       string
+	value     V
+	expiresAt time.Time
+}
+
+func New[V any](ttl time.Duration, maxSize int) *Cache[V] {
+	return &Cache[V]{
+		ttl:     ttl,
+		maxSize: maxSize,
+		items:   make(map[string]*list.Element),
+		lru:     list.New(),
+		now:     time.Now,
+	}
+}
+
+func (c *Cache[V]) Get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var zero V
+	el, ok := c.items[key]
+	if !ok {
+		return zero, false
+	}
+
+	e := el.Value.(*entry[V])
+	if c.now().After(e.expiresAt) {
+		c.removeElement(el)
+		return zero, false
+	}
+
+	c.lru.MoveToFront(el)
+	return e.value, true
+}
+
+func (c *Cache[V]) Set(key string, value V) {
+	if c.maxSize <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expiresAt := c.now().Add(c.ttl)
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*entry[V])
+		e.value = value
+		e.expiresAt = expiresAt
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	for c.lru.Len() >= c.maxSize {
+		c.removeElement(c.lru.Back())
+	}
+
+	c.items[key] = c.lru.PushFront(&entry[V]{key: key, value: value, expiresAt: expiresAt})
+}
+
+func (c *Cache[V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+func (c *Cache[V]) removeElement(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.items, el.Value.(*entry[V]).key)
+}
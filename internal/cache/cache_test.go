@@ -0,0 +1,53 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCache_GetSet(t *testing.T) {
+	c := New[string](time.Minute, 10)
+
+	_, ok := c.Get("missing")
+	assert.False(t, ok)
+
+	c.Set("key", "value")
+	v, ok := c.Get("key")
+	assert.True(t, ok)
+	assert.Equal(t, "value", v)
+}
+
+func TestCache_Expiration(t *testing.T) {
+	now := time.Now()
+	c := New[string](time.Minute, 10)
+	c.now = func() time.Time { return now }
+
+	c.Set("key", "value")
+
+	now = now.Add(2 * time.Minute)
+	_, ok := c.Get("key")
+	assert.False(t, ok)
+	assert.Zero(t, c.Len())
+}
+
+func TestCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	c := New[int](time.Minute, 2)
+
+	c.Set("a", 1)
+	c.Set("b", 2)
+	_, _ = c.Get("a")
+	c.Set("c", 3)
+
+	_, ok := c.Get("b")
+	assert.False(t, ok)
+
+	v, ok := c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, v)
+
+	v, ok = c.Get("c")
+	assert.True(t, ok)
+	assert.Equal(t, 3, v)
+}
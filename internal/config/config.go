@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/ClickHouse/clickhouse-go/v2"
@@ -11,29 +12,98 @@ import (
 )
 
 type Config struct {
-	Upstream      UpstreamConfig `yaml:"upstream"`
-	Server        ServerConfig   `yaml:"server"`
-	Database      DatabaseConfig `yaml:"database"`
-	Insert        InsertConfig   `yaml:"insert"`
-	Tracing       *otlp.Config   `yaml:"tracing"`
-	MetadataLimit uint64         `yaml:"metadata_limit"`
-	SeriesLimit   uint64         `yaml:"series_limit"`
+	Upstream      UpstreamConfig  `yaml:"upstream"`
+	Server        ServerConfig    `yaml:"server"`
+	Proxy         ProxyConfig     `yaml:"proxy"`
+	Database      DatabaseConfig  `yaml:"database"`
+	Insert        InsertConfig    `yaml:"insert"`
+	Analytics     AnalyticsConfig `yaml:"analytics"`
+	Retention     RetentionConfig `yaml:"retention"`
+	Reports       ReportsConfig   `yaml:"reports"`
+	Log           LogConfig       `yaml:"log"`
+	Tracing       *otlp.Config    `yaml:"tracing"`
+	MetadataLimit uint64          `yaml:"metadata_limit"`
+	SeriesLimit   uint64          `yaml:"series_limit"`
+}
+
+type LogConfig struct {
+	AccessLog     bool `yaml:"access_log"`
+	RedactQueries bool `yaml:"redact_queries"`
 }
 
 type DatabaseConfig struct {
-	Provider   string           `yaml:"provider"`
-	ClickHouse ClickHouseConfig `yaml:"clickhouse"`
-	PostgreSQL PostgreSQLConfig `yaml:"postgresql"`
-	SQLite     SQLiteConfig     `yaml:"sqlite"`
+	Provider     string              `yaml:"provider"`
+	QueryTimeout time.Duration       `yaml:"query_timeout"`
+	Cache        DatabaseCacheConfig `yaml:"cache"`
+	ClickHouse   ClickHouseConfig    `yaml:"clickhouse"`
+	PostgreSQL   PostgreSQLConfig    `yaml:"postgresql"`
+	SQLite       SQLiteConfig        `yaml:"sqlite"`
+}
+
+type DatabaseCacheConfig struct {
+	Enabled bool          `yaml:"enabled"`
+	TTL     time.Duration `yaml:"ttl"`
+	MaxSize int           `yaml:"max_size"`
 }
 
 type UpstreamConfig struct {
-	URL               string `yaml:"url"`
-	IncludeQueryStats bool   `yaml:"include_query_stats"`
+	URL                   string             `yaml:"url"`
+	URLs                  []string           `yaml:"urls"`
+	IncludeQueryStats     bool               `yaml:"include_query_stats"`
+	IncludeHeadersSize    bool               `yaml:"include_headers_size"`
+	MaxResponseParseBytes int64              `yaml:"max_response_parse_bytes"`
+	Auth                  UpstreamAuthConfig `yaml:"auth"`
+}
+
+type UpstreamAuthConfig struct {
+	BasicUsername   string `yaml:"basic_username"`
+	BasicPassword   string `yaml:"basic_password"`
+	BearerTokenFile string `yaml:"bearer_token_file"`
 }
 
 type ServerConfig struct {
-	InsecureListenAddress string `yaml:"insecure_listen_address"`
+	InsecureListenAddress string          `yaml:"insecure_listen_address"`
+	InternalListenAddress string          `yaml:"internal_listen_address"`
+	AdminToken            string          `yaml:"admin_token"`
+	TLS                   ServerTLSConfig `yaml:"tls"`
+	Compression           bool            `yaml:"compression"`
+	AnalyticsRateLimit    float64         `yaml:"analytics_rate_limit"`
+	AnalyticsBurst        int             `yaml:"analytics_burst"`
+	AnalyticsRateLimitIP  bool            `yaml:"analytics_rate_limit_per_ip"`
+	CORS                  CORSConfig      `yaml:"cors"`
+}
+
+type CORSConfig struct {
+	AllowedOrigins   []string `yaml:"allowed_origins"`
+	AllowedMethods   []string `yaml:"allowed_methods"`
+	AllowCredentials bool     `yaml:"allow_credentials"`
+}
+
+type ServerTLSConfig struct {
+	CertFile     string `yaml:"cert_file"`
+	KeyFile      string `yaml:"key_file"`
+	ClientCAFile string `yaml:"client_ca_file"`
+}
+
+type ProxyConfig struct {
+	ResultCache       ResultCacheConfig     `yaml:"result_cache"`
+	CoalesceQueries   bool                  `yaml:"coalesce_queries"`
+	SplitInterval     time.Duration         `yaml:"split_interval"`
+	SplitCacheMaxSize int                   `yaml:"split_cache_max_size"`
+	TenantHeader      string                `yaml:"tenant_header"`
+	ResponseHeaders   ResponseHeadersConfig `yaml:"response_headers"`
+	TrustedProxies    []string              `yaml:"trusted_proxies"`
+	StripParams       []string              `yaml:"strip_params"`
+}
+
+type ResponseHeadersConfig struct {
+	Strip []string          `yaml:"strip"`
+	Set   map[string]string `yaml:"set"`
+}
+
+type ResultCacheConfig struct {
+	TTL     time.Duration `yaml:"ttl"`
+	MaxSize int           `yaml:"max_size"`
 }
 
 type ClickHouseConfig struct {
@@ -43,25 +113,73 @@ type ClickHouseConfig struct {
 }
 
 type PostgreSQLConfig struct {
-	Addr        string        `yaml:"addr"`
-	Database    string        `yaml:"database"`
-	DialTimeout time.Duration `yaml:"dial_timeout"`
-	Password    string        `yaml:"password"`
-	Port        int           `yaml:"port"`
-	SSLMode     string        `yaml:"sslmode"`
-	User        string        `yaml:"user"`
+	Addr         string        `yaml:"addr"`
+	Database     string        `yaml:"database"`
+	DialTimeout  time.Duration `yaml:"dial_timeout"`
+	Password     string        `yaml:"password"`
+	Port         int           `yaml:"port"`
+	SSLMode      string        `yaml:"sslmode"`
+	User         string        `yaml:"user"`
+	Partitioning string        `yaml:"partitioning"`
 }
 
 type SQLiteConfig struct {
-	DatabasePath string `yaml:"database_path"`
+	DatabasePath string        `yaml:"database_path"`
+	QueryLabels  bool          `yaml:"query_labels"`
+	BusyTimeout  time.Duration `yaml:"busy_timeout"`
+	JournalMode  string        `yaml:"journal_mode"`
+	Synchronous  string        `yaml:"synchronous"`
 }
 
 type InsertConfig struct {
-	BatchSize     int           `yaml:"batch_size"`
-	BufferSize    int           `yaml:"buffer_size"`
-	FlushInterval time.Duration `yaml:"flush_interval"`
-	GracePeriod   time.Duration `yaml:"grace_period"`
-	Timeout       time.Duration `yaml:"timeout"`
+	BatchSize           int           `yaml:"batch_size"`
+	BufferSize          int           `yaml:"buffer_size"`
+	FlushInterval       time.Duration `yaml:"flush_interval"`
+	GracePeriod         time.Duration `yaml:"grace_period"`
+	Timeout             time.Duration `yaml:"timeout"`
+	WALPath             string        `yaml:"wal_path"`
+	WALMaxBytes         int64         `yaml:"wal_max_bytes"`
+	StoredLabelNames    []string      `yaml:"stored_label_names"`
+	MaxLabelMatchers    int           `yaml:"max_label_matchers"`
+	MaxQueryParamLength int           `yaml:"max_query_param_length"`
+	NormalizeQueries    bool          `yaml:"normalize_queries"`
+	FingerprintMode     string        `yaml:"fingerprint_mode"`
+	ReadOnly            bool          `yaml:"read_only"`
+	SampleRate          float64       `yaml:"sample_rate"`
+	RuleEvalUserAgents  []string      `yaml:"rule_eval_user_agents"`
+	OTLPListenAddress   string        `yaml:"otlp_listen_address"`
+}
+
+type AnalyticsConfig struct {
+	MetricsRefreshInterval time.Duration `yaml:"metrics_refresh_interval"`
+	MetricsWindow          time.Duration `yaml:"metrics_window"`
+	DefaultLookback        time.Duration `yaml:"default_lookback"`
+	UsageLookback          time.Duration `yaml:"usage_lookback"`
+}
+
+type RetentionConfig struct {
+	MaxAge   time.Duration     `yaml:"max_age"`
+	Interval time.Duration     `yaml:"interval"`
+	Policies []RetentionPolicy `yaml:"policies"`
+}
+
+// RetentionPolicy overrides the retention of the queries it matches, the
+// first matching policy applies.
+type RetentionPolicy struct {
+	Match  RetentionMatch `yaml:"match"`
+	MaxAge time.Duration  `yaml:"max_age"`
+}
+
+type RetentionMatch struct {
+	// Type is the query type, instant or range.
+	Type string `yaml:"type"`
+	// Status is the status class, 1xx to 5xx, success or error.
+	Status string `yaml:"status"`
+}
+
+type ReportsConfig struct {
+	Schedule time.Duration `yaml:"schedule"`
+	Webhook  string        `yaml:"webhook"`
 }
 
 var DefaultConfig = &Config{}
@@ -79,6 +197,21 @@ func LoadConfig(path string) error {
 	return nil
 }
 
+// GetURLs returns the upstream URLs in failover order. URL is a shorthand
+// for a single upstream, tried first when URLs is also set.
+func (c *UpstreamConfig) GetURLs() []string {
+	urls := make([]string, 0, len(c.URLs)+1)
+	if c.URL != "" {
+		urls = append(urls, c.URL)
+	}
+	for _, u := range c.URLs {
+		if u = strings.TrimSpace(u); u != "" && u != c.URL {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
 func (c *Config) IsTracingEnabled() bool {
 	return c.Tracing != nil
 }
@@ -0,0 +1,136 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvPrefix prefixes the environment variables overriding the configuration.
+const EnvPrefix = "PROM_ANALYTICS_"
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// envAliases maps the environment variables to the shorter names they can
+// also be set with, the former taking precedence.
+var envAliases = map[string]string{
+	EnvPrefix + "UPSTREAM_URL": EnvPrefix + "UPSTREAM",
+}
+
+// LoadEnv overrides the configuration fields with the environment variables
+// named after their path in the configuration file, upper cased, joined by
+// underscores and prefixed by EnvPrefix, e.g. PROM_ANALYTICS_DATABASE_PROVIDER
+// for database.provider, or by one of the envAliases. Lists are comma separated. Maps, lists of objects
+// and the tracing configuration can only be set in the configuration file.
+func LoadEnv() error {
+	return applyEnv(DefaultConfig)
+}
+
+func applyEnv(c *Config) error {
+	return loadEnv(reflect.ValueOf(c).Elem(), strings.TrimSuffix(EnvPrefix, "_"))
+}
+
+func loadEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := range t.NumField() {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := yamlFieldName(field)
+		if name == "" {
+			continue
+		}
+		key := prefix + "_" + strings.ToUpper(name)
+
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Struct {
+			if err := loadEnv(fv, key); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, ok := os.LookupEnv(key)
+		if alias, hasAlias := envAliases[key]; !ok && hasAlias {
+			value, ok = os.LookupEnv(alias)
+		}
+		if !ok {
+			continue
+		}
+		if err := setEnvValue(fv, value); err != nil {
+			return fmt.Errorf("invalid value for %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// yamlFieldName returns the name of the field in the configuration file, the
+// way yaml names it, or an empty string when it is not part of it.
+func yamlFieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	switch name {
+	case "-":
+		return ""
+	case "":
+		return strings.ToLower(field.Name)
+	}
+	return name
+}
+
+func setEnvValue(v reflect.Value, value string) error {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("can only be set in the configuration file")
+		}
+		items := make([]string, 0)
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items).Convert(v.Type()))
+	default:
+		return fmt.Errorf("can only be set in the configuration file")
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// resetDefaultConfig restores the default configuration once the test ends.
+func resetDefaultConfig(t *testing.T) {
+	t.Helper()
+	saved := DefaultConfig
+	DefaultConfig = &Config{}
+	t.Cleanup(func() { DefaultConfig = saved })
+}
+
+func TestLoadEnv_OverridesConfigFile(t *testing.T) {
+	resetDefaultConfig(t)
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+upstream:
+  url: http://file:9090
+  include_query_stats: false
+database:
+  provider: sqlite
+  query_timeout: 10s
+insert:
+  batch_size: 10
+  sample_rate: 1
+  stored_label_names: [job]
+metadata_limit: 5
+`), 0o600))
+	require.NoError(t, LoadConfig(path))
+
+	t.Setenv("PROM_ANALYTICS_UPSTREAM_URL", "http://env:9090")
+	t.Setenv("PROM_ANALYTICS_UPSTREAM_INCLUDE_QUERY_STATS", "true")
+	t.Setenv("PROM_ANALYTICS_DATABASE_PROVIDER", "postgresql")
+	t.Setenv("PROM_ANALYTICS_DATABASE_QUERY_TIMEOUT", "1m")
+	t.Setenv("PROM_ANALYTICS_DATABASE_CLICKHOUSE_AUTH_USERNAME", "analytics")
+	t.Setenv("PROM_ANALYTICS_INSERT_BATCH_SIZE", "100")
+	t.Setenv("PROM_ANALYTICS_INSERT_SAMPLE_RATE", "0.5")
+	t.Setenv("PROM_ANALYTICS_INSERT_STORED_LABEL_NAMES", "job, instance,")
+	t.Setenv("PROM_ANALYTICS_METADATA_LIMIT", "50")
+	require.NoError(t, LoadEnv())
+
+	assert.Equal(t, "http://env:9090", DefaultConfig.Upstream.URL)
+	assert.True(t, DefaultConfig.Upstream.IncludeQueryStats)
+	assert.Equal(t, "postgresql", DefaultConfig.Database.Provider)
+	assert.Equal(t, time.Minute, DefaultConfig.Database.QueryTimeout)
+	assert.Equal(t, "analytics", DefaultConfig.Database.ClickHouse.Auth.Username)
+	assert.Equal(t, 100, DefaultConfig.Insert.BatchSize)
+	assert.Equal(t, 0.5, DefaultConfig.Insert.SampleRate)
+	assert.Equal(t, []string{"job", "instance"}, DefaultConfig.Insert.StoredLabelNames)
+	assert.Equal(t, uint64(50), DefaultConfig.MetadataLimit)
+}
+
+func TestLoadEnv_KeepsUnsetFields(t *testing.T) {
+	resetDefaultConfig(t)
+	DefaultConfig.Database.Provider = "sqlite"
+	DefaultConfig.Insert.BatchSize = 10
+
+	require.NoError(t, LoadEnv())
+	assert.Equal(t, "sqlite", DefaultConfig.Database.Provider)
+	assert.Equal(t, 10, DefaultConfig.Insert.BatchSize)
+}
+
+func TestLoadEnv_Invalid(t *testing.T) {
+	for name, env := range map[string][2]string{
+		"duration":      {"PROM_ANALYTICS_DATABASE_QUERY_TIMEOUT", "soon"},
+		"bool":          {"PROM_ANALYTICS_SERVER_COMPRESSION", "maybe"},
+		"int":           {"PROM_ANALYTICS_INSERT_BATCH_SIZE", "many"},
+		"negative uint": {"PROM_ANALYTICS_SERIES_LIMIT", "-1"},
+		"map":           {"PROM_ANALYTICS_PROXY_RESPONSE_HEADERS_SET", "X-Foo=bar"},
+		"object list":   {"PROM_ANALYTICS_RETENTION_POLICIES", "error"},
+		"tracing":       {"PROM_ANALYTICS_TRACING", "otlp"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			resetDefaultConfig(t)
+			t.Setenv(env[0], env[1])
+
+			err := LoadEnv()
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), env[0])
+		})
+	}
+}
+
+func TestLoadEnv_Aliases(t *testing.T) {
+	resetDefaultConfig(t)
+
+	t.Setenv("PROM_ANALYTICS_UPSTREAM", "http://alias:9090")
+	require.NoError(t, LoadEnv())
+	assert.Equal(t, "http://alias:9090", DefaultConfig.Upstream.URL)
+
+	// The full name wins over the alias.
+	t.Setenv("PROM_ANALYTICS_UPSTREAM_URL", "http://env:9090")
+	require.NoError(t, LoadEnv())
+	assert.Equal(t, "http://env:9090", DefaultConfig.Upstream.URL)
+}
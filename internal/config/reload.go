@@ -0,0 +1,82 @@
+package config
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"reflect"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Reload reads the configuration file and the environment variables again
+// over a copy of the current configuration and validates the result. Only
+// the sampling rate, the database query timeout and the retention settings
+// besides its interval can change at runtime: the returned configuration
+// holds their new values and the current values of every other setting,
+// the ones set to a different value being returned as requiring a restart.
+// The current configuration is left untouched.
+func Reload(path string, databaseProviders []string) (*Config, []string, error) {
+	f, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	next := cloneConfig(DefaultConfig)
+	if err := yaml.Unmarshal(f, next); err != nil {
+		return nil, nil, fmt.Errorf("failed to unmarshal config file: %w", err)
+	}
+	if err := applyEnv(next); err != nil {
+		return nil, nil, err
+	}
+	if err := next.Validate(databaseProviders); err != nil {
+		return nil, nil, err
+	}
+
+	reloaded := cloneConfig(DefaultConfig)
+	reloaded.Insert.SampleRate = next.Insert.SampleRate
+	reloaded.Database.QueryTimeout = next.Database.QueryTimeout
+	reloaded.Retention.MaxAge = next.Retention.MaxAge
+	reloaded.Retention.Policies = next.Retention.Policies
+
+	return reloaded, changedSettings(reflect.ValueOf(reloaded).Elem(), reflect.ValueOf(next).Elem(), ""), nil
+}
+
+// cloneConfig copies the configuration so it can be unmarshaled into without
+// altering the original.
+func cloneConfig(c *Config) *Config {
+	clone := *c
+	clone.Proxy.ResponseHeaders.Set = maps.Clone(c.Proxy.ResponseHeaders.Set)
+	if c.Tracing != nil {
+		tracing := *c.Tracing
+		clone.Tracing = &tracing
+	}
+	return &clone
+}
+
+// changedSettings returns the path in the configuration file of the settings
+// whose value differ.
+func changedSettings(a, b reflect.Value, prefix string) []string {
+	changed := make([]string, 0)
+	t := a.Type()
+	for i := range t.NumField() {
+		field := t.Field(i)
+		name := yamlFieldName(field)
+		if !field.IsExported() || name == "" {
+			continue
+		}
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+
+		fa, fb := a.Field(i), b.Field(i)
+		if fa.Kind() == reflect.Struct {
+			changed = append(changed, changedSettings(fa, fb, name)...)
+			continue
+		}
+		if !reflect.DeepEqual(fa.Interface(), fb.Interface()) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
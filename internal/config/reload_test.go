@@ -0,0 +1,114 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const reloadTestConfig = `
+upstream:
+  url: http://localhost:9090
+server:
+  insecure_listen_address: ":9091"
+database:
+  provider: sqlite
+  query_timeout: 30s
+  sqlite:
+    database_path: analytics.db
+insert:
+  batch_size: 10
+  flush_interval: 5s
+  sample_rate: 1
+retention:
+  interval: 1h
+  max_age: 720h
+`
+
+func TestReload(t *testing.T) {
+	resetDefaultConfig(t)
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(reloadTestConfig), 0o600))
+	require.NoError(t, LoadConfig(path))
+
+	require.NoError(t, os.WriteFile(path, []byte(`
+upstream:
+  url: http://localhost:9090
+server:
+  insecure_listen_address: ":9092"
+database:
+  provider: sqlite
+  query_timeout: 10s
+  sqlite:
+    database_path: analytics.db
+insert:
+  batch_size: 10
+  flush_interval: 5s
+  sample_rate: 0.25
+retention:
+  interval: 1h
+  max_age: 168h
+  policies:
+    - match:
+        status: error
+      max_age: 2160h
+`), 0o600))
+
+	cfg, requiresRestart, err := Reload(path, testDatabaseProviders)
+	require.NoError(t, err)
+
+	assert.Equal(t, 0.25, cfg.Insert.SampleRate)
+	assert.Equal(t, 10*time.Second, cfg.Database.QueryTimeout)
+	assert.Equal(t, 168*time.Hour, cfg.Retention.MaxAge)
+	require.Len(t, cfg.Retention.Policies, 1)
+	assert.Equal(t, "error", cfg.Retention.Policies[0].Match.Status)
+	assert.Equal(t, ":9091", cfg.Server.InsecureListenAddress)
+	assert.Equal(t, []string{"server.insecure_listen_address"}, requiresRestart)
+
+	// The current configuration is left untouched.
+	assert.Equal(t, float64(1), DefaultConfig.Insert.SampleRate)
+	assert.Equal(t, 30*time.Second, DefaultConfig.Database.QueryTimeout)
+	assert.Equal(t, ":9091", DefaultConfig.Server.InsecureListenAddress)
+}
+
+func TestReload_Unchanged(t *testing.T) {
+	resetDefaultConfig(t)
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(reloadTestConfig), 0o600))
+	require.NoError(t, LoadConfig(path))
+
+	_, requiresRestart, err := Reload(path, testDatabaseProviders)
+	require.NoError(t, err)
+	assert.Empty(t, requiresRestart)
+}
+
+func TestReload_Invalid(t *testing.T) {
+	resetDefaultConfig(t)
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(reloadTestConfig), 0o600))
+	require.NoError(t, LoadConfig(path))
+
+	for name, content := range map[string]string{
+		"unparsable":  "insert: [",
+		"invalid":     strings.Replace(reloadTestConfig, "sample_rate: 1", "sample_rate: 2", 1),
+		"no provider": "database:\n  provider: \"\"\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+			_, _, err := Reload(path, testDatabaseProviders)
+			assert.Error(t, err)
+			assert.Equal(t, float64(1), DefaultConfig.Insert.SampleRate)
+		})
+	}
+
+	_, _, err := Reload(filepath.Join(t.TempDir(), "missing.yaml"), testDatabaseProviders)
+	assert.Error(t, err)
+}
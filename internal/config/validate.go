@@ -0,0 +1,163 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// Validate checks the configuration, returning an error listing every
+// problem found. databaseProviders lists the supported database providers,
+// which are registered by the db package.
+func (c *Config) Validate(databaseProviders []string) error {
+	var errs []error
+	add := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	urls := c.Upstream.GetURLs()
+	if len(urls) == 0 {
+		add("upstream: an upstream URL is required")
+	}
+	for _, rawURL := range urls {
+		u, err := url.Parse(rawURL)
+		switch {
+		case err != nil:
+			add("upstream: invalid URL %q: %w", rawURL, err)
+		case u.Scheme != "http" && u.Scheme != "https":
+			add("upstream: invalid scheme for URL %q, only 'http' and 'https' are supported", rawURL)
+		case u.Host == "":
+			add("upstream: missing host in URL %q", rawURL)
+		}
+	}
+	if c.Upstream.MaxResponseParseBytes < 0 {
+		add("upstream.max_response_parse_bytes: must not be negative")
+	}
+
+	if c.Server.AnalyticsRateLimit < 0 {
+		add("server.analytics_rate_limit: must not be negative")
+	}
+	if c.Server.AnalyticsRateLimit > 0 && c.Server.AnalyticsBurst <= 0 {
+		add("server.analytics_burst: must be positive when the analytics API is rate limited")
+	}
+
+	switch c.Database.Provider {
+	case "":
+		add("database.provider: a database provider is required, supported values are: %s", strings.Join(databaseProviders, ", "))
+	case "clickhouse":
+		if c.Database.ClickHouse.Addr == "" {
+			add("database.clickhouse.addr: required by the clickhouse provider")
+		}
+	case "postgresql":
+		if c.Database.PostgreSQL.Addr == "" {
+			add("database.postgresql.addr: required by the postgresql provider")
+		}
+		if c.Database.PostgreSQL.Database == "" {
+			add("database.postgresql.database: required by the postgresql provider")
+		}
+		if c.Database.PostgreSQL.Port < 1 || c.Database.PostgreSQL.Port > 65535 {
+			add("database.postgresql.port: %d is not a valid port", c.Database.PostgreSQL.Port)
+		}
+		switch c.Database.PostgreSQL.Partitioning {
+		case "", "off", "monthly":
+		default:
+			add("database.postgresql.partitioning: invalid value %q, supported values are: off, monthly", c.Database.PostgreSQL.Partitioning)
+		}
+	case "sqlite":
+		if c.Database.SQLite.DatabasePath == "" {
+			add("database.sqlite.database_path: required by the sqlite provider")
+		}
+	}
+	if c.Database.Provider != "" && !slices.Contains(databaseProviders, c.Database.Provider) {
+		add("database.provider: invalid database provider %q, supported values are: %s", c.Database.Provider, strings.Join(databaseProviders, ", "))
+	}
+	if c.Database.QueryTimeout < 0 {
+		add("database.query_timeout: must not be negative")
+	}
+	if c.Database.Cache.Enabled {
+		if c.Database.Cache.TTL <= 0 {
+			add("database.cache.ttl: must be positive when the cache is enabled")
+		}
+		if c.Database.Cache.MaxSize <= 0 {
+			add("database.cache.max_size: must be positive when the cache is enabled")
+		}
+	}
+
+	if c.Proxy.ResultCache.TTL < 0 {
+		add("proxy.result_cache.ttl: must not be negative")
+	}
+	if c.Proxy.ResultCache.TTL > 0 && c.Proxy.ResultCache.MaxSize <= 0 {
+		add("proxy.result_cache.max_size: must be positive when the result cache is enabled")
+	}
+	if c.Proxy.SplitInterval < 0 {
+		add("proxy.split_interval: must not be negative")
+	}
+	if c.Proxy.SplitInterval > 0 && c.Proxy.SplitCacheMaxSize <= 0 {
+		add("proxy.split_cache_max_size: must be positive when range queries are split")
+	}
+
+	if c.Insert.BatchSize <= 0 {
+		add("insert.batch_size: must be positive")
+	}
+	if c.Insert.BufferSize < 0 {
+		add("insert.buffer_size: must not be negative")
+	}
+	if c.Insert.FlushInterval <= 0 {
+		add("insert.flush_interval: must be positive")
+	}
+	if c.Insert.Timeout < 0 {
+		add("insert.timeout: must not be negative")
+	}
+	if c.Insert.GracePeriod < 0 {
+		add("insert.grace_period: must not be negative")
+	}
+	if c.Insert.MaxLabelMatchers < 0 {
+		add("insert.max_label_matchers: must not be negative")
+	}
+	if c.Insert.MaxQueryParamLength < 0 {
+		add("insert.max_query_param_length: must not be negative")
+	}
+	if c.Insert.SampleRate < 0 || c.Insert.SampleRate > 1 {
+		add("insert.sample_rate: %g is not between 0 and 1", c.Insert.SampleRate)
+	}
+
+	if c.Analytics.MetricsRefreshInterval < 0 {
+		add("analytics.metrics_refresh_interval: must not be negative")
+	}
+	if c.Analytics.MetricsRefreshInterval > 0 && c.Analytics.MetricsWindow <= 0 {
+		add("analytics.metrics_window: must be positive when the analytics metrics are refreshed")
+	}
+	if c.Analytics.DefaultLookback < 0 {
+		add("analytics.default_lookback: must not be negative")
+	}
+	if c.Analytics.UsageLookback < 0 {
+		add("analytics.usage_lookback: must not be negative")
+	}
+
+	if c.Retention.MaxAge < 0 {
+		add("retention.max_age: must not be negative")
+	}
+	if (c.Retention.MaxAge > 0 || len(c.Retention.Policies) > 0) && c.Retention.Interval <= 0 {
+		add("retention.interval: must be positive when a retention is configured")
+	}
+	for i, p := range c.Retention.Policies {
+		if p.MaxAge < 0 {
+			add("retention.policies[%d].max_age: must not be negative", i)
+		}
+	}
+
+	if c.Reports.Schedule < 0 {
+		add("reports.schedule: must not be negative")
+	}
+	if c.Reports.Schedule > 0 {
+		if c.Reports.Webhook == "" {
+			add("reports.webhook: required when reports are scheduled")
+		} else if u, err := url.Parse(c.Reports.Webhook); err != nil || u.Host == "" {
+			add("reports.webhook: invalid URL %q", c.Reports.Webhook)
+		}
+	}
+
+	return errors.Join(errs...)
+}
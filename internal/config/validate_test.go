@@ -0,0 +1,107 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testDatabaseProviders = []string{"clickhouse", "none", "postgresql", "sqlite"}
+
+// validConfig returns a configuration with the defaults of the command line
+// flags.
+func validConfig() *Config {
+	return &Config{
+		Upstream: UpstreamConfig{URL: "http://localhost:9090"},
+		Database: DatabaseConfig{
+			Provider:     "postgresql",
+			QueryTimeout: 30 * time.Second,
+			Cache:        DatabaseCacheConfig{TTL: 30 * time.Second, MaxSize: 1000},
+			PostgreSQL:   PostgreSQLConfig{Addr: "localhost", Port: 5432, Database: "analytics"},
+		},
+		Insert: InsertConfig{
+			BatchSize:     10,
+			BufferSize:    100,
+			FlushInterval: 5 * time.Second,
+			SampleRate:    1,
+		},
+		Retention: RetentionConfig{Interval: time.Hour},
+	}
+}
+
+func TestValidate_Valid(t *testing.T) {
+	require.NoError(t, validConfig().Validate(testDatabaseProviders))
+}
+
+func TestValidate_Invalid(t *testing.T) {
+	for name, tc := range map[string]struct {
+		mutate func(*Config)
+		errors []string
+	}{
+		"unknown provider": {
+			mutate: func(c *Config) { c.Database.Provider = "postgres" },
+			errors: []string{`invalid database provider "postgres", supported values are: clickhouse, none, postgresql, sqlite`},
+		},
+		"missing provider": {
+			mutate: func(c *Config) { c.Database.Provider = "" },
+			errors: []string{"database.provider: a database provider is required"},
+		},
+		"missing postgresql fields": {
+			mutate: func(c *Config) { c.Database.PostgreSQL = PostgreSQLConfig{} },
+			errors: []string{"database.postgresql.addr", "database.postgresql.database", "database.postgresql.port"},
+		},
+		"invalid postgresql partitioning": {
+			mutate: func(c *Config) { c.Database.PostgreSQL.Partitioning = "daily" },
+			errors: []string{`database.postgresql.partitioning: invalid value "daily"`},
+		},
+		"missing sqlite path": {
+			mutate: func(c *Config) { c.Database.Provider = "sqlite" },
+			errors: []string{"database.sqlite.database_path"},
+		},
+		"missing upstream": {
+			mutate: func(c *Config) { c.Upstream.URL = "" },
+			errors: []string{"an upstream URL is required"},
+		},
+		"invalid upstreams": {
+			mutate: func(c *Config) {
+				c.Upstream.URL = "localhost:9090"
+				c.Upstream.URLs = []string{"http://%zz", "http://"}
+			},
+			errors: []string{`invalid scheme for URL "localhost:9090"`, `invalid URL "http://%zz"`, `missing host in URL "http://"`},
+		},
+		"numeric bounds": {
+			mutate: func(c *Config) {
+				c.Insert.BatchSize = 0
+				c.Insert.BufferSize = -1
+				c.Insert.SampleRate = 2
+				c.Database.Cache.Enabled = true
+				c.Database.Cache.MaxSize = -5
+			},
+			errors: []string{"insert.batch_size", "insert.buffer_size", "insert.sample_rate: 2 is not between 0 and 1", "database.cache.max_size"},
+		},
+		"reports without webhook": {
+			mutate: func(c *Config) { c.Reports.Schedule = 24 * time.Hour },
+			errors: []string{"reports.webhook: required when reports are scheduled"},
+		},
+		"negative retention policy": {
+			mutate: func(c *Config) {
+				c.Retention.Policies = []RetentionPolicy{{MaxAge: time.Hour}, {MaxAge: -time.Hour}}
+			},
+			errors: []string{"retention.policies[1].max_age"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := validConfig()
+			tc.mutate(cfg)
+
+			err := cfg.Validate(testDatabaseProviders)
+			require.Error(t, err)
+			for _, msg := range tc.errors {
+				assert.Contains(t, err.Error(), msg)
+			}
+			assert.Len(t, err.(interface{ Unwrap() []error }).Unwrap(), len(tc.errors))
+		})
+	}
+}
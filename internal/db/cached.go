@@ -0,0 +1,156 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/cache"
+)
+
+// CachedProvider wraps a Provider and caches the results of its read-only
+// analytics methods for a fixed TTL. Nothing is invalidated on writes, so
+// results may be stale for up to the TTL. Every other method is forwarded to
+// the wrapped provider.
+type CachedProvider struct {
+	Provider
+	cache *cache.Cache[any]
+}
+
+// NewCachedProvider returns a provider caching up to maxSize results of the
+// given provider for the given TTL.
+func NewCachedProvider(p Provider, ttl time.Duration, maxSize int) *CachedProvider {
+	return &CachedProvider{
+		Provider: p,
+		cache:    cache.New[any](ttl, maxSize),
+	}
+}
+
+// cacheKey hashes the method name and its arguments. Times are formatted
+// without their monotonic clock reading so equal instants share a key.
+func cacheKey(method string, args ...any) string {
+	var sb strings.Builder
+	sb.WriteString(method)
+	for _, arg := range args {
+		sb.WriteByte(0)
+		switch v := arg.(type) {
+		case time.Time:
+			sb.WriteString(v.UTC().Format(time.RFC3339Nano))
+		case TimeRange:
+			sb.WriteString(v.From.UTC().Format(time.RFC3339Nano))
+			sb.WriteByte(0)
+			sb.WriteString(v.To.UTC().Format(time.RFC3339Nano))
+		default:
+			fmt.Fprintf(&sb, "%v", v)
+		}
+	}
+	sum := sha256.Sum256([]byte(sb.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// cached returns the cached result for key, calling fetch and caching its
+// result on a miss. Errors are never cached.
+func cached[T any](c *CachedProvider, key string, fetch func() (T, error)) (T, error) {
+	if v, ok := c.cache.Get(key); ok {
+		return v.(T), nil
+	}
+	v, err := fetch()
+	if err != nil {
+		return v, err
+	}
+	c.cache.Set(key, v)
+	return v, nil
+}
+
+func (c *CachedProvider) Query(ctx context.Context, query string) (*QueryResult, error) {
+	return cached(c, cacheKey("Query", query), func() (*QueryResult, error) {
+		return c.Provider.Query(ctx, query)
+	})
+}
+
+func (c *CachedProvider) GetQueriesBySerieName(ctx context.Context, serieName string, page int, pageSize int, sortBy string, sortOrder string) (*PagedResult, error) {
+	return cached(c, cacheKey("GetQueriesBySerieName", serieName, page, pageSize, sortBy, sortOrder), func() (*PagedResult, error) {
+		return c.Provider.GetQueriesBySerieName(ctx, serieName, page, pageSize, sortBy, sortOrder)
+	})
+}
+
+func (c *CachedProvider) GetRulesUsage(ctx context.Context, serie string, kind string, page int, pageSize int) (*PagedResult, error) {
+	return cached(c, cacheKey("GetRulesUsage", serie, kind, page, pageSize), func() (*PagedResult, error) {
+		return c.Provider.GetRulesUsage(ctx, serie, kind, page, pageSize)
+	})
+}
+
+func (c *CachedProvider) GetDashboardUsage(ctx context.Context, serieName string, page int, pageSize int) (*PagedResult, error) {
+	return cached(c, cacheKey("GetDashboardUsage", serieName, page, pageSize), func() (*PagedResult, error) {
+		return c.Provider.GetDashboardUsage(ctx, serieName, page, pageSize)
+	})
+}
+
+func (c *CachedProvider) GetSimilarDashboards(ctx context.Context, threshold float64) ([]SimilarDashboards, error) {
+	return cached(c, cacheKey("GetSimilarDashboards", threshold), func() ([]SimilarDashboards, error) {
+		return c.Provider.GetSimilarDashboards(ctx, threshold)
+	})
+}
+
+func (c *CachedProvider) GetQueriesSummary(ctx context.Context, startTime, endTime time.Time) (*QueriesSummary, error) {
+	return cached(c, cacheKey("GetQueriesSummary", startTime, endTime), func() (*QueriesSummary, error) {
+		return c.Provider.GetQueriesSummary(ctx, startTime, endTime)
+	})
+}
+
+func (c *CachedProvider) GetTopQueries(ctx context.Context, startTime, endTime time.Time, limit int) ([]TopQuery, error) {
+	return cached(c, cacheKey("GetTopQueries", startTime, endTime, limit), func() ([]TopQuery, error) {
+		return c.Provider.GetTopQueries(ctx, startTime, endTime, limit)
+	})
+}
+
+func (c *CachedProvider) GetSlowestQueries(ctx context.Context, tr TimeRange, tenant string, source string, limit int) ([]SlowQueryRow, error) {
+	return cached(c, cacheKey("GetSlowestQueries", tr, tenant, source, limit), func() ([]SlowQueryRow, error) {
+		return c.Provider.GetSlowestQueries(ctx, tr, tenant, source, limit)
+	})
+}
+
+func (c *CachedProvider) GetQueryExecutionDetail(ctx context.Context, id int64) (*QueryExecutionDetail, error) {
+	return cached(c, cacheKey("GetQueryExecutionDetail", id), func() (*QueryExecutionDetail, error) {
+		return c.Provider.GetQueryExecutionDetail(ctx, id)
+	})
+}
+
+func (c *CachedProvider) GetQueryErrorBreakdown(ctx context.Context, tr TimeRange, tenant string, source string) ([]ErrorBreakdownRow, error) {
+	return cached(c, cacheKey("GetQueryErrorBreakdown", tr, tenant, source), func() ([]ErrorBreakdownRow, error) {
+		return c.Provider.GetQueryErrorBreakdown(ctx, tr, tenant, source)
+	})
+}
+
+func (c *CachedProvider) GetQueriesByIP(ctx context.Context, tr TimeRange, tenant string, source string, limit int) ([]SourceIPStats, error) {
+	return cached(c, cacheKey("GetQueriesByIP", tr, tenant, source, limit), func() ([]SourceIPStats, error) {
+		return c.Provider.GetQueriesByIP(ctx, tr, tenant, source, limit)
+	})
+}
+
+func (c *CachedProvider) GetMetricStatisticsBatch(ctx context.Context, names []string, tr TimeRange) (map[string]MetricUsageStatistics, error) {
+	return cached(c, cacheKey("GetMetricStatisticsBatch", names, tr), func() (map[string]MetricUsageStatistics, error) {
+		return c.Provider.GetMetricStatisticsBatch(ctx, names, tr)
+	})
+}
+
+func (c *CachedProvider) GetTopQueriedMetrics(ctx context.Context, tr TimeRange, tenant string, source string, limit int) ([]MetricQueryCount, error) {
+	return cached(c, cacheKey("GetTopQueriedMetrics", tr, tenant, source, limit), func() ([]MetricQueryCount, error) {
+		return c.Provider.GetTopQueriedMetrics(ctx, tr, tenant, source, limit)
+	})
+}
+
+func (c *CachedProvider) GetQueryThroughput(ctx context.Context, tr TimeRange, tenant string, source string, step time.Duration, groupBy ThroughputGroupBy) ([]ThroughputBucket, error) {
+	return cached(c, cacheKey("GetQueryThroughput", tr, tenant, source, step, groupBy), func() ([]ThroughputBucket, error) {
+		return c.Provider.GetQueryThroughput(ctx, tr, tenant, source, step, groupBy)
+	})
+}
+
+func (c *CachedProvider) GetLatencyRegressions(ctx context.Context, currentWindow, baselineWindow time.Duration, factor float64) ([]LatencyRegression, error) {
+	return cached(c, cacheKey("GetLatencyRegressions", currentWindow, baselineWindow, factor), func() ([]LatencyRegression, error) {
+		return c.Provider.GetLatencyRegressions(ctx, currentWindow, baselineWindow, factor)
+	})
+}
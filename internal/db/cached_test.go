@@ -0,0 +1,85 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type countingProvider struct {
+	Provider
+	calls int
+	err   error
+}
+
+func (p *countingProvider) GetSlowestQueries(ctx context.Context, tr TimeRange, tenant string, source string, limit int) ([]SlowQueryRow, error) {
+	p.calls++
+	if p.err != nil {
+		return nil, p.err
+	}
+	return []SlowQueryRow{{QueryParam: tenant}}, nil
+}
+
+func (p *countingProvider) InsertRulesUsage(ctx context.Context, rulesUsage []RulesUsage) error {
+	p.calls++
+	return nil
+}
+
+func TestCachedProvider(t *testing.T) {
+	ctx := context.Background()
+	counting := &countingProvider{}
+	provider := NewCachedProvider(counting, time.Minute, 10)
+
+	now := time.Now()
+	tr := TimeRange{From: now.Add(-time.Hour), To: now}
+
+	first, err := provider.GetSlowestQueries(ctx, tr, "team-a", "", 10)
+	require.NoError(t, err)
+	// The same instants, without the monotonic clock reading.
+	second, err := provider.GetSlowestQueries(ctx, TimeRange{From: tr.From.Round(0), To: tr.To.Round(0)}, "team-a", "", 10)
+	require.NoError(t, err)
+	assert.Equal(t, first, second)
+	assert.Equal(t, 1, counting.calls)
+
+	// Different arguments are cached separately.
+	other, err := provider.GetSlowestQueries(ctx, tr, "team-b", "", 10)
+	require.NoError(t, err)
+	assert.Equal(t, "team-b", other[0].QueryParam)
+	assert.Equal(t, 2, counting.calls)
+
+	// Writes are not cached.
+	require.NoError(t, provider.InsertRulesUsage(ctx, nil))
+	require.NoError(t, provider.InsertRulesUsage(ctx, nil))
+	assert.Equal(t, 4, counting.calls)
+}
+
+func TestCachedProvider_Expiry(t *testing.T) {
+	ctx := context.Background()
+	counting := &countingProvider{}
+	provider := NewCachedProvider(counting, time.Millisecond, 10)
+
+	tr := TimeRange{From: time.Unix(0, 0), To: time.Unix(3600, 0)}
+	_, err := provider.GetSlowestQueries(ctx, tr, "", "", 10)
+	require.NoError(t, err)
+	time.Sleep(5 * time.Millisecond)
+	_, err = provider.GetSlowestQueries(ctx, tr, "", "", 10)
+	require.NoError(t, err)
+	assert.Equal(t, 2, counting.calls)
+}
+
+func TestCachedProvider_ErrorsAreNotCached(t *testing.T) {
+	ctx := context.Background()
+	counting := &countingProvider{err: errors.New("database is locked")}
+	provider := NewCachedProvider(counting, time.Minute, 10)
+
+	tr := TimeRange{From: time.Unix(0, 0), To: time.Unix(3600, 0)}
+	for range 2 {
+		_, err := provider.GetSlowestQueries(ctx, tr, "", "", 10)
+		assert.Error(t, err)
+	}
+	assert.Equal(t, 2, counting.calls)
+}
@@ -6,7 +6,6 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
-	"math"
 	"os"
 	"strings"
 	"sync"
@@ -19,6 +18,10 @@ import (
 type ClickHouseProvider struct {
 	mu sync.RWMutex
 	db *sql.DB
+
+	// usageLookback is how far back the rules and dashboards usage and the
+	// queries of a serie are looked up.
+	usageLookback time.Duration
 }
 
 const (
@@ -30,6 +33,7 @@ const (
 			Duration UInt64,
 			StatusCode Int32,
 			BodySize Int32,
+			TotalBytes Int32,
 			Fingerprint String,
 			LabelMatchers Nested (
 				key String,
@@ -40,12 +44,103 @@ const (
 			Start DateTime,
 			End DateTime,
 			TotalQueryableSamples Int32,
-			PeakSamples Int32
+			PeakSamples Int32,
+			Cached Bool,
+			Error String,
+			Tenant String,
+			SourceIP String,
+			MetricNames Array(String),
+			UpstreamDuration Nullable(UInt64),
+			Method String,
+			Source LowCardinality(String) DEFAULT 'user',
+			DashboardUID Nullable(String),
+			ResultStatus LowCardinality(String)
 		) 
 		ENGINE = MergeTree()
 		ORDER BY TS;
 	`
 
+	// migrateClickHouseTotalBytesStmt adds the TotalBytes column to tables
+	// created before it existed, next to BodySize as in the created tables.
+	migrateClickHouseTotalBytesStmt = `
+		ALTER TABLE queries ADD COLUMN IF NOT EXISTS TotalBytes Int32 AFTER BodySize;
+	`
+
+	// migrateClickHouseCachedStmt adds the Cached column to tables
+	// created before it existed, next to PeakSamples as in the created tables.
+	migrateClickHouseCachedStmt = `
+		ALTER TABLE queries ADD COLUMN IF NOT EXISTS Cached Bool AFTER PeakSamples;
+	`
+
+	// migrateClickHouseErrorStmt adds the Error column to tables
+	// created before it existed, next to Cached as in the created tables.
+	migrateClickHouseErrorStmt = `
+		ALTER TABLE queries ADD COLUMN IF NOT EXISTS Error String AFTER Cached;
+	`
+
+	// migrateClickHouseTenantStmt adds the Tenant column to tables
+	// created before it existed, next to Error as in the created tables.
+	migrateClickHouseTenantStmt = `
+		ALTER TABLE queries ADD COLUMN IF NOT EXISTS Tenant String AFTER Error;
+	`
+
+	// migrateClickHouseSourceIPStmt adds the SourceIP column to tables
+	// created before it existed, next to Tenant as in the created tables.
+	migrateClickHouseSourceIPStmt = `
+		ALTER TABLE queries ADD COLUMN IF NOT EXISTS SourceIP String AFTER Tenant;
+	`
+
+	// insertClickHouseQueriesStmt names the inserted columns, as the columns
+	// added to existing tables may not be in the order of the created ones.
+	insertClickHouseQueriesStmt = `INSERT INTO queries (
+		TS, QueryParam, TimeParam, Duration, StatusCode, BodySize, TotalBytes, Fingerprint, LabelMatchers.key, LabelMatchers.value, Type, Step, Start, End, TotalQueryableSamples, PeakSamples, Cached, Error, Tenant, SourceIP, MetricNames, UpstreamDuration, Method, Source, DashboardUID, ResultStatus
+	) VALUES `
+
+	// migrateClickHouseMetricNamesStmt adds the MetricNames column to tables
+	// created before it existed. Its default derives the metric names of the
+	// existing rows from their label matchers.
+	migrateClickHouseMetricNamesStmt = `
+		ALTER TABLE queries ADD COLUMN IF NOT EXISTS MetricNames Array(String)
+		DEFAULT arraySort(arrayDistinct(arrayFilter((v, k) -> k = '__name__', LabelMatchers.value, LabelMatchers.key)));
+	`
+
+	// migrateClickHouseUpstreamDurationStmt adds the UpstreamDuration column
+	// to tables created before it existed. It is left empty for the existing
+	// rows, whose upstream latency is unknown.
+	migrateClickHouseUpstreamDurationStmt = `
+		ALTER TABLE queries ADD COLUMN IF NOT EXISTS UpstreamDuration Nullable(UInt64);
+	`
+
+	// migrateClickHouseMethodStmt adds the Method column to tables created
+	// before it existed. It is left empty for the existing rows.
+	migrateClickHouseMethodStmt = `
+		ALTER TABLE queries ADD COLUMN IF NOT EXISTS Method String;
+	`
+
+	// migrateClickHouseSourceStmt adds the Source column to tables created
+	// before it existed. The existing rows are attributed to users.
+	migrateClickHouseSourceStmt = `
+		ALTER TABLE queries ADD COLUMN IF NOT EXISTS Source LowCardinality(String) DEFAULT 'user';
+	`
+
+	// migrateClickHouseDashboardUIDStmt adds the DashboardUID column to
+	// tables created before it existed. It is left empty for the existing
+	// rows.
+	migrateClickHouseDashboardUIDStmt = `
+		ALTER TABLE queries ADD COLUMN IF NOT EXISTS DashboardUID Nullable(String);
+	`
+
+	// migrateClickHouseResultStatusStmt adds the ResultStatus column to
+	// tables created before it existed. It is left empty for the existing
+	// rows, whose failures are told by their status code only.
+	migrateClickHouseResultStatusStmt = `
+		ALTER TABLE queries ADD COLUMN IF NOT EXISTS ResultStatus LowCardinality(String);
+	`
+
+	// clickHouseFailedQueryCondition matches the failed queries, see
+	// Query.Failed.
+	clickHouseFailedQueryCondition = "(StatusCode >= 400 OR ResultStatus = '" + QueryResultStatusError + "')"
+
 	createClickHouseRulesUsageTableStmt = `
 		CREATE TABLE IF NOT EXISTS RulesUsage (
 			serie String,               -- TEXT equivalent in ClickHouse
@@ -73,6 +168,10 @@ const (
 	`
 )
 
+func init() {
+	RegisterProvider(ClickHouse, newClickHouseProvider)
+}
+
 func RegisterClickHouseFlags(flagSet *flag.FlagSet) {
 	flagSet.DurationVar(&config.DefaultConfig.Database.ClickHouse.DialTimeout, "clickhouse-dial-timeout", 5*time.Second, "Timeout to dial clickhouse.")
 	flagSet.StringVar(&config.DefaultConfig.Database.ClickHouse.Addr, "clickhouse-addr", "localhost:9000", "Address of the clickhouse server, comma separated for multiple servers.")
@@ -82,6 +181,7 @@ func RegisterClickHouseFlags(flagSet *flag.FlagSet) {
 }
 
 func newClickHouseProvider(ctx context.Context) (Provider, error) {
+	usageLookback := usageLookbackOrDefault(config.DefaultConfig.Analytics.UsageLookback)
 	config := config.DefaultConfig.Database.ClickHouse
 	opts := &clickhouse.Options{
 		Addr:        strings.Split(config.Addr, ","),
@@ -105,6 +205,50 @@ func newClickHouseProvider(ctx context.Context) (Provider, error) {
 		return nil, err
 	}
 
+	if _, err := db.ExecContext(ctx, migrateClickHouseTotalBytesStmt); err != nil {
+		return nil, err
+	}
+
+	if _, err := db.ExecContext(ctx, migrateClickHouseCachedStmt); err != nil {
+		return nil, err
+	}
+
+	if _, err := db.ExecContext(ctx, migrateClickHouseErrorStmt); err != nil {
+		return nil, err
+	}
+
+	if _, err := db.ExecContext(ctx, migrateClickHouseTenantStmt); err != nil {
+		return nil, err
+	}
+
+	if _, err := db.ExecContext(ctx, migrateClickHouseSourceIPStmt); err != nil {
+		return nil, err
+	}
+
+	if _, err := db.ExecContext(ctx, migrateClickHouseMetricNamesStmt); err != nil {
+		return nil, err
+	}
+
+	if _, err := db.ExecContext(ctx, migrateClickHouseUpstreamDurationStmt); err != nil {
+		return nil, err
+	}
+
+	if _, err := db.ExecContext(ctx, migrateClickHouseMethodStmt); err != nil {
+		return nil, err
+	}
+
+	if _, err := db.ExecContext(ctx, migrateClickHouseSourceStmt); err != nil {
+		return nil, err
+	}
+
+	if _, err := db.ExecContext(ctx, migrateClickHouseDashboardUIDStmt); err != nil {
+		return nil, err
+	}
+
+	if _, err := db.ExecContext(ctx, migrateClickHouseResultStatusStmt); err != nil {
+		return nil, err
+	}
+
 	if _, err := db.ExecContext(ctx, createClickHouseRulesUsageTableStmt); err != nil {
 		return nil, err
 	}
@@ -114,7 +258,8 @@ func newClickHouseProvider(ctx context.Context) (Provider, error) {
 	}
 
 	return &ClickHouseProvider{
-		db: db,
+		db:            db,
+		usageLookback: usageLookback,
 	}, nil
 }
 
@@ -130,11 +275,39 @@ func (c *ClickHouseProvider) Close() error {
 	return c.db.Close()
 }
 
+func (c *ClickHouseProvider) Stats(ctx context.Context) (*DBStats, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	tableRows, err := countTableRows(ctx, c.db)
+	if err != nil {
+		return nil, err
+	}
+
+	var size int64
+	err = c.db.QueryRowContext(ctx, `
+		SELECT sum(bytes_on_disk)
+		FROM system.parts
+		WHERE active AND database = currentDatabase() AND table IN (?, ?, ?)
+	`, statsTables[0], statsTables[1], statsTables[2]).Scan(&size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the database size: %w", err)
+	}
+
+	return &DBStats{TableRows: tableRows, SizeBytes: size}, nil
+}
+
+func (c *ClickHouseProvider) Ping(ctx context.Context) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.db.PingContext(ctx)
+}
+
 func (c *ClickHouseProvider) Insert(ctx context.Context, queries []Query) error {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	args := make([]interface{}, 0, len(queries)*15)
+	args := make([]interface{}, 0, len(queries)*26)
 
 	for _, query := range queries {
 		keys := make([]string, 0, len(query.LabelMatchers))
@@ -153,6 +326,7 @@ func (c *ClickHouseProvider) Insert(ctx context.Context, queries []Query) error
 			query.Duration.Milliseconds(), // Store Duration as milliseconds
 			query.StatusCode,
 			query.BodySize,
+			query.TotalBytes,
 			query.Fingerprint,
 			keys,
 			values,
@@ -162,10 +336,20 @@ func (c *ClickHouseProvider) Insert(ctx context.Context, queries []Query) error
 			query.End,
 			query.TotalQueryableSamples,
 			query.PeakSamples,
+			query.Cached,
+			query.Error,
+			query.Tenant,
+			query.SourceIP,
+			query.MetricNames,
+			query.UpstreamDuration.Milliseconds(),
+			query.Method,
+			query.Source.orDefault(),
+			nullString(query.DashboardUID),
+			query.ResultStatus,
 		)
 	}
 
-	stmt := fmt.Sprintf("INSERT INTO queries VALUES %s", strings.Repeat("(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?),", len(queries)-1)+"(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	stmt := insertClickHouseQueriesStmt + strings.Repeat("(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?),", len(queries)-1) + "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
 	_, err := c.db.ExecContext(ctx, stmt, args...)
 	if err != nil {
 		return fmt.Errorf("unable to execute batch insert: %w", err)
@@ -241,29 +425,24 @@ func (p *ClickHouseProvider) GetQueriesBySerieName(
 	ctx context.Context,
 	serieName string,
 	page int,
-	pageSize int) (*PagedResult, error) {
+	pageSize int,
+	sortBy string,
+	sortOrder string) (*PagedResult, error) {
 
 	endTime := time.Now()
-	startTime := endTime.Add(-30 * 24 * time.Hour) // 30 days ago
+	startTime := endTime.Add(-p.usageLookback)
 
 	totalCount, err := p.getQueriesBySerieNameTotalCount(ctx, serieName, startTime, endTime)
 	if err != nil {
 		return nil, err
 	}
 
-	// Calculate total pages
-	totalPages := int(math.Ceil(float64(totalCount) / float64(pageSize)))
-
-	data, err := p.getQueriesBySerieNameQueryData(ctx, serieName, startTime, endTime, page, pageSize)
+	data, err := p.getQueriesBySerieNameQueryData(ctx, serieName, startTime, endTime, page, pageSize, sortBy, sortOrder)
 	if err != nil {
 		return nil, err
 	}
 
-	return &PagedResult{
-		Total:      totalCount,
-		TotalPages: totalPages,
-		Data:       data,
-	}, nil
+	return newPagedResult(data, totalCount, page, pageSize, page*pageSize), nil
 }
 
 func (p *ClickHouseProvider) getQueriesBySerieNameTotalCount(ctx context.Context, serieName string, startTime, endTime time.Time) (int, error) {
@@ -271,7 +450,7 @@ func (p *ClickHouseProvider) getQueriesBySerieNameTotalCount(ctx context.Context
 		SELECT COUNT(DISTINCT QueryParam) AS TotalCount
 		FROM queries
 		WHERE 
-			LabelMatchers.value[indexOf(LabelMatchers.key, '__name__')] = ?
+			has(MetricNames, ?)
 			AND TS BETWEEN ? AND ?;
 	`
 
@@ -284,21 +463,23 @@ func (p *ClickHouseProvider) getQueriesBySerieNameTotalCount(ctx context.Context
 	return totalCount, nil
 }
 
-func (p *ClickHouseProvider) getQueriesBySerieNameQueryData(ctx context.Context, serieName string, startTime, endTime time.Time, page, pageSize int) ([]QueriesBySerieNameResult, error) {
+func (p *ClickHouseProvider) getQueriesBySerieNameQueryData(ctx context.Context, serieName string, startTime, endTime time.Time, page, pageSize int, sortBy, sortOrder string) ([]QueriesBySerieNameResult, error) {
 	query := `
 		SELECT
-			QueryParam AS Query,
-			AVG(Duration) AS AvgDuration,
-			AVG(PeakSamples) AS AvgPeakSamples,
-			MAX(PeakSamples) AS MaxPeakSamples
+			QueryParam AS queryParam,
+			AVG(Duration) AS avgDuration,
+			AVG(PeakSamples) AS avgPeakySamples,
+			MAX(PeakSamples) AS maxPeakSamples,
+			count() AS executions,
+			100 * countIf(` + clickHouseFailedQueryCondition + `) / count() AS errorRatePercent
 		FROM queries
 		WHERE 
-			LabelMatchers.value[indexOf(LabelMatchers.key, '__name__')] = ?
+			has(MetricNames, ?)
 			AND TS BETWEEN ? AND ?
 		GROUP BY
 			QueryParam
 		ORDER BY
-			AvgDuration DESC
+			` + serieQueriesOrderBy(sortBy, sortOrder) + `
 		LIMIT ? OFFSET ?;
 	`
 
@@ -311,7 +492,7 @@ func (p *ClickHouseProvider) getQueriesBySerieNameQueryData(ctx context.Context,
 	data := []QueriesBySerieNameResult{}
 	for rows.Next() {
 		var r QueriesBySerieNameResult
-		if err := rows.Scan(&r.QueryParam, &r.AvgDuration, &r.AvgPeakySamples, &r.MaxPeakSamples); err != nil {
+		if err := rows.Scan(&r.QueryParam, &r.AvgDuration, &r.AvgPeakySamples, &r.MaxPeakSamples, &r.Executions, &r.ErrorRatePercent); err != nil {
 			return nil, fmt.Errorf("unable to scan row: %w", err)
 		}
 		data = append(data, r)
@@ -394,17 +575,14 @@ func (p *ClickHouseProvider) GetRulesUsage(ctx context.Context, serie string, ki
 		FROM RulesUsage
 		WHERE serie = ? 
 		AND kind = ?
-		AND created_at >= NOW() - INTERVAL 30 DAY;
+		AND created_at >= NOW() - toIntervalSecond(?);
 	`
 	var totalCount int
-	err := p.db.QueryRowContext(ctx, countQuery, serie, kind).Scan(&totalCount)
+	err := p.db.QueryRowContext(ctx, countQuery, serie, kind, int64(p.usageLookback.Seconds())).Scan(&totalCount)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query total count: %w", err)
 	}
 
-	// Calculate total pages
-	totalPages := int(math.Ceil(float64(totalCount) / float64(pageSize)))
-
 	// Query for paginated results
 	query := `
 		WITH latest_rules AS (
@@ -418,7 +596,7 @@ func (p *ClickHouseProvider) GetRulesUsage(ctx context.Context, serie string, ki
 				created_at,
 				ROW_NUMBER() OVER (PARTITION BY serie, name ORDER BY created_at DESC) AS rank
 			FROM RulesUsage
-			WHERE serie = ? AND kind = ? AND created_at >= NOW() - INTERVAL 30 DAY
+			WHERE serie = ? AND kind = ? AND created_at >= NOW() - toIntervalSecond(?)
 		)
 		SELECT 
 			serie,
@@ -434,7 +612,7 @@ func (p *ClickHouseProvider) GetRulesUsage(ctx context.Context, serie string, ki
 		LIMIT ? OFFSET ?;
 	`
 
-	rows, err := p.db.QueryContext(ctx, query, serie, kind, pageSize, offset)
+	rows, err := p.db.QueryContext(ctx, query, serie, kind, int64(p.usageLookback.Seconds()), pageSize, offset)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query rules usage: %w", err)
 	}
@@ -482,11 +660,7 @@ func (p *ClickHouseProvider) GetRulesUsage(ctx context.Context, serie string, ki
 		return nil, fmt.Errorf("row iteration error: %w", err)
 	}
 
-	return &PagedResult{
-		Total:      totalCount, // Use totalCount instead of len(results)
-		TotalPages: totalPages,
-		Data:       results,
-	}, nil
+	return newPagedResult(results, totalCount, page, pageSize, offset), nil
 }
 
 func (p *ClickHouseProvider) InsertDashboardUsage(ctx context.Context, dashboardUsage []DashboardUsage) error {
@@ -547,17 +721,14 @@ func (p *ClickHouseProvider) GetDashboardUsage(ctx context.Context, serie string
 		SELECT COUNT(DISTINCT CONCAT(id))
 		FROM DashboardUsage
 		WHERE serie = ? 
-		AND created_at >= NOW() - INTERVAL 30 DAY;
+		AND created_at >= NOW() - toIntervalSecond(?);
 	`
 	var totalCount int
-	err := p.db.QueryRowContext(ctx, countQuery, serie).Scan(&totalCount)
+	err := p.db.QueryRowContext(ctx, countQuery, serie, int64(p.usageLookback.Seconds())).Scan(&totalCount)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query total count: %w", err)
 	}
 
-	// Calculate total pages
-	totalPages := int(math.Ceil(float64(totalCount) / float64(pageSize)))
-
 	// Query for paginated results
 	query := `
 		WITH latest_rules AS (
@@ -569,7 +740,7 @@ func (p *ClickHouseProvider) GetDashboardUsage(ctx context.Context, serie string
 				created_at,
 				ROW_NUMBER() OVER (PARTITION BY serie, id ORDER BY created_at DESC) AS rank
 			FROM DashboardUsage
-			WHERE serie = ? AND created_at >= NOW() - INTERVAL 30 DAY
+			WHERE serie = ? AND created_at >= NOW() - toIntervalSecond(?)
 		)
 		SELECT 
 			id,
@@ -583,7 +754,7 @@ func (p *ClickHouseProvider) GetDashboardUsage(ctx context.Context, serie string
 		LIMIT ? OFFSET ?;
 	`
 
-	rows, err := p.db.QueryContext(ctx, query, serie, pageSize, offset)
+	rows, err := p.db.QueryContext(ctx, query, serie, int64(p.usageLookback.Seconds()), pageSize, offset)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query rules usage: %w", err)
 	}
@@ -619,9 +790,306 @@ func (p *ClickHouseProvider) GetDashboardUsage(ctx context.Context, serie string
 		return nil, fmt.Errorf("row iteration error: %w", err)
 	}
 
-	return &PagedResult{
-		Total:      totalCount, // Use totalCount instead of len(results)
-		TotalPages: totalPages,
-		Data:       results,
-	}, nil
+	return newPagedResult(results, totalCount, page, pageSize, offset), nil
+}
+
+func (p *ClickHouseProvider) GetQueriesSummary(ctx context.Context, startTime, endTime time.Time) (*QueriesSummary, error) {
+	query := `
+		SELECT
+			count() AS TotalQueries,
+			countIf(` + clickHouseFailedQueryCondition + `) AS FailedQueries,
+			if(count() = 0, 0, avg(Duration)) AS AvgDuration,
+			if(count() = 0, 0, quantile(0.95)(Duration)) AS P95Duration
+		FROM queries
+		WHERE TS BETWEEN ? AND ?;
+	`
+
+	summary := &QueriesSummary{}
+	err := p.db.QueryRowContext(ctx, query, startTime, endTime).Scan(&summary.TotalQueries, &summary.FailedQueries, &summary.AvgDuration, &summary.P95Duration)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query summary: %w", err)
+	}
+
+	return summary, nil
+}
+
+func (p *ClickHouseProvider) DeleteQueriesBefore(ctx context.Context, cutoff time.Time, filter QueryFilter) (int64, error) {
+	where, filterArgs := filter.where("Type", "StatusCode")
+	args := append([]interface{}{cutoff}, filterArgs...)
+
+	// Mutations do not report the number of affected rows, so count them first.
+	var count uint64
+	err := p.db.QueryRowContext(ctx, "SELECT count() FROM queries WHERE TS < ?"+where, args...).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count queries to delete: %w", err)
+	}
+	if count == 0 {
+		return 0, nil
+	}
+
+	_, err = p.db.ExecContext(ctx, "ALTER TABLE queries DELETE WHERE TS < ?"+where, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete queries: %w", err)
+	}
+
+	return int64(count), nil
+}
+
+func (p *ClickHouseProvider) GetSimilarDashboards(ctx context.Context, threshold float64) ([]SimilarDashboards, error) {
+	query := `
+		SELECT id, serie, max(name), max(url)
+		FROM DashboardUsage
+		WHERE created_at >= NOW() - toIntervalSecond(?)
+		GROUP BY id, serie
+		ORDER BY id;
+	`
+
+	rows, err := p.db.QueryContext(ctx, query, int64(p.usageLookback.Seconds()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query dashboard series: %w", err)
+	}
+	defer rows.Close()
+
+	dashboards, err := scanDashboardSeries(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	return similarDashboards(dashboards, threshold), nil
+}
+
+func (p *ClickHouseProvider) GetTopQueries(ctx context.Context, startTime, endTime time.Time, limit int) ([]TopQuery, error) {
+	query := `
+		SELECT
+			Fingerprint,
+			any(QueryParam) AS Query,
+			count() AS Executions,
+			avg(Duration) AS AvgDuration
+		FROM queries
+		WHERE TS BETWEEN ? AND ?
+		GROUP BY Fingerprint
+		ORDER BY Executions DESC, AvgDuration DESC
+		LIMIT ?;
+	`
+
+	rows, err := p.db.QueryContext(ctx, query, startTime, endTime, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	data := []TopQuery{}
+	for rows.Next() {
+		var r TopQuery
+		if err := rows.Scan(&r.Fingerprint, &r.QueryParam, &r.Executions, &r.AvgDuration); err != nil {
+			return nil, fmt.Errorf("unable to scan row: %w", err)
+		}
+		data = append(data, r)
+	}
+
+	return data, nil
+}
+
+// GetQueryExecutionDetail is not supported as ClickHouse rows have no
+// stable id.
+func (p *ClickHouseProvider) GetQueryExecutionDetail(ctx context.Context, id int64) (*QueryExecutionDetail, error) {
+	return nil, ErrNotSupported
+}
+
+func (p *ClickHouseProvider) GetSlowestQueries(ctx context.Context, tr TimeRange, tenant string, source string, limit int) ([]SlowQueryRow, error) {
+	query := `
+		SELECT TS, QueryParam, Duration, StatusCode, PeakSamples, Fingerprint
+		FROM queries
+		WHERE TS BETWEEN ? AND ? AND (? = '' OR Tenant = ?) AND (? = '' OR Source = ?)
+		ORDER BY Duration DESC
+		LIMIT ?;
+	`
+
+	rows, err := p.db.QueryContext(ctx, query, tr.From, tr.To, tenant, tenant, source, source, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	data := []SlowQueryRow{}
+	for rows.Next() {
+		var r SlowQueryRow
+		if err := rows.Scan(&r.TS, &r.QueryParam, &r.Duration, &r.StatusCode, &r.PeakSamples, &r.Fingerprint); err != nil {
+			return nil, fmt.Errorf("unable to scan row: %w", err)
+		}
+		data = append(data, r)
+	}
+
+	return data, nil
+}
+
+func (p *ClickHouseProvider) GetLatencyRegressions(ctx context.Context, currentWindow, baselineWindow time.Duration, factor float64) ([]LatencyRegression, error) {
+	now := time.Now()
+	baselineStart, currentStart := regressionWindows(now, currentWindow, baselineWindow)
+
+	query := `
+		SELECT
+			Fingerprint,
+			any(QueryParam) AS Query,
+			quantileIf(0.95)(Duration, TS >= ?) AS CurrentP95,
+			quantileIf(0.95)(Duration, TS < ?) AS BaselineP95
+		FROM queries
+		WHERE TS BETWEEN ? AND ?
+		GROUP BY Fingerprint
+		HAVING countIf(TS >= ?) > 0 AND countIf(TS < ?) > 0;
+	`
+
+	rows, err := p.db.QueryContext(ctx, query, currentStart, currentStart, baselineStart, now, currentStart, currentStart)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	candidates := []LatencyRegression{}
+	for rows.Next() {
+		var r LatencyRegression
+		if err := rows.Scan(&r.Fingerprint, &r.QueryParam, &r.CurrentP95, &r.BaselineP95); err != nil {
+			return nil, fmt.Errorf("unable to scan row: %w", err)
+		}
+		candidates = append(candidates, r)
+	}
+
+	return latencyRegressions(candidates, factor), nil
+}
+
+func (p *ClickHouseProvider) GetQueryErrorBreakdown(ctx context.Context, tr TimeRange, tenant string, source string) ([]ErrorBreakdownRow, error) {
+	query := `
+		SELECT Error, count()
+		FROM queries
+		WHERE ` + clickHouseFailedQueryCondition + ` AND TS BETWEEN ? AND ? AND (? = '' OR Tenant = ?) AND (? = '' OR Source = ?)
+		GROUP BY Error;
+	`
+
+	rows, err := p.db.QueryContext(ctx, query, tr.From, tr.To, tenant, tenant, source, source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var (
+			message string
+			count   uint64
+		)
+		if err := rows.Scan(&message, &count); err != nil {
+			return nil, fmt.Errorf("unable to scan row: %w", err)
+		}
+		counts[message] += int(count)
+	}
+
+	return errorBreakdown(counts), nil
+}
+
+func (p *ClickHouseProvider) GetQueriesByIP(ctx context.Context, tr TimeRange, tenant string, source string, limit int) ([]SourceIPStats, error) {
+	query := `
+		SELECT SourceIP, count() AS queries, countIf(` + clickHouseFailedQueryCondition + `)
+		FROM queries
+		WHERE TS BETWEEN ? AND ? AND SourceIP != '' AND (? = '' OR Tenant = ?) AND (? = '' OR Source = ?)
+		GROUP BY SourceIP
+		ORDER BY queries DESC
+		LIMIT ?;
+	`
+
+	rows, err := p.db.QueryContext(ctx, query, tr.From, tr.To, tenant, tenant, source, source, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	data := []SourceIPStats{}
+	for rows.Next() {
+		var (
+			r             SourceIPStats
+			queries, errs uint64
+		)
+		if err := rows.Scan(&r.IP, &queries, &errs); err != nil {
+			return nil, fmt.Errorf("unable to scan row: %w", err)
+		}
+		r.Queries, r.Errors = int(queries), int(errs)
+		if r.Queries > 0 {
+			r.ErrorRate = float64(r.Errors) / float64(r.Queries)
+		}
+		data = append(data, r)
+	}
+
+	return data, nil
+}
+
+// GetMetricStatisticsBatch is not supported by ClickHouse yet.
+func (p *ClickHouseProvider) GetMetricStatisticsBatch(ctx context.Context, names []string, tr TimeRange) (map[string]MetricUsageStatistics, error) {
+	return nil, ErrNotSupported
+}
+
+func (p *ClickHouseProvider) GetTopQueriedMetrics(ctx context.Context, tr TimeRange, tenant string, source string, limit int) ([]MetricQueryCount, error) {
+	query := `
+		SELECT name, count() AS queries, sum(PeakSamples)
+		FROM queries
+		ARRAY JOIN MetricNames AS name
+		WHERE TS BETWEEN ? AND ? AND name != '' AND (? = '' OR Tenant = ?) AND (? = '' OR Source = ?)
+		GROUP BY name
+		ORDER BY queries DESC, name
+		LIMIT ?;
+	`
+
+	rows, err := p.db.QueryContext(ctx, query, tr.From, tr.To, tenant, tenant, source, source, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	data := []MetricQueryCount{}
+	for rows.Next() {
+		var (
+			r       MetricQueryCount
+			queries uint64
+		)
+		if err := rows.Scan(&r.Name, &queries, &r.PeakSamples); err != nil {
+			return nil, fmt.Errorf("unable to scan row: %w", err)
+		}
+		r.Queries = int(queries)
+		data = append(data, r)
+	}
+
+	return data, nil
+}
+
+func (p *ClickHouseProvider) GetQueryThroughput(ctx context.Context, tr TimeRange, tenant string, source string, step time.Duration, groupBy ThroughputGroupBy) ([]ThroughputBucket, error) {
+	query := fmt.Sprintf(`
+		SELECT intDiv(toInt64(toUnixTimestamp(TS)), ?) * ? AS bucket, %s AS series, count()
+		FROM queries
+		WHERE TS BETWEEN ? AND ? AND (? = '' OR Tenant = ?) AND (? = '' OR Source = ?)
+		GROUP BY bucket, series;
+	`, groupBy.column("Tenant", "Source", "Method"))
+
+	seconds := int64(step.Seconds())
+	rows, err := p.db.QueryContext(ctx, query, seconds, seconds, tr.From, tr.To, tenant, tenant, source, source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	counts := []throughputCount{}
+	for rows.Next() {
+		var (
+			c     throughputCount
+			count uint64
+		)
+		if err := rows.Scan(&c.bucket, &c.series, &count); err != nil {
+			return nil, fmt.Errorf("unable to scan row: %w", err)
+		}
+		c.count = int(count)
+		counts = append(counts, c)
+	}
+
+	return throughputBuckets(tr, step, counts), nil
+}
+
+func (p *ClickHouseProvider) Explain(ctx context.Context, query string) (*QueryResult, error) {
+	return p.Query(ctx, "EXPLAIN "+query)
 }
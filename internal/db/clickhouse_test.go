@@ -2,7 +2,10 @@ package db
 
 import (
 	"context"
+	"database/sql/driver"
 	"fmt"
+	"regexp"
+	"strings"
 	"testing"
 	"time"
 
@@ -73,3 +76,30 @@ func TestClickhouseProvider_Query(t *testing.T) {
 		})
 	}
 }
+
+// passthroughConverter hands the arguments as is to sqlmock, as the
+// ClickHouse driver accepts slices.
+type passthroughConverter struct{}
+
+func (passthroughConverter) ConvertValue(v any) (driver.Value, error) {
+	return v, nil
+}
+
+func TestClickHouseProvider_InsertColumns(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.ValueConverterOption(passthroughConverter{}))
+	require.NoError(t, err)
+	defer db.Close()
+
+	// Every named column is given a value, whatever the order of the
+	// columns of an existing table.
+	columns := strings.Split(strings.TrimSuffix(strings.SplitN(insertClickHouseQueriesStmt, "(", 2)[1], ") VALUES "), ",")
+	args := make([]driver.Value, len(columns))
+	for i := range args {
+		args[i] = sqlmock.AnyArg()
+	}
+	mock.ExpectExec(regexp.QuoteMeta(insertClickHouseQueriesStmt)).WithArgs(args...).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	provider := &ClickHouseProvider{db: db}
+	require.NoError(t, provider.Insert(context.Background(), []Query{{TS: time.Now(), QueryParam: "up", Type: QueryTypeInstant, TotalBytes: 42}}))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
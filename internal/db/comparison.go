@@ -0,0 +1,69 @@
+package db
+
+import (
+	"context"
+	"fmt"
+)
+
+// MetricComparison compares a metric between two windows. DeltaPercent is
+// nil when the previous value is zero.
+type MetricComparison struct {
+	Current      float64  `json:"current"`
+	Previous     float64  `json:"previous"`
+	Delta        float64  `json:"delta"`
+	DeltaPercent *float64 `json:"deltaPercent"`
+}
+
+func newMetricComparison(current, previous float64) MetricComparison {
+	c := MetricComparison{
+		Current:  current,
+		Previous: previous,
+		Delta:    current - previous,
+	}
+	if previous != 0 {
+		deltaPercent := c.Delta / previous * 100
+		c.DeltaPercent = &deltaPercent
+	}
+	return c
+}
+
+// ComparisonResult compares the queries recorded in two windows, e.g. this
+// week against the previous one. Durations are in milliseconds.
+type ComparisonResult struct {
+	Current          TimeRange        `json:"current"`
+	Previous         TimeRange        `json:"previous"`
+	TotalQueries     MetricComparison `json:"totalQueries"`
+	ErrorRatePercent MetricComparison `json:"errorRatePercent"`
+	AvgDuration      MetricComparison `json:"avgDuration"`
+	P95Duration      MetricComparison `json:"p95Duration"`
+}
+
+// GetWindowComparison compares the summaries of the queries recorded in the
+// current and previous windows.
+func GetWindowComparison(ctx context.Context, p Provider, current, previous TimeRange) (*ComparisonResult, error) {
+	currentSummary, err := p.GetQueriesSummary(ctx, current.From, current.To)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get current window summary: %w", err)
+	}
+
+	previousSummary, err := p.GetQueriesSummary(ctx, previous.From, previous.To)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get previous window summary: %w", err)
+	}
+
+	return &ComparisonResult{
+		Current:          current,
+		Previous:         previous,
+		TotalQueries:     newMetricComparison(float64(currentSummary.TotalQueries), float64(previousSummary.TotalQueries)),
+		ErrorRatePercent: newMetricComparison(errorRatePercent(currentSummary), errorRatePercent(previousSummary)),
+		AvgDuration:      newMetricComparison(currentSummary.AvgDuration, previousSummary.AvgDuration),
+		P95Duration:      newMetricComparison(currentSummary.P95Duration, previousSummary.P95Duration),
+	}, nil
+}
+
+func errorRatePercent(summary *QueriesSummary) float64 {
+	if summary.TotalQueries == 0 {
+		return 0
+	}
+	return float64(summary.FailedQueries) / float64(summary.TotalQueries) * 100
+}
@@ -0,0 +1,85 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+)
+
+type dashboardSeries struct {
+	ref    DashboardRef
+	series map[string]struct{}
+}
+
+// scanDashboardSeries reads rows of (id, serie, name, url) into the set of
+// series referenced by each dashboard.
+func scanDashboardSeries(rows *sql.Rows) ([]*dashboardSeries, error) {
+	byID := make(map[string]*dashboardSeries)
+	dashboards := make([]*dashboardSeries, 0)
+
+	for rows.Next() {
+		var id, serie, name, url string
+		if err := rows.Scan(&id, &serie, &name, &url); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		d, ok := byID[id]
+		if !ok {
+			d = &dashboardSeries{
+				ref:    DashboardRef{Id: id, Name: name, URL: url},
+				series: make(map[string]struct{}),
+			}
+			byID[id] = d
+			dashboards = append(dashboards, d)
+		}
+		d.series[serie] = struct{}{}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	return dashboards, nil
+}
+
+// similarDashboards returns every pair of dashboards whose Jaccard similarity
+// of referenced series is at least threshold, most similar first.
+func similarDashboards(dashboards []*dashboardSeries, threshold float64) []SimilarDashboards {
+	results := make([]SimilarDashboards, 0)
+
+	for i := 0; i < len(dashboards); i++ {
+		for j := i + 1; j < len(dashboards); j++ {
+			a, b := dashboards[i], dashboards[j]
+
+			shared := 0
+			for serie := range a.series {
+				if _, ok := b.series[serie]; ok {
+					shared++
+				}
+			}
+
+			union := len(a.series) + len(b.series) - shared
+			if union == 0 {
+				continue
+			}
+
+			similarity := float64(shared) / float64(union)
+			if similarity < threshold {
+				continue
+			}
+
+			results = append(results, SimilarDashboards{
+				Dashboard:        a.ref,
+				SimilarDashboard: b.ref,
+				Similarity:       similarity,
+				SharedSeries:     shared,
+			})
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Similarity > results[j].Similarity
+	})
+
+	return results
+}
@@ -0,0 +1,52 @@
+package db
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetSimilarDashboards(t *testing.T) {
+	ctx := context.Background()
+
+	provider := newTestSqliteProvider(t)
+
+	usage := func(id, name string, series ...string) []DashboardUsage {
+		res := make([]DashboardUsage, 0, len(series))
+		for _, serie := range series {
+			res = append(res, DashboardUsage{Id: id, Name: name, URL: "/d/" + id, Serie: serie})
+		}
+		return res
+	}
+
+	// "node" and "node-copy" share 4 of 5 series, "node-light" shares 2 of
+	// 4 with "node", "api" shares nothing with the others.
+	require.NoError(t, provider.InsertDashboardUsage(ctx, usage("node", "Node", "node_cpu", "node_memory", "node_disk", "node_network")))
+	require.NoError(t, provider.InsertDashboardUsage(ctx, usage("node-copy", "Node (copy)", "node_cpu", "node_memory", "node_disk", "node_network", "node_load1")))
+	require.NoError(t, provider.InsertDashboardUsage(ctx, usage("node-light", "Node light", "node_cpu", "node_memory")))
+	require.NoError(t, provider.InsertDashboardUsage(ctx, usage("api", "API", "http_requests_total", "http_request_duration_seconds")))
+	// Usage pushed again must not change the referenced series.
+	require.NoError(t, provider.InsertDashboardUsage(ctx, usage("node", "Node", "node_cpu")))
+
+	similar, err := provider.GetSimilarDashboards(ctx, 0.8)
+	require.NoError(t, err)
+	require.Len(t, similar, 1)
+	assert.Equal(t, "node", similar[0].Dashboard.Id)
+	assert.Equal(t, "node-copy", similar[0].SimilarDashboard.Id)
+	assert.Equal(t, "Node (copy)", similar[0].SimilarDashboard.Name)
+	assert.Equal(t, 4, similar[0].SharedSeries)
+	assert.InDelta(t, 0.8, similar[0].Similarity, 1e-9)
+
+	similar, err = provider.GetSimilarDashboards(ctx, 0.4)
+	require.NoError(t, err)
+	require.Len(t, similar, 3)
+	assert.InDelta(t, 0.8, similar[0].Similarity, 1e-9)
+	assert.InDelta(t, 0.5, similar[1].Similarity, 1e-9)
+	assert.InDelta(t, 0.4, similar[2].Similarity, 1e-9)
+	for _, pair := range similar {
+		assert.NotEqual(t, "api", pair.Dashboard.Id)
+		assert.NotEqual(t, "api", pair.SimilarDashboard.Id)
+	}
+}
@@ -0,0 +1,50 @@
+package db
+
+import (
+	"sort"
+	"strings"
+)
+
+// categorizeError maps the error returned by the upstream for a failed
+// query to a normalized category.
+func categorizeError(message string) ErrorCategory {
+	message = strings.ToLower(message)
+
+	switch {
+	case strings.Contains(message, "many-to-many"):
+		return ErrorCategoryManyToMany
+	case strings.Contains(message, "regexp") || strings.Contains(message, "regular expression"):
+		return ErrorCategoryRegex
+	case strings.Contains(message, `"errortype":"timeout"`) ||
+		strings.Contains(message, "timed out") ||
+		strings.Contains(message, "deadline exceeded"):
+		return ErrorCategoryTimeout
+	case strings.Contains(message, `"errortype":"bad_data"`) ||
+		strings.Contains(message, "parse error"):
+		return ErrorCategoryBadData
+	default:
+		return ErrorCategoryOther
+	}
+}
+
+// errorBreakdown sums the counts of the distinct error messages per
+// category, most frequent first.
+func errorBreakdown(counts map[string]int) []ErrorBreakdownRow {
+	byCategory := make(map[ErrorCategory]int)
+	for message, count := range counts {
+		byCategory[categorizeError(message)] += count
+	}
+
+	rows := make([]ErrorBreakdownRow, 0, len(byCategory))
+	for category, count := range byCategory {
+		rows = append(rows, ErrorBreakdownRow{Category: category, Count: count})
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Count != rows[j].Count {
+			return rows[i].Count > rows[j].Count
+		}
+		return rows[i].Category < rows[j].Category
+	})
+	return rows
+}
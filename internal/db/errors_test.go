@@ -0,0 +1,55 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCategorizeError(t *testing.T) {
+	tests := []struct {
+		message  string
+		expected ErrorCategory
+	}{
+		{`{"status":"error","errorType":"execution","error":"found duplicate series for the match group {job=\"api\"} on the right hand-side of the operation: many-to-many matching not allowed"}`, ErrorCategoryManyToMany},
+		{`{"status":"error","errorType":"bad_data","error":"invalid parameter \"query\": 1:9: parse error: error parsing regexp: missing closing ]"}`, ErrorCategoryRegex},
+		{`{"status":"error","errorType":"timeout","error":"query timed out in expression evaluation"}`, ErrorCategoryTimeout},
+		{`{"status":"error","errorType":"bad_data","error":"invalid parameter \"query\": 1:4: parse error: unexpected end of input"}`, ErrorCategoryBadData},
+		{`{"status":"error","errorType":"internal","error":"something went wrong"}`, ErrorCategoryOther},
+		{``, ErrorCategoryOther},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.expected), func(t *testing.T) {
+			assert.Equal(t, tt.expected, categorizeError(tt.message))
+		})
+	}
+}
+
+func TestSQLiteProvider_GetQueryErrorBreakdown(t *testing.T) {
+	ctx := context.Background()
+	provider := newTestSqliteProvider(t)
+
+	now := time.Now()
+	queries := []Query{
+		{TS: now.Add(-time.Minute), StatusCode: 200, Type: QueryTypeInstant},
+		{TS: now.Add(-time.Minute), StatusCode: 422, Error: "many-to-many matching not allowed", Type: QueryTypeInstant},
+		{TS: now.Add(-time.Minute), StatusCode: 422, Error: "many-to-many matching not allowed: matching labels must be unique on one side", Type: QueryTypeInstant},
+		{TS: now.Add(-time.Minute), StatusCode: 400, Error: `{"errorType":"bad_data","error":"parse error"}`, Type: QueryTypeInstant},
+		{TS: now.Add(-time.Minute), StatusCode: 503, Type: QueryTypeInstant},
+		// Outside of the requested time range.
+		{TS: now.Add(-48 * time.Hour), StatusCode: 400, Error: "parse error", Type: QueryTypeInstant},
+	}
+	require.NoError(t, provider.Insert(ctx, queries))
+
+	breakdown, err := provider.GetQueryErrorBreakdown(ctx, TimeRange{From: now.Add(-time.Hour), To: now}, "", "")
+	require.NoError(t, err)
+	assert.Equal(t, []ErrorBreakdownRow{
+		{Category: ErrorCategoryManyToMany, Count: 2},
+		{Category: ErrorCategoryBadData, Count: 1},
+		{Category: ErrorCategoryOther, Count: 1},
+	}, breakdown)
+}
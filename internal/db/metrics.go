@@ -0,0 +1,95 @@
+package db
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// statsCollectTimeout bounds the time spent gathering the stats on scrape.
+	statsCollectTimeout = 10 * time.Second
+	// statsRefreshInterval is how long the stats are reused across scrapes,
+	// as counting the rows of large tables is expensive.
+	statsRefreshInterval = 5 * time.Minute
+)
+
+// statsCollector exposes the Provider stats as gauges, gathered on scrape
+// at most once per refresh interval.
+type statsCollector struct {
+	provider  Provider
+	tableRows *prometheus.Desc
+	sizeBytes *prometheus.Desc
+
+	refreshInterval time.Duration
+	now             func() time.Time
+
+	mu          sync.Mutex
+	stats       *DBStats
+	collectedAt time.Time
+}
+
+// NewStatsCollector returns a collector exposing the row count of each
+// table and the size of the store of the given provider.
+func NewStatsCollector(p Provider) prometheus.Collector {
+	return &statsCollector{
+		provider:        p,
+		refreshInterval: statsRefreshInterval,
+		now:             time.Now,
+		tableRows: prometheus.NewDesc(
+			"prom_analytics_proxy_db_table_rows",
+			"Number of rows of the analytics database tables.",
+			[]string{"table"}, nil,
+		),
+		sizeBytes: prometheus.NewDesc(
+			"prom_analytics_proxy_db_size_bytes",
+			"Estimated size on disk of the analytics database tables.",
+			nil, nil,
+		),
+	}
+}
+
+func (c *statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.tableRows
+	ch <- c.sizeBytes
+}
+
+func (c *statsCollector) Collect(ch chan<- prometheus.Metric) {
+	stats, err := c.collect()
+	if err != nil {
+		slog.Error("unable to collect database stats", "err", err)
+		ch <- prometheus.NewInvalidMetric(c.sizeBytes, err)
+		return
+	}
+
+	for table, rows := range stats.TableRows {
+		ch <- prometheus.MustNewConstMetric(c.tableRows, prometheus.GaugeValue, float64(rows), table)
+	}
+	ch <- prometheus.MustNewConstMetric(c.sizeBytes, prometheus.GaugeValue, float64(stats.SizeBytes))
+}
+
+// collect returns the stats gathered within the refresh interval, gathering
+// them again once they are older. Concurrent scrapes wait for a single
+// gathering.
+func (c *statsCollector) collect() (*DBStats, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stats != nil && c.now().Sub(c.collectedAt) < c.refreshInterval {
+		return c.stats, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), statsCollectTimeout)
+	defer cancel()
+
+	stats, err := c.provider.Stats(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.stats = stats
+	c.collectedAt = c.now()
+	return stats, nil
+}
@@ -0,0 +1,73 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type statsProvider struct {
+	Provider
+	stats *DBStats
+	err   error
+	calls int
+}
+
+func (p *statsProvider) Stats(ctx context.Context) (*DBStats, error) {
+	p.calls++
+	return p.stats, p.err
+}
+
+func TestStatsCollector(t *testing.T) {
+	collector := NewStatsCollector(&statsProvider{stats: &DBStats{
+		TableRows: map[string]int64{"queries": 42, "RulesUsage": 3, "DashboardUsage": 1},
+		SizeBytes: 4096,
+	}})
+
+	expected := `
+# HELP prom_analytics_proxy_db_size_bytes Estimated size on disk of the analytics database tables.
+# TYPE prom_analytics_proxy_db_size_bytes gauge
+prom_analytics_proxy_db_size_bytes 4096
+# HELP prom_analytics_proxy_db_table_rows Number of rows of the analytics database tables.
+# TYPE prom_analytics_proxy_db_table_rows gauge
+prom_analytics_proxy_db_table_rows{table="DashboardUsage"} 1
+prom_analytics_proxy_db_table_rows{table="RulesUsage"} 3
+prom_analytics_proxy_db_table_rows{table="queries"} 42
+`
+	require.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected)))
+}
+
+func TestStatsCollector_Error(t *testing.T) {
+	collector := NewStatsCollector(&statsProvider{err: errors.New("database is locked")})
+	_, err := testutil.CollectAndLint(collector)
+	assert.Error(t, err)
+}
+
+func TestStatsCollector_Refresh(t *testing.T) {
+	provider := &statsProvider{stats: &DBStats{TableRows: map[string]int64{"queries": 42}}}
+	now := time.Now()
+	collector := NewStatsCollector(provider).(*statsCollector)
+	collector.now = func() time.Time { return now }
+
+	// The rows are only counted again once the refresh interval elapsed.
+	for range 3 {
+		assert.Equal(t, 2, testutil.CollectAndCount(collector))
+	}
+	assert.Equal(t, 1, provider.calls)
+
+	provider.stats = &DBStats{TableRows: map[string]int64{"queries": 43}}
+	now = now.Add(statsRefreshInterval)
+	expected := `
+# HELP prom_analytics_proxy_db_table_rows Number of rows of the analytics database tables.
+# TYPE prom_analytics_proxy_db_table_rows gauge
+prom_analytics_proxy_db_table_rows{table="queries"} 43
+`
+	require.NoError(t, testutil.CollectAndCompare(collector, strings.NewReader(expected), "prom_analytics_proxy_db_table_rows"))
+	assert.Equal(t, 2, provider.calls)
+}
@@ -0,0 +1,53 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// The kinds of the rows counting the dashboards and the queries using a
+// metric, the rules being counted by their own kind.
+const (
+	metricStatisticsQueryKind     = "query"
+	metricStatisticsDashboardKind = "dashboard"
+)
+
+// scanMetricStatistics folds the serie, kind and count rows returned by the
+// databases into the statistics of each metric, the metrics without usage
+// being reported as well.
+func scanMetricStatistics(rows *sql.Rows, names []string) (map[string]MetricUsageStatistics, error) {
+	data := make(map[string]MetricUsageStatistics, len(names))
+	for _, name := range names {
+		data[name] = MetricUsageStatistics{}
+	}
+
+	for rows.Next() {
+		var (
+			name, kind string
+			count      int
+		)
+		if err := rows.Scan(&name, &kind, &count); err != nil {
+			return nil, fmt.Errorf("unable to scan row: %w", err)
+		}
+		stats, ok := data[name]
+		if !ok {
+			continue
+		}
+		switch kind {
+		case string(RuleUsageKindAlert):
+			stats.Alerts = count
+		case string(RuleUsageKindRecord):
+			stats.Records = count
+		case metricStatisticsDashboardKind:
+			stats.Dashboards = count
+		case metricStatisticsQueryKind:
+			stats.Queries = count
+		}
+		data[name] = stats
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read rows: %w", err)
+	}
+
+	return data, nil
+}
@@ -1,6 +1,12 @@
 package db
 
 import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
 	"time"
 )
 
@@ -13,6 +19,7 @@ const (
 	ClickHouse       DatabaseProvider = "clickhouse"
 	PostGreSQL       DatabaseProvider = "postgresql"
 	SQLite           DatabaseProvider = "sqlite"
+	None             DatabaseProvider = "none"
 )
 
 type LabelMatchers []map[string]string
@@ -22,9 +29,13 @@ type Query struct {
 	QueryParam            string
 	TimeParam             time.Time
 	Duration              time.Duration
+	UpstreamDuration      time.Duration
 	StatusCode            int
+	ResultStatus          string
 	BodySize              int
+	TotalBytes            int
 	LabelMatchers         LabelMatchers
+	MetricNames           []string
 	Fingerprint           string
 	Type                  QueryType
 	Step                  float64
@@ -32,8 +43,28 @@ type Query struct {
 	End                   time.Time
 	TotalQueryableSamples int
 	PeakSamples           int
+	Cached                bool
+	Error                 string
+	Tenant                string
+	SourceIP              string
+	Method                string
+	Source                QuerySource
+	DashboardUID          string
 }
 
+// QueryResultStatusError is the result status of the queries whose response
+// body reported an error, which may come with a 200 status code.
+const QueryResultStatusError = "error"
+
+// Failed reports whether the query failed, either with an error status code
+// or with an error result status.
+func (q Query) Failed() bool {
+	return q.StatusCode >= 400 || q.ResultStatus == QueryResultStatusError
+}
+
+// failedQueryCondition matches the failed queries, see Query.Failed.
+const failedQueryCondition = "(statusCode >= 400 OR resultStatus = '" + QueryResultStatusError + "')"
+
 type QueryResult struct {
 	Columns []string                 `json:"columns"`
 	Data    []map[string]interface{} `json:"data"`
@@ -47,15 +78,104 @@ type QueryShortCut struct {
 type PagedResult struct {
 	TotalPages int         `json:"totalPages"`
 	Total      int         `json:"total"`
+	Page       int         `json:"page"`
+	PageSize   int         `json:"pageSize"`
+	HasNext    bool        `json:"hasNext"`
 	Data       interface{} `json:"data"`
 }
 
+// newPagedResult wraps the page of data read at offset along with the
+// pagination metadata. A negative offset is treated as zero, as the
+// databases do.
+func newPagedResult(data interface{}, total, page, pageSize, offset int) *PagedResult {
+	totalPages := 0
+	if pageSize > 0 {
+		totalPages = int(math.Ceil(float64(total) / float64(pageSize)))
+	}
+	return &PagedResult{
+		TotalPages: totalPages,
+		Total:      total,
+		Page:       page,
+		PageSize:   pageSize,
+		HasNext:    max(offset, 0)+pageSize < total,
+		Data:       data,
+	}
+}
+
 type QueriesBySerieNameResult struct {
-	QueryParam      string    `json:"queryParam"`
-	AvgDuration     float64   `json:"avgDuration"`
-	AvgPeakySamples float64   `json:"avgPeakySamples"`
-	MaxPeakSamples  int       `json:"maxPeakSamples"`
-	TS              time.Time `json:"ts"`
+	QueryParam       string    `json:"queryParam"`
+	AvgDuration      float64   `json:"avgDuration"`
+	AvgPeakySamples  float64   `json:"avgPeakySamples"`
+	MaxPeakSamples   int       `json:"maxPeakSamples"`
+	Executions       int       `json:"executions"`
+	ErrorRatePercent float64   `json:"errorRatePercent"`
+	TS               time.Time `json:"ts"`
+}
+
+// DefaultSerieQueriesSortBy is the field the queries of a serie are sorted
+// by when none is given.
+const DefaultSerieQueriesSortBy = "avgDuration"
+
+// serieQueriesSortFields lists the fields of QueriesBySerieNameResult the
+// queries of a serie can be sorted by. The providers alias their columns
+// with these names.
+var serieQueriesSortFields = map[string]struct{}{
+	"queryParam":       {},
+	"avgDuration":      {},
+	"avgPeakySamples":  {},
+	"maxPeakSamples":   {},
+	"executions":       {},
+	"errorRatePercent": {},
+}
+
+// IsValidSerieQueriesSort reports whether the queries of a serie can be
+// sorted by the given field and order.
+func IsValidSerieQueriesSort(sortBy, sortOrder string) bool {
+	_, ok := serieQueriesSortFields[sortBy]
+	return ok && (strings.EqualFold(sortOrder, "asc") || strings.EqualFold(sortOrder, "desc"))
+}
+
+// serieQueriesOrderBy returns the ORDER BY clause sorting the queries of a
+// serie, falling back to the slowest first for an invalid sort. Ties are
+// broken by the query so pages are stable.
+func serieQueriesOrderBy(sortBy, sortOrder string) string {
+	if !IsValidSerieQueriesSort(sortBy, sortOrder) {
+		sortBy, sortOrder = DefaultSerieQueriesSortBy, "desc"
+	}
+	orderBy := sortBy + " " + strings.ToUpper(sortOrder)
+	if sortBy != "queryParam" {
+		orderBy += ", queryParam ASC"
+	}
+	return orderBy
+}
+
+type QueriesSummary struct {
+	TotalQueries  int     `json:"totalQueries"`
+	FailedQueries int     `json:"failedQueries"`
+	AvgDuration   float64 `json:"avgDuration"` // milliseconds
+	P95Duration   float64 `json:"p95Duration"` // milliseconds
+}
+
+// QuerySource tells whether a query was sent by a user or by a rule
+// evaluator, such as the Thanos ruler or vmalert.
+type QuerySource string
+
+const (
+	QuerySourceUser QuerySource = "user"
+	QuerySourceRule QuerySource = "rule"
+)
+
+// IsValidQuerySource reports whether source is a known query source.
+func IsValidQuerySource(source string) bool {
+	return source == string(QuerySourceUser) || source == string(QuerySourceRule)
+}
+
+// orDefault attributes the queries of unknown source to users.
+func (s QuerySource) orDefault() string {
+	if s == "" {
+		return string(QuerySourceUser)
+	}
+	return string(s)
 }
 
 type RuleUsageKind string
@@ -82,3 +202,166 @@ type DashboardUsage struct {
 	URL       string    `json:"url"`
 	CreatedAt time.Time `json:"created_at"`
 }
+
+type DashboardRef struct {
+	Id   string `json:"id"`
+	Name string `json:"title"`
+	URL  string `json:"url"`
+}
+
+type SimilarDashboards struct {
+	Dashboard        DashboardRef `json:"dashboard"`
+	SimilarDashboard DashboardRef `json:"similarDashboard"`
+	Similarity       float64      `json:"similarity"`
+	SharedSeries     int          `json:"sharedSeries"`
+}
+
+type TopQuery struct {
+	Fingerprint string  `json:"fingerprint"`
+	QueryParam  string  `json:"queryParam"`
+	Executions  int     `json:"executions"`
+	AvgDuration float64 `json:"avgDuration"` // milliseconds
+}
+
+type TimeRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// Previous returns the window of the same length immediately preceding tr.
+// It ends right before tr starts, as the databases include both bounds of a
+// time range, with a microsecond precision at best.
+func (tr TimeRange) Previous() TimeRange {
+	return TimeRange{From: tr.From.Add(-tr.To.Sub(tr.From)), To: tr.From.Add(-time.Microsecond)}
+}
+
+type SlowQueryRow struct {
+	ID          int64     `json:"id,omitempty"`
+	TS          time.Time `json:"ts"`
+	QueryParam  string    `json:"queryParam"`
+	Duration    int64     `json:"duration"` // milliseconds
+	StatusCode  int       `json:"statusCode"`
+	PeakSamples int       `json:"peakSamples"`
+	Fingerprint string    `json:"fingerprint"`
+}
+
+// QueryExecutionDetail is everything recorded about a single query
+// execution. Durations are in milliseconds.
+type QueryExecutionDetail struct {
+	ID                    int64         `json:"id"`
+	TS                    time.Time     `json:"ts"`
+	QueryParam            string        `json:"queryParam"`
+	Type                  QueryType     `json:"type"`
+	TimeParam             time.Time     `json:"timeParam"`
+	Start                 time.Time     `json:"start"`
+	End                   time.Time     `json:"end"`
+	Step                  float64       `json:"step"`
+	Duration              int64         `json:"duration"`
+	UpstreamDuration      int64         `json:"upstreamDuration"`
+	StatusCode            int           `json:"statusCode"`
+	ResultStatus          string        `json:"resultStatus,omitempty"`
+	Error                 string        `json:"error"`
+	BodySize              int           `json:"bodySize"`
+	TotalBytes            int           `json:"totalBytes"`
+	TotalQueryableSamples int           `json:"totalQueryableSamples"`
+	PeakSamples           int           `json:"peakSamples"`
+	Cached                bool          `json:"cached"`
+	LabelMatchers         LabelMatchers `json:"labelMatchers"`
+	Fingerprint           string        `json:"fingerprint"`
+	Tenant                string        `json:"tenant"`
+	SourceIP              string        `json:"sourceIP"`
+	Method                string        `json:"method"`
+	Source                QuerySource   `json:"source"`
+	DashboardUID          string        `json:"dashboardUID,omitempty"`
+}
+
+// nullString stores empty strings as NULL.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+// queryExecutionDetailColumns are the columns scanned by
+// scanQueryExecutionDetail, the id of the row coming first.
+const queryExecutionDetailColumns = `
+	ts, queryParam, type, timeParam, start, "end", step, duration, COALESCE(upstreamDuration, 0),
+	statusCode, COALESCE(error, ''), bodySize, totalBytes, totalQueryableSamples, peakSamples, cached,
+	labelMatchers, fingerprint, COALESCE(tenant, ''), COALESCE(sourceIP, ''), COALESCE(method, ''), source,
+	COALESCE(dashboardUID, ''), COALESCE(resultStatus, '')`
+
+func scanQueryExecutionDetail(row *sql.Row) (*QueryExecutionDetail, error) {
+	var (
+		d             QueryExecutionDetail
+		labelMatchers []byte
+	)
+	err := row.Scan(&d.ID, &d.TS, &d.QueryParam, &d.Type, &d.TimeParam, &d.Start, &d.End, &d.Step, &d.Duration, &d.UpstreamDuration,
+		&d.StatusCode, &d.Error, &d.BodySize, &d.TotalBytes, &d.TotalQueryableSamples, &d.PeakSamples, &d.Cached,
+		&labelMatchers, &d.Fingerprint, &d.Tenant, &d.SourceIP, &d.Method, &d.Source, &d.DashboardUID, &d.ResultStatus)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to scan query execution: %w", err)
+	}
+
+	if len(labelMatchers) > 0 {
+		if err := json.Unmarshal(labelMatchers, &d.LabelMatchers); err != nil {
+			return nil, fmt.Errorf("unable to unmarshal label matchers: %w", err)
+		}
+	}
+	return &d, nil
+}
+
+// DBStats reports how much the analytics store has grown.
+type DBStats struct {
+	// TableRows holds the number of rows of each table.
+	TableRows map[string]int64 `json:"tableRows"`
+	// SizeBytes estimates the size of the tables on disk.
+	SizeBytes int64 `json:"sizeBytes"`
+}
+
+// SourceIPStats aggregates the queries sent by a single client IP.
+type SourceIPStats struct {
+	IP        string  `json:"ip"`
+	Queries   int     `json:"queries"`
+	Errors    int     `json:"errors"`
+	ErrorRate float64 `json:"errorRate"`
+}
+
+// MetricQueryCount aggregates the queries selecting a single metric.
+type MetricQueryCount struct {
+	Name        string `json:"name"`
+	Queries     int    `json:"queries"`
+	PeakSamples int64  `json:"peakSamples"`
+}
+
+// MetricUsageStatistics counts the distinct alerts, recording rules,
+// dashboards and queries using a metric.
+type MetricUsageStatistics struct {
+	Alerts     int `json:"alerts"`
+	Records    int `json:"records"`
+	Dashboards int `json:"dashboards"`
+	Queries    int `json:"queries"`
+}
+
+type LatencyRegression struct {
+	Fingerprint string  `json:"fingerprint"`
+	QueryParam  string  `json:"queryParam"`
+	CurrentP95  float64 `json:"currentP95"`  // milliseconds
+	BaselineP95 float64 `json:"baselineP95"` // milliseconds
+	Ratio       float64 `json:"ratio"`
+}
+
+type ErrorCategory string
+
+const (
+	ErrorCategoryBadData    ErrorCategory = "bad_data"
+	ErrorCategoryManyToMany ErrorCategory = "many-to-many"
+	ErrorCategoryRegex      ErrorCategory = "regex"
+	ErrorCategoryTimeout    ErrorCategory = "timeout"
+	ErrorCategoryOther      ErrorCategory = "other"
+)
+
+type ErrorBreakdownRow struct {
+	Category ErrorCategory `json:"category"`
+	Count    int           `json:"count"`
+}
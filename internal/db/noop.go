@@ -0,0 +1,120 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// NoopProvider discards every write and answers reads with empty results,
+// allowing the proxy to run without any analytics storage.
+type NoopProvider struct{}
+
+func init() {
+	RegisterProvider(None, newNoopProvider)
+}
+
+func newNoopProvider(_ context.Context) (Provider, error) {
+	return &NoopProvider{}, nil
+}
+
+func (p *NoopProvider) WithDB(f func(db *sql.DB)) {}
+
+func (p *NoopProvider) Close() error {
+	return nil
+}
+
+func (p *NoopProvider) Stats(ctx context.Context) (*DBStats, error) {
+	return &DBStats{TableRows: map[string]int64{}}, nil
+}
+
+func (p *NoopProvider) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (p *NoopProvider) Insert(ctx context.Context, queries []Query) error {
+	return nil
+}
+
+func (p *NoopProvider) Query(ctx context.Context, query string) (*QueryResult, error) {
+	return &QueryResult{
+		Columns: []string{},
+		Data:    []map[string]interface{}{},
+	}, nil
+}
+
+func (p *NoopProvider) QueryShortCuts() []QueryShortCut {
+	return []QueryShortCut{}
+}
+
+func (p *NoopProvider) GetQueriesBySerieName(ctx context.Context, serieName string, page int, pageSize int, sortBy string, sortOrder string) (*PagedResult, error) {
+	return newPagedResult([]QueriesBySerieNameResult{}, 0, page, pageSize, 0), nil
+}
+
+func (p *NoopProvider) InsertRulesUsage(ctx context.Context, rulesUsage []RulesUsage) error {
+	return nil
+}
+
+func (p *NoopProvider) GetRulesUsage(ctx context.Context, serie string, kind string, page int, pageSize int) (*PagedResult, error) {
+	return newPagedResult([]RulesUsage{}, 0, page, pageSize, 0), nil
+}
+
+func (p *NoopProvider) InsertDashboardUsage(ctx context.Context, dashboardUsage []DashboardUsage) error {
+	return nil
+}
+
+func (p *NoopProvider) GetDashboardUsage(ctx context.Context, serieName string, page int, pageSize int) (*PagedResult, error) {
+	return newPagedResult([]DashboardUsage{}, 0, page, pageSize, 0), nil
+}
+
+func (p *NoopProvider) GetQueriesSummary(ctx context.Context, startTime, endTime time.Time) (*QueriesSummary, error) {
+	return &QueriesSummary{}, nil
+}
+
+func (p *NoopProvider) DeleteQueriesBefore(ctx context.Context, cutoff time.Time, filter QueryFilter) (int64, error) {
+	return 0, nil
+}
+
+func (p *NoopProvider) GetSimilarDashboards(ctx context.Context, threshold float64) ([]SimilarDashboards, error) {
+	return []SimilarDashboards{}, nil
+}
+
+func (p *NoopProvider) GetTopQueries(ctx context.Context, startTime, endTime time.Time, limit int) ([]TopQuery, error) {
+	return []TopQuery{}, nil
+}
+
+func (p *NoopProvider) GetSlowestQueries(ctx context.Context, tr TimeRange, tenant string, source string, limit int) ([]SlowQueryRow, error) {
+	return []SlowQueryRow{}, nil
+}
+
+func (p *NoopProvider) GetLatencyRegressions(ctx context.Context, currentWindow, baselineWindow time.Duration, factor float64) ([]LatencyRegression, error) {
+	return []LatencyRegression{}, nil
+}
+
+func (p *NoopProvider) GetQueryExecutionDetail(ctx context.Context, id int64) (*QueryExecutionDetail, error) {
+	return nil, ErrNotFound
+}
+
+func (p *NoopProvider) GetQueryErrorBreakdown(ctx context.Context, tr TimeRange, tenant string, source string) ([]ErrorBreakdownRow, error) {
+	return []ErrorBreakdownRow{}, nil
+}
+
+func (p *NoopProvider) GetQueriesByIP(ctx context.Context, tr TimeRange, tenant string, source string, limit int) ([]SourceIPStats, error) {
+	return []SourceIPStats{}, nil
+}
+
+func (p *NoopProvider) GetMetricStatisticsBatch(ctx context.Context, names []string, tr TimeRange) (map[string]MetricUsageStatistics, error) {
+	return map[string]MetricUsageStatistics{}, nil
+}
+
+func (p *NoopProvider) GetTopQueriedMetrics(ctx context.Context, tr TimeRange, tenant string, source string, limit int) ([]MetricQueryCount, error) {
+	return []MetricQueryCount{}, nil
+}
+
+func (p *NoopProvider) GetQueryThroughput(ctx context.Context, tr TimeRange, tenant string, source string, step time.Duration, groupBy ThroughputGroupBy) ([]ThroughputBucket, error) {
+	return []ThroughputBucket{}, nil
+}
+
+func (p *NoopProvider) Explain(ctx context.Context, query string) (*QueryResult, error) {
+	return p.Query(ctx, query)
+}
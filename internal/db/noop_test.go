@@ -0,0 +1,46 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNoopProvider(t *testing.T) {
+	ctx := context.Background()
+
+	provider, err := GetDbProvider(ctx, None)
+	require.NoError(t, err)
+	defer provider.Close()
+
+	err = provider.Insert(ctx, []Query{{TS: time.Now(), QueryParam: "up"}})
+	assert.NoError(t, err)
+
+	result, err := provider.Query(ctx, "SELECT * FROM queries")
+	require.NoError(t, err)
+	assert.Empty(t, result.Columns)
+	assert.Empty(t, result.Data)
+
+	queries, err := provider.GetQueriesBySerieName(ctx, "up", 1, 10, DefaultSerieQueriesSortBy, "desc")
+	require.NoError(t, err)
+	assert.Zero(t, queries.Total)
+	assert.Equal(t, 1, queries.Page)
+	assert.Equal(t, 10, queries.PageSize)
+	assert.False(t, queries.HasNext)
+	assert.Empty(t, queries.Data)
+
+	assert.NoError(t, provider.InsertRulesUsage(ctx, []RulesUsage{{Serie: "up"}}))
+	rules, err := provider.GetRulesUsage(ctx, "up", string(RuleUsageKindAlert), 1, 10)
+	require.NoError(t, err)
+	assert.Zero(t, rules.Total)
+	assert.Empty(t, rules.Data)
+
+	assert.NoError(t, provider.InsertDashboardUsage(ctx, []DashboardUsage{{Serie: "up"}}))
+	dashboards, err := provider.GetDashboardUsage(ctx, "up", 1, 10)
+	require.NoError(t, err)
+	assert.Zero(t, dashboards.Total)
+	assert.Empty(t, dashboards.Data)
+}
@@ -4,14 +4,15 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"math"
+	"log/slog"
 	"os"
 	"sync"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/nicolastakashi/prom-analytics-proxy/internal/config"
 	"github.com/uptrace/opentelemetry-go-extra/otelsql"
 	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
@@ -20,17 +21,31 @@ import (
 type PostGreSQLProvider struct {
 	mu sync.RWMutex
 	db *sql.DB
+
+	partitioned    bool
+	stopPartitions context.CancelFunc
+	partitionsDone chan struct{}
+
+	// usageLookback is how far back the rules and dashboards usage and the
+	// queries of a serie are looked up.
+	usageLookback time.Duration
 }
 
 const (
-	createPostgresTableStmt = `
-		CREATE TABLE IF NOT EXISTS queries (
+	createPostgresTableStmt = `CREATE TABLE IF NOT EXISTS queries (` + postgresQueriesColumns + `);`
+
+	// createPostgresPartitionedTableStmt creates the queries table
+	// partitioned by month on ts, see createPostgresPartitions.
+	createPostgresPartitionedTableStmt = `CREATE TABLE IF NOT EXISTS queries (` + postgresQueriesColumns + `) PARTITION BY RANGE (ts);`
+
+	postgresQueriesColumns = `
 			ts TIMESTAMP,
 			queryParam TEXT,
 			timeParam TIMESTAMP,
 			duration BIGINT,
 			statusCode SMALLINT,
 			bodySize INTEGER,
+			totalBytes INTEGER,
 			fingerprint TEXT,
 			labelMatchers JSONB,
 			type TEXT,
@@ -38,8 +53,19 @@ const (
 			start TIMESTAMP,
 			"end" TIMESTAMP,
 			totalQueryableSamples INTEGER,
-			peakSamples INTEGER
-		);`
+			peakSamples INTEGER,
+			cached BOOLEAN,
+			error TEXT,
+			tenant TEXT,
+			sourceIP TEXT,
+			metricNames JSONB,
+			upstreamDuration BIGINT,
+			method TEXT,
+			source TEXT NOT NULL DEFAULT 'user',
+			id BIGSERIAL,
+			dashboardUID TEXT,
+			resultStatus TEXT
+		`
 
 	createPostgresRulesUsageTableStmt = `
 		CREATE TABLE IF NOT EXISTS RulesUsage (
@@ -62,6 +88,10 @@ const (
 		);`
 )
 
+func init() {
+	RegisterProvider(PostGreSQL, newPostGreSQLProvider)
+}
+
 func RegisterPostGreSQLFlags(flagSet *flag.FlagSet) {
 	flagSet.DurationVar(&config.DefaultConfig.Database.PostgreSQL.DialTimeout, "postgresql-dial-timeout", 5*time.Second, "Timeout to dial postgresql.")
 	flagSet.StringVar(&config.DefaultConfig.Database.PostgreSQL.Addr, "postgresql-addr", "localhost", "Address of the postgresql server.")
@@ -70,6 +100,7 @@ func RegisterPostGreSQLFlags(flagSet *flag.FlagSet) {
 	flagSet.StringVar(&config.DefaultConfig.Database.PostgreSQL.Password, "postgresql-password", os.Getenv("POSTGRESQL_PASSWORD"), "Password for the postgresql server, can also be set via POSTGRESQL_PASSWORD env var.")
 	flagSet.StringVar(&config.DefaultConfig.Database.PostgreSQL.Database, "postgresql-database", os.Getenv("POSTGRESQL_DATABASE"), "Database for the postgresql server, can also be set via POSTGRESQL_DATABASE env var.")
 	flagSet.StringVar(&config.DefaultConfig.Database.PostgreSQL.SSLMode, "postgresql-sslmode", "disable", "SSL mode for the postgresql server.")
+	flagSet.StringVar(&config.DefaultConfig.Database.PostgreSQL.Partitioning, "postgresql-partitioning", PostgreSQLPartitioningOff, "Partitioning of the queries table by time, expired partitions being dropped instead of deleting their queries. Supported values: off, monthly. An existing table is partitioned in place and stays partitioned when turned off again.")
 }
 
 func newPostGreSQLProvider(ctx context.Context) (Provider, error) {
@@ -78,6 +109,20 @@ func newPostGreSQLProvider(ctx context.Context) (Provider, error) {
 	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s "+"password=%s dbname=%s sslmode=disable",
 		postgresConfig.Addr, postgresConfig.Port, postgresConfig.User, postgresConfig.Password, postgresConfig.Database)
 
+	// The schema is set up before the statement timeout applies, as adding a
+	// column or an index to a large table may take much longer than any
+	// analytics query.
+	partitioned := postgresConfig.Partitioning == PostgreSQLPartitioningMonthly
+	if err := setupPostgresSchema(ctx, psqlInfo, partitioned); err != nil {
+		return nil, err
+	}
+
+	// Bound every statement on the server side as well, so a query is
+	// cancelled even when the client stops waiting for it.
+	if timeout := config.DefaultConfig.Database.QueryTimeout; timeout > 0 {
+		psqlInfo += fmt.Sprintf(" statement_timeout=%d", timeout.Milliseconds())
+	}
+
 	db, err := otelsql.Open("postgres", psqlInfo, otelsql.WithAttributes(semconv.DBSystemPostgreSQL))
 	if err != nil {
 		return nil, fmt.Errorf("failed to open postgresql connection: %w", err)
@@ -87,21 +132,228 @@ func newPostGreSQLProvider(ctx context.Context) (Provider, error) {
 		return nil, fmt.Errorf("failed to ping postgresql: %w", err)
 	}
 
-	if _, err := db.ExecContext(ctx, createPostgresTableStmt); err != nil {
-		return nil, fmt.Errorf("failed to create table: %w", err)
+	p := &PostGreSQLProvider{
+		db:            db,
+		partitioned:   partitioned,
+		usageLookback: usageLookbackOrDefault(config.DefaultConfig.Analytics.UsageLookback),
+	}
+	if partitioned {
+		partitionsCtx, cancel := context.WithCancel(context.Background())
+		p.stopPartitions = cancel
+		p.partitionsDone = make(chan struct{})
+		go p.maintainPartitions(partitionsCtx)
+	}
+
+	return p, nil
+}
+
+// setupPostgresSchema creates the tables and indexes, migrating the tables
+// created by earlier releases, on a connection without statement timeout.
+func setupPostgresSchema(ctx context.Context, psqlInfo string, partitioned bool) error {
+	db, err := otelsql.Open("postgres", psqlInfo, otelsql.WithAttributes(semconv.DBSystemPostgreSQL))
+	if err != nil {
+		return fmt.Errorf("failed to open postgresql connection: %w", err)
+	}
+	defer db.Close()
+
+	if err := db.PingContext(ctx); err != nil {
+		return fmt.Errorf("failed to ping postgresql: %w", err)
+	}
+
+	createTableStmt := createPostgresTableStmt
+	if partitioned {
+		createTableStmt = createPostgresPartitionedTableStmt
+	}
+	if _, err := db.ExecContext(ctx, createTableStmt); err != nil {
+		return fmt.Errorf("failed to create table: %w", err)
+	}
+
+	if _, err := db.ExecContext(ctx, "ALTER TABLE queries ADD COLUMN IF NOT EXISTS totalBytes INTEGER"); err != nil {
+		return fmt.Errorf("failed to add total bytes column: %w", err)
+	}
+
+	if _, err := db.ExecContext(ctx, "ALTER TABLE queries ADD COLUMN IF NOT EXISTS cached BOOLEAN"); err != nil {
+		return fmt.Errorf("failed to add cached column: %w", err)
+	}
+
+	if _, err := db.ExecContext(ctx, "ALTER TABLE queries ADD COLUMN IF NOT EXISTS error TEXT"); err != nil {
+		return fmt.Errorf("failed to add error column: %w", err)
+	}
+
+	if _, err := db.ExecContext(ctx, "ALTER TABLE queries ADD COLUMN IF NOT EXISTS tenant TEXT"); err != nil {
+		return fmt.Errorf("failed to add tenant column: %w", err)
+	}
+
+	if _, err := db.ExecContext(ctx, "ALTER TABLE queries ADD COLUMN IF NOT EXISTS sourceIP TEXT"); err != nil {
+		return fmt.Errorf("failed to add source ip column: %w", err)
+	}
+
+	if err := migratePostgresMetricNames(ctx, db); err != nil {
+		return err
+	}
+
+	// Left empty for the existing rows, whose upstream latency is unknown.
+	if _, err := db.ExecContext(ctx, "ALTER TABLE queries ADD COLUMN IF NOT EXISTS upstreamDuration BIGINT"); err != nil {
+		return fmt.Errorf("failed to add upstream duration column: %w", err)
+	}
+
+	if _, err := db.ExecContext(ctx, "ALTER TABLE queries ADD COLUMN IF NOT EXISTS method TEXT"); err != nil {
+		return fmt.Errorf("failed to add method column: %w", err)
+	}
+
+	// The existing rows are attributed to users.
+	if _, err := db.ExecContext(ctx, "ALTER TABLE queries ADD COLUMN IF NOT EXISTS source TEXT NOT NULL DEFAULT 'user'"); err != nil {
+		return fmt.Errorf("failed to add source column: %w", err)
+	}
+
+	// Numbers the existing rows as well, so every execution can be looked up.
+	if _, err := db.ExecContext(ctx, "ALTER TABLE queries ADD COLUMN IF NOT EXISTS id BIGSERIAL"); err != nil {
+		return fmt.Errorf("failed to add id column: %w", err)
+	}
+
+	if !partitioned {
+		if _, err := db.ExecContext(ctx, "CREATE UNIQUE INDEX IF NOT EXISTS queries_id_idx ON queries (id)"); err != nil {
+			return fmt.Errorf("failed to create id index: %w", err)
+		}
+	}
+
+	if _, err := db.ExecContext(ctx, "ALTER TABLE queries ADD COLUMN IF NOT EXISTS dashboardUID TEXT"); err != nil {
+		return fmt.Errorf("failed to add dashboard uid column: %w", err)
+	}
+
+	// Left empty for the existing rows, whose failures are told by their
+	// status code only.
+	if _, err := db.ExecContext(ctx, "ALTER TABLE queries ADD COLUMN IF NOT EXISTS resultStatus TEXT"); err != nil {
+		return fmt.Errorf("failed to add result status column: %w", err)
+	}
+
+	if partitioned {
+		if err := partitionPostgresQueries(ctx, db, time.Now()); err != nil {
+			return err
+		}
+		if _, err := db.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS queries_id_idx ON queries (id)"); err != nil {
+			return fmt.Errorf("failed to create id index: %w", err)
+		}
+		if err := createPostgresPartitions(ctx, db, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	if err := createPostgresQueriesIndexes(ctx, db, partitioned); err != nil {
+		return err
 	}
 
 	if _, err := db.ExecContext(ctx, createPostgresRulesUsageTableStmt); err != nil {
-		return nil, fmt.Errorf("failed to create rules usage table: %w", err)
+		return fmt.Errorf("failed to create rules usage table: %w", err)
 	}
 
 	if _, err := db.ExecContext(ctx, createPostgresDashboardUsageTableStmt); err != nil {
-		return nil, fmt.Errorf("failed to create dashboard usage table: %w", err)
+		return fmt.Errorf("failed to create dashboard usage table: %w", err)
 	}
 
-	return &PostGreSQLProvider{
-		db: db,
-	}, nil
+	return nil
+}
+
+// postgresQueriesIndexes index the columns the analytics filter on. The GIN
+// indexes serve the containment filters on the label matchers and on the
+// metric names extracted from them.
+var postgresQueriesIndexes = []struct {
+	name, definition string
+}{
+	{"queries_ts_idx", "(ts)"},
+	{"queries_fingerprint_ts_idx", "(fingerprint, ts)"},
+	{"queries_type_ts_idx", "(type, ts)"},
+	{"queries_label_matchers_idx", "USING GIN (labelMatchers jsonb_path_ops)"},
+	{"queries_metric_names_idx", "USING GIN (metricNames jsonb_path_ops)"},
+}
+
+// createPostgresQueriesIndexes creates the missing queries indexes. They are
+// built concurrently on a table which is not partitioned, so the queries
+// keep being inserted while a large table is indexed, and an index left
+// invalid by an interrupted build is built again. PostgreSQL cannot build
+// the indexes of a partitioned table concurrently; created on it, they are
+// created on every partition as well.
+func createPostgresQueriesIndexes(ctx context.Context, db *sql.DB, partitioned bool) error {
+	for _, index := range postgresQueriesIndexes {
+		if partitioned {
+			if _, err := db.ExecContext(ctx, "CREATE INDEX IF NOT EXISTS "+index.name+" ON queries "+index.definition); err != nil {
+				return fmt.Errorf("failed to create index %s: %w", index.name, err)
+			}
+			continue
+		}
+
+		var valid bool
+		err := db.QueryRowContext(ctx, `
+			SELECT i.indisvalid FROM pg_index i
+			JOIN pg_class c ON c.oid = i.indexrelid
+			JOIN pg_namespace n ON n.oid = c.relnamespace
+			WHERE n.nspname = current_schema() AND c.relname = $1
+		`, index.name).Scan(&valid)
+		switch {
+		case err == nil && valid:
+			continue
+		case err == nil:
+			slog.Warn("rebuilding invalid index", "index", index.name)
+			if _, err := db.ExecContext(ctx, "DROP INDEX CONCURRENTLY IF EXISTS "+index.name); err != nil {
+				return fmt.Errorf("failed to drop invalid index %s: %w", index.name, err)
+			}
+		case !errors.Is(err, sql.ErrNoRows):
+			return fmt.Errorf("failed to check index %s: %w", index.name, err)
+		}
+
+		if _, err := db.ExecContext(ctx, "CREATE INDEX CONCURRENTLY IF NOT EXISTS "+index.name+" ON queries "+index.definition); err != nil {
+			return fmt.Errorf("failed to create index %s: %w", index.name, err)
+		}
+	}
+	return nil
+}
+
+// migratePostgresMetricNames adds the metricNames column to tables created
+// before it existed, populating it from the stored label matchers.
+func migratePostgresMetricNames(ctx context.Context, db *sql.DB) error {
+	var exists int
+	err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = 'queries' AND column_name = 'metricnames'
+	`).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("failed to check metric names column: %w", err)
+	}
+	if exists > 0 {
+		return nil
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Populating the column may take longer than the statement timeout.
+	if _, err := tx.ExecContext(ctx, "SET LOCAL statement_timeout = 0"); err != nil {
+		return fmt.Errorf("failed to disable statement timeout: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, "ALTER TABLE queries ADD COLUMN IF NOT EXISTS metricNames JSONB"); err != nil {
+		return fmt.Errorf("failed to add metric names column: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE queries SET metricNames = COALESCE((
+			SELECT jsonb_agg(DISTINCT m->>'__name__')
+			FROM jsonb_array_elements(labelMatchers) m
+			WHERE m->>'__name__' IS NOT NULL
+		), '[]'::jsonb)
+		WHERE jsonb_typeof(labelMatchers) = 'array'
+	`); err != nil {
+		return fmt.Errorf("failed to populate metric names column: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
 }
 
 func (p *PostGreSQLProvider) WithDB(f func(db *sql.DB)) {
@@ -111,21 +363,59 @@ func (p *PostGreSQLProvider) WithDB(f func(db *sql.DB)) {
 }
 
 func (p *PostGreSQLProvider) Close() error {
+	if p.stopPartitions != nil {
+		p.stopPartitions()
+		<-p.partitionsDone
+	}
+
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	return p.db.Close()
 }
 
+func (p *PostGreSQLProvider) Stats(ctx context.Context) (*DBStats, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	tableRows, err := countTableRows(ctx, p.db)
+	if err != nil {
+		return nil, err
+	}
+
+	var size int64
+	// A partitioned table has no storage of its own.
+	queriesSize := "pg_total_relation_size('queries')"
+	if p.partitioned {
+		queriesSize = "(SELECT COALESCE(SUM(pg_total_relation_size(relid)), 0) FROM pg_partition_tree('queries'))"
+	}
+	err = p.db.QueryRowContext(ctx, `
+		SELECT `+queriesSize+`
+			+ pg_total_relation_size('RulesUsage')
+			+ pg_total_relation_size('DashboardUsage')
+	`).Scan(&size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the database size: %w", err)
+	}
+
+	return &DBStats{TableRows: tableRows, SizeBytes: size}, nil
+}
+
+func (p *PostGreSQLProvider) Ping(ctx context.Context) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.db.PingContext(ctx)
+}
+
 func (p *PostGreSQLProvider) Insert(ctx context.Context, queries []Query) error {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 
 	query := `
 		INSERT INTO queries (
-			ts, queryParam, timeParam, duration, statusCode, bodySize, fingerprint, labelMatchers, type, step, start, "end", totalQueryableSamples, peakSamples
+			ts, queryParam, timeParam, duration, statusCode, bodySize, totalBytes, fingerprint, labelMatchers, type, step, start, "end", totalQueryableSamples, peakSamples, cached, error, tenant, sourceIP, metricNames, upstreamDuration, method, source, dashboardUID, resultStatus
 		) VALUES `
 
-	values := make([]interface{}, 0, len(queries)*14)
+	values := make([]interface{}, 0, len(queries)*25)
 	placeholders := ""
 
 	for i, q := range queries {
@@ -134,24 +424,32 @@ func (p *PostGreSQLProvider) Insert(ctx context.Context, queries []Query) error
 			return fmt.Errorf("failed to marshal label matchers: %w", err)
 		}
 
+		metricNamesJSON, err := json.Marshal(q.MetricNames)
+		if err != nil {
+			return fmt.Errorf("failed to marshal metric names: %w", err)
+		}
+
 		// This is required to build a string like
-		// "($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14), ($15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28)"
+		// "($1, $2, ..., $25), ($26, $27, ..., $50)"
 		placeholders += fmt.Sprintf(
-			"($%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d)",
-			i*14+1, i*14+2, i*14+3, i*14+4, i*14+5, i*14+6, i*14+7, i*14+8, i*14+9, i*14+10, i*14+11, i*14+12, i*14+13, i*14+14,
+			"($%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d, $%d)",
+			i*25+1, i*25+2, i*25+3, i*25+4, i*25+5, i*25+6, i*25+7, i*25+8, i*25+9, i*25+10, i*25+11, i*25+12, i*25+13, i*25+14, i*25+15, i*25+16, i*25+17, i*25+18, i*25+19, i*25+20, i*25+21, i*25+22, i*25+23, i*25+24, i*25+25,
 		)
 
 		if i < len(queries)-1 {
 			placeholders += ", "
 		}
 
+		// ts has no time zone, it holds the UTC time like the bounds of
+		// the monthly partitions.
 		values = append(values,
-			q.TS,
+			q.TS.UTC(),
 			q.QueryParam,
 			q.TimeParam,
 			q.Duration.Milliseconds(),
 			q.StatusCode,
 			q.BodySize,
+			q.TotalBytes,
 			q.Fingerprint,
 			labelMatchersJSON,
 			q.Type,
@@ -160,6 +458,16 @@ func (p *PostGreSQLProvider) Insert(ctx context.Context, queries []Query) error
 			q.End,
 			q.TotalQueryableSamples,
 			q.PeakSamples,
+			q.Cached,
+			q.Error,
+			q.Tenant,
+			q.SourceIP,
+			metricNamesJSON,
+			q.UpstreamDuration.Milliseconds(),
+			q.Method,
+			q.Source.orDefault(),
+			nullString(q.DashboardUID),
+			nullString(q.ResultStatus),
 		)
 	}
 
@@ -234,29 +542,24 @@ func (p *PostGreSQLProvider) GetQueriesBySerieName(
 	ctx context.Context,
 	serieName string,
 	page int,
-	pageSize int) (*PagedResult, error) {
+	pageSize int,
+	sortBy string,
+	sortOrder string) (*PagedResult, error) {
 
 	endTime := time.Now()
-	startTime := endTime.Add(-30 * 24 * time.Hour) // 30 days ago
+	startTime := endTime.Add(-p.usageLookback)
 
 	totalCount, err := p.getQueriesBySerieNameTotalCount(ctx, serieName, startTime, endTime)
 	if err != nil {
 		return nil, err
 	}
 
-	// Calculate total pages
-	totalPages := int(math.Ceil(float64(totalCount) / float64(pageSize)))
-
-	data, err := p.getQueriesBySerieNameQueryData(ctx, serieName, startTime, endTime, page, pageSize)
+	data, err := p.getQueriesBySerieNameQueryData(ctx, serieName, startTime, endTime, page, pageSize, sortBy, sortOrder)
 	if err != nil {
 		return nil, err
 	}
 
-	return &PagedResult{
-		Total:      totalCount,
-		TotalPages: totalPages,
-		Data:       data,
-	}, nil
+	return newPagedResult(data, totalCount, page, pageSize, page*pageSize), nil
 }
 
 func (p *PostGreSQLProvider) getQueriesBySerieNameTotalCount(ctx context.Context, serieName string, startTime, endTime time.Time) (int, error) {
@@ -264,12 +567,12 @@ func (p *PostGreSQLProvider) getQueriesBySerieNameTotalCount(ctx context.Context
 		SELECT COUNT(DISTINCT queryParam) AS TotalCount
 		FROM queries
 		WHERE
-			labelMatchers @> $1::jsonb
+			metricNames @> jsonb_build_array($1::text)
 			AND ts BETWEEN $2 AND $3;
 	`
 
 	var totalCount int
-	err := p.db.QueryRowContext(ctx, countQuery, fmt.Sprintf(`[{"__name__": "%s"}]`, serieName), startTime, endTime).Scan(&totalCount)
+	err := p.db.QueryRowContext(ctx, countQuery, serieName, startTime.UTC(), endTime.UTC()).Scan(&totalCount)
 	if err != nil {
 		return 0, fmt.Errorf("failed to count rows: %w", err)
 	}
@@ -277,26 +580,28 @@ func (p *PostGreSQLProvider) getQueriesBySerieNameTotalCount(ctx context.Context
 	return totalCount, nil
 }
 
-func (p *PostGreSQLProvider) getQueriesBySerieNameQueryData(ctx context.Context, serieName string, startTime, endTime time.Time, page, pageSize int) ([]QueriesBySerieNameResult, error) {
+func (p *PostGreSQLProvider) getQueriesBySerieNameQueryData(ctx context.Context, serieName string, startTime, endTime time.Time, page, pageSize int, sortBy, sortOrder string) ([]QueriesBySerieNameResult, error) {
 	query := `
 		SELECT
-			queryParam AS Query,
-			AVG(duration) AS AvgDuration,
-			AVG(peakSamples) AS AvgPeakSamples,
-			MAX(peakSamples) AS MaxPeakSamples
+			queryParam,
+			AVG(duration) AS avgDuration,
+			AVG(peakSamples) AS avgPeakySamples,
+			MAX(peakSamples) AS maxPeakSamples,
+			COUNT(*) AS executions,
+			100.0 * COUNT(*) FILTER (WHERE ` + failedQueryCondition + `) / COUNT(*) AS errorRatePercent
 		FROM
 			queries
 		WHERE
-			labelMatchers @> $1::jsonb
+			metricNames @> jsonb_build_array($1::text)
 			AND ts BETWEEN $2 AND $3
 		GROUP BY
 			queryParam
 		ORDER BY
-			AvgDuration DESC
+			` + serieQueriesOrderBy(sortBy, sortOrder) + `
 		LIMIT $4 OFFSET $5;
 	`
 
-	rows, err := p.db.QueryContext(ctx, query, fmt.Sprintf(`[{"__name__": "%s"}]`, serieName), startTime, endTime, pageSize, page*pageSize)
+	rows, err := p.db.QueryContext(ctx, query, serieName, startTime.UTC(), endTime.UTC(), pageSize, page*pageSize)
 	if err != nil {
 		return nil, fmt.Errorf("failed to execute query: %w", err)
 	}
@@ -305,7 +610,7 @@ func (p *PostGreSQLProvider) getQueriesBySerieNameQueryData(ctx context.Context,
 	data := []QueriesBySerieNameResult{}
 	for rows.Next() {
 		var r QueriesBySerieNameResult
-		if err := rows.Scan(&r.QueryParam, &r.AvgDuration, &r.AvgPeakySamples, &r.MaxPeakSamples); err != nil {
+		if err := rows.Scan(&r.QueryParam, &r.AvgDuration, &r.AvgPeakySamples, &r.MaxPeakSamples, &r.Executions, &r.ErrorRatePercent); err != nil {
 			return nil, fmt.Errorf("unable to scan row: %w", err)
 		}
 		data = append(data, r)
@@ -380,17 +685,14 @@ func (p *PostGreSQLProvider) GetRulesUsage(ctx context.Context, serie string, ki
 		FROM RulesUsage
 		WHERE serie = $1
 		AND kind = $2
-		AND created_at >= NOW() - INTERVAL '30 days';
+		AND created_at >= NOW() - make_interval(secs => $3);
 	`
 	var totalCount int
-	err := p.db.QueryRowContext(ctx, countQuery, serie, kind).Scan(&totalCount)
+	err := p.db.QueryRowContext(ctx, countQuery, serie, kind, p.usageLookback.Seconds()).Scan(&totalCount)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query total count: %w", err)
 	}
 
-	// Calculate total pages
-	totalPages := int(math.Ceil(float64(totalCount) / float64(pageSize)))
-
 	// Query for paginated results
 	query := `
 		WITH latest_rules AS (
@@ -404,7 +706,7 @@ func (p *PostGreSQLProvider) GetRulesUsage(ctx context.Context, serie string, ki
 				created_at,
 				ROW_NUMBER() OVER (PARTITION BY serie, name ORDER BY created_at DESC) AS rank
 			FROM RulesUsage
-			WHERE serie = $1 AND kind = $2 AND created_at >= NOW() - INTERVAL '30 days'
+			WHERE serie = $1 AND kind = $2 AND created_at >= NOW() - make_interval(secs => $5)
 		)
 		SELECT 
 			serie,
@@ -420,7 +722,7 @@ func (p *PostGreSQLProvider) GetRulesUsage(ctx context.Context, serie string, ki
 		LIMIT $3 OFFSET $4;
 	`
 
-	rows, err := p.db.QueryContext(ctx, query, serie, kind, pageSize, offset)
+	rows, err := p.db.QueryContext(ctx, query, serie, kind, pageSize, offset, p.usageLookback.Seconds())
 	if err != nil {
 		return nil, fmt.Errorf("failed to query rules usage: %w", err)
 	}
@@ -468,11 +770,7 @@ func (p *PostGreSQLProvider) GetRulesUsage(ctx context.Context, serie string, ki
 		return nil, fmt.Errorf("row iteration error: %w", err)
 	}
 
-	return &PagedResult{
-		Total:      totalCount,
-		TotalPages: totalPages,
-		Data:       results,
-	}, nil
+	return newPagedResult(results, totalCount, page, pageSize, offset), nil
 }
 
 func (p *PostGreSQLProvider) InsertDashboardUsage(ctx context.Context, dashboardUsage []DashboardUsage) error {
@@ -532,17 +830,14 @@ func (p *PostGreSQLProvider) GetDashboardUsage(ctx context.Context, serie string
 		SELECT COUNT(DISTINCT name
 		FROM DashboardUsage
 		WHERE serie = $1
-		AND created_at >= NOW() - INTERVAL '30 days';
+		AND created_at >= NOW() - make_interval(secs => $2);
 	`
 	var totalCount int
-	err := p.db.QueryRowContext(ctx, countQuery, serie).Scan(&totalCount)
+	err := p.db.QueryRowContext(ctx, countQuery, serie, p.usageLookback.Seconds()).Scan(&totalCount)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query total count: %w", err)
 	}
 
-	// Calculate total pages
-	totalPages := int(math.Ceil(float64(totalCount) / float64(pageSize)))
-
 	// Query for paginated results
 	query := `
 		WITH latest_rules AS (
@@ -554,7 +849,7 @@ func (p *PostGreSQLProvider) GetDashboardUsage(ctx context.Context, serie string
 				created_at,
 				ROW_NUMBER() OVER (PARTITION BY serie, name ORDER BY created_at DESC) AS rank
 			FROM RulesUsage
-			WHERE serie = $1 AND created_at >= NOW() - INTERVAL '30 days'
+			WHERE serie = $1 AND created_at >= NOW() - make_interval(secs => $2)
 		)
 		SELECT 
 			id,
@@ -568,7 +863,7 @@ func (p *PostGreSQLProvider) GetDashboardUsage(ctx context.Context, serie string
 		LIMIT $3 OFFSET $4;
 	`
 
-	rows, err := p.db.QueryContext(ctx, query, serie, pageSize, offset)
+	rows, err := p.db.QueryContext(ctx, query, serie, p.usageLookback.Seconds(), pageSize, offset)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query rules usage: %w", err)
 	}
@@ -604,9 +899,338 @@ func (p *PostGreSQLProvider) GetDashboardUsage(ctx context.Context, serie string
 		return nil, fmt.Errorf("row iteration error: %w", err)
 	}
 
-	return &PagedResult{
-		Total:      totalCount,
-		TotalPages: totalPages,
-		Data:       results,
-	}, nil
+	return newPagedResult(results, totalCount, page, pageSize, offset), nil
+}
+
+func (p *PostGreSQLProvider) GetQueriesSummary(ctx context.Context, startTime, endTime time.Time) (*QueriesSummary, error) {
+	query := `
+		SELECT
+			COUNT(*) AS totalQueries,
+			COALESCE(SUM(CASE WHEN ` + failedQueryCondition + ` THEN 1 ELSE 0 END), 0) AS failedQueries,
+			COALESCE(AVG(duration), 0) AS avgDuration,
+			COALESCE(percentile_cont(0.95) WITHIN GROUP (ORDER BY duration), 0) AS p95Duration
+		FROM queries
+		WHERE ts BETWEEN $1 AND $2;
+	`
+
+	summary := &QueriesSummary{}
+	err := p.db.QueryRowContext(ctx, query, startTime.UTC(), endTime.UTC()).Scan(&summary.TotalQueries, &summary.FailedQueries, &summary.AvgDuration, &summary.P95Duration)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query summary: %w", err)
+	}
+
+	return summary, nil
+}
+
+func (p *PostGreSQLProvider) DeleteQueriesBefore(ctx context.Context, cutoff time.Time, filter QueryFilter) (int64, error) {
+	where, filterArgs := filter.where("type", "statusCode")
+	query := rebindPostgres(fmt.Sprintf(`
+		DELETE FROM queries
+		WHERE (tableoid, ctid) IN (
+			SELECT tableoid, ctid FROM queries WHERE ts < ?%s LIMIT ?
+		);
+	`, where))
+
+	args := append([]interface{}{cutoff.UTC()}, filterArgs...)
+	args = append(args, deleteQueriesBatchSize)
+
+	var deleted int64
+	if p.partitioned && filter.Match == (QueryMatch{}) && len(filter.Exclude) == 0 {
+		n, err := dropPostgresPartitionsBefore(ctx, p.db, cutoff)
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+	}
+
+	for {
+		res, err := p.db.ExecContext(ctx, query, args...)
+		if err != nil {
+			return deleted, fmt.Errorf("failed to delete queries: %w", err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return deleted, fmt.Errorf("failed to get deleted queries count: %w", err)
+		}
+		deleted += n
+		if n < deleteQueriesBatchSize {
+			return deleted, nil
+		}
+	}
+}
+
+func (p *PostGreSQLProvider) GetSimilarDashboards(ctx context.Context, threshold float64) ([]SimilarDashboards, error) {
+	query := `
+		SELECT id, serie, MAX(name), MAX(url)
+		FROM DashboardUsage
+		WHERE created_at >= NOW() - make_interval(secs => $1)
+		GROUP BY id, serie
+		ORDER BY id;
+	`
+
+	rows, err := p.db.QueryContext(ctx, query, p.usageLookback.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query dashboard series: %w", err)
+	}
+	defer rows.Close()
+
+	dashboards, err := scanDashboardSeries(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	return similarDashboards(dashboards, threshold), nil
+}
+
+func (p *PostGreSQLProvider) GetTopQueries(ctx context.Context, startTime, endTime time.Time, limit int) ([]TopQuery, error) {
+	query := `
+		SELECT
+			fingerprint,
+			MIN(queryParam) AS queryParam,
+			COUNT(*) AS executions,
+			AVG(duration) AS avgDuration
+		FROM queries
+		WHERE ts BETWEEN $1 AND $2
+		GROUP BY fingerprint
+		ORDER BY executions DESC, avgDuration DESC
+		LIMIT $3;
+	`
+
+	rows, err := p.db.QueryContext(ctx, query, startTime.UTC(), endTime.UTC(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	data := []TopQuery{}
+	for rows.Next() {
+		var r TopQuery
+		if err := rows.Scan(&r.Fingerprint, &r.QueryParam, &r.Executions, &r.AvgDuration); err != nil {
+			return nil, fmt.Errorf("unable to scan row: %w", err)
+		}
+		data = append(data, r)
+	}
+
+	return data, nil
+}
+
+func (p *PostGreSQLProvider) GetQueryExecutionDetail(ctx context.Context, id int64) (*QueryExecutionDetail, error) {
+	query := "SELECT id, " + queryExecutionDetailColumns + " FROM queries WHERE id = $1"
+	return scanQueryExecutionDetail(p.db.QueryRowContext(ctx, query, id))
+}
+
+func (p *PostGreSQLProvider) GetSlowestQueries(ctx context.Context, tr TimeRange, tenant string, source string, limit int) ([]SlowQueryRow, error) {
+	query := `
+		SELECT id, ts, queryParam, duration, statusCode, peakSamples, fingerprint
+		FROM queries
+		WHERE ts BETWEEN $1 AND $2 AND ($3 = '' OR tenant = $3) AND ($4 = '' OR source = $4)
+		ORDER BY duration DESC
+		LIMIT $5;
+	`
+
+	rows, err := p.db.QueryContext(ctx, query, tr.From.UTC(), tr.To.UTC(), tenant, source, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	data := []SlowQueryRow{}
+	for rows.Next() {
+		var r SlowQueryRow
+		if err := rows.Scan(&r.ID, &r.TS, &r.QueryParam, &r.Duration, &r.StatusCode, &r.PeakSamples, &r.Fingerprint); err != nil {
+			return nil, fmt.Errorf("unable to scan row: %w", err)
+		}
+		data = append(data, r)
+	}
+
+	return data, nil
+}
+
+func (p *PostGreSQLProvider) GetLatencyRegressions(ctx context.Context, currentWindow, baselineWindow time.Duration, factor float64) ([]LatencyRegression, error) {
+	now := time.Now().UTC()
+	baselineStart, currentStart := regressionWindows(now, currentWindow, baselineWindow)
+
+	query := `
+		SELECT
+			fingerprint,
+			MIN(queryParam) AS queryParam,
+			percentile_cont(0.95) WITHIN GROUP (ORDER BY duration) FILTER (WHERE ts >= $2) AS currentP95,
+			percentile_cont(0.95) WITHIN GROUP (ORDER BY duration) FILTER (WHERE ts < $2) AS baselineP95
+		FROM queries
+		WHERE ts BETWEEN $1 AND $3
+		GROUP BY fingerprint
+		HAVING COUNT(*) FILTER (WHERE ts >= $2) > 0 AND COUNT(*) FILTER (WHERE ts < $2) > 0;
+	`
+
+	rows, err := p.db.QueryContext(ctx, query, baselineStart, currentStart, now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	candidates := []LatencyRegression{}
+	for rows.Next() {
+		var r LatencyRegression
+		if err := rows.Scan(&r.Fingerprint, &r.QueryParam, &r.CurrentP95, &r.BaselineP95); err != nil {
+			return nil, fmt.Errorf("unable to scan row: %w", err)
+		}
+		candidates = append(candidates, r)
+	}
+
+	return latencyRegressions(candidates, factor), nil
+}
+
+func (p *PostGreSQLProvider) GetQueryErrorBreakdown(ctx context.Context, tr TimeRange, tenant string, source string) ([]ErrorBreakdownRow, error) {
+	query := `
+		SELECT COALESCE(error, ''), COUNT(*)
+		FROM queries
+		WHERE ` + failedQueryCondition + ` AND ts BETWEEN $1 AND $2 AND ($3 = '' OR tenant = $3) AND ($4 = '' OR source = $4)
+		GROUP BY error;
+	`
+
+	rows, err := p.db.QueryContext(ctx, query, tr.From.UTC(), tr.To.UTC(), tenant, source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var (
+			message string
+			count   int
+		)
+		if err := rows.Scan(&message, &count); err != nil {
+			return nil, fmt.Errorf("unable to scan row: %w", err)
+		}
+		counts[message] += count
+	}
+
+	return errorBreakdown(counts), nil
+}
+
+func (p *PostGreSQLProvider) GetQueriesByIP(ctx context.Context, tr TimeRange, tenant string, source string, limit int) ([]SourceIPStats, error) {
+	query := `
+		SELECT sourceIP, COUNT(*) AS queries, COUNT(*) FILTER (WHERE ` + failedQueryCondition + `)
+		FROM queries
+		WHERE ts BETWEEN $1 AND $2 AND sourceIP <> '' AND ($3 = '' OR tenant = $3) AND ($4 = '' OR source = $4)
+		GROUP BY sourceIP
+		ORDER BY queries DESC
+		LIMIT $5;
+	`
+
+	rows, err := p.db.QueryContext(ctx, query, tr.From.UTC(), tr.To.UTC(), tenant, source, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	data := []SourceIPStats{}
+	for rows.Next() {
+		var r SourceIPStats
+		if err := rows.Scan(&r.IP, &r.Queries, &r.Errors); err != nil {
+			return nil, fmt.Errorf("unable to scan row: %w", err)
+		}
+		if r.Queries > 0 {
+			r.ErrorRate = float64(r.Errors) / float64(r.Queries)
+		}
+		data = append(data, r)
+	}
+
+	return data, nil
+}
+
+func (p *PostGreSQLProvider) GetTopQueriedMetrics(ctx context.Context, tr TimeRange, tenant string, source string, limit int) ([]MetricQueryCount, error) {
+	query := `
+		SELECT m.name, COUNT(*) AS queries, COALESCE(SUM(q.peakSamples), 0)
+		FROM queries q
+		CROSS JOIN LATERAL jsonb_array_elements_text(
+			CASE WHEN jsonb_typeof(q.metricNames) = 'array' THEN q.metricNames ELSE '[]'::jsonb END
+		) AS m(name)
+		WHERE q.ts BETWEEN $1 AND $2 AND m.name <> '' AND ($3 = '' OR q.tenant = $3) AND ($4 = '' OR q.source = $4)
+		GROUP BY m.name
+		ORDER BY queries DESC, m.name
+		LIMIT $5;
+	`
+
+	rows, err := p.db.QueryContext(ctx, query, tr.From.UTC(), tr.To.UTC(), tenant, source, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	data := []MetricQueryCount{}
+	for rows.Next() {
+		var r MetricQueryCount
+		if err := rows.Scan(&r.Name, &r.Queries, &r.PeakSamples); err != nil {
+			return nil, fmt.Errorf("unable to scan row: %w", err)
+		}
+		data = append(data, r)
+	}
+
+	return data, nil
+}
+
+func (p *PostGreSQLProvider) GetMetricStatisticsBatch(ctx context.Context, names []string, tr TimeRange) (map[string]MetricUsageStatistics, error) {
+	if len(names) == 0 {
+		return map[string]MetricUsageStatistics{}, nil
+	}
+
+	query := `
+		SELECT serie, kind, COUNT(DISTINCT name)
+		FROM RulesUsage
+		WHERE serie = ANY($1) AND created_at >= NOW() - make_interval(secs => $2)
+		GROUP BY serie, kind
+		UNION ALL
+		SELECT serie, '` + metricStatisticsDashboardKind + `', COUNT(DISTINCT name)
+		FROM DashboardUsage
+		WHERE serie = ANY($1) AND created_at >= NOW() - make_interval(secs => $2)
+		GROUP BY serie
+		UNION ALL
+		SELECT m.name, '` + metricStatisticsQueryKind + `', COUNT(DISTINCT q.queryParam)
+		FROM queries q
+		CROSS JOIN LATERAL jsonb_array_elements_text(
+			CASE WHEN jsonb_typeof(q.metricNames) = 'array' THEN q.metricNames ELSE '[]'::jsonb END
+		) AS m(name)
+		WHERE m.name = ANY($1) AND q.ts BETWEEN $3 AND $4
+		GROUP BY m.name;
+	`
+
+	rows, err := p.db.QueryContext(ctx, query, pq.Array(names), p.usageLookback.Seconds(), tr.From.UTC(), tr.To.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	return scanMetricStatistics(rows, names)
+}
+
+func (p *PostGreSQLProvider) GetQueryThroughput(ctx context.Context, tr TimeRange, tenant string, source string, step time.Duration, groupBy ThroughputGroupBy) ([]ThroughputBucket, error) {
+	query := fmt.Sprintf(`
+		SELECT (FLOOR(EXTRACT(EPOCH FROM ts) / $1) * $1)::BIGINT AS bucket, %s AS series, COUNT(*)
+		FROM queries
+		WHERE ts BETWEEN $2 AND $3 AND ($4 = '' OR tenant = $4) AND ($5 = '' OR source = $5)
+		GROUP BY bucket, series;
+	`, groupBy.column("tenant", "source", "method"))
+
+	rows, err := p.db.QueryContext(ctx, query, int64(step.Seconds()), tr.From.UTC(), tr.To.UTC(), tenant, source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	counts := []throughputCount{}
+	for rows.Next() {
+		var c throughputCount
+		if err := rows.Scan(&c.bucket, &c.series, &c.count); err != nil {
+			return nil, fmt.Errorf("unable to scan row: %w", err)
+		}
+		counts = append(counts, c)
+	}
+
+	return throughputBuckets(tr, step, counts), nil
+}
+
+func (p *PostGreSQLProvider) Explain(ctx context.Context, query string) (*QueryResult, error) {
+	return p.Query(ctx, "EXPLAIN ANALYZE "+query)
 }
@@ -0,0 +1,239 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The supported values of postgresql.partitioning.
+const (
+	PostgreSQLPartitioningOff     = "off"
+	PostgreSQLPartitioningMonthly = "monthly"
+)
+
+const (
+	// postgresPartitionsAhead is the number of monthly partitions created
+	// ahead of the current month.
+	postgresPartitionsAhead = 2
+	// postgresPartitionsInterval is the interval to create the upcoming
+	// monthly partitions.
+	postgresPartitionsInterval = time.Hour
+	// postgresPartitionNameLayout names the monthly partitions after the
+	// month they hold.
+	postgresPartitionNameLayout = "queries_2006_01"
+	// postgresLegacyPartition holds the queries recorded before the table
+	// was partitioned.
+	postgresLegacyPartition = "queries_legacy"
+	// postgresDefaultPartition holds the queries outside of every monthly
+	// partition, e.g. recorded with a clock far off.
+	postgresDefaultPartition = "queries_default"
+
+	// errCodeInvalidObjectDefinition is reported when a partition would
+	// overlap another one.
+	errCodeInvalidObjectDefinition = "42P17"
+	// errCodeCheckViolation is reported when the default partition holds
+	// queries of a partition being created.
+	errCodeCheckViolation = "23514"
+)
+
+// partitionPostgresQueries turns a queries table created without
+// partitioning into one partitioned by month on ts. The existing queries
+// are kept in the legacy partition, which holds every query up to the next
+// month, so they are not copied.
+func partitionPostgresQueries(ctx context.Context, db *sql.DB, now time.Time) error {
+	var kind string
+	err := db.QueryRowContext(ctx, `
+		SELECT c.relkind FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = current_schema() AND c.relname = 'queries'
+	`).Scan(&kind)
+	if err != nil {
+		return fmt.Errorf("failed to check queries table: %w", err)
+	}
+	if kind == "p" {
+		return nil
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Attaching the existing queries scans them, which may take longer than
+	// the statement timeout.
+	if _, err := tx.ExecContext(ctx, "SET LOCAL statement_timeout = 0"); err != nil {
+		return fmt.Errorf("failed to disable statement timeout: %w", err)
+	}
+
+	for _, stmt := range []string{
+		"ALTER TABLE queries RENAME TO " + postgresLegacyPartition,
+		// A unique index must include the partition key, it is created again
+		// without uniqueness on the partitioned table.
+		"DROP INDEX IF EXISTS queries_id_idx",
+		// The defaults are copied so the ids keep following the same sequence.
+		"CREATE TABLE queries (LIKE " + postgresLegacyPartition + " INCLUDING DEFAULTS) PARTITION BY RANGE (ts)",
+		fmt.Sprintf("ALTER TABLE queries ATTACH PARTITION %s FOR VALUES FROM (MINVALUE) TO ('%s')",
+			postgresLegacyPartition, postgresMonth(now).AddDate(0, 1, 0).Format(time.DateOnly)),
+		// Otherwise dropping the legacy partition would drop the sequence.
+		"ALTER SEQUENCE IF EXISTS queries_id_seq OWNED BY queries.id",
+	} {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("failed to partition queries table: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	slog.Info("partitioned the queries table by month", "legacyPartition", postgresLegacyPartition)
+	return nil
+}
+
+// createPostgresPartitions creates the default partition and the monthly
+// partitions from the month of now to postgresPartitionsAhead months ahead.
+// Months already held by the legacy partition are skipped, and the queries
+// of a month already recorded in the default partition are moved to the new
+// partition.
+func createPostgresPartitions(ctx context.Context, db *sql.DB, now time.Time) error {
+	if _, err := db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+postgresDefaultPartition+" PARTITION OF queries DEFAULT"); err != nil {
+		return fmt.Errorf("failed to create default partition: %w", err)
+	}
+
+	month := postgresMonth(now)
+	for i := range postgresPartitionsAhead + 1 {
+		from := month.AddDate(0, i, 0)
+		name := from.Format(postgresPartitionNameLayout)
+		_, err := db.ExecContext(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF queries FOR VALUES FROM ('%s') TO ('%s')",
+			name, from.Format(time.DateOnly), from.AddDate(0, 1, 0).Format(time.DateOnly)))
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == errCodeInvalidObjectDefinition {
+			continue
+		}
+		if errors.As(err, &pqErr) && pqErr.Code == errCodeCheckViolation {
+			err = movePostgresDefaultPartition(ctx, db, name, from, from.AddDate(0, 1, 0))
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create partition %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// movePostgresDefaultPartition creates the partition of the queries from
+// from to to, moving them out of the default partition, which otherwise
+// prevents creating it.
+func movePostgresDefaultPartition(ctx context.Context, db *sql.DB, name string, from, to time.Time) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Moving the queries may take longer than the statement timeout.
+	if _, err := tx.ExecContext(ctx, "SET LOCAL statement_timeout = 0"); err != nil {
+		return fmt.Errorf("failed to disable statement timeout: %w", err)
+	}
+
+	bounds := fmt.Sprintf("ts >= '%s' AND ts < '%s'", from.Format(time.DateOnly), to.Format(time.DateOnly))
+	for _, stmt := range []string{
+		// The queries recorded meanwhile would be routed to the default
+		// partition as well.
+		"LOCK TABLE " + postgresDefaultPartition + " IN EXCLUSIVE MODE",
+		"CREATE TABLE " + name + " (LIKE queries INCLUDING DEFAULTS)",
+		"WITH moved AS (DELETE FROM " + postgresDefaultPartition + " WHERE " + bounds + " RETURNING *) INSERT INTO " + name + " SELECT * FROM moved",
+		fmt.Sprintf("ALTER TABLE queries ATTACH PARTITION %s FOR VALUES FROM ('%s') TO ('%s')",
+			name, from.Format(time.DateOnly), to.Format(time.DateOnly)),
+	} {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("failed to move the default partition queries: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	slog.Info("moved the queries of the default partition", "partition", name)
+	return nil
+}
+
+// dropPostgresPartitionsBefore drops the monthly partitions holding only
+// queries older than cutoff, returning how many queries they held.
+func dropPostgresPartitionsBefore(ctx context.Context, db *sql.DB, cutoff time.Time) (int64, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT c.relname FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		WHERE i.inhparent = 'queries'::regclass
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list partitions: %w", err)
+	}
+	var expired []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan partition: %w", err)
+		}
+		from, err := time.Parse(postgresPartitionNameLayout, name)
+		if err != nil {
+			// Neither the legacy nor the default partition are monthly.
+			continue
+		}
+		if !from.AddDate(0, 1, 0).After(cutoff) {
+			expired = append(expired, name)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to list partitions: %w", err)
+	}
+
+	var deleted int64
+	for _, name := range expired {
+		var count int64
+		if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+name).Scan(&count); err != nil {
+			return deleted, fmt.Errorf("failed to count the queries of partition %s: %w", name, err)
+		}
+		if _, err := db.ExecContext(ctx, "DROP TABLE "+name); err != nil {
+			return deleted, fmt.Errorf("failed to drop partition %s: %w", name, err)
+		}
+		deleted += count
+		slog.Info("dropped expired queries partition", "partition", name, "queries", count)
+	}
+	return deleted, nil
+}
+
+// maintainPartitions creates the upcoming monthly partitions until ctx is
+// done.
+func (p *PostGreSQLProvider) maintainPartitions(ctx context.Context) {
+	defer close(p.partitionsDone)
+
+	ticker := time.NewTicker(postgresPartitionsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := createPostgresPartitions(ctx, p.db, time.Now()); err != nil {
+				slog.Error("unable to create the queries partitions", "err", err)
+			}
+		}
+	}
+}
+
+// postgresMonth returns the start of the UTC month of t, the monthly
+// partitions being bounded by UTC months.
+func postgresMonth(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
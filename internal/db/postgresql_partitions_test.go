@@ -0,0 +1,159 @@
+//go:build docker
+
+// These tests need a PostgreSQL server, e.g. started with
+//
+//	docker run -d -p 5432:5432 -e POSTGRES_PASSWORD=postgres postgres:16
+//
+// and run with go test -tags docker ./internal/db/. The connection is set
+// with the POSTGRESQL_ADDR, POSTGRESQL_USER, POSTGRESQL_PASSWORD and
+// POSTGRESQL_DATABASE environment variables.
+
+package db
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestPostgreSQLProvider connects to an empty database with the given
+// partitioning.
+func newTestPostgreSQLProvider(t *testing.T, partitioning string) *PostGreSQLProvider {
+	t.Helper()
+
+	saved := config.DefaultConfig.Database.PostgreSQL
+	t.Cleanup(func() { config.DefaultConfig.Database.PostgreSQL = saved })
+	config.DefaultConfig.Database.PostgreSQL = config.PostgreSQLConfig{
+		Addr:         cmp.Or(os.Getenv("POSTGRESQL_ADDR"), "localhost"),
+		Port:         5432,
+		User:         cmp.Or(os.Getenv("POSTGRESQL_USER"), "postgres"),
+		Password:     cmp.Or(os.Getenv("POSTGRESQL_PASSWORD"), "postgres"),
+		Database:     cmp.Or(os.Getenv("POSTGRESQL_DATABASE"), "postgres"),
+		Partitioning: partitioning,
+	}
+
+	provider, err := newPostGreSQLProvider(context.Background())
+	require.NoError(t, err)
+	p := provider.(*PostGreSQLProvider)
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func dropTestPostgreSQLTables(t *testing.T) {
+	t.Helper()
+
+	pg := config.PostgreSQLConfig{
+		Addr:     cmp.Or(os.Getenv("POSTGRESQL_ADDR"), "localhost"),
+		User:     cmp.Or(os.Getenv("POSTGRESQL_USER"), "postgres"),
+		Password: cmp.Or(os.Getenv("POSTGRESQL_PASSWORD"), "postgres"),
+		Database: cmp.Or(os.Getenv("POSTGRESQL_DATABASE"), "postgres"),
+	}
+	db, err := sql.Open("postgres", fmt.Sprintf("host=%s port=5432 user=%s password=%s dbname=%s sslmode=disable",
+		pg.Addr, pg.User, pg.Password, pg.Database))
+	require.NoError(t, err)
+	defer db.Close()
+
+	_, err = db.Exec("DROP TABLE IF EXISTS queries, RulesUsage, DashboardUsage CASCADE")
+	require.NoError(t, err)
+}
+
+// partitionOf returns the partition holding the queries of the given text.
+func partitionOf(t *testing.T, p *PostGreSQLProvider, query string) string {
+	t.Helper()
+
+	var partition string
+	err := p.db.QueryRow("SELECT tableoid::regclass::text FROM queries WHERE queryParam = $1", query).Scan(&partition)
+	require.NoError(t, err)
+	return partition
+}
+
+func TestPostGreSQLProvider_Partitioning(t *testing.T) {
+	dropTestPostgreSQLTables(t)
+	p := newTestPostgreSQLProvider(t, PostgreSQLPartitioningMonthly)
+	ctx := context.Background()
+
+	now := time.Now().UTC()
+	month := postgresMonth(now)
+	require.NoError(t, p.Insert(ctx, []Query{
+		{TS: now, QueryParam: "current", Type: QueryTypeInstant, StatusCode: 200},
+		{TS: month.AddDate(0, 1, 1), QueryParam: "next", Type: QueryTypeInstant, StatusCode: 200},
+		{TS: month.AddDate(0, -6, 0), QueryParam: "old", Type: QueryTypeInstant, StatusCode: 200},
+	}))
+
+	assert.Equal(t, month.Format(postgresPartitionNameLayout), partitionOf(t, p, "current"))
+	assert.Equal(t, month.AddDate(0, 1, 0).Format(postgresPartitionNameLayout), partitionOf(t, p, "next"))
+	assert.Equal(t, postgresDefaultPartition, partitionOf(t, p, "old"))
+
+	// The partition of the next month is dropped once it expires.
+	deleted, err := p.DeleteQueriesBefore(ctx, month.AddDate(0, 2, 0), QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), deleted)
+
+	var partitions int
+	require.NoError(t, p.db.QueryRow("SELECT COUNT(*) FROM pg_inherits WHERE inhparent = 'queries'::regclass").Scan(&partitions))
+	assert.Equal(t, 2, partitions, "the default partition and the one two months ahead are left")
+}
+
+func TestPostGreSQLProvider_PartitionExistingTable(t *testing.T) {
+	dropTestPostgreSQLTables(t)
+	ctx := context.Background()
+
+	p := newTestPostgreSQLProvider(t, PostgreSQLPartitioningOff)
+	require.NoError(t, p.Insert(ctx, []Query{{TS: time.Now().UTC(), QueryParam: "before", Type: QueryTypeInstant, StatusCode: 200}}))
+	require.NoError(t, p.Close())
+
+	p = newTestPostgreSQLProvider(t, PostgreSQLPartitioningMonthly)
+	month := postgresMonth(time.Now())
+	require.NoError(t, p.Insert(ctx, []Query{
+		{TS: time.Now().UTC(), QueryParam: "after", Type: QueryTypeInstant, StatusCode: 200},
+		{TS: month.AddDate(0, 1, 1), QueryParam: "next", Type: QueryTypeInstant, StatusCode: 200},
+	}))
+
+	// The legacy partition holds the existing queries and the current month.
+	assert.Equal(t, postgresLegacyPartition, partitionOf(t, p, "before"))
+	assert.Equal(t, postgresLegacyPartition, partitionOf(t, p, "after"))
+	assert.Equal(t, month.AddDate(0, 1, 0).Format(postgresPartitionNameLayout), partitionOf(t, p, "next"))
+
+	// The ids keep following the same sequence.
+	var ids int
+	require.NoError(t, p.db.QueryRow("SELECT COUNT(DISTINCT id) FROM queries").Scan(&ids))
+	assert.Equal(t, 3, ids)
+}
+
+func TestPostGreSQLProvider_QueriesIndexes(t *testing.T) {
+	for _, partitioning := range []string{PostgreSQLPartitioningOff, PostgreSQLPartitioningMonthly} {
+		t.Run(partitioning, func(t *testing.T) {
+			dropTestPostgreSQLTables(t)
+			// Creating the provider again must not fail on the existing indexes.
+			require.NoError(t, newTestPostgreSQLProvider(t, partitioning).Close())
+			p := newTestPostgreSQLProvider(t, partitioning)
+
+			rows, err := p.db.Query("SELECT indexname FROM pg_indexes WHERE tablename = 'queries' ORDER BY indexname")
+			require.NoError(t, err)
+			defer rows.Close()
+
+			var indexes []string
+			for rows.Next() {
+				var name string
+				require.NoError(t, rows.Scan(&name))
+				indexes = append(indexes, name)
+			}
+			require.NoError(t, rows.Err())
+			assert.Subset(t, indexes, []string{
+				"queries_fingerprint_ts_idx",
+				"queries_label_matchers_idx",
+				"queries_metric_names_idx",
+				"queries_ts_idx",
+				"queries_type_ts_idx",
+			})
+		})
+	}
+}
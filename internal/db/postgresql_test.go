@@ -7,7 +7,7 @@ import (
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -73,3 +73,138 @@ func TestPostGreSQLProvider_Query(t *testing.T) {
 		})
 	}
 }
+
+func TestPostGreSQLProvider_DeleteQueriesBeforeDropsPartitions(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	provider := &PostGreSQLProvider{db: db, partitioned: true}
+	cutoff := time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC)
+
+	mock.ExpectQuery("SELECT c.relname FROM pg_inherits").WillReturnRows(sqlmock.NewRows([]string{"relname"}).
+		AddRow("queries_legacy").
+		AddRow("queries_default").
+		AddRow("queries_2024_01").
+		AddRow("queries_2024_02").
+		AddRow("queries_2024_03"))
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM queries_2024_01").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(7))
+	mock.ExpectExec("DROP TABLE queries_2024_01").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM queries_2024_02").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(5))
+	mock.ExpectExec("DROP TABLE queries_2024_02").WillReturnResult(sqlmock.NewResult(0, 0))
+	// The rest is deleted from the partitions still holding recent queries.
+	mock.ExpectExec("DELETE FROM queries").WithArgs(cutoff, deleteQueriesBatchSize).WillReturnResult(sqlmock.NewResult(0, 3))
+
+	deleted, err := provider.DeleteQueriesBefore(context.Background(), cutoff, QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(15), deleted)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostGreSQLProvider_DeleteQueriesBeforeKeepsPartitionsWithPolicies(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	provider := &PostGreSQLProvider{db: db, partitioned: true}
+	cutoff := time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC)
+
+	// Partitions may hold queries kept longer by a policy.
+	mock.ExpectExec("DELETE FROM queries").WillReturnResult(sqlmock.NewResult(0, 2))
+
+	deleted, err := provider.DeleteQueriesBefore(context.Background(), cutoff, QueryFilter{Exclude: []QueryMatch{{Status: StatusClassError}}})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), deleted)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostGreSQLProvider_GetMetricStatisticsBatch(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	provider := &PostGreSQLProvider{db: db}
+	tr := TimeRange{From: time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC), To: time.Date(2024, 3, 16, 0, 0, 0, 0, time.UTC)}
+
+	// A single query counts the rules, dashboards and queries of every metric.
+	mock.ExpectQuery("SELECT serie, kind, COUNT\\(DISTINCT name\\)").
+		WithArgs(`{"up","node_load1"}`, sqlmock.AnyArg(), tr.From, tr.To).
+		WillReturnRows(sqlmock.NewRows([]string{"serie", "kind", "count"}).
+			AddRow("up", "alert", 2).
+			AddRow("up", "dashboard", 1).
+			AddRow("node_load1", "record", 3).
+			AddRow("node_load1", "query", 4))
+
+	stats, err := provider.GetMetricStatisticsBatch(context.Background(), []string{"up", "node_load1"}, tr)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]MetricUsageStatistics{
+		"up":         {Alerts: 2, Dashboards: 1},
+		"node_load1": {Records: 3, Queries: 4},
+	}, stats)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCreatePostgresQueriesIndexes(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	for i, index := range postgresQueriesIndexes {
+		rows := sqlmock.NewRows([]string{"indisvalid"})
+		switch i {
+		case 0:
+			// Already built.
+			mock.ExpectQuery("SELECT i.indisvalid FROM pg_index").WithArgs(index.name).WillReturnRows(rows.AddRow(true))
+			continue
+		case 1:
+			// Left invalid by an interrupted build.
+			mock.ExpectQuery("SELECT i.indisvalid FROM pg_index").WithArgs(index.name).WillReturnRows(rows.AddRow(false))
+			mock.ExpectExec("DROP INDEX CONCURRENTLY IF EXISTS " + index.name).WillReturnResult(sqlmock.NewResult(0, 0))
+		default:
+			mock.ExpectQuery("SELECT i.indisvalid FROM pg_index").WithArgs(index.name).WillReturnRows(rows)
+		}
+		mock.ExpectExec("CREATE INDEX CONCURRENTLY IF NOT EXISTS " + index.name + " ON queries").WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	require.NoError(t, createPostgresQueriesIndexes(context.Background(), db, false))
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	// The indexes of a partitioned table cannot be built concurrently.
+	for _, index := range postgresQueriesIndexes {
+		mock.ExpectExec("CREATE INDEX IF NOT EXISTS " + index.name + " ON queries").WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	require.NoError(t, createPostgresQueriesIndexes(context.Background(), db, true))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestCreatePostgresPartitions(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	require.NoError(t, err)
+	defer db.Close()
+
+	now := time.Date(2024, 12, 15, 0, 0, 0, 0, time.UTC)
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS queries_default PARTITION OF queries DEFAULT").WillReturnResult(sqlmock.NewResult(0, 0))
+	// Held by the legacy partition.
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS queries_2024_12 PARTITION OF queries FOR VALUES FROM ('2024-12-01') TO ('2025-01-01')").
+		WillReturnError(&pq.Error{Code: errCodeInvalidObjectDefinition})
+	// Queries of January were recorded in the default partition.
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS queries_2025_01 PARTITION OF queries FOR VALUES FROM ('2025-01-01') TO ('2025-02-01')").
+		WillReturnError(&pq.Error{Code: errCodeCheckViolation})
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL statement_timeout = 0").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("LOCK TABLE queries_default IN EXCLUSIVE MODE").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE queries_2025_01 (LIKE queries INCLUDING DEFAULTS)").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("WITH moved AS (DELETE FROM queries_default WHERE ts >= '2025-01-01' AND ts < '2025-02-01' RETURNING *) INSERT INTO queries_2025_01 SELECT * FROM moved").
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec("ALTER TABLE queries ATTACH PARTITION queries_2025_01 FOR VALUES FROM ('2025-01-01') TO ('2025-02-01')").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS queries_2025_02 PARTITION OF queries FOR VALUES FROM ('2025-02-01') TO ('2025-03-01')").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	require.NoError(t, createPostgresPartitions(context.Background(), db, now))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresMonth(t *testing.T) {
+	month := postgresMonth(time.Date(2024, 12, 31, 23, 30, 0, 0, time.FixedZone("UTC-2", -2*60*60)))
+	assert.Equal(t, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), month)
+	assert.Equal(t, "queries_2025_01", month.Format(postgresPartitionNameLayout))
+}
@@ -3,34 +3,141 @@ package db
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"sort"
 	"strings"
+	"sync"
+	"time"
+	"unicode"
 )
 
 type Provider interface {
 	WithDB(func(db *sql.DB))
 	Insert(ctx context.Context, queries []Query) error
 	Query(ctx context.Context, query string) (*QueryResult, error)
+	// Explain returns the plan the database uses to execute the query.
+	Explain(ctx context.Context, query string) (*QueryResult, error)
 	QueryShortCuts() []QueryShortCut
-	GetQueriesBySerieName(ctx context.Context, serieName string, page int, pageSize int) (*PagedResult, error)
+	GetQueriesBySerieName(ctx context.Context, serieName string, page int, pageSize int, sortBy string, sortOrder string) (*PagedResult, error)
 	InsertRulesUsage(ctx context.Context, rulesUsage []RulesUsage) error
 	GetRulesUsage(ctx context.Context, serie string, kind string, page int, pageSize int) (*PagedResult, error)
 	InsertDashboardUsage(ctx context.Context, dashboardUsage []DashboardUsage) error
 	GetDashboardUsage(ctx context.Context, serieName string, page int, pageSize int) (*PagedResult, error)
+	GetSimilarDashboards(ctx context.Context, threshold float64) ([]SimilarDashboards, error)
+	GetQueriesSummary(ctx context.Context, startTime, endTime time.Time) (*QueriesSummary, error)
+	GetTopQueries(ctx context.Context, startTime, endTime time.Time, limit int) ([]TopQuery, error)
+	GetSlowestQueries(ctx context.Context, tr TimeRange, tenant string, source string, limit int) ([]SlowQueryRow, error)
+	GetQueryErrorBreakdown(ctx context.Context, tr TimeRange, tenant string, source string) ([]ErrorBreakdownRow, error)
+	GetQueriesByIP(ctx context.Context, tr TimeRange, tenant string, source string, limit int) ([]SourceIPStats, error)
+	// GetTopQueriedMetrics ranks the metrics by the number of queries
+	// selecting them. A query selecting several metrics counts for each one.
+	GetTopQueriedMetrics(ctx context.Context, tr TimeRange, tenant string, source string, limit int) ([]MetricQueryCount, error)
+	// GetMetricStatisticsBatch returns the usage statistics of each of the
+	// metrics, the queries being counted within the time range and the rules
+	// and dashboards within the usage lookback.
+	GetMetricStatisticsBatch(ctx context.Context, names []string, tr TimeRange) (map[string]MetricUsageStatistics, error)
+	// GetQueryThroughput counts the queries of each step of the time range,
+	// in a single series or in one series per value of the dimension.
+	GetQueryThroughput(ctx context.Context, tr TimeRange, tenant string, source string, step time.Duration, groupBy ThroughputGroupBy) ([]ThroughputBucket, error)
+	GetLatencyRegressions(ctx context.Context, currentWindow, baselineWindow time.Duration, factor float64) ([]LatencyRegression, error)
+	// GetQueryExecutionDetail returns everything recorded about a single
+	// query execution, or ErrNotFound when there is no execution with this id.
+	GetQueryExecutionDetail(ctx context.Context, id int64) (*QueryExecutionDetail, error)
+	// DeleteQueriesBefore deletes the queries selected by the filter that are
+	// older than the cutoff and returns how many were removed.
+	DeleteQueriesBefore(ctx context.Context, cutoff time.Time, filter QueryFilter) (int64, error)
+	// Stats returns the row count of each table and the size of the store.
+	Stats(ctx context.Context) (*DBStats, error)
+	// Ping verifies the connection to the database is alive.
+	Ping(ctx context.Context) error
 	Close() error
 }
 
+var (
+	// ErrNotFound is returned when the requested record does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrNotSupported is returned by the providers unable to serve a request.
+	ErrNotSupported = errors.New("not supported by this database provider")
+)
+
+// deleteQueriesBatchSize bounds the number of rows removed by a single
+// statement when pruning old queries.
+const deleteQueriesBatchSize = 10000
+
+// defaultUsageLookback is used when no usage lookback is configured.
+const defaultUsageLookback = 7 * 24 * time.Hour
+
+// usageLookbackOrDefault returns how far back the rules and dashboards usage
+// and the queries of a serie are looked up given the configured lookback.
+func usageLookbackOrDefault(lookback time.Duration) time.Duration {
+	if lookback > 0 {
+		return lookback
+	}
+	return defaultUsageLookback
+}
+
+// statsTables lists the tables reported by Provider.Stats.
+var statsTables = []string{"queries", "RulesUsage", "DashboardUsage"}
+
+// countTableRows counts the rows of each of the statsTables.
+func countTableRows(ctx context.Context, db *sql.DB) (map[string]int64, error) {
+	rows := make(map[string]int64, len(statsTables))
+	for _, table := range statsTables {
+		var count int64
+		if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+table).Scan(&count); err != nil {
+			return nil, fmt.Errorf("failed to count the rows of %s: %w", table, err)
+		}
+		rows[table] = count
+	}
+	return rows, nil
+}
+
+// ProviderConstructor builds a Provider from the current configuration.
+type ProviderConstructor func(ctx context.Context) (Provider, error)
+
+var (
+	providersMu sync.RWMutex
+	providers   = make(map[DatabaseProvider]ProviderConstructor)
+)
+
+// RegisterProvider makes a database provider available by name. It is meant
+// to be called from the init function of the package implementing the provider.
+func RegisterProvider(name DatabaseProvider, constructor ProviderConstructor) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+
+	if constructor == nil {
+		panic(fmt.Sprintf("db: constructor for provider %q is nil", name))
+	}
+	if _, exists := providers[name]; exists {
+		panic(fmt.Sprintf("db: provider %q is already registered", name))
+	}
+	providers[name] = constructor
+}
+
+// RegisteredProviders returns the sorted names of all registered providers.
+func RegisteredProviders() []string {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	return names
+}
+
 func GetDbProvider(ctx context.Context, dbProvider DatabaseProvider) (Provider, error) {
-	switch dbProvider {
-	case ClickHouse:
-		return newClickHouseProvider(ctx)
-	case PostGreSQL:
-		return newPostGreSQLProvider(ctx)
-	case SQLite:
-		return newSqliteProvider(ctx)
-	default:
-		return nil, fmt.Errorf("invalid database type %q, only 'clickhouse' and 'postgresql' are supported", dbProvider)
+	providersMu.RLock()
+	constructor, ok := providers[dbProvider]
+	providersMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("invalid database type %q, supported values are: %s", dbProvider, strings.Join(RegisteredProviders(), ", "))
 	}
+	return constructor(ctx)
 }
 
 var deniedKeywords = []string{"DROP", "DELETE", "UPDATE", "INSERT", "ALTER", "TRUNCATE", "EXEC", "--", ";"}
@@ -56,7 +163,37 @@ func containsDeniedPattern(query string) bool {
 	return false
 }
 
+// explainPrefixes are the statement prefixes used by the providers to
+// explain a query, the explained query must be a read one as well.
+var explainPrefixes = []string{"EXPLAIN QUERY PLAN ", "EXPLAIN ANALYZE ", "EXPLAIN "}
+
+// isReadStatement reports whether the query is a SELECT statement, possibly
+// with common table expressions or explained.
+func isReadStatement(query string) bool {
+	statement := strings.ToUpper(strings.TrimSpace(query))
+	for _, prefix := range explainPrefixes {
+		if strings.HasPrefix(statement, prefix) {
+			statement = strings.TrimSpace(statement[len(prefix):])
+			break
+		}
+	}
+	statement = strings.TrimLeft(statement, "( \t\r\n")
+
+	for _, keyword := range []string{"SELECT", "WITH"} {
+		if rest, ok := strings.CutPrefix(statement, keyword); ok {
+			return rest == "" || !unicode.IsLetter(rune(rest[0])) && rest[0] != '_'
+		}
+	}
+	return false
+}
+
+// ValidateSQLQuery rejects the queries the analytics API must not run, that
+// is anything but a single read statement.
 func ValidateSQLQuery(query string) error {
+	if !isReadStatement(query) {
+		return fmt.Errorf("only SELECT queries are allowed")
+	}
+
 	if containsDeniedKeyword(query) {
 		return fmt.Errorf("query contains disallowed keyword")
 	}
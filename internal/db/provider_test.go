@@ -0,0 +1,77 @@
+package db
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeProvider struct {
+	Provider
+}
+
+func TestGetDbProvider_Registry(t *testing.T) {
+	const fake DatabaseProvider = "fake"
+
+	expected := &fakeProvider{}
+	RegisterProvider(fake, func(ctx context.Context) (Provider, error) {
+		return expected, nil
+	})
+	t.Cleanup(func() {
+		providersMu.Lock()
+		defer providersMu.Unlock()
+		delete(providers, fake)
+	})
+
+	config.DefaultConfig.Database.Provider = string(fake)
+	t.Cleanup(func() {
+		config.DefaultConfig.Database.Provider = ""
+	})
+
+	provider, err := GetDbProvider(context.Background(), DatabaseProvider(config.DefaultConfig.Database.Provider))
+	require.NoError(t, err)
+	assert.Same(t, expected, provider)
+	assert.Contains(t, RegisteredProviders(), string(fake))
+}
+
+func TestGetDbProvider_Unknown(t *testing.T) {
+	provider, err := GetDbProvider(context.Background(), "unknown")
+	assert.Error(t, err)
+	assert.Nil(t, provider)
+}
+
+func TestRegisterProvider_Duplicate(t *testing.T) {
+	assert.Panics(t, func() {
+		RegisterProvider(SQLite, newSqliteProvider)
+	})
+}
+
+func TestValidateSQLQuery(t *testing.T) {
+	for _, query := range []string{
+		"SELECT 1",
+		"  select * from queries where statusCode = 200",
+		"WITH slow AS (SELECT * FROM queries WHERE duration > 1000) SELECT COUNT(*) FROM slow",
+		"(SELECT 1) UNION (SELECT 2)",
+		"EXPLAIN QUERY PLAN SELECT * FROM queries",
+		"EXPLAIN ANALYZE SELECT * FROM queries",
+	} {
+		assert.NoError(t, ValidateSQLQuery(query), query)
+	}
+
+	for _, query := range []string{
+		"",
+		"DELETE FROM queries",
+		"PRAGMA writable_schema = ON",
+		"ATTACH DATABASE '/tmp/other.db' AS other",
+		"CREATE TABLE copy AS SELECT * FROM queries",
+		"VACUUM INTO '/tmp/copy.db'",
+		"SELECTED",
+		"EXPLAIN ANALYZE CREATE TABLE copy AS SELECT * FROM queries",
+		"SELECT 1; DROP TABLE queries",
+	} {
+		assert.Error(t, ValidateSQLQuery(query), query)
+	}
+}
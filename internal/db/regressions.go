@@ -0,0 +1,44 @@
+package db
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// regressionWindows returns the bounds of the baseline window, immediately
+// followed by the current window ending at now.
+func regressionWindows(now time.Time, currentWindow, baselineWindow time.Duration) (baselineStart, currentStart time.Time) {
+	currentStart = now.Add(-currentWindow)
+	return currentStart.Add(-baselineWindow), currentStart
+}
+
+// latencyRegressions keeps the fingerprints whose current p95 is more than
+// factor times their baseline p95, largest regression first.
+func latencyRegressions(candidates []LatencyRegression, factor float64) []LatencyRegression {
+	results := make([]LatencyRegression, 0)
+	for _, c := range candidates {
+		if c.BaselineP95 <= 0 {
+			continue
+		}
+		c.Ratio = c.CurrentP95 / c.BaselineP95
+		if c.Ratio > factor {
+			results = append(results, c)
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Ratio > results[j].Ratio
+	})
+	return results
+}
+
+// nearestRankP95 returns the 95th percentile of the given durations using the
+// nearest-rank method, for databases without a percentile function.
+func nearestRankP95(durations []float64) float64 {
+	if len(durations) == 0 {
+		return 0
+	}
+	sort.Float64s(durations)
+	return durations[int(math.Ceil(float64(len(durations))*0.95))-1]
+}
@@ -0,0 +1,105 @@
+package db
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// StatusClass groups the status codes of the queries: "1xx" to "5xx",
+// "success" for codes below 400 and "error" for 400 and above.
+type StatusClass string
+
+const (
+	StatusClassSuccess StatusClass = "success"
+	StatusClassError   StatusClass = "error"
+)
+
+// ParseStatusClass validates a status class, an empty class matches every
+// status code.
+func ParseStatusClass(s string) (StatusClass, error) {
+	class := StatusClass(strings.ToLower(s))
+	if _, _, err := class.bounds(); err != nil {
+		return "", err
+	}
+	return class, nil
+}
+
+// bounds returns the status codes of the class as the [low, high) range.
+func (c StatusClass) bounds() (int, int, error) {
+	switch c {
+	case "":
+		return 0, 1000, nil
+	case StatusClassSuccess:
+		return 0, 400, nil
+	case StatusClassError:
+		return 400, 1000, nil
+	}
+	if len(c) == 3 && strings.HasSuffix(string(c), "xx") {
+		if n, err := strconv.Atoi(string(c[0])); err == nil && n >= 1 && n <= 5 {
+			return n * 100, (n + 1) * 100, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("unknown status class %q", c)
+}
+
+// QueryMatch selects queries by type and status class. Empty fields match
+// every query.
+type QueryMatch struct {
+	Type   QueryType
+	Status StatusClass
+}
+
+// QueryFilter selects the queries matching Match but none of Exclude.
+type QueryFilter struct {
+	Match   QueryMatch
+	Exclude []QueryMatch
+}
+
+func (m QueryMatch) condition(typeColumn, statusColumn string) (string, []interface{}) {
+	conds := make([]string, 0, 2)
+	args := make([]interface{}, 0, 3)
+	if m.Type != "" {
+		conds = append(conds, typeColumn+" = ?")
+		args = append(args, string(m.Type))
+	}
+	if m.Status != "" {
+		low, high, _ := m.Status.bounds()
+		conds = append(conds, statusColumn+" >= ? AND "+statusColumn+" < ?")
+		args = append(args, low, high)
+	}
+	if len(conds) == 0 {
+		return "1 = 1", nil
+	}
+	return "(" + strings.Join(conds, " AND ") + ")", args
+}
+
+// where returns the filter as conditions to append to a WHERE clause, with
+// ? placeholders.
+func (f QueryFilter) where(typeColumn, statusColumn string) (string, []interface{}) {
+	cond, args := f.Match.condition(typeColumn, statusColumn)
+	var sb strings.Builder
+	sb.WriteString(" AND " + cond)
+	for _, m := range f.Exclude {
+		exclude, excludeArgs := m.condition(typeColumn, statusColumn)
+		sb.WriteString(" AND NOT " + exclude)
+		args = append(args, excludeArgs...)
+	}
+	return sb.String(), args
+}
+
+// rebindPostgres replaces the ? placeholders of the query with the numbered
+// placeholders of PostgreSQL.
+func rebindPostgres(query string) string {
+	var sb strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			sb.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
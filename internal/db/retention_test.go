@@ -0,0 +1,34 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryFilter_Where(t *testing.T) {
+	where, args := QueryFilter{}.where("type", "statusCode")
+	assert.Equal(t, " AND 1 = 1", where)
+	assert.Empty(t, args)
+
+	where, args = QueryFilter{
+		Match:   QueryMatch{Type: QueryTypeRange},
+		Exclude: []QueryMatch{{Status: StatusClassError}, {Type: QueryTypeInstant, Status: "5xx"}},
+	}.where("type", "statusCode")
+	assert.Equal(t, " AND (type = ?) AND NOT (statusCode >= ? AND statusCode < ?) AND NOT (type = ? AND statusCode >= ? AND statusCode < ?)", where)
+	assert.Equal(t, []interface{}{"range", 400, 1000, "instant", 500, 600}, args)
+
+	assert.Equal(t, "ts < $1 AND (type = $2) LIMIT $3", rebindPostgres("ts < ? AND (type = ?) LIMIT ?"))
+}
+
+func TestParseStatusClass(t *testing.T) {
+	for _, valid := range []string{"", "success", "error", "1xx", "4XX", "5xx"} {
+		_, err := ParseStatusClass(valid)
+		require.NoError(t, err, valid)
+	}
+	for _, invalid := range []string{"0xx", "6xx", "4x", "failed"} {
+		_, err := ParseStatusClass(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
@@ -1,12 +1,16 @@
 package db
 
 import (
+	"cmp"
 	"context"
 	"database/sql"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"math"
+	"net/url"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
@@ -19,17 +23,29 @@ import (
 type SQLiteProvider struct {
 	mu sync.RWMutex
 	db *sql.DB
+
+	// queryLabels enables the query_labels table, which stores every label
+	// of a query as a separate row for fast label based filtering.
+	queryLabels bool
+	// usageLookback is how far back the rules and dashboards usage and the
+	// queries of a serie are looked up.
+	usageLookback time.Duration
 }
 
 const (
-	createSqliteTableStmt = `
-		CREATE TABLE IF NOT EXISTS queries (
+	// sqliteQueriesTableColumns defines the columns of the queries table.
+	// The id is an alias of the rowid which, being AUTOINCREMENT, is kept
+	// by VACUUM and never reused for the query_labels to keep pointing at
+	// the right queries.
+	sqliteQueriesTableColumns = `
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
 			ts TIMESTAMP,
 			queryParam TEXT,
 			timeParam TIMESTAMP,
 			duration INTEGER,
 			statusCode INTEGER,
 			bodySize INTEGER,
+			totalBytes INTEGER,
 			fingerprint TEXT,
 			labelMatchers TEXT,
 			type TEXT,
@@ -37,13 +53,40 @@ const (
 			start TIMESTAMP,
 			"end" TIMESTAMP,
 			totalQueryableSamples INTEGER,
-			peakSamples INTEGER
-		);
+			peakSamples INTEGER,
+			cached INTEGER,
+			error TEXT,
+			tenant TEXT,
+			sourceIP TEXT,
+			metricNames TEXT,
+			upstreamDuration INTEGER,
+			method TEXT,
+			source TEXT NOT NULL DEFAULT 'user',
+			dashboardUID TEXT,
+			resultStatus TEXT
 	`
-	configureSqliteStmt = `
-		PRAGMA journal_mode = WAL;
-		PRAGMA synchronous = normal;
-		PRAGMA journal_size_limit = 6144000;
+	createSqliteTableStmt = `
+		CREATE TABLE IF NOT EXISTS queries (` + sqliteQueriesTableColumns + `);
+	`
+	// createSqliteQueriesIndexesStmt indexes the columns the analytics
+	// filter on, the metric names being indexed by the query_labels table.
+	createSqliteQueriesIndexesStmt = `
+		CREATE INDEX IF NOT EXISTS queries_ts_idx ON queries (ts);
+		CREATE INDEX IF NOT EXISTS queries_fingerprint_ts_idx ON queries (fingerprint, ts);
+		CREATE INDEX IF NOT EXISTS queries_type_ts_idx ON queries (type, ts);
+	`
+	createSqliteQueryLabelsTableStmt = `
+		CREATE TABLE IF NOT EXISTS query_labels (
+			query_id INTEGER NOT NULL,
+			label_name TEXT NOT NULL,
+			label_value TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS query_labels_name_value_idx ON query_labels (label_name, label_value, query_id);
+		CREATE INDEX IF NOT EXISTS query_labels_query_id_idx ON query_labels (query_id);
+		CREATE TRIGGER IF NOT EXISTS queries_delete_labels AFTER DELETE ON queries
+		BEGIN
+			DELETE FROM query_labels WHERE query_id = old.id;
+		END;
 	`
 
 	createSqliteRulesUsageTableStmt = `
@@ -68,12 +111,65 @@ const (
 	`
 )
 
+func init() {
+	RegisterProvider(SQLite, newSqliteProvider)
+}
+
 func RegisterSqliteFlags(flagSet *flag.FlagSet) {
 	flagSet.StringVar(&config.DefaultConfig.Database.SQLite.DatabasePath, "sqlite-database-path", "prom-analytics-proxy.db", "Path to the sqlite database.")
+	flagSet.BoolVar(&config.DefaultConfig.Database.SQLite.QueryLabels, "sqlite-query-labels", false, "Store the labels of each query in a separate indexed table to speed up label based filtering.")
+	flagSet.DurationVar(&config.DefaultConfig.Database.SQLite.BusyTimeout, "sqlite-busy-timeout", defaultSqliteBusyTimeout, "How long a connection waits for a lock held by another one before failing with SQLITE_BUSY.")
+	flagSet.StringVar(&config.DefaultConfig.Database.SQLite.JournalMode, "sqlite-journal-mode", defaultSqliteJournalMode, "The sqlite journal mode. Supported values: delete, truncate, persist, memory, wal, off.")
+	flagSet.StringVar(&config.DefaultConfig.Database.SQLite.Synchronous, "sqlite-synchronous", defaultSqliteSynchronous, "The sqlite synchronous mode, trading durability for write throughput. Supported values: off, normal, full, extra.")
+}
+
+const (
+	defaultSqliteBusyTimeout = 5 * time.Second
+	defaultSqliteJournalMode = "wal"
+	defaultSqliteSynchronous = "normal"
+)
+
+var (
+	sqliteJournalModes = []string{"delete", "truncate", "persist", "memory", "wal", "off"}
+	sqliteSynchronous  = []string{"off", "normal", "full", "extra"}
+)
+
+// sqliteDSN builds the data source name of the database. The pragmas are
+// part of it so they apply to every connection of the pool rather than only
+// the one that happens to run them.
+func sqliteDSN(cfg config.SQLiteConfig) (string, error) {
+	journalMode := strings.ToLower(cmp.Or(cfg.JournalMode, defaultSqliteJournalMode))
+	if !slices.Contains(sqliteJournalModes, journalMode) {
+		return "", fmt.Errorf("invalid sqlite journal mode %q, supported values: %s", cfg.JournalMode, strings.Join(sqliteJournalModes, ", "))
+	}
+	synchronous := strings.ToLower(cmp.Or(cfg.Synchronous, defaultSqliteSynchronous))
+	if !slices.Contains(sqliteSynchronous, synchronous) {
+		return "", fmt.Errorf("invalid sqlite synchronous mode %q, supported values: %s", cfg.Synchronous, strings.Join(sqliteSynchronous, ", "))
+	}
+	if cfg.BusyTimeout < 0 {
+		return "", fmt.Errorf("invalid sqlite busy timeout %s, must not be negative", cfg.BusyTimeout)
+	}
+
+	params := url.Values{}
+	params.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", cfg.BusyTimeout.Milliseconds()))
+	params.Add("_pragma", fmt.Sprintf("journal_mode(%s)", journalMode))
+	params.Add("_pragma", fmt.Sprintf("synchronous(%s)", synchronous))
+	params.Add("_pragma", "journal_size_limit(6144000)")
+
+	separator := "?"
+	if strings.Contains(cfg.DatabasePath, "?") {
+		separator = "&"
+	}
+	return cfg.DatabasePath + separator + params.Encode(), nil
 }
 
 func newSqliteProvider(ctx context.Context) (Provider, error) {
-	db, err := otelsql.Open("sqlite", config.DefaultConfig.Database.SQLite.DatabasePath, otelsql.WithAttributes(semconv.DBSystemSqlite))
+	dsn, err := sqliteDSN(config.DefaultConfig.Database.SQLite)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := otelsql.Open("sqlite", dsn, otelsql.WithAttributes(semconv.DBSystemSqlite))
 	if err != nil {
 		return nil, fmt.Errorf("failed to open sqlite database: %w", err)
 	}
@@ -86,8 +182,26 @@ func newSqliteProvider(ctx context.Context) (Provider, error) {
 		return nil, fmt.Errorf("failed to create table: %w", err)
 	}
 
-	if _, err := db.Exec(configureSqliteStmt); err != nil {
-		return nil, fmt.Errorf("failed to configure sqlite database: %w)", err)
+	if err := migrateSqliteMetricNames(ctx, db); err != nil {
+		return nil, err
+	}
+
+	if err := migrateSqliteTimestampsToUTC(ctx, db); err != nil {
+		return nil, err
+	}
+
+	for _, c := range sqliteQueriesColumnMigrations {
+		if err := addSqliteColumnIfMissing(ctx, db, c.column, c.definition); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := migrateSqliteQueriesID(ctx, db); err != nil {
+		return nil, err
+	}
+
+	if _, err := db.ExecContext(ctx, createSqliteQueriesIndexesStmt); err != nil {
+		return nil, fmt.Errorf("failed to create queries indexes: %w", err)
 	}
 
 	if _, err := db.ExecContext(ctx, createSqliteRulesUsageTableStmt); err != nil {
@@ -98,60 +212,356 @@ func newSqliteProvider(ctx context.Context) (Provider, error) {
 		return nil, fmt.Errorf("failed to create dashboard usage table: %w", err)
 	}
 
-	return &SQLiteProvider{
-		db: db,
-	}, nil
+	p := &SQLiteProvider{
+		db:            db,
+		queryLabels:   config.DefaultConfig.Database.SQLite.QueryLabels,
+		usageLookback: usageLookbackOrDefault(config.DefaultConfig.Analytics.UsageLookback),
+	}
+
+	if p.queryLabels {
+		if err := p.createQueryLabelsTable(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// migrateSqliteMetricNames adds the metricNames column to tables created
+// before it existed, populating it from the stored label matchers.
+func migrateSqliteMetricNames(ctx context.Context, db *sql.DB) error {
+	exists, err := sqliteColumnExists(ctx, db, "metricNames")
+	if err != nil || exists {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "ALTER TABLE queries ADD COLUMN metricNames TEXT"); err != nil {
+		return fmt.Errorf("failed to add metric names column: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE queries SET metricNames = (
+			SELECT json_group_array(DISTINCT json_extract(m.value, '$.__name__'))
+			FROM json_each(CAST(queries.labelMatchers AS TEXT)) m
+			WHERE json_extract(m.value, '$.__name__') IS NOT NULL
+		)
+		WHERE json_valid(CAST(labelMatchers AS TEXT))
+	`); err != nil {
+		return fmt.Errorf("failed to populate metric names column: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// sqliteUTCTimestampsVersion is the user_version of the databases whose
+// queries timestamps are stored in UTC.
+const sqliteUTCTimestampsVersion = 1
+
+// migrateSqliteTimestampsToUTC rewrites in UTC the queries timestamps stored
+// in the zone of the host by the previous releases, as the timestamps are
+// compared as text to UTC bounds.
+func migrateSqliteTimestampsToUTC(ctx context.Context, db *sql.DB) error {
+	var version int
+	if err := db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return fmt.Errorf("failed to get database version: %w", err)
+	}
+	if version >= sqliteUTCTimestampsVersion {
+		return nil
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// The fraction of the seconds, if any, is kept as it was written.
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(`
+		UPDATE queries
+		SET ts = datetime(%[1]s, 'unixepoch') || substr(ts, 20, instr(substr(ts, 12), ' ') - 9) || ' +0000 UTC'
+		WHERE ts LIKE '____-__-__ __:__:__%%' AND %[2]s != '+0000'
+	`, sqliteUnixTime("ts"), sqliteTimeOffset("ts"))); err != nil {
+		return fmt.Errorf("failed to convert queries timestamps to UTC: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", sqliteUTCTimestampsVersion)); err != nil {
+		return fmt.Errorf("failed to set database version: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// sqliteQueriesColumnMigrations are the columns added to the queries table
+// after it was first released, besides metricNames which is populated from
+// the label matchers. They are left empty for the existing rows unless their
+// definition has a default.
+var sqliteQueriesColumnMigrations = []struct {
+	column, definition string
+}{
+	{"totalBytes", "totalBytes INTEGER"},
+	{"cached", "cached INTEGER"},
+	{"error", "error TEXT"},
+	{"tenant", "tenant TEXT"},
+	{"sourceIP", "sourceIP TEXT"},
+	// The upstream latency of the existing rows is unknown.
+	{"upstreamDuration", "upstreamDuration INTEGER"},
+	{"method", "method TEXT"},
+	// The existing rows are attributed to users.
+	{"source", "source TEXT NOT NULL DEFAULT 'user'"},
+	{"dashboardUID", "dashboardUID TEXT"},
+	// The failures of the existing rows are told by their status code only.
+	{"resultStatus", "resultStatus TEXT"},
+}
+
+// migrateSqliteQueriesID rebuilds the queries tables created before the id
+// column existed, whose query_labels pointed at their implicit rowid. The
+// rowid of every query becomes its id so its labels are kept. It runs after
+// the columns migrations so the rebuilt table has them all.
+func migrateSqliteQueriesID(ctx context.Context, db *sql.DB) error {
+	exists, err := sqliteColumnExists(ctx, db, "id")
+	if err != nil || exists {
+		return err
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT name FROM pragma_table_info('queries')")
+	if err != nil {
+		return fmt.Errorf("failed to list queries columns: %w", err)
+	}
+	columns := []string{}
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			rows.Close()
+			return fmt.Errorf("unable to scan row: %w", err)
+		}
+		columns = append(columns, fmt.Sprintf("%q", column))
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// The indexes and the trigger of the queries table are dropped with it
+	// and created again on the rebuilt one.
+	list := strings.Join(columns, ", ")
+	for _, stmt := range []string{
+		"CREATE TABLE queries_rebuild (" + sqliteQueriesTableColumns + ")",
+		"INSERT INTO queries_rebuild (id, " + list + ") SELECT rowid, " + list + " FROM queries ORDER BY rowid",
+		"DROP TABLE queries",
+		"ALTER TABLE queries_rebuild RENAME TO queries",
+	} {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("failed to rebuild queries table with an id column: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// sqliteColumnExists reports whether the queries table has the column.
+func sqliteColumnExists(ctx context.Context, db *sql.DB, column string) (bool, error) {
+	var exists int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM pragma_table_info('queries') WHERE name = ?", column).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("failed to check %s column: %w", column, err)
+	}
+	return exists > 0, nil
+}
+
+// addSqliteColumnIfMissing adds the column, given its definition, to queries
+// tables created before it existed.
+func addSqliteColumnIfMissing(ctx context.Context, db *sql.DB, column, definition string) error {
+	exists, err := sqliteColumnExists(ctx, db, column)
+	if err != nil || exists {
+		return err
+	}
+
+	if _, err := db.ExecContext(ctx, "ALTER TABLE queries ADD COLUMN "+definition); err != nil {
+		return fmt.Errorf("failed to add %s column: %w", column, err)
+	}
+	return nil
+}
+
+// usageSince returns the datetime modifier selecting the usage recorded
+// within the usage lookback.
+func (p *SQLiteProvider) usageSince() string {
+	return fmt.Sprintf("-%d seconds", int64(p.usageLookback.Seconds()))
+}
+
+// createQueryLabelsTable creates the query_labels table, populating it from
+// the existing queries the first time it is created.
+func (p *SQLiteProvider) createQueryLabelsTable(ctx context.Context) error {
+	var exists int
+	err := p.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'query_labels'").Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("failed to check query labels table: %w", err)
+	}
+
+	if _, err := p.db.ExecContext(ctx, createSqliteQueryLabelsTableStmt); err != nil {
+		return fmt.Errorf("failed to create query labels table: %w", err)
+	}
+
+	if exists > 0 {
+		return nil
+	}
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, "SELECT id, labelMatchers FROM queries")
+	if err != nil {
+		return fmt.Errorf("failed to query existing queries: %w", err)
+	}
+
+	type queryLabels struct {
+		id            int64
+		labelMatchers LabelMatchers
+	}
+	existing := []queryLabels{}
+	for rows.Next() {
+		var (
+			q   queryLabels
+			raw []byte
+		)
+		if err := rows.Scan(&q.id, &raw); err != nil {
+			rows.Close()
+			return fmt.Errorf("unable to scan row: %w", err)
+		}
+		// Queries that could not be parsed have no labels to store.
+		if json.Unmarshal(raw, &q.labelMatchers) == nil {
+			existing = append(existing, q)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	for _, q := range existing {
+		if err := insertQueryLabels(ctx, tx, q.id, q.labelMatchers); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// insertQueryLabels stores each distinct label of the query as a row of the
+// query_labels table.
+func insertQueryLabels(ctx context.Context, tx *sql.Tx, queryID int64, labelMatchers LabelMatchers) error {
+	seen := make(map[[2]string]struct{})
+	for _, matchers := range labelMatchers {
+		for name, value := range matchers {
+			key := [2]string{name, value}
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+
+			_, err := tx.ExecContext(ctx, "INSERT INTO query_labels (query_id, label_name, label_value) VALUES (?, ?, ?)", queryID, name, value)
+			if err != nil {
+				return fmt.Errorf("failed to insert query labels: %w", err)
+			}
+		}
+	}
+	return nil
 }
 
 func (p *SQLiteProvider) Close() error {
 	return p.db.Close()
 }
 
+func (p *SQLiteProvider) Ping(ctx context.Context) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.db.PingContext(ctx)
+}
+
+func (p *SQLiteProvider) Stats(ctx context.Context) (*DBStats, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	tableRows, err := countTableRows(ctx, p.db)
+	if err != nil {
+		return nil, err
+	}
+
+	var size int64
+	err = p.db.QueryRowContext(ctx, "SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()").Scan(&size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the database size: %w", err)
+	}
+
+	return &DBStats{TableRows: tableRows, SizeBytes: size}, nil
+}
+
 func (p *SQLiteProvider) WithDB(f func(db *sql.DB)) {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 	f(p.db)
 }
 
+const (
+	insertSqliteQueriesStmt = `
+		INSERT INTO queries (
+			ts, queryParam, timeParam, duration, statusCode, bodySize, totalBytes, fingerprint, labelMatchers, type, step, start, "end", totalQueryableSamples, peakSamples, cached, error, tenant, sourceIP, metricNames, upstreamDuration, method, source, dashboardUID, resultStatus
+		) VALUES `
+	insertSqliteQueriesPlaceholders = "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+)
+
 func (p *SQLiteProvider) Insert(ctx context.Context, queries []Query) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	query := `
-		INSERT INTO queries (
-			ts, queryParam, timeParam, duration, statusCode, bodySize, fingerprint, labelMatchers, type, step, start, "end", totalQueryableSamples, peakSamples
-		) VALUES `
 
-	values := make([]interface{}, 0, len(queries)*14)
+	if p.queryLabels {
+		return p.insertWithLabels(ctx, queries)
+	}
+
+	query := insertSqliteQueriesStmt
+
+	values := make([]interface{}, 0, len(queries)*25)
 	placeholders := ""
 
 	for i, q := range queries {
-		labelMatchersJSON, err := json.Marshal(q.LabelMatchers)
+		queryValues, err := sqliteQueryValues(q)
 		if err != nil {
-			return fmt.Errorf("failed to marshal label matchers: %w", err)
+			return err
 		}
 
-		placeholders += "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+		placeholders += insertSqliteQueriesPlaceholders
 
 		if i < len(queries)-1 {
 			placeholders += ", "
 		}
 
-		values = append(values,
-			q.TS,
-			q.QueryParam,
-			q.TimeParam,
-			q.Duration.Milliseconds(),
-			q.StatusCode,
-			q.BodySize,
-			q.Fingerprint,
-			labelMatchersJSON,
-			q.Type,
-			q.Step,
-			q.Start,
-			q.End,
-			q.TotalQueryableSamples,
-			q.PeakSamples,
-		)
+		values = append(values, queryValues...)
 	}
 
 	query += placeholders
@@ -164,6 +574,89 @@ func (p *SQLiteProvider) Insert(ctx context.Context, queries []Query) error {
 	return nil
 }
 
+// insertWithLabels inserts the queries one by one so the id of each one
+// is known to populate the query_labels table.
+func (p *SQLiteProvider) insertWithLabels(ctx context.Context, queries []Query) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, insertSqliteQueriesStmt+insertSqliteQueriesPlaceholders)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, q := range queries {
+		values, err := sqliteQueryValues(q)
+		if err != nil {
+			return err
+		}
+
+		res, err := stmt.ExecContext(ctx, values...)
+		if err != nil {
+			return fmt.Errorf("failed to execute insert query: %w", err)
+		}
+
+		id, err := res.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("failed to get inserted query id: %w", err)
+		}
+
+		if err := insertQueryLabels(ctx, tx, id, q.LabelMatchers); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+func sqliteQueryValues(q Query) ([]interface{}, error) {
+	labelMatchersJSON, err := json.Marshal(q.LabelMatchers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal label matchers: %w", err)
+	}
+
+	metricNamesJSON, err := json.Marshal(q.MetricNames)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal metric names: %w", err)
+	}
+
+	return []interface{}{
+		q.TS.UTC(),
+		q.QueryParam,
+		q.TimeParam,
+		q.Duration.Milliseconds(),
+		q.StatusCode,
+		q.BodySize,
+		q.TotalBytes,
+		q.Fingerprint,
+		labelMatchersJSON,
+		q.Type,
+		q.Step,
+		q.Start,
+		q.End,
+		q.TotalQueryableSamples,
+		q.PeakSamples,
+		q.Cached,
+		q.Error,
+		q.Tenant,
+		q.SourceIP,
+		string(metricNamesJSON),
+		q.UpstreamDuration.Milliseconds(),
+		q.Method,
+		q.Source.orDefault(),
+		nullString(q.DashboardUID),
+		nullString(q.ResultStatus),
+	}, nil
+}
+
 func (p *SQLiteProvider) Query(ctx context.Context, query string) (*QueryResult, error) {
 	if err := ValidateSQLQuery(query); err != nil {
 		return nil, fmt.Errorf("query not allowed: %w", err)
@@ -225,33 +718,37 @@ func (p *SQLiteProvider) GetQueriesBySerieName(
 	ctx context.Context,
 	serieName string,
 	page int,
-	pageSize int) (*PagedResult, error) {
+	pageSize int,
+	sortBy string,
+	sortOrder string) (*PagedResult, error) {
 
 	endTime := time.Now()
-	startTime := endTime.Add(-30 * 24 * time.Hour) // 30 days ago
+	startTime := endTime.Add(-p.usageLookback)
 
-	// Format timestamps for SQLite (YYYY-MM-DD HH:MM:SS)
-	startTimeFormatted := startTime.Format("2006-01-02 15:04:05")
-	endTimeFormatted := endTime.Format("2006-01-02 15:04:05")
+	// Format timestamps for SQLite (YYYY-MM-DD HH:MM:SS in UTC)
+	startTimeFormatted := sqliteTime(startTime)
+	endTimeFormatted := sqliteTime(endTime)
 
 	totalCount, err := p.getQueriesBySerieNameTotalCount(ctx, serieName, startTimeFormatted, endTimeFormatted)
 	if err != nil {
 		return nil, err
 	}
 
-	// Calculate total pages
-	totalPages := int(math.Ceil(float64(totalCount) / float64(pageSize)))
-
-	data, err := p.getQueriesBySerieNameQueryData(ctx, serieName, startTimeFormatted, endTimeFormatted, page, pageSize)
+	data, err := p.getQueriesBySerieNameQueryData(ctx, serieName, startTimeFormatted, endTimeFormatted, page, pageSize, sortBy, sortOrder)
 	if err != nil {
 		return nil, err
 	}
 
-	return &PagedResult{
-		Total:      totalCount,
-		TotalPages: totalPages,
-		Data:       data,
-	}, nil
+	return newPagedResult(data, totalCount, page, pageSize, page*pageSize), nil
+}
+
+// serieNameFilter returns the condition matching the queries selecting the
+// given serie name, using the query_labels table when it is enabled.
+func (p *SQLiteProvider) serieNameFilter() string {
+	if p.queryLabels {
+		return "id IN (SELECT query_id FROM query_labels WHERE label_name = '__name__' AND label_value = ?)"
+	}
+	return "EXISTS (SELECT 1 FROM json_each(metricNames) WHERE value = ?)"
 }
 
 func (p *SQLiteProvider) getQueriesBySerieNameTotalCount(ctx context.Context, serieName, startTime, endTime string) (int, error) {
@@ -259,7 +756,7 @@ func (p *SQLiteProvider) getQueriesBySerieNameTotalCount(ctx context.Context, se
 		SELECT COUNT(DISTINCT queryParam) AS TotalCount
 		FROM queries
 		WHERE
-			json_extract(labelMatchers, '$[0].__name__') = ?
+			` + p.serieNameFilter() + `
 			AND ts BETWEEN ? AND ?;
 	`
 
@@ -272,22 +769,24 @@ func (p *SQLiteProvider) getQueriesBySerieNameTotalCount(ctx context.Context, se
 	return totalCount, nil
 }
 
-func (p *SQLiteProvider) getQueriesBySerieNameQueryData(ctx context.Context, serieName, startTime, endTime string, page, pageSize int) ([]QueriesBySerieNameResult, error) {
+func (p *SQLiteProvider) getQueriesBySerieNameQueryData(ctx context.Context, serieName, startTime, endTime string, page, pageSize int, sortBy, sortOrder string) ([]QueriesBySerieNameResult, error) {
 	query := `
 		SELECT
-			queryParam AS query,
+			queryParam,
 			AVG(duration) AS avgDuration,
 			AVG(peakSamples) AS avgPeakySamples,
-			MAX(peakSamples) AS maxPeakSamples
+			MAX(peakSamples) AS maxPeakSamples,
+			COUNT(*) AS executions,
+			100.0 * SUM(CASE WHEN ` + failedQueryCondition + ` THEN 1 ELSE 0 END) / COUNT(*) AS errorRatePercent
 		FROM
 			queries
 		WHERE
-			json_extract(labelMatchers, '$[0].__name__') = ?
+			` + p.serieNameFilter() + `
 			AND ts BETWEEN ? AND ?
 		GROUP BY
 			queryParam
 		ORDER BY
-			avgDuration DESC
+			` + serieQueriesOrderBy(sortBy, sortOrder) + `
 		LIMIT ? OFFSET ?;
 	`
 
@@ -300,7 +799,7 @@ func (p *SQLiteProvider) getQueriesBySerieNameQueryData(ctx context.Context, ser
 	data := []QueriesBySerieNameResult{}
 	for rows.Next() {
 		var r QueriesBySerieNameResult
-		if err := rows.Scan(&r.QueryParam, &r.AvgDuration, &r.AvgPeakySamples, &r.MaxPeakSamples); err != nil {
+		if err := rows.Scan(&r.QueryParam, &r.AvgDuration, &r.AvgPeakySamples, &r.MaxPeakSamples, &r.Executions, &r.ErrorRatePercent); err != nil {
 			return nil, fmt.Errorf("unable to scan row: %w", err)
 		}
 		data = append(data, r)
@@ -333,7 +832,7 @@ func (p *SQLiteProvider) InsertRulesUsage(ctx context.Context, rulesUsage []Rule
 	}
 	defer stmt.Close()
 
-	createdAt := time.Now()
+	createdAt := time.Now().UTC()
 
 	// Iterate over the rulesUsage slice and execute the insert statement
 	for _, rule := range rulesUsage {
@@ -375,17 +874,14 @@ func (p *SQLiteProvider) GetRulesUsage(ctx context.Context, serie string, kind s
 		FROM RulesUsage
 		WHERE serie = ? 
 		AND kind = ?
-		AND created_at >= datetime('now', '-30 days');
+		AND created_at >= datetime('now', ?);
 	`
 	var totalCount int
-	err := p.db.QueryRowContext(ctx, countQuery, serie, kind).Scan(&totalCount)
+	err := p.db.QueryRowContext(ctx, countQuery, serie, kind, p.usageSince()).Scan(&totalCount)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query total count: %w", err)
 	}
 
-	// Calculate total pages
-	totalPages := int(math.Ceil(float64(totalCount) / float64(pageSize)))
-
 	// Query for paginated results
 	query := `
 		WITH latest_rules AS (
@@ -399,7 +895,7 @@ func (p *SQLiteProvider) GetRulesUsage(ctx context.Context, serie string, kind s
 				created_at,
 				ROW_NUMBER() OVER (PARTITION BY serie, name ORDER BY created_at DESC) AS rank
 			FROM RulesUsage
-			WHERE serie = ? AND kind = ? AND created_at >= datetime('now', '-30 days')
+			WHERE serie = ? AND kind = ? AND created_at >= datetime('now', ?)
 		)
 		SELECT 
 			serie,
@@ -415,7 +911,7 @@ func (p *SQLiteProvider) GetRulesUsage(ctx context.Context, serie string, kind s
 		LIMIT ? OFFSET ?;
 	`
 
-	rows, err := p.db.QueryContext(ctx, query, serie, kind, pageSize, offset)
+	rows, err := p.db.QueryContext(ctx, query, serie, kind, p.usageSince(), pageSize, offset)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query rules usage: %w", err)
 	}
@@ -463,11 +959,7 @@ func (p *SQLiteProvider) GetRulesUsage(ctx context.Context, serie string, kind s
 		return nil, fmt.Errorf("row iteration error: %w", err)
 	}
 
-	return &PagedResult{
-		Total:      len(results),
-		TotalPages: totalPages,
-		Data:       results,
-	}, nil
+	return newPagedResult(results, totalCount, page, pageSize, offset), nil
 }
 
 func (p *SQLiteProvider) InsertDashboardUsage(ctx context.Context, dashboardUsage []DashboardUsage) error {
@@ -483,7 +975,7 @@ func (p *SQLiteProvider) InsertDashboardUsage(ctx context.Context, dashboardUsag
 		}
 	}()
 
-	createdAt := time.Now()
+	createdAt := time.Now().UTC()
 
 	// Prepare the SQL statement for insertion
 	stmt, err := tx.PrepareContext(ctx, `
@@ -526,17 +1018,14 @@ func (p *SQLiteProvider) GetDashboardUsage(ctx context.Context, serie string, pa
 		SELECT COUNT(DISTINCT name)
 		FROM DashboardUsage
 		WHERE serie = ? 
-		AND created_at >= datetime('now', '-30 days');
+		AND created_at >= datetime('now', ?);
 	`
 	var totalCount int
-	err := p.db.QueryRowContext(ctx, countQuery, serie).Scan(&totalCount)
+	err := p.db.QueryRowContext(ctx, countQuery, serie, p.usageSince()).Scan(&totalCount)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query total count: %w", err)
 	}
 
-	// Calculate total pages
-	totalPages := int(math.Ceil(float64(totalCount) / float64(pageSize)))
-
 	// Query for paginated results
 	query := `
 		WITH latest_rules AS (
@@ -548,7 +1037,7 @@ func (p *SQLiteProvider) GetDashboardUsage(ctx context.Context, serie string, pa
 				created_at,
 				ROW_NUMBER() OVER (PARTITION BY serie, name ORDER BY created_at DESC) AS rank
 			FROM DashboardUsage
-			WHERE serie = ? AND created_at >= datetime('now', '-30 days')
+			WHERE serie = ? AND created_at >= datetime('now', ?)
 		)
 		SELECT 
 			id,
@@ -562,7 +1051,7 @@ func (p *SQLiteProvider) GetDashboardUsage(ctx context.Context, serie string, pa
 		LIMIT ? OFFSET ?;
 	`
 
-	rows, err := p.db.QueryContext(ctx, query, serie, pageSize, offset)
+	rows, err := p.db.QueryContext(ctx, query, serie, p.usageSince(), pageSize, offset)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query dashboard usage: %w", err)
 	}
@@ -598,9 +1087,434 @@ func (p *SQLiteProvider) GetDashboardUsage(ctx context.Context, serie string, pa
 		return nil, fmt.Errorf("row iteration error: %w", err)
 	}
 
-	return &PagedResult{
-		Total:      len(results),
-		TotalPages: totalPages,
-		Data:       results,
-	}, nil
+	return newPagedResult(results, totalCount, page, pageSize, offset), nil
+}
+
+func (p *SQLiteProvider) GetQueriesSummary(ctx context.Context, startTime, endTime time.Time) (*QueriesSummary, error) {
+	// Format timestamps for SQLite (YYYY-MM-DD HH:MM:SS in UTC)
+	startTimeFormatted := sqliteTime(startTime)
+	endTimeFormatted := sqliteTime(endTime)
+
+	countQuery := `
+		SELECT
+			COUNT(*) AS totalQueries,
+			COALESCE(SUM(CASE WHEN ` + failedQueryCondition + ` THEN 1 ELSE 0 END), 0) AS failedQueries,
+			COALESCE(AVG(duration), 0) AS avgDuration
+		FROM queries
+		WHERE ts BETWEEN ? AND ?;
+	`
+
+	summary := &QueriesSummary{}
+	err := p.db.QueryRowContext(ctx, countQuery, startTimeFormatted, endTimeFormatted).Scan(&summary.TotalQueries, &summary.FailedQueries, &summary.AvgDuration)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query summary: %w", err)
+	}
+
+	if summary.TotalQueries == 0 {
+		return summary, nil
+	}
+
+	// SQLite has no percentile function, so pick the row at the p95 rank.
+	percentileQuery := `
+		SELECT duration
+		FROM queries
+		WHERE ts BETWEEN ? AND ?
+		ORDER BY duration ASC
+		LIMIT 1 OFFSET ?;
+	`
+
+	offset := int(math.Ceil(float64(summary.TotalQueries)*0.95)) - 1
+	err = p.db.QueryRowContext(ctx, percentileQuery, startTimeFormatted, endTimeFormatted, offset).Scan(&summary.P95Duration)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query p95 duration: %w", err)
+	}
+
+	return summary, nil
+}
+
+func (p *SQLiteProvider) DeleteQueriesBefore(ctx context.Context, cutoff time.Time, filter QueryFilter) (int64, error) {
+	where, filterArgs := filter.where("type", "statusCode")
+	query := fmt.Sprintf(`
+		DELETE FROM queries
+		WHERE id IN (
+			SELECT id FROM queries WHERE ts < ?%s LIMIT ?
+		);
+	`, where)
+
+	// Format timestamps for SQLite (YYYY-MM-DD HH:MM:SS in UTC)
+	args := append([]interface{}{sqliteTime(cutoff)}, filterArgs...)
+	args = append(args, deleteQueriesBatchSize)
+
+	var deleted int64
+	for {
+		n, err := p.deleteQueriesBatch(ctx, query, args)
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+		if n < deleteQueriesBatchSize {
+			return deleted, nil
+		}
+	}
+}
+
+func (p *SQLiteProvider) deleteQueriesBatch(ctx context.Context, query string, args []interface{}) (int64, error) {
+	// Lock per batch so inserts are not blocked for the whole deletion.
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	res, err := p.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete queries: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get deleted queries count: %w", err)
+	}
+	return n, nil
+}
+
+func (p *SQLiteProvider) GetSimilarDashboards(ctx context.Context, threshold float64) ([]SimilarDashboards, error) {
+	query := `
+		SELECT id, serie, MAX(name), MAX(url)
+		FROM DashboardUsage
+		WHERE created_at >= datetime('now', ?)
+		GROUP BY id, serie
+		ORDER BY id;
+	`
+
+	rows, err := p.db.QueryContext(ctx, query, p.usageSince())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query dashboard series: %w", err)
+	}
+	defer rows.Close()
+
+	dashboards, err := scanDashboardSeries(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	return similarDashboards(dashboards, threshold), nil
+}
+
+func (p *SQLiteProvider) GetTopQueries(ctx context.Context, startTime, endTime time.Time, limit int) ([]TopQuery, error) {
+	query := `
+		SELECT
+			fingerprint,
+			MIN(queryParam) AS queryParam,
+			COUNT(*) AS executions,
+			AVG(duration) AS avgDuration
+		FROM queries
+		WHERE ts BETWEEN ? AND ?
+		GROUP BY fingerprint
+		ORDER BY executions DESC, avgDuration DESC
+		LIMIT ?;
+	`
+
+	rows, err := p.db.QueryContext(ctx, query, sqliteTime(startTime), sqliteTime(endTime), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	data := []TopQuery{}
+	for rows.Next() {
+		var r TopQuery
+		if err := rows.Scan(&r.Fingerprint, &r.QueryParam, &r.Executions, &r.AvgDuration); err != nil {
+			return nil, fmt.Errorf("unable to scan row: %w", err)
+		}
+		data = append(data, r)
+	}
+
+	return data, nil
+}
+
+func (p *SQLiteProvider) GetQueryExecutionDetail(ctx context.Context, id int64) (*QueryExecutionDetail, error) {
+	query := "SELECT id, " + queryExecutionDetailColumns + " FROM queries WHERE id = ?"
+	return scanQueryExecutionDetail(p.db.QueryRowContext(ctx, query, id))
+}
+
+func (p *SQLiteProvider) GetSlowestQueries(ctx context.Context, tr TimeRange, tenant string, source string, limit int) ([]SlowQueryRow, error) {
+	query := `
+		SELECT id, ts, queryParam, duration, statusCode, peakSamples, fingerprint
+		FROM queries
+		WHERE ts BETWEEN ? AND ? AND (? = '' OR tenant = ?) AND (? = '' OR source = ?)
+		ORDER BY duration DESC
+		LIMIT ?;
+	`
+
+	rows, err := p.db.QueryContext(ctx, query, sqliteTime(tr.From), sqliteTime(tr.To), tenant, tenant, source, source, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	data := []SlowQueryRow{}
+	for rows.Next() {
+		var r SlowQueryRow
+		if err := rows.Scan(&r.ID, &r.TS, &r.QueryParam, &r.Duration, &r.StatusCode, &r.PeakSamples, &r.Fingerprint); err != nil {
+			return nil, fmt.Errorf("unable to scan row: %w", err)
+		}
+		data = append(data, r)
+	}
+
+	return data, nil
+}
+
+func (p *SQLiteProvider) GetLatencyRegressions(ctx context.Context, currentWindow, baselineWindow time.Duration, factor float64) ([]LatencyRegression, error) {
+	now := time.Now()
+	baselineStart, currentStart := regressionWindows(now, currentWindow, baselineWindow)
+
+	// SQLite has no percentile function, so the p95 of each window is
+	// computed from the raw durations.
+	query := `
+		SELECT fingerprint, queryParam, duration, ts >= ? AS isCurrent
+		FROM queries
+		WHERE ts BETWEEN ? AND ?;
+	`
+
+	rows, err := p.db.QueryContext(ctx, query,
+		sqliteTime(currentStart),
+		sqliteTime(baselineStart),
+		sqliteTime(now),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	type windows struct {
+		queryParam string
+		current    []float64
+		baseline   []float64
+	}
+	byFingerprint := make(map[string]*windows)
+	for rows.Next() {
+		var (
+			fingerprint, queryParam string
+			duration                float64
+			isCurrent               bool
+		)
+		if err := rows.Scan(&fingerprint, &queryParam, &duration, &isCurrent); err != nil {
+			return nil, fmt.Errorf("unable to scan row: %w", err)
+		}
+
+		w, ok := byFingerprint[fingerprint]
+		if !ok {
+			w = &windows{queryParam: queryParam}
+			byFingerprint[fingerprint] = w
+		}
+		if isCurrent {
+			w.current = append(w.current, duration)
+		} else {
+			w.baseline = append(w.baseline, duration)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	candidates := make([]LatencyRegression, 0, len(byFingerprint))
+	for fingerprint, w := range byFingerprint {
+		if len(w.current) == 0 || len(w.baseline) == 0 {
+			continue
+		}
+		candidates = append(candidates, LatencyRegression{
+			Fingerprint: fingerprint,
+			QueryParam:  w.queryParam,
+			CurrentP95:  nearestRankP95(w.current),
+			BaselineP95: nearestRankP95(w.baseline),
+		})
+	}
+
+	return latencyRegressions(candidates, factor), nil
+}
+
+func (p *SQLiteProvider) GetQueryErrorBreakdown(ctx context.Context, tr TimeRange, tenant string, source string) ([]ErrorBreakdownRow, error) {
+	query := `
+		SELECT COALESCE(error, ''), COUNT(*)
+		FROM queries
+		WHERE ` + failedQueryCondition + ` AND ts BETWEEN ? AND ? AND (? = '' OR tenant = ?) AND (? = '' OR source = ?)
+		GROUP BY error;
+	`
+
+	rows, err := p.db.QueryContext(ctx, query, sqliteTime(tr.From), sqliteTime(tr.To), tenant, tenant, source, source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var (
+			message string
+			count   int
+		)
+		if err := rows.Scan(&message, &count); err != nil {
+			return nil, fmt.Errorf("unable to scan row: %w", err)
+		}
+		counts[message] += count
+	}
+
+	return errorBreakdown(counts), nil
+}
+
+func (p *SQLiteProvider) GetQueriesByIP(ctx context.Context, tr TimeRange, tenant string, source string, limit int) ([]SourceIPStats, error) {
+	query := `
+		SELECT sourceIP, COUNT(*) AS queries, SUM(CASE WHEN ` + failedQueryCondition + ` THEN 1 ELSE 0 END)
+		FROM queries
+		WHERE ts BETWEEN ? AND ? AND sourceIP != '' AND (? = '' OR tenant = ?) AND (? = '' OR source = ?)
+		GROUP BY sourceIP
+		ORDER BY queries DESC
+		LIMIT ?;
+	`
+
+	rows, err := p.db.QueryContext(ctx, query, sqliteTime(tr.From), sqliteTime(tr.To), tenant, tenant, source, source, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	data := []SourceIPStats{}
+	for rows.Next() {
+		var r SourceIPStats
+		if err := rows.Scan(&r.IP, &r.Queries, &r.Errors); err != nil {
+			return nil, fmt.Errorf("unable to scan row: %w", err)
+		}
+		if r.Queries > 0 {
+			r.ErrorRate = float64(r.Errors) / float64(r.Queries)
+		}
+		data = append(data, r)
+	}
+
+	return data, nil
+}
+
+func (p *SQLiteProvider) GetTopQueriedMetrics(ctx context.Context, tr TimeRange, tenant string, source string, limit int) ([]MetricQueryCount, error) {
+	query := `
+		SELECT m.value AS name, COUNT(*) AS queries, COALESCE(SUM(q.peakSamples), 0)
+		FROM queries q, json_each(q.metricNames) m
+		WHERE q.ts BETWEEN ? AND ? AND m.type = 'text' AND m.value != '' AND (? = '' OR q.tenant = ?) AND (? = '' OR q.source = ?)
+		GROUP BY m.value
+		ORDER BY queries DESC, name
+		LIMIT ?;
+	`
+
+	rows, err := p.db.QueryContext(ctx, query, sqliteTime(tr.From), sqliteTime(tr.To), tenant, tenant, source, source, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	data := []MetricQueryCount{}
+	for rows.Next() {
+		var r MetricQueryCount
+		if err := rows.Scan(&r.Name, &r.Queries, &r.PeakSamples); err != nil {
+			return nil, fmt.Errorf("unable to scan row: %w", err)
+		}
+		data = append(data, r)
+	}
+
+	return data, nil
+}
+
+func (p *SQLiteProvider) GetMetricStatisticsBatch(ctx context.Context, names []string, tr TimeRange) (map[string]MetricUsageStatistics, error) {
+	if len(names) == 0 {
+		return map[string]MetricUsageStatistics{}, nil
+	}
+
+	in := strings.Repeat("?, ", len(names)-1) + "?"
+	query := `
+		SELECT serie, kind, COUNT(DISTINCT name)
+		FROM RulesUsage
+		WHERE serie IN (` + in + `) AND created_at >= datetime('now', ?)
+		GROUP BY serie, kind
+		UNION ALL
+		SELECT serie, '` + metricStatisticsDashboardKind + `', COUNT(DISTINCT name)
+		FROM DashboardUsage
+		WHERE serie IN (` + in + `) AND created_at >= datetime('now', ?)
+		GROUP BY serie
+		UNION ALL
+		SELECT m.value, '` + metricStatisticsQueryKind + `', COUNT(DISTINCT q.queryParam)
+		FROM queries q, json_each(q.metricNames) m
+		WHERE m.value IN (` + in + `) AND q.ts BETWEEN ? AND ?
+		GROUP BY m.value;
+	`
+
+	// The names are bound once for each of the united queries.
+	args := make([]any, 0, 3*len(names)+4)
+	withNames := func(params ...any) {
+		for _, name := range names {
+			args = append(args, name)
+		}
+		args = append(args, params...)
+	}
+	withNames(p.usageSince())
+	withNames(p.usageSince())
+	withNames(sqliteTime(tr.From), sqliteTime(tr.To))
+
+	rows, err := p.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	return scanMetricStatistics(rows, names)
+}
+
+func (p *SQLiteProvider) GetQueryThroughput(ctx context.Context, tr TimeRange, tenant string, source string, step time.Duration, groupBy ThroughputGroupBy) ([]ThroughputBucket, error) {
+	query := fmt.Sprintf(`
+		SELECT %s / ? * ? AS bucket, %s AS series, COUNT(*)
+		FROM queries
+		WHERE ts BETWEEN ? AND ? AND (? = '' OR tenant = ?) AND (? = '' OR source = ?)
+		GROUP BY bucket, series;
+	`, sqliteUnixTime("ts"), groupBy.column("tenant", "source", "method"))
+
+	seconds := int64(step.Seconds())
+	rows, err := p.db.QueryContext(ctx, query, seconds, seconds, sqliteTime(tr.From), sqliteTime(tr.To), tenant, tenant, source, source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	counts := []throughputCount{}
+	for rows.Next() {
+		var c throughputCount
+		if err := rows.Scan(&c.bucket, &c.series, &c.count); err != nil {
+			return nil, fmt.Errorf("unable to scan row: %w", err)
+		}
+		counts = append(counts, c)
+	}
+
+	return throughputBuckets(tr, step, counts), nil
+}
+
+// sqliteTimeFormat is the layout of the bounds the queries timestamps, the
+// text of UTC times, are compared to.
+const sqliteTimeFormat = "2006-01-02 15:04:05"
+
+// sqliteTime formats t as a bound of the queries timestamps.
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format(sqliteTimeFormat)
+}
+
+// sqliteTimeOffset returns the expression extracting the zone offset, such
+// as "-0700", of the column holding the text of a time.Time.
+func sqliteTimeOffset(column string) string {
+	return fmt.Sprintf("substr(%[1]s, 12 + instr(substr(%[1]s, 12), ' '), 5)", column)
+}
+
+// sqliteUnixTime returns the expression converting the column, holding the
+// text of a time.Time such as "2006-01-02 15:04:05.999 -0700 MST", to its
+// unix time. Its date and time are the wall clock time of its zone, so the
+// offset following them is subtracted.
+func sqliteUnixTime(column string) string {
+	offset := sqliteTimeOffset(column)
+	return fmt.Sprintf(`(CAST(strftime('%%s', substr(%[1]s, 1, 19)) AS INTEGER) -
+		(CASE substr(%[2]s, 1, 1) WHEN '-' THEN -1 ELSE 1 END) *
+		(CAST(substr(%[2]s, 2, 2) AS INTEGER) * 3600 + CAST(substr(%[2]s, 4, 2) AS INTEGER) * 60))`, column, offset)
+}
+
+func (p *SQLiteProvider) Explain(ctx context.Context, query string) (*QueryResult, error) {
+	return p.Query(ctx, "EXPLAIN QUERY PLAN "+query)
 }
@@ -0,0 +1,1226 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+)
+
+func newTestSqliteProvider(t testing.TB) Provider {
+	t.Helper()
+
+	config.DefaultConfig.Database.SQLite.DatabasePath = filepath.Join(t.TempDir(), "prom-analytics-proxy.db")
+	provider, err := newSqliteProvider(context.Background())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		provider.Close()
+	})
+	return provider
+}
+
+// baselineSqliteTableStmt creates the queries table of the first release,
+// before any column was added to it.
+const baselineSqliteTableStmt = `
+	CREATE TABLE queries (
+		ts TIMESTAMP, queryParam TEXT, timeParam TIMESTAMP, duration INTEGER, statusCode INTEGER,
+		bodySize INTEGER, fingerprint TEXT, labelMatchers TEXT, type TEXT, step REAL,
+		start TIMESTAMP, "end" TIMESTAMP, totalQueryableSamples INTEGER, peakSamples INTEGER
+	);
+`
+
+// newBaselineSqliteProvider starts a provider on a database created by the
+// first release, after running the given statements on it.
+func newBaselineSqliteProvider(t *testing.T, stmts string) Provider {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "prom-analytics-proxy.db")
+	db, err := sql.Open("sqlite", path)
+	require.NoError(t, err)
+	_, err = db.Exec(baselineSqliteTableStmt + stmts)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	config.DefaultConfig.Database.SQLite.DatabasePath = path
+	provider, err := newSqliteProvider(context.Background())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		provider.Close()
+	})
+	return provider
+}
+
+func TestSQLiteProvider_UpgradeFromBaseline(t *testing.T) {
+	ctx := context.Background()
+	provider := newBaselineSqliteProvider(t, "")
+
+	provider.WithDB(func(db *sql.DB) {
+		for _, column := range []string{"totalBytes", "cached", "error", "tenant", "sourceIP"} {
+			exists, err := sqliteColumnExists(ctx, db, column)
+			require.NoError(t, err)
+			assert.True(t, exists, column)
+		}
+	})
+
+	// Every column written by the inserts exists.
+	require.NoError(t, provider.Insert(ctx, []Query{{
+		TS:         time.Now(),
+		QueryParam: "up",
+		Type:       QueryTypeInstant,
+		StatusCode: 422,
+		TotalBytes: 42,
+		Cached:     true,
+		Error:      "bad_data",
+		Tenant:     "team-a",
+		SourceIP:   "10.0.0.1",
+	}}))
+	provider.WithDB(func(db *sql.DB) {
+		var (
+			totalBytes              int
+			cached                  bool
+			errMsg, tenant, address string
+		)
+		err := db.QueryRowContext(ctx, "SELECT totalBytes, cached, error, tenant, sourceIP FROM queries").Scan(&totalBytes, &cached, &errMsg, &tenant, &address)
+		require.NoError(t, err)
+		assert.Equal(t, 42, totalBytes)
+		assert.True(t, cached)
+		assert.Equal(t, "bad_data", errMsg)
+		assert.Equal(t, "team-a", tenant)
+		assert.Equal(t, "10.0.0.1", address)
+	})
+}
+
+func TestSQLiteProvider_GetSlowestQueries(t *testing.T) {
+	ctx := context.Background()
+	provider := newTestSqliteProvider(t)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	durations := []time.Duration{300, 50, 1200, 700, 10}
+	queries := make([]Query, 0, len(durations)+1)
+	for i, d := range durations {
+		queries = append(queries, Query{
+			TS:          now.Add(-time.Duration(i+1) * time.Minute),
+			QueryParam:  "up",
+			Fingerprint: "fp",
+			Duration:    d * time.Millisecond,
+			StatusCode:  200,
+			PeakSamples: i,
+			Type:        QueryTypeInstant,
+		})
+	}
+	// Outside of the requested time range.
+	queries = append(queries, Query{
+		TS:         now.Add(-48 * time.Hour),
+		QueryParam: "up",
+		Duration:   time.Hour,
+		StatusCode: 200,
+		Type:       QueryTypeInstant,
+	})
+	require.NoError(t, provider.Insert(ctx, queries))
+
+	slowest, err := provider.GetSlowestQueries(ctx, TimeRange{From: now.Add(-time.Hour), To: now}, "", "", 3)
+	require.NoError(t, err)
+	require.Len(t, slowest, 3)
+
+	assert.Equal(t, int64(1200), slowest[0].Duration)
+	assert.Equal(t, int64(700), slowest[1].Duration)
+	assert.Equal(t, int64(300), slowest[2].Duration)
+	assert.Equal(t, 2, slowest[0].PeakSamples)
+	assert.Equal(t, "fp", slowest[0].Fingerprint)
+	assert.Equal(t, 200, slowest[0].StatusCode)
+	assert.True(t, now.Add(-3*time.Minute).Equal(slowest[0].TS))
+}
+
+func TestSQLiteProvider_TimeZones(t *testing.T) {
+	ctx := context.Background()
+	provider := newTestSqliteProvider(t)
+
+	// The queries are recorded in a zone behind UTC and looked up with UTC
+	// bounds, as parsed from the API parameters.
+	zone := time.FixedZone("UTC-3", -3*60*60)
+	now := time.Now().UTC().Truncate(time.Second)
+	require.NoError(t, provider.Insert(ctx, []Query{
+		{TS: now.Add(-time.Minute).In(zone), QueryParam: "up", Duration: time.Second, StatusCode: 200, SourceIP: "10.0.0.1", Type: QueryTypeInstant},
+		{TS: now.Add(-2 * time.Hour).In(zone), QueryParam: "down", Duration: time.Second, StatusCode: 200, SourceIP: "10.0.0.2", Type: QueryTypeInstant},
+	}))
+	tr := TimeRange{From: now.Add(-time.Hour), To: now}
+
+	slowest, err := provider.GetSlowestQueries(ctx, tr, "", "", 10)
+	require.NoError(t, err)
+	require.Len(t, slowest, 1)
+	assert.Equal(t, "up", slowest[0].QueryParam)
+	assert.True(t, now.Add(-time.Minute).Equal(slowest[0].TS))
+
+	ips, err := provider.GetQueriesByIP(ctx, tr, "", "", 10)
+	require.NoError(t, err)
+	require.Len(t, ips, 1)
+	assert.Equal(t, "10.0.0.1", ips[0].IP)
+}
+
+func TestSQLiteProvider_UTCTimestampsMigration(t *testing.T) {
+	ctx := context.Background()
+	provider := newBaselineSqliteProvider(t, `
+		INSERT INTO queries (ts, queryParam) VALUES
+			('2025-01-01 22:30:00.5 -0300 -03 m=+1.000000001', 'local'),
+			('2025-01-01 10:00:00 +0530 IST', 'ahead'),
+			('2025-01-01 10:00:00 +0000 UTC', 'utc');
+	`)
+
+	provider.WithDB(func(db *sql.DB) {
+		rows, err := db.QueryContext(ctx, "SELECT queryParam, CAST(ts AS TEXT) FROM queries ORDER BY queryParam")
+		require.NoError(t, err)
+		defer rows.Close()
+
+		stored := map[string]string{}
+		for rows.Next() {
+			var queryParam, ts string
+			require.NoError(t, rows.Scan(&queryParam, &ts))
+			stored[queryParam] = ts
+		}
+		require.NoError(t, rows.Err())
+		assert.Equal(t, map[string]string{
+			"local": "2025-01-02 01:30:00.5 +0000 UTC",
+			"ahead": "2025-01-01 04:30:00 +0000 UTC",
+			"utc":   "2025-01-01 10:00:00 +0000 UTC",
+		}, stored)
+
+		var version int
+		require.NoError(t, db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version))
+		assert.Equal(t, sqliteUTCTimestampsVersion, version)
+	})
+}
+
+func TestSQLiteProvider_GetLatencyRegressions(t *testing.T) {
+	ctx := context.Background()
+	provider := newTestSqliteProvider(t)
+
+	now := time.Now()
+	queries := make([]Query, 0)
+	add := func(fingerprint string, ts time.Time, duration time.Duration) {
+		queries = append(queries, Query{
+			TS:          ts,
+			QueryParam:  fingerprint,
+			Fingerprint: fingerprint,
+			Duration:    duration,
+			StatusCode:  200,
+			Type:        QueryTypeInstant,
+		})
+	}
+
+	for i := 1; i <= 10; i++ {
+		baselineTS := now.Add(-48*time.Hour - time.Duration(i)*time.Hour)
+		currentTS := now.Add(-time.Duration(i) * time.Minute)
+
+		// Regressed from ~100ms to ~500ms.
+		add("regressed", baselineTS, 100*time.Millisecond)
+		add("regressed", currentTS, 500*time.Millisecond)
+		// Slightly slower, below the factor.
+		add("stable", baselineTS, 100*time.Millisecond)
+		add("stable", currentTS, 150*time.Millisecond)
+	}
+	// No baseline to compare with.
+	add("new", now.Add(-time.Minute), 10*time.Second)
+	require.NoError(t, provider.Insert(ctx, queries))
+
+	regressions, err := provider.GetLatencyRegressions(ctx, 24*time.Hour, 7*24*time.Hour, 2)
+	require.NoError(t, err)
+	require.Len(t, regressions, 1)
+
+	assert.Equal(t, "regressed", regressions[0].Fingerprint)
+	assert.Equal(t, 500.0, regressions[0].CurrentP95)
+	assert.Equal(t, 100.0, regressions[0].BaselineP95)
+	assert.Equal(t, 5.0, regressions[0].Ratio)
+}
+
+func TestSQLiteProvider_QueryLabels(t *testing.T) {
+	ctx := context.Background()
+
+	config.DefaultConfig.Database.SQLite.QueryLabels = true
+	t.Cleanup(func() {
+		config.DefaultConfig.Database.SQLite.QueryLabels = false
+	})
+	provider := newTestSqliteProvider(t)
+
+	now := time.Now()
+	queries := []Query{
+		{
+			TS:            now.Add(-time.Minute),
+			QueryParam:    `up{job="api"}`,
+			LabelMatchers: LabelMatchers{{"__name__": "up", "job": "api"}},
+			Duration:      100 * time.Millisecond,
+			Type:          QueryTypeInstant,
+		},
+		{
+			TS:            now.Add(-time.Minute),
+			QueryParam:    `up{job="node"}`,
+			LabelMatchers: LabelMatchers{{"__name__": "up", "job": "node"}},
+			Duration:      200 * time.Millisecond,
+			Type:          QueryTypeInstant,
+		},
+		{
+			// The serie is only referenced by the second selector.
+			TS:            now.Add(-time.Minute),
+			QueryParam:    `node_load1 / up{job="node"}`,
+			LabelMatchers: LabelMatchers{{"__name__": "node_load1"}, {"__name__": "up", "job": "node"}},
+			Duration:      300 * time.Millisecond,
+			Type:          QueryTypeInstant,
+		},
+		{
+			TS:            now.Add(-time.Minute),
+			QueryParam:    `node_load1`,
+			LabelMatchers: LabelMatchers{{"__name__": "node_load1"}},
+			Duration:      400 * time.Millisecond,
+			Type:          QueryTypeInstant,
+		},
+	}
+	require.NoError(t, provider.Insert(ctx, queries))
+
+	var apiQueries int
+	provider.WithDB(func(db *sql.DB) {
+		err := db.QueryRowContext(ctx, `
+			SELECT COUNT(*) FROM queries
+			WHERE id IN (SELECT query_id FROM query_labels WHERE label_name = 'job' AND label_value = 'api')
+		`).Scan(&apiQueries)
+		require.NoError(t, err)
+	})
+	assert.Equal(t, 1, apiQueries)
+
+	result, err := provider.GetQueriesBySerieName(ctx, "up", 0, 10, DefaultSerieQueriesSortBy, "desc")
+	require.NoError(t, err)
+	assert.Equal(t, 3, result.Total)
+	assert.Equal(t, 1, result.TotalPages)
+	assert.Equal(t, 0, result.Page)
+	assert.Equal(t, 10, result.PageSize)
+	assert.False(t, result.HasNext)
+
+	data := result.Data.([]QueriesBySerieNameResult)
+	require.Len(t, data, 3)
+	assert.Equal(t, `node_load1 / up{job="node"}`, data[0].QueryParam)
+	assert.Equal(t, `up{job="node"}`, data[1].QueryParam)
+	assert.Equal(t, `up{job="api"}`, data[2].QueryParam)
+
+	// Deleting queries removes their labels.
+	deleted, err := provider.DeleteQueriesBefore(ctx, now.Add(time.Minute), QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), deleted)
+
+	var labels int
+	provider.WithDB(func(db *sql.DB) {
+		require.NoError(t, db.QueryRowContext(ctx, "SELECT COUNT(*) FROM query_labels").Scan(&labels))
+	})
+	assert.Zero(t, labels)
+}
+
+func TestSQLiteProvider_QueryLabelsBackfill(t *testing.T) {
+	ctx := context.Background()
+
+	config.DefaultConfig.Database.SQLite.DatabasePath = filepath.Join(t.TempDir(), "prom-analytics-proxy.db")
+	provider, err := newSqliteProvider(ctx)
+	require.NoError(t, err)
+	require.NoError(t, provider.Insert(ctx, []Query{{
+		TS:            time.Now(),
+		QueryParam:    `up{job="api"}`,
+		LabelMatchers: LabelMatchers{{"__name__": "up", "job": "api"}},
+		Type:          QueryTypeInstant,
+	}}))
+	require.NoError(t, provider.Close())
+
+	config.DefaultConfig.Database.SQLite.QueryLabels = true
+	t.Cleanup(func() {
+		config.DefaultConfig.Database.SQLite.QueryLabels = false
+	})
+	provider, err = newSqliteProvider(ctx)
+	require.NoError(t, err)
+	defer provider.Close()
+
+	var labels int
+	provider.WithDB(func(db *sql.DB) {
+		require.NoError(t, db.QueryRowContext(ctx, "SELECT COUNT(*) FROM query_labels").Scan(&labels))
+	})
+	assert.Equal(t, 2, labels)
+}
+
+func TestSQLiteProvider_QueriesIDMigration(t *testing.T) {
+	ctx := context.Background()
+
+	config.DefaultConfig.Database.SQLite.QueryLabels = true
+	t.Cleanup(func() {
+		config.DefaultConfig.Database.SQLite.QueryLabels = false
+	})
+	// The labels of the previous releases point at the rowid of the
+	// queries, the second query having been deleted.
+	ts := time.Now().UTC().Add(-time.Minute).String()
+	provider := newBaselineSqliteProvider(t, fmt.Sprintf(`
+		CREATE TABLE query_labels (query_id INTEGER NOT NULL, label_name TEXT NOT NULL, label_value TEXT NOT NULL);
+		CREATE TRIGGER queries_delete_labels AFTER DELETE ON queries
+		BEGIN
+			DELETE FROM query_labels WHERE query_id = old.rowid;
+		END;
+		INSERT INTO queries (ts, queryParam, duration, statusCode, peakSamples, labelMatchers) VALUES
+			('%[1]s', 'up', 100, 200, 1, '[{"__name__":"up"}]'),
+			('%[1]s', 'deleted', 100, 200, 1, '[]'),
+			('%[1]s', 'node_load1', 100, 200, 1, '[{"__name__":"node_load1"}]');
+		DELETE FROM queries WHERE queryParam = 'deleted';
+		INSERT INTO query_labels VALUES (1, '__name__', 'up'), (3, '__name__', 'node_load1');
+	`, ts))
+
+	queryIDs := func() map[string]int64 {
+		ids := map[string]int64{}
+		provider.WithDB(func(db *sql.DB) {
+			rows, err := db.QueryContext(ctx, "SELECT id, queryParam FROM queries")
+			require.NoError(t, err)
+			defer rows.Close()
+			for rows.Next() {
+				var (
+					id         int64
+					queryParam string
+				)
+				require.NoError(t, rows.Scan(&id, &queryParam))
+				ids[queryParam] = id
+			}
+			require.NoError(t, rows.Err())
+		})
+		return ids
+	}
+	assert.Equal(t, map[string]int64{"up": 1, "node_load1": 3}, queryIDs())
+
+	result, err := provider.GetQueriesBySerieName(ctx, "node_load1", 0, 10, DefaultSerieQueriesSortBy, "desc")
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Total)
+
+	// The id of a deleted query is never reused, and is kept by VACUUM.
+	provider.WithDB(func(db *sql.DB) {
+		_, err := db.ExecContext(ctx, "DELETE FROM queries WHERE queryParam = 'node_load1'")
+		require.NoError(t, err)
+	})
+	require.NoError(t, provider.Insert(ctx, []Query{{
+		TS:            time.Now(),
+		QueryParam:    "node_load5",
+		LabelMatchers: LabelMatchers{{"__name__": "node_load5"}},
+		Type:          QueryTypeInstant,
+	}}))
+	provider.WithDB(func(db *sql.DB) {
+		_, err := db.ExecContext(ctx, "VACUUM")
+		require.NoError(t, err)
+	})
+	assert.Equal(t, map[string]int64{"up": 1, "node_load5": 4}, queryIDs())
+
+	var labels []string
+	provider.WithDB(func(db *sql.DB) {
+		rows, err := db.QueryContext(ctx, "SELECT query_id || '=' || label_value FROM query_labels ORDER BY query_id")
+		require.NoError(t, err)
+		defer rows.Close()
+		for rows.Next() {
+			var label string
+			require.NoError(t, rows.Scan(&label))
+			labels = append(labels, label)
+		}
+		require.NoError(t, rows.Err())
+	})
+	assert.Equal(t, []string{"1=up", "4=node_load5"}, labels)
+}
+
+func TestSQLiteProvider_GetQueriesBySerieNameMultipleMetrics(t *testing.T) {
+	ctx := context.Background()
+	provider := newTestSqliteProvider(t)
+
+	now := time.Now()
+	queries := []Query{
+		{
+			TS:            now.Add(-time.Minute),
+			QueryParam:    `rate(errors_total[5m]) / rate(requests_total[5m])`,
+			LabelMatchers: LabelMatchers{{"__name__": "errors_total"}, {"__name__": "requests_total"}},
+			MetricNames:   []string{"errors_total", "requests_total"},
+			Type:          QueryTypeInstant,
+		},
+		{
+			TS:            now.Add(-time.Minute),
+			QueryParam:    `requests_total`,
+			LabelMatchers: LabelMatchers{{"__name__": "requests_total"}},
+			MetricNames:   []string{"requests_total"},
+			Type:          QueryTypeInstant,
+		},
+	}
+	require.NoError(t, provider.Insert(ctx, queries))
+
+	result, err := provider.GetQueriesBySerieName(ctx, "errors_total", 0, 10, DefaultSerieQueriesSortBy, "desc")
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Total)
+
+	result, err = provider.GetQueriesBySerieName(ctx, "requests_total", 0, 10, DefaultSerieQueriesSortBy, "desc")
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Total)
+}
+
+func TestSQLiteProvider_GetQueriesBySerieNameSort(t *testing.T) {
+	ctx := context.Background()
+	provider := newTestSqliteProvider(t)
+
+	now := time.Now()
+	query := func(queryParam string, statusCode int) Query {
+		return Query{
+			TS:          now.Add(-time.Minute),
+			QueryParam:  queryParam,
+			MetricNames: []string{"up"},
+			StatusCode:  statusCode,
+			Duration:    time.Duration(len(queryParam)) * time.Millisecond,
+			Type:        QueryTypeInstant,
+		}
+	}
+	require.NoError(t, provider.Insert(ctx, []Query{
+		query(`up`, 200),
+		query(`sum(up)`, 200),
+		query(`sum(up)`, 500),
+		query(`sum(up)`, 200),
+		query(`count(up)`, 422),
+		query(`count(up)`, 422),
+	}))
+
+	result, err := provider.GetQueriesBySerieName(ctx, "up", 0, 10, "executions", "desc")
+	require.NoError(t, err)
+	data := result.Data.([]QueriesBySerieNameResult)
+	require.Len(t, data, 3)
+	assert.Equal(t, "sum(up)", data[0].QueryParam)
+	assert.Equal(t, 3, data[0].Executions)
+	assert.InDelta(t, 100.0/3, data[0].ErrorRatePercent, 0.001)
+	assert.Equal(t, "count(up)", data[1].QueryParam)
+	assert.Equal(t, 2, data[1].Executions)
+	assert.InDelta(t, 100.0, data[1].ErrorRatePercent, 0.001)
+	assert.Equal(t, "up", data[2].QueryParam)
+	assert.Equal(t, 1, data[2].Executions)
+	assert.Zero(t, data[2].ErrorRatePercent)
+
+	result, err = provider.GetQueriesBySerieName(ctx, "up", 0, 10, "errorRatePercent", "asc")
+	require.NoError(t, err)
+	data = result.Data.([]QueriesBySerieNameResult)
+	require.Len(t, data, 3)
+	assert.Equal(t, []string{"up", "sum(up)", "count(up)"}, []string{data[0].QueryParam, data[1].QueryParam, data[2].QueryParam})
+}
+
+func TestIsValidSerieQueriesSort(t *testing.T) {
+	assert.True(t, IsValidSerieQueriesSort("executions", "desc"))
+	assert.True(t, IsValidSerieQueriesSort("errorRatePercent", "ASC"))
+	assert.False(t, IsValidSerieQueriesSort("executions", "sideways"))
+	assert.False(t, IsValidSerieQueriesSort("duration; DROP TABLE queries", "desc"))
+	assert.Equal(t, "avgDuration DESC, queryParam ASC", serieQueriesOrderBy("unknown", "desc"))
+}
+
+func TestSQLiteProvider_MetricNamesMigration(t *testing.T) {
+	ctx := context.Background()
+	provider := newBaselineSqliteProvider(t, `
+		INSERT INTO queries (ts, queryParam, duration, peakSamples, labelMatchers, type) VALUES
+			(datetime('now'), 'a / b', 100, 10, '[{"__name__":"a"},{"__name__":"b","job":"api"}]', 'instant');
+	`)
+
+	for _, name := range []string{"a", "b"} {
+		result, err := provider.GetQueriesBySerieName(ctx, name, 0, 10, DefaultSerieQueriesSortBy, "desc")
+		require.NoError(t, err)
+		assert.Equal(t, 1, result.Total, name)
+	}
+
+	// The upstream duration of the existing rows is unknown.
+	require.NoError(t, provider.Insert(ctx, []Query{{
+		TS:               time.Now(),
+		QueryParam:       "a",
+		Duration:         120 * time.Millisecond,
+		UpstreamDuration: 100 * time.Millisecond,
+		Type:             QueryTypeInstant,
+	}}))
+	provider.WithDB(func(db *sql.DB) {
+		rows, err := db.QueryContext(ctx, "SELECT upstreamDuration FROM queries ORDER BY rowid")
+		require.NoError(t, err)
+		defer rows.Close()
+
+		var durations []sql.NullInt64
+		for rows.Next() {
+			var d sql.NullInt64
+			require.NoError(t, rows.Scan(&d))
+			durations = append(durations, d)
+		}
+		require.NoError(t, rows.Err())
+		assert.Equal(t, []sql.NullInt64{{}, {Int64: 100, Valid: true}}, durations)
+	})
+}
+
+func TestSQLiteProvider_TenantIsolation(t *testing.T) {
+	ctx := context.Background()
+	provider := newTestSqliteProvider(t)
+
+	now := time.Now()
+	queries := []Query{
+		{TS: now.Add(-time.Minute), QueryParam: "a_ok", Duration: 100 * time.Millisecond, StatusCode: 200, Tenant: "team-a", Type: QueryTypeInstant},
+		{TS: now.Add(-time.Minute), QueryParam: "a_failed", Duration: 200 * time.Millisecond, StatusCode: 422, Error: "many-to-many matching not allowed", Tenant: "team-a", Type: QueryTypeInstant},
+		{TS: now.Add(-time.Minute), QueryParam: "b_failed", Duration: 300 * time.Millisecond, StatusCode: 400, Error: "parse error", Tenant: "team-b", Type: QueryTypeInstant},
+		{TS: now.Add(-time.Minute), QueryParam: "no_tenant", Duration: 400 * time.Millisecond, StatusCode: 200, Type: QueryTypeInstant},
+	}
+	require.NoError(t, provider.Insert(ctx, queries))
+
+	tr := TimeRange{From: now.Add(-time.Hour), To: now}
+
+	slowest, err := provider.GetSlowestQueries(ctx, tr, "team-a", "", 10)
+	require.NoError(t, err)
+	require.Len(t, slowest, 2)
+	assert.Equal(t, "a_failed", slowest[0].QueryParam)
+	assert.Equal(t, "a_ok", slowest[1].QueryParam)
+
+	breakdown, err := provider.GetQueryErrorBreakdown(ctx, tr, "team-b", "")
+	require.NoError(t, err)
+	assert.Equal(t, []ErrorBreakdownRow{{Category: ErrorCategoryBadData, Count: 1}}, breakdown)
+
+	// Without tenant every query is considered.
+	slowest, err = provider.GetSlowestQueries(ctx, tr, "", "", 10)
+	require.NoError(t, err)
+	assert.Len(t, slowest, 4)
+}
+
+func TestSQLiteProvider_GetQueryExecutionDetail(t *testing.T) {
+	ctx := context.Background()
+	provider := newTestSqliteProvider(t)
+
+	ts := time.Now().UTC().Truncate(time.Second)
+	query := Query{
+		TS:                    ts,
+		QueryParam:            `rate(http_requests_total{job="api"}[5m])`,
+		Type:                  QueryTypeRange,
+		Start:                 ts.Add(-time.Hour),
+		End:                   ts,
+		Step:                  15,
+		Duration:              250 * time.Millisecond,
+		UpstreamDuration:      200 * time.Millisecond,
+		StatusCode:            200,
+		BodySize:              1024,
+		TotalBytes:            2048,
+		TotalQueryableSamples: 5000,
+		PeakSamples:           300,
+		LabelMatchers:         LabelMatchers{{"__name__": "http_requests_total", "job": "api"}},
+		Fingerprint:           "abc",
+		Tenant:                "team-a",
+		SourceIP:              "10.0.0.1",
+		Method:                http.MethodPost,
+		Source:                QuerySourceRule,
+	}
+	require.NoError(t, provider.Insert(ctx, []Query{{TS: ts, QueryParam: "up", Type: QueryTypeInstant}, query}))
+
+	slowest, err := provider.GetSlowestQueries(ctx, TimeRange{From: ts.Add(-time.Minute), To: ts.Add(time.Minute)}, "", "", 1)
+	require.NoError(t, err)
+	require.Len(t, slowest, 1)
+
+	detail, err := provider.GetQueryExecutionDetail(ctx, slowest[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, slowest[0].ID, detail.ID)
+	assert.True(t, ts.Equal(detail.TS))
+	assert.Equal(t, query.QueryParam, detail.QueryParam)
+	assert.Equal(t, QueryTypeRange, detail.Type)
+	assert.True(t, query.Start.Equal(detail.Start))
+	assert.True(t, query.End.Equal(detail.End))
+	assert.Equal(t, 15.0, detail.Step)
+	assert.EqualValues(t, 250, detail.Duration)
+	assert.EqualValues(t, 200, detail.UpstreamDuration)
+	assert.Equal(t, 200, detail.StatusCode)
+	assert.Equal(t, 1024, detail.BodySize)
+	assert.Equal(t, 2048, detail.TotalBytes)
+	assert.Equal(t, 5000, detail.TotalQueryableSamples)
+	assert.Equal(t, 300, detail.PeakSamples)
+	assert.Equal(t, query.LabelMatchers, detail.LabelMatchers)
+	assert.Equal(t, "abc", detail.Fingerprint)
+	assert.Equal(t, "team-a", detail.Tenant)
+	assert.Equal(t, "10.0.0.1", detail.SourceIP)
+	assert.Equal(t, http.MethodPost, detail.Method)
+	assert.Equal(t, QuerySourceRule, detail.Source)
+
+	_, err = provider.GetQueryExecutionDetail(ctx, slowest[0].ID+100)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// The id of an execution is kept by VACUUM and never given to another
+	// one once it is deleted.
+	deleted, err := provider.DeleteQueriesBefore(ctx, ts.Add(time.Minute), QueryFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), deleted)
+	require.NoError(t, provider.Insert(ctx, []Query{{TS: ts, QueryParam: "up", Type: QueryTypeInstant}}))
+	provider.WithDB(func(db *sql.DB) {
+		_, err := db.ExecContext(ctx, "VACUUM")
+		require.NoError(t, err)
+	})
+	_, err = provider.GetQueryExecutionDetail(ctx, slowest[0].ID)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	slowest, err = provider.GetSlowestQueries(ctx, TimeRange{From: ts.Add(-time.Minute), To: ts.Add(time.Minute)}, "", "", 1)
+	require.NoError(t, err)
+	require.Len(t, slowest, 1)
+	assert.Equal(t, int64(3), slowest[0].ID)
+}
+
+func TestSQLiteProvider_SourceFilter(t *testing.T) {
+	ctx := context.Background()
+	provider := newTestSqliteProvider(t)
+
+	now := time.Now()
+	queries := []Query{
+		{TS: now.Add(-time.Minute), QueryParam: "user_ok", Duration: 100 * time.Millisecond, StatusCode: 200, Source: QuerySourceUser, Type: QueryTypeInstant},
+		{TS: now.Add(-time.Minute), QueryParam: "user_failed", Duration: 200 * time.Millisecond, StatusCode: 400, Error: "parse error", Source: QuerySourceUser, Type: QueryTypeInstant},
+		{TS: now.Add(-time.Minute), QueryParam: "rule_ok", Duration: 300 * time.Millisecond, StatusCode: 200, Source: QuerySourceRule, Type: QueryTypeInstant},
+		{TS: now.Add(-time.Minute), QueryParam: "rule_failed", Duration: 400 * time.Millisecond, StatusCode: 503, Error: "query timed out", Source: QuerySourceRule, Type: QueryTypeInstant},
+		// Queries of unknown source are attributed to users.
+		{TS: now.Add(-time.Minute), QueryParam: "unknown", Duration: 50 * time.Millisecond, StatusCode: 200, Type: QueryTypeInstant},
+	}
+	require.NoError(t, provider.Insert(ctx, queries))
+
+	tr := TimeRange{From: now.Add(-time.Hour), To: now}
+	params := func(rows []SlowQueryRow) []string {
+		names := make([]string, 0, len(rows))
+		for _, row := range rows {
+			names = append(names, row.QueryParam)
+		}
+		return names
+	}
+
+	slowest, err := provider.GetSlowestQueries(ctx, tr, "", string(QuerySourceUser), 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"user_failed", "user_ok", "unknown"}, params(slowest))
+
+	slowest, err = provider.GetSlowestQueries(ctx, tr, "", string(QuerySourceRule), 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"rule_failed", "rule_ok"}, params(slowest))
+
+	slowest, err = provider.GetSlowestQueries(ctx, tr, "", "", 10)
+	require.NoError(t, err)
+	assert.Len(t, slowest, 5)
+
+	breakdown, err := provider.GetQueryErrorBreakdown(ctx, tr, "", string(QuerySourceUser))
+	require.NoError(t, err)
+	assert.Equal(t, []ErrorBreakdownRow{{Category: ErrorCategoryBadData, Count: 1}}, breakdown)
+}
+
+func TestSQLiteProvider_GetQueriesByIP(t *testing.T) {
+	ctx := context.Background()
+	provider := newTestSqliteProvider(t)
+
+	now := time.Now()
+	queries := []Query{
+		{TS: now.Add(-time.Minute), QueryParam: "up", StatusCode: 200, SourceIP: "10.0.0.1", Type: QueryTypeInstant},
+		{TS: now.Add(-time.Minute), QueryParam: "up", StatusCode: 200, SourceIP: "10.0.0.1", Type: QueryTypeInstant},
+		{TS: now.Add(-time.Minute), QueryParam: "up", StatusCode: 422, SourceIP: "10.0.0.1", Type: QueryTypeInstant},
+		{TS: now.Add(-time.Minute), QueryParam: "up", StatusCode: 400, SourceIP: "10.0.0.2", Tenant: "team-a", Type: QueryTypeInstant},
+		{TS: now.Add(-time.Minute), QueryParam: "up", StatusCode: 200, Type: QueryTypeInstant},
+		// Outside of the requested time range.
+		{TS: now.Add(-48 * time.Hour), QueryParam: "up", StatusCode: 200, SourceIP: "10.0.0.2", Type: QueryTypeInstant},
+	}
+	require.NoError(t, provider.Insert(ctx, queries))
+
+	stats, err := provider.GetQueriesByIP(ctx, TimeRange{From: now.Add(-time.Hour), To: now}, "", "", 10)
+	require.NoError(t, err)
+	require.Len(t, stats, 2)
+
+	assert.Equal(t, "10.0.0.1", stats[0].IP)
+	assert.Equal(t, 3, stats[0].Queries)
+	assert.Equal(t, 1, stats[0].Errors)
+	assert.InDelta(t, 1.0/3, stats[0].ErrorRate, 0.001)
+
+	assert.Equal(t, SourceIPStats{IP: "10.0.0.2", Queries: 1, Errors: 1, ErrorRate: 1}, stats[1])
+
+	stats, err = provider.GetQueriesByIP(ctx, TimeRange{From: now.Add(-time.Hour), To: now}, "", "", 1)
+	require.NoError(t, err)
+	assert.Len(t, stats, 1)
+
+	stats, err = provider.GetQueriesByIP(ctx, TimeRange{From: now.Add(-time.Hour), To: now}, "team-a", "", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []SourceIPStats{{IP: "10.0.0.2", Queries: 1, Errors: 1, ErrorRate: 1}}, stats)
+}
+
+func TestSQLiteProvider_GetTopQueriedMetrics(t *testing.T) {
+	ctx := context.Background()
+	provider := newTestSqliteProvider(t)
+
+	now := time.Now()
+	queries := []Query{
+		{TS: now.Add(-time.Minute), QueryParam: "up", MetricNames: []string{"up"}, PeakSamples: 10, Type: QueryTypeInstant},
+		{TS: now.Add(-time.Minute), QueryParam: "up == 0", MetricNames: []string{"up"}, PeakSamples: 5, Type: QueryTypeInstant},
+		{TS: now.Add(-time.Minute), QueryParam: "rate(http_requests_total[5m]) / up", MetricNames: []string{"http_requests_total", "up"}, PeakSamples: 100, Type: QueryTypeRange},
+		{TS: now.Add(-time.Minute), QueryParam: "rate(http_requests_total[5m])", MetricNames: []string{"http_requests_total"}, PeakSamples: 50, Source: QuerySourceRule, Type: QueryTypeRange},
+		{TS: now.Add(-time.Minute), QueryParam: "go_goroutines", MetricNames: []string{"go_goroutines"}, PeakSamples: 1, Tenant: "team-a", Type: QueryTypeInstant},
+		// Without metric name.
+		{TS: now.Add(-time.Minute), QueryParam: `{job="prometheus"}`, PeakSamples: 1000, Type: QueryTypeInstant},
+		// Outside of the requested time range.
+		{TS: now.Add(-48 * time.Hour), QueryParam: "go_goroutines", MetricNames: []string{"go_goroutines"}, Type: QueryTypeInstant},
+		{TS: now.Add(-48 * time.Hour), QueryParam: "go_goroutines", MetricNames: []string{"go_goroutines"}, Type: QueryTypeInstant},
+	}
+	require.NoError(t, provider.Insert(ctx, queries))
+
+	tr := TimeRange{From: now.Add(-time.Hour), To: now}
+	metrics, err := provider.GetTopQueriedMetrics(ctx, tr, "", "", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []MetricQueryCount{
+		{Name: "up", Queries: 3, PeakSamples: 115},
+		{Name: "http_requests_total", Queries: 2, PeakSamples: 150},
+		{Name: "go_goroutines", Queries: 1, PeakSamples: 1},
+	}, metrics)
+
+	metrics, err = provider.GetTopQueriedMetrics(ctx, tr, "", "", 1)
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, "up", metrics[0].Name)
+
+	metrics, err = provider.GetTopQueriedMetrics(ctx, tr, "team-a", "", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []MetricQueryCount{{Name: "go_goroutines", Queries: 1, PeakSamples: 1}}, metrics)
+
+	metrics, err = provider.GetTopQueriedMetrics(ctx, tr, "", string(QuerySourceRule), 10)
+	require.NoError(t, err)
+	assert.Equal(t, []MetricQueryCount{{Name: "http_requests_total", Queries: 1, PeakSamples: 50}}, metrics)
+}
+
+func TestSQLiteProvider_Method(t *testing.T) {
+	ctx := context.Background()
+	provider := newTestSqliteProvider(t)
+
+	now := time.Now()
+	require.NoError(t, provider.Insert(ctx, []Query{
+		{TS: now, QueryParam: "up", Method: http.MethodGet, Type: QueryTypeInstant},
+		{TS: now, QueryParam: "rate(errors_total[5m])", Method: http.MethodPost, Type: QueryTypeRange},
+		{TS: now, QueryParam: "rate(requests_total[5m])", Method: http.MethodPost, Type: QueryTypeRange},
+	}))
+
+	result, err := provider.Query(ctx, "SELECT queryParam FROM queries WHERE method = 'POST' ORDER BY queryParam")
+	require.NoError(t, err)
+	require.Len(t, result.Data, 2)
+	assert.Equal(t, "rate(errors_total[5m])", result.Data[0]["queryParam"])
+	assert.Equal(t, "rate(requests_total[5m])", result.Data[1]["queryParam"])
+
+	result, err = provider.Query(ctx, "SELECT COUNT(*) AS total FROM queries")
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, result.Data[0]["total"])
+}
+
+func TestSQLiteProvider_Query(t *testing.T) {
+	ctx := context.Background()
+	provider := newTestSqliteProvider(t)
+
+	require.NoError(t, provider.Insert(ctx, []Query{
+		{TS: time.Now(), QueryParam: "up", StatusCode: 200, Type: QueryTypeInstant},
+		{TS: time.Now(), QueryParam: "down", StatusCode: 422, Type: QueryTypeInstant},
+	}))
+
+	result, err := provider.Query(ctx, "SELECT queryParam, statusCode FROM queries WHERE statusCode >= 400")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"queryParam", "statusCode"}, result.Columns)
+	require.Len(t, result.Data, 1)
+	assert.Equal(t, "down", result.Data[0]["queryParam"])
+	assert.EqualValues(t, 422, result.Data[0]["statusCode"])
+
+	for _, query := range []string{"DELETE FROM queries", "PRAGMA writable_schema = ON", "VACUUM INTO 'copy.db'"} {
+		_, err = provider.Query(ctx, query)
+		assert.ErrorContains(t, err, "query not allowed", query)
+	}
+
+	result, err = provider.Query(ctx, "SELECT COUNT(*) AS total FROM queries")
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, result.Data[0]["total"])
+}
+
+func TestSQLiteProvider_DashboardUID(t *testing.T) {
+	ctx := context.Background()
+	provider := newTestSqliteProvider(t)
+
+	now := time.Now()
+	require.NoError(t, provider.Insert(ctx, []Query{
+		{TS: now, QueryParam: "up", DashboardUID: "node-exporter", Type: QueryTypeInstant},
+		{TS: now, QueryParam: "node_load1", DashboardUID: "node-exporter", Type: QueryTypeRange},
+		{TS: now, QueryParam: "rate(requests_total[5m])", DashboardUID: "api", Type: QueryTypeRange},
+		{TS: now, QueryParam: "up", Type: QueryTypeInstant},
+	}))
+
+	result, err := provider.Query(ctx, "SELECT dashboardUID, COUNT(*) AS total FROM queries GROUP BY dashboardUID ORDER BY total DESC, dashboardUID")
+	require.NoError(t, err)
+	require.Len(t, result.Data, 3)
+	assert.Equal(t, "node-exporter", result.Data[0]["dashboardUID"])
+	assert.EqualValues(t, 2, result.Data[0]["total"])
+	// Queries sent without dashboard are stored as NULL.
+	assert.Nil(t, result.Data[1]["dashboardUID"])
+	assert.Equal(t, "api", result.Data[2]["dashboardUID"])
+
+	detail, err := provider.GetQueryExecutionDetail(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "node-exporter", detail.DashboardUID)
+	detail, err = provider.GetQueryExecutionDetail(ctx, 4)
+	require.NoError(t, err)
+	assert.Empty(t, detail.DashboardUID)
+}
+
+func TestGetWindowComparison(t *testing.T) {
+	ctx := context.Background()
+	provider := newTestSqliteProvider(t)
+
+	now := time.Now()
+	current := TimeRange{From: now.Add(-time.Hour), To: now}
+	queries := []Query{
+		{TS: now.Add(-time.Minute), QueryParam: "up", StatusCode: 200, Duration: 100 * time.Millisecond, Type: QueryTypeInstant},
+		{TS: now.Add(-time.Minute), QueryParam: "up", StatusCode: 200, Duration: 200 * time.Millisecond, Type: QueryTypeInstant},
+		{TS: now.Add(-time.Minute), QueryParam: "up", StatusCode: 200, Duration: 300 * time.Millisecond, Type: QueryTypeInstant},
+		{TS: now.Add(-time.Minute), QueryParam: "up", StatusCode: 500, Duration: 400 * time.Millisecond, Type: QueryTypeInstant},
+		// Only counted in the current window.
+		{TS: current.From, QueryParam: "up", StatusCode: 200, Duration: 250 * time.Millisecond, Type: QueryTypeInstant},
+		{TS: now.Add(-90 * time.Minute), QueryParam: "up", StatusCode: 200, Duration: 100 * time.Millisecond, Type: QueryTypeInstant},
+		{TS: now.Add(-90 * time.Minute), QueryParam: "up", StatusCode: 200, Duration: 100 * time.Millisecond, Type: QueryTypeInstant},
+	}
+	require.NoError(t, provider.Insert(ctx, queries))
+
+	comparison, err := GetWindowComparison(ctx, provider, current, current.Previous())
+	require.NoError(t, err)
+	assert.Equal(t, current.From.Add(-time.Microsecond), comparison.Previous.To)
+	assert.Equal(t, current.From.Add(-time.Hour), comparison.Previous.From)
+
+	assert.Equal(t, 5.0, comparison.TotalQueries.Current)
+	assert.Equal(t, 2.0, comparison.TotalQueries.Previous)
+	assert.Equal(t, 3.0, comparison.TotalQueries.Delta)
+	require.NotNil(t, comparison.TotalQueries.DeltaPercent)
+	assert.InDelta(t, 150, *comparison.TotalQueries.DeltaPercent, 0.001)
+
+	assert.InDelta(t, 20, comparison.ErrorRatePercent.Current, 0.001)
+	assert.Zero(t, comparison.ErrorRatePercent.Previous)
+	assert.Nil(t, comparison.ErrorRatePercent.DeltaPercent)
+
+	assert.InDelta(t, 250, comparison.AvgDuration.Current, 0.001)
+	assert.InDelta(t, 100, comparison.AvgDuration.Previous, 0.001)
+	require.NotNil(t, comparison.AvgDuration.DeltaPercent)
+	assert.InDelta(t, 150, *comparison.AvgDuration.DeltaPercent, 0.001)
+}
+
+func TestSqliteDSN_Invalid(t *testing.T) {
+	_, err := sqliteDSN(config.SQLiteConfig{DatabasePath: "test.db", JournalMode: "fast"})
+	assert.ErrorContains(t, err, "journal mode")
+
+	_, err = sqliteDSN(config.SQLiteConfig{DatabasePath: "test.db", Synchronous: "sometimes"})
+	assert.ErrorContains(t, err, "synchronous")
+
+	_, err = sqliteDSN(config.SQLiteConfig{DatabasePath: "test.db", BusyTimeout: -time.Second})
+	assert.ErrorContains(t, err, "busy timeout")
+}
+
+func TestSQLiteProvider_Pragmas(t *testing.T) {
+	ctx := context.Background()
+
+	config.DefaultConfig.Database.SQLite.BusyTimeout = 2 * time.Second
+	config.DefaultConfig.Database.SQLite.Synchronous = "FULL"
+	t.Cleanup(func() {
+		config.DefaultConfig.Database.SQLite.BusyTimeout = 0
+		config.DefaultConfig.Database.SQLite.Synchronous = ""
+	})
+	provider := newTestSqliteProvider(t)
+
+	provider.WithDB(func(db *sql.DB) {
+		// Hold two connections at once so the pragmas are checked on more
+		// than the one that opened the database.
+		conns := make([]*sql.Conn, 0, 2)
+		for range 2 {
+			conn, err := db.Conn(ctx)
+			require.NoError(t, err)
+			defer conn.Close()
+			conns = append(conns, conn)
+		}
+
+		for _, conn := range conns {
+			var journalMode string
+			var busyTimeout, synchronous int
+			require.NoError(t, conn.QueryRowContext(ctx, "PRAGMA journal_mode").Scan(&journalMode))
+			require.NoError(t, conn.QueryRowContext(ctx, "PRAGMA busy_timeout").Scan(&busyTimeout))
+			require.NoError(t, conn.QueryRowContext(ctx, "PRAGMA synchronous").Scan(&synchronous))
+
+			assert.Equal(t, "wal", journalMode)
+			assert.Equal(t, 2000, busyTimeout)
+			// FULL is reported as 2.
+			assert.Equal(t, 2, synchronous)
+		}
+	})
+}
+
+func TestSQLiteProvider_ConcurrentReadsAndWrites(t *testing.T) {
+	ctx := context.Background()
+	provider := newTestSqliteProvider(t)
+
+	now := time.Now()
+	g, gctx := errgroup.WithContext(ctx)
+	for w := range 4 {
+		g.Go(func() error {
+			for i := range 25 {
+				err := provider.Insert(gctx, []Query{{
+					TS:            now.Add(-time.Minute),
+					QueryParam:    fmt.Sprintf("up{writer=\"%d\",i=\"%d\"}", w, i),
+					LabelMatchers: LabelMatchers{{"__name__": "up"}},
+					MetricNames:   []string{"up"},
+					Duration:      time.Millisecond,
+					Type:          QueryTypeInstant,
+				}})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	for range 4 {
+		g.Go(func() error {
+			for range 25 {
+				if _, err := provider.GetQueriesBySerieName(gctx, "up", 0, 10, DefaultSerieQueriesSortBy, "desc"); err != nil {
+					return err
+				}
+				if _, err := provider.GetSlowestQueries(gctx, TimeRange{From: now.Add(-time.Hour), To: now}, "", "", 10); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	require.NoError(t, g.Wait())
+
+	result, err := provider.GetQueriesBySerieName(ctx, "up", 0, 10, DefaultSerieQueriesSortBy, "desc")
+	require.NoError(t, err)
+	assert.Equal(t, 100, result.Total)
+	assert.True(t, result.HasNext)
+}
+
+func TestSQLiteProvider_GetDashboardUsagePagination(t *testing.T) {
+	ctx := context.Background()
+	provider := newTestSqliteProvider(t)
+
+	require.NoError(t, provider.InsertDashboardUsage(ctx, []DashboardUsage{
+		{Id: "1", Serie: "up", Name: "Overview", URL: "/d/1"},
+		{Id: "2", Serie: "up", Name: "Nodes", URL: "/d/2"},
+		{Id: "3", Serie: "up", Name: "Alerts", URL: "/d/3"},
+	}))
+
+	first, err := provider.GetDashboardUsage(ctx, "up", 1, 2)
+	require.NoError(t, err)
+	assert.Equal(t, 3, first.Total)
+	assert.Equal(t, 2, first.TotalPages)
+	assert.Equal(t, 1, first.Page)
+	assert.Equal(t, 2, first.PageSize)
+	assert.True(t, first.HasNext)
+	assert.Len(t, first.Data, 2)
+
+	last, err := provider.GetDashboardUsage(ctx, "up", 2, 2)
+	require.NoError(t, err)
+	assert.Equal(t, 3, last.Total)
+	assert.Equal(t, 2, last.Page)
+	assert.False(t, last.HasNext)
+	assert.Len(t, last.Data, 1)
+}
+
+func TestSQLiteProvider_UsageLookback(t *testing.T) {
+	ctx := context.Background()
+	provider := newTestSqliteProvider(t)
+
+	require.NoError(t, provider.InsertDashboardUsage(ctx, []DashboardUsage{
+		{Id: "1", Serie: "up", Name: "Overview", URL: "/d/1"},
+		{Id: "2", Serie: "up", Name: "Nodes", URL: "/d/2"},
+	}))
+	provider.WithDB(func(db *sql.DB) {
+		_, err := db.ExecContext(ctx, "UPDATE DashboardUsage SET created_at = ? WHERE id = '2'", time.Now().Add(-10*24*time.Hour))
+		require.NoError(t, err)
+	})
+
+	// Only the first dashboard was pushed within the default 7 days.
+	result, err := provider.GetDashboardUsage(ctx, "up", 1, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Total)
+	require.Len(t, result.Data, 1)
+	assert.Equal(t, "1", result.Data.([]DashboardUsage)[0].Id)
+
+	provider.(*SQLiteProvider).usageLookback = 30 * 24 * time.Hour
+	result, err = provider.GetDashboardUsage(ctx, "up", 1, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Total)
+}
+
+func TestSQLiteProvider_Stats(t *testing.T) {
+	ctx := context.Background()
+	provider := newTestSqliteProvider(t)
+
+	stats, err := provider.Stats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"queries": 0, "RulesUsage": 0, "DashboardUsage": 0}, stats.TableRows)
+	emptySize := stats.SizeBytes
+	assert.Positive(t, emptySize)
+
+	now := time.Now()
+	queries := make([]Query, 0, 500)
+	for i := range 500 {
+		queries = append(queries, Query{
+			TS:         now.Add(-time.Duration(i) * time.Second),
+			QueryParam: fmt.Sprintf(`up{instance="node-%d"}`, i),
+			Type:       QueryTypeInstant,
+		})
+	}
+	require.NoError(t, provider.Insert(ctx, queries))
+	require.NoError(t, provider.InsertRulesUsage(ctx, []RulesUsage{
+		{Serie: "up", GroupName: "nodes", Name: "NodeDown", Expression: "up == 0", Kind: string(RuleUsageKindAlert)},
+		{Serie: "up", GroupName: "nodes", Name: "job:up:sum", Expression: "sum by (job) (up)", Kind: string(RuleUsageKindRecord)},
+	}))
+	require.NoError(t, provider.InsertDashboardUsage(ctx, []DashboardUsage{
+		{Id: "1", Serie: "up", Name: "Overview", URL: "/d/1"},
+	}))
+
+	stats, err = provider.Stats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"queries": 500, "RulesUsage": 2, "DashboardUsage": 1}, stats.TableRows)
+	assert.Greater(t, stats.SizeBytes, emptySize)
+}
+
+func TestSQLiteProvider_QueriesIndexes(t *testing.T) {
+	ctx := context.Background()
+
+	path := filepath.Join(t.TempDir(), "prom-analytics-proxy.db")
+	config.DefaultConfig.Database.SQLite.DatabasePath = path
+	// Opening the database again must not fail on the existing indexes.
+	for range 2 {
+		provider, err := newSqliteProvider(ctx)
+		require.NoError(t, err)
+		require.NoError(t, provider.Close())
+	}
+
+	provider := newTestSqliteProvider(t)
+	provider.WithDB(func(db *sql.DB) {
+		rows, err := db.QueryContext(ctx, "SELECT name FROM sqlite_master WHERE type = 'index' AND tbl_name = 'queries' ORDER BY name")
+		require.NoError(t, err)
+		defer rows.Close()
+
+		var indexes []string
+		for rows.Next() {
+			var name string
+			require.NoError(t, rows.Scan(&name))
+			indexes = append(indexes, name)
+		}
+		require.NoError(t, rows.Err())
+		assert.Equal(t, []string{"queries_fingerprint_ts_idx", "queries_ts_idx", "queries_type_ts_idx"}, indexes)
+
+		var plan string
+		require.NoError(t, db.QueryRowContext(ctx, "EXPLAIN QUERY PLAN SELECT COUNT(*) FROM queries WHERE ts BETWEEN ? AND ?", "a", "b").Scan(new(int), new(int), new(int), &plan))
+		assert.Contains(t, plan, "queries_ts_idx")
+	})
+}
+
+// BenchmarkSQLiteProvider_QueriesIndexes compares the time range lookups of
+// 100k queries with and without the queries indexes.
+func BenchmarkSQLiteProvider_QueriesIndexes(b *testing.B) {
+	ctx := context.Background()
+	provider := newTestSqliteProvider(b)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	queries := make([]Query, 0, 1000)
+	for i := range 100_000 {
+		queries = append(queries, Query{
+			TS:          now.Add(-time.Duration(i) * 30 * time.Second),
+			QueryParam:  fmt.Sprintf("up{job=\"%d\"}", i%100),
+			Fingerprint: fmt.Sprintf("fp%d", i%100),
+			Duration:    time.Duration(i%1000) * time.Millisecond,
+			StatusCode:  200,
+			Type:        QueryTypeInstant,
+		})
+		if len(queries) == cap(queries) {
+			require.NoError(b, provider.Insert(ctx, queries))
+			queries = queries[:0]
+		}
+	}
+	tr := TimeRange{From: now.Add(-time.Hour), To: now}
+
+	run := func(b *testing.B) {
+		for range b.N {
+			if _, err := provider.GetSlowestQueries(ctx, tr, "", "", 10); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := provider.GetTopQueries(ctx, tr.From, tr.To, 10); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.Run("indexed", run)
+	provider.WithDB(func(db *sql.DB) {
+		_, err := db.ExecContext(ctx, "DROP INDEX queries_ts_idx; DROP INDEX queries_fingerprint_ts_idx; DROP INDEX queries_type_ts_idx")
+		require.NoError(b, err)
+	})
+	b.Run("unindexed", run)
+}
+
+func TestSQLiteProvider_GetMetricStatisticsBatch(t *testing.T) {
+	ctx := context.Background()
+	provider := newTestSqliteProvider(t)
+
+	now := time.Now()
+	require.NoError(t, provider.Insert(ctx, []Query{
+		{TS: now.Add(-time.Minute), QueryParam: "up", MetricNames: []string{"up"}, Type: QueryTypeInstant},
+		{TS: now.Add(-2 * time.Minute), QueryParam: "up", MetricNames: []string{"up"}, Type: QueryTypeInstant},
+		{TS: now.Add(-time.Minute), QueryParam: "rate(http_requests_total[5m]) / up", MetricNames: []string{"http_requests_total", "up"}, Type: QueryTypeRange},
+		// Outside of the requested time range.
+		{TS: now.Add(-48 * time.Hour), QueryParam: "node_load1", MetricNames: []string{"node_load1"}, Type: QueryTypeInstant},
+	}))
+	require.NoError(t, provider.InsertRulesUsage(ctx, []RulesUsage{
+		{Serie: "up", GroupName: "g", Name: "InstanceDown", Expression: "up == 0", Kind: string(RuleUsageKindAlert)},
+		{Serie: "up", GroupName: "g", Name: "InstanceDown", Expression: "up == 0", Kind: string(RuleUsageKindAlert)},
+		{Serie: "up", GroupName: "g", Name: "job:up:sum", Expression: "sum by (job) (up)", Kind: string(RuleUsageKindRecord)},
+		{Serie: "node_load1", GroupName: "g", Name: "HighLoad", Expression: "node_load1 > 4", Kind: string(RuleUsageKindAlert)},
+	}))
+	require.NoError(t, provider.InsertDashboardUsage(ctx, []DashboardUsage{
+		{Id: "1", Serie: "up", Name: "Overview", URL: "/d/1"},
+		{Id: "2", Serie: "http_requests_total", Name: "HTTP", URL: "/d/2"},
+	}))
+
+	tr := TimeRange{From: now.Add(-time.Hour), To: now}
+	stats, err := provider.GetMetricStatisticsBatch(ctx, []string{"up", "http_requests_total", "node_load1", "unused_total"}, tr)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]MetricUsageStatistics{
+		"up":                  {Alerts: 1, Records: 1, Dashboards: 1, Queries: 2},
+		"http_requests_total": {Dashboards: 1, Queries: 1},
+		"node_load1":          {Alerts: 1},
+		"unused_total":        {},
+	}, stats)
+
+	stats, err = provider.GetMetricStatisticsBatch(ctx, nil, tr)
+	require.NoError(t, err)
+	assert.Empty(t, stats)
+}
+
+func TestSQLiteProvider_ResultStatus(t *testing.T) {
+	ctx := context.Background()
+	provider := newTestSqliteProvider(t)
+
+	now := time.Now()
+	require.NoError(t, provider.Insert(ctx, []Query{
+		{TS: now.Add(-time.Minute), QueryParam: "up", StatusCode: 200, ResultStatus: "success", SourceIP: "10.0.0.1", MetricNames: []string{"up"}, Type: QueryTypeInstant},
+		// Failed with a 200 status code.
+		{TS: now.Add(-time.Minute), QueryParam: "up", StatusCode: 200, ResultStatus: QueryResultStatusError, Error: "query timed out in expression evaluation", SourceIP: "10.0.0.1", MetricNames: []string{"up"}, Type: QueryTypeInstant},
+		// Recorded before the result status was.
+		{TS: now.Add(-time.Minute), QueryParam: "up", StatusCode: 200, SourceIP: "10.0.0.1", MetricNames: []string{"up"}, Type: QueryTypeInstant},
+		{TS: now.Add(-time.Minute), QueryParam: "up", StatusCode: 422, ResultStatus: QueryResultStatusError, Error: "many-to-many matching not allowed", SourceIP: "10.0.0.1", MetricNames: []string{"up"}, Type: QueryTypeInstant},
+	}))
+	tr := TimeRange{From: now.Add(-time.Hour), To: now}
+
+	summary, err := provider.GetQueriesSummary(ctx, tr.From, tr.To)
+	require.NoError(t, err)
+	assert.Equal(t, 4, summary.TotalQueries)
+	assert.Equal(t, 2, summary.FailedQueries)
+
+	breakdown, err := provider.GetQueryErrorBreakdown(ctx, tr, "", "")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []ErrorBreakdownRow{
+		{Category: ErrorCategoryTimeout, Count: 1},
+		{Category: ErrorCategoryManyToMany, Count: 1},
+	}, breakdown)
+
+	ips, err := provider.GetQueriesByIP(ctx, tr, "", "", 10)
+	require.NoError(t, err)
+	require.Len(t, ips, 1)
+	assert.Equal(t, 2, ips[0].Errors)
+
+	result, err := provider.GetQueriesBySerieName(ctx, "up", 0, 10, DefaultSerieQueriesSortBy, "desc")
+	require.NoError(t, err)
+	require.Len(t, result.Data, 1)
+	assert.InDelta(t, 50.0, result.Data.([]QueriesBySerieNameResult)[0].ErrorRatePercent, 0.001)
+}
@@ -0,0 +1,91 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// ThroughputGroupBy is the dimension splitting the query throughput into
+// several series.
+type ThroughputGroupBy string
+
+const (
+	ThroughputGroupByNone   ThroughputGroupBy = ""
+	ThroughputGroupByTenant ThroughputGroupBy = "tenant"
+	ThroughputGroupBySource ThroughputGroupBy = "source"
+	ThroughputGroupByMethod ThroughputGroupBy = "method"
+)
+
+// ThroughputTotalSeries names the single series of the throughput when it
+// is not grouped.
+const ThroughputTotalSeries = "total"
+
+// ParseThroughputGroupBy validates a throughput dimension, an empty one
+// returning the total throughput only.
+func ParseThroughputGroupBy(s string) (ThroughputGroupBy, error) {
+	switch groupBy := ThroughputGroupBy(s); groupBy {
+	case ThroughputGroupByNone, ThroughputGroupByTenant, ThroughputGroupBySource, ThroughputGroupByMethod:
+		return groupBy, nil
+	}
+	return "", fmt.Errorf("unknown group by %q, must be one of tenant, source or method", s)
+}
+
+// column returns the expression of the dimension, given the columns of the
+// tenant, source and method. Queries without a value are grouped together
+// in the series named after the empty string.
+func (g ThroughputGroupBy) column(tenant, source, method string) string {
+	switch g {
+	case ThroughputGroupByTenant:
+		return "COALESCE(" + tenant + ", '')"
+	case ThroughputGroupBySource:
+		return "COALESCE(" + source + ", '')"
+	case ThroughputGroupByMethod:
+		return "COALESCE(" + method + ", '')"
+	}
+	return "'" + ThroughputTotalSeries + "'"
+}
+
+// ThroughputBucket is the number of queries of each series recorded within
+// a step starting at Time.
+type ThroughputBucket struct {
+	Time   time.Time      `json:"time"`
+	Series map[string]int `json:"series"`
+}
+
+// throughputCount is the number of queries of a series within the step
+// starting at the given unix time, as returned by the databases.
+type throughputCount struct {
+	bucket int64
+	series string
+	count  int
+}
+
+// throughputBuckets shapes the counts into one bucket per step of the time
+// range, every bucket holding every series so they can be stacked.
+func throughputBuckets(tr TimeRange, step time.Duration, counts []throughputCount) []ThroughputBucket {
+	seconds := int64(step.Seconds())
+	first := tr.From.Unix() / seconds * seconds
+
+	series := make(map[string]struct{})
+	for _, c := range counts {
+		series[c.series] = struct{}{}
+	}
+
+	buckets := make([]ThroughputBucket, 0, (tr.To.Unix()-first)/seconds+1)
+	for t := first; t <= tr.To.Unix(); t += seconds {
+		bucket := ThroughputBucket{Time: time.Unix(t, 0).UTC(), Series: make(map[string]int, len(series))}
+		for name := range series {
+			bucket.Series[name] = 0
+		}
+		buckets = append(buckets, bucket)
+	}
+
+	for _, c := range counts {
+		i := (c.bucket - first) / seconds
+		if i < 0 || i >= int64(len(buckets)) {
+			continue
+		}
+		buckets[i].Series[c.series] += c.count
+	}
+	return buckets
+}
@@ -0,0 +1,108 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseThroughputGroupBy(t *testing.T) {
+	for _, s := range []string{"", "tenant", "source", "method"} {
+		groupBy, err := ParseThroughputGroupBy(s)
+		require.NoError(t, err)
+		assert.Equal(t, ThroughputGroupBy(s), groupBy)
+	}
+
+	_, err := ParseThroughputGroupBy("fingerprint")
+	assert.Error(t, err)
+}
+
+func TestThroughputBuckets(t *testing.T) {
+	tr := TimeRange{From: time.Unix(90, 0), To: time.Unix(250, 0)}
+	buckets := throughputBuckets(tr, time.Minute, []throughputCount{
+		{bucket: 60, series: "a", count: 1},
+		{bucket: 180, series: "a", count: 2},
+		{bucket: 180, series: "b", count: 3},
+	})
+
+	assert.Equal(t, []ThroughputBucket{
+		{Time: time.Unix(60, 0).UTC(), Series: map[string]int{"a": 1, "b": 0}},
+		{Time: time.Unix(120, 0).UTC(), Series: map[string]int{"a": 0, "b": 0}},
+		{Time: time.Unix(180, 0).UTC(), Series: map[string]int{"a": 2, "b": 3}},
+		{Time: time.Unix(240, 0).UTC(), Series: map[string]int{"a": 0, "b": 0}},
+	}, buckets)
+}
+
+func TestSQLiteProvider_GetQueryThroughput(t *testing.T) {
+	ctx := context.Background()
+	provider := newTestSqliteProvider(t)
+
+	from := time.Now().UTC().Truncate(time.Hour).Add(-time.Hour)
+	require.NoError(t, provider.Insert(ctx, []Query{
+		{TS: from.Add(5 * time.Minute), QueryParam: "up", StatusCode: 200, Tenant: "team-a", Method: "GET", Type: QueryTypeInstant},
+		{TS: from.Add(10 * time.Minute), QueryParam: "up", StatusCode: 200, Tenant: "team-a", Method: "POST", Type: QueryTypeInstant},
+		{TS: from.Add(20 * time.Minute), QueryParam: "up", StatusCode: 200, Tenant: "team-b", Method: "GET", Type: QueryTypeRange},
+		{TS: from.Add(40 * time.Minute), QueryParam: "up", StatusCode: 200, Tenant: "team-a", Method: "GET", Source: QuerySourceRule, Type: QueryTypeRange},
+	}))
+	tr := TimeRange{From: from, To: from.Add(time.Hour - time.Second)}
+
+	throughput, err := provider.GetQueryThroughput(ctx, tr, "", "", 15*time.Minute, ThroughputGroupByTenant)
+	require.NoError(t, err)
+	assert.Equal(t, []ThroughputBucket{
+		{Time: from, Series: map[string]int{"team-a": 2, "team-b": 0}},
+		{Time: from.Add(15 * time.Minute), Series: map[string]int{"team-a": 0, "team-b": 1}},
+		{Time: from.Add(30 * time.Minute), Series: map[string]int{"team-a": 1, "team-b": 0}},
+		{Time: from.Add(45 * time.Minute), Series: map[string]int{"team-a": 0, "team-b": 0}},
+	}, throughput)
+
+	throughput, err = provider.GetQueryThroughput(ctx, tr, "", "", 30*time.Minute, ThroughputGroupByNone)
+	require.NoError(t, err)
+	assert.Equal(t, []ThroughputBucket{
+		{Time: from, Series: map[string]int{ThroughputTotalSeries: 3}},
+		{Time: from.Add(30 * time.Minute), Series: map[string]int{ThroughputTotalSeries: 1}},
+	}, throughput)
+
+	throughput, err = provider.GetQueryThroughput(ctx, tr, "", "", time.Hour, ThroughputGroupByMethod)
+	require.NoError(t, err)
+	assert.Equal(t, []ThroughputBucket{
+		{Time: from, Series: map[string]int{"GET": 3, "POST": 1}},
+	}, throughput)
+
+	throughput, err = provider.GetQueryThroughput(ctx, tr, "team-a", "", time.Hour, ThroughputGroupByMethod)
+	require.NoError(t, err)
+	assert.Equal(t, []ThroughputBucket{
+		{Time: from, Series: map[string]int{"GET": 2, "POST": 1}},
+	}, throughput)
+
+	throughput, err = provider.GetQueryThroughput(ctx, tr, "team-a", string(QuerySourceRule), time.Hour, ThroughputGroupByMethod)
+	require.NoError(t, err)
+	assert.Equal(t, []ThroughputBucket{
+		{Time: from, Series: map[string]int{"GET": 1}},
+	}, throughput)
+}
+
+func TestSQLiteProvider_GetQueryThroughputTimeZone(t *testing.T) {
+	ctx := context.Background()
+	provider := newTestSqliteProvider(t)
+
+	// The buckets are aligned on the unix time, whatever the zone the
+	// queries were recorded in.
+	zone := time.FixedZone("UTC-3", -3*60*60)
+	from := time.Now().UTC().Truncate(time.Hour).Add(-time.Hour).In(zone)
+	require.NoError(t, provider.Insert(ctx, []Query{
+		{TS: from.Add(5 * time.Minute), QueryParam: "up", StatusCode: 200, Type: QueryTypeInstant},
+		{TS: from.Add(35*time.Minute + 500*time.Millisecond), QueryParam: "up", StatusCode: 200, Type: QueryTypeInstant},
+		{TS: from.Add(40 * time.Minute), QueryParam: "up", StatusCode: 200, Type: QueryTypeInstant},
+	}))
+	tr := TimeRange{From: from, To: from.Add(time.Hour - time.Second)}
+
+	throughput, err := provider.GetQueryThroughput(ctx, tr, "", "", 30*time.Minute, ThroughputGroupByNone)
+	require.NoError(t, err)
+	assert.Equal(t, []ThroughputBucket{
+		{Time: from.UTC(), Series: map[string]int{ThroughputTotalSeries: 1}},
+		{Time: from.UTC().Add(30 * time.Minute), Series: map[string]int{ThroughputTotalSeries: 2}},
+	}, throughput)
+}
@@ -0,0 +1,72 @@
+package ingester
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type metrics struct {
+	queriesTotal prometheus.Counter
+	droppedTotal prometheus.Counter
+}
+
+func newMetrics(qi *QueryIngester, reg prometheus.Registerer) *metrics {
+	m := &metrics{
+		queriesTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prom_analytics_proxy_ingester_queries_total",
+			Help: "Total number of queries accepted by the ingester.",
+		}),
+		droppedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prom_analytics_proxy_ingester_dropped_total",
+			Help: "Total number of queries dropped by the ingester without being persisted.",
+		}),
+	}
+
+	if reg != nil {
+		reg.MustRegister(
+			m.queriesTotal,
+			m.droppedTotal,
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Name: "prom_analytics_proxy_ingester_buffer_size",
+				Help: "Number of queries waiting in the ingester buffer.",
+			}, func() float64 {
+				return float64(len(qi.queriesC))
+			}),
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Name: "prom_analytics_proxy_ingester_lag_seconds",
+				Help: "Time the oldest query waiting to be persisted has been buffered.",
+			}, func() float64 {
+				lag, _ := qi.IngestionLag()
+				return lag.Seconds()
+			}),
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Name: "prom_analytics_proxy_ingester_sample_rate",
+				Help: "Fraction of the successful queries recorded, failed queries are always recorded.",
+			}, func() float64 {
+				return qi.SampleRate()
+			}),
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Name: "prom_analytics_proxy_ingester_read_only",
+				Help: "Whether the writes to the database are suspended (1) or not (0).",
+			}, func() float64 {
+				if qi.ReadOnly() {
+					return 1
+				}
+				return 0
+			}),
+		)
+	}
+
+	return m
+}
+
+func (m *metrics) ingested() {
+	if m != nil {
+		m.queriesTotal.Inc()
+	}
+}
+
+func (m *metrics) dropped(n int) {
+	if m != nil {
+		m.droppedTotal.Add(float64(n))
+	}
+}
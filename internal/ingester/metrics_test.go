@@ -0,0 +1,33 @@
+package ingester
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/db"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryIngester_DroppedMetric(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	ingester := NewQueryIngester(
+		new(MockDBProvider),
+		WithBufferSize(2),
+		WithRegisterer(reg),
+	)
+
+	for range 5 {
+		ingester.Ingest(db.Query{QueryParam: "up"})
+	}
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(ingester.metrics.queriesTotal))
+	assert.Equal(t, 3.0, testutil.ToFloat64(ingester.metrics.droppedTotal))
+
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP prom_analytics_proxy_ingester_buffer_size Number of queries waiting in the ingester buffer.
+# TYPE prom_analytics_proxy_ingester_buffer_size gauge
+prom_analytics_proxy_ingester_buffer_size 2
+`), "prom_analytics_proxy_ingester_buffer_size"))
+}
@@ -0,0 +1,165 @@
+package ingester
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/db"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	"google.golang.org/grpc"
+)
+
+// The attributes of the OTLP log records describing a query.
+const (
+	otlpQueryAttr      = "query"
+	otlpTypeAttr       = "type"
+	otlpDurationAttr   = "duration_ms"
+	otlpStatusCodeAttr = "status_code"
+)
+
+// OTLPReceiver is an OTLP logs gRPC service recording the queries described
+// by the received log records, so queries which are not sent through the
+// proxy can be analyzed as well. Each log record describes a query with the
+// query, type (instant or range), duration_ms and status_code attributes.
+type OTLPReceiver struct {
+	collogspb.UnimplementedLogsServiceServer
+
+	ingester *QueryIngester
+}
+
+func NewOTLPReceiver(ingester *QueryIngester) *OTLPReceiver {
+	return &OTLPReceiver{ingester: ingester}
+}
+
+// Register registers the receiver on the gRPC server.
+func (r *OTLPReceiver) Register(s *grpc.Server) {
+	collogspb.RegisterLogsServiceServer(s, r)
+}
+
+// Export ingests the queries of the log records. Log records not describing
+// a valid query are rejected, which is reported as a partial success.
+func (r *OTLPReceiver) Export(ctx context.Context, req *collogspb.ExportLogsServiceRequest) (*collogspb.ExportLogsServiceResponse, error) {
+	var (
+		rejected int64
+		lastErr  error
+	)
+	for _, resourceLogs := range req.GetResourceLogs() {
+		for _, scopeLogs := range resourceLogs.GetScopeLogs() {
+			for _, record := range scopeLogs.GetLogRecords() {
+				query, err := queryFromLogRecord(record)
+				if err != nil {
+					rejected++
+					lastErr = err
+					continue
+				}
+				r.ingester.Ingest(query)
+			}
+		}
+	}
+
+	resp := &collogspb.ExportLogsServiceResponse{}
+	if rejected > 0 {
+		slog.Debug("rejected OTLP log records", "rejected", rejected, "err", lastErr)
+		resp.PartialSuccess = &collogspb.ExportLogsPartialSuccess{
+			RejectedLogRecords: rejected,
+			ErrorMessage:       lastErr.Error(),
+		}
+	}
+	return resp, nil
+}
+
+// queryFromLogRecord returns the query described by the attributes of the
+// log record, recorded at the time of the log record.
+func queryFromLogRecord(record *logspb.LogRecord) (db.Query, error) {
+	attrs := make(map[string]*commonpb.AnyValue, len(record.GetAttributes()))
+	for _, kv := range record.GetAttributes() {
+		attrs[kv.GetKey()] = kv.GetValue()
+	}
+
+	query := db.Query{
+		TS:     logRecordTime(record),
+		Source: db.QuerySourceUser,
+	}
+
+	query.QueryParam = attrs[otlpQueryAttr].GetStringValue()
+	if query.QueryParam == "" {
+		return db.Query{}, fmt.Errorf("missing %s attribute", otlpQueryAttr)
+	}
+
+	switch queryType := db.QueryType(attrs[otlpTypeAttr].GetStringValue()); queryType {
+	case db.QueryTypeInstant:
+		query.Type = queryType
+		query.TimeParam = query.TS
+	case db.QueryTypeRange:
+		query.Type = queryType
+	default:
+		return db.Query{}, fmt.Errorf("invalid %s attribute %q, supported values are: instant, range", otlpTypeAttr, queryType)
+	}
+
+	statusCode, ok := intAttribute(attrs[otlpStatusCodeAttr])
+	if !ok || statusCode < 100 || statusCode > 599 {
+		return db.Query{}, fmt.Errorf("missing or invalid %s attribute", otlpStatusCodeAttr)
+	}
+	query.StatusCode = int(statusCode)
+
+	if v, found := attrs[otlpDurationAttr]; found {
+		duration, ok := floatAttribute(v)
+		if !ok || duration < 0 {
+			return db.Query{}, fmt.Errorf("invalid %s attribute", otlpDurationAttr)
+		}
+		query.Duration = time.Duration(duration * float64(time.Millisecond))
+	}
+
+	return query, nil
+}
+
+// logRecordTime returns the time of the event of the log record, or when it
+// was observed when unknown.
+func logRecordTime(record *logspb.LogRecord) time.Time {
+	switch {
+	case record.GetTimeUnixNano() > 0:
+		return time.Unix(0, int64(record.GetTimeUnixNano()))
+	case record.GetObservedTimeUnixNano() > 0:
+		return time.Unix(0, int64(record.GetObservedTimeUnixNano()))
+	}
+	return time.Now()
+}
+
+// intAttribute returns the value of an integer attribute, which may also be
+// sent as an integral double or a string.
+func intAttribute(v *commonpb.AnyValue) (int64, bool) {
+	switch value := v.GetValue().(type) {
+	case *commonpb.AnyValue_IntValue:
+		return value.IntValue, true
+	case *commonpb.AnyValue_DoubleValue:
+		if value.DoubleValue != math.Trunc(value.DoubleValue) {
+			return 0, false
+		}
+		return int64(value.DoubleValue), true
+	case *commonpb.AnyValue_StringValue:
+		n, err := strconv.ParseInt(value.StringValue, 10, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// floatAttribute returns the value of a numeric attribute, which may also be
+// sent as a string.
+func floatAttribute(v *commonpb.AnyValue) (float64, bool) {
+	switch value := v.GetValue().(type) {
+	case *commonpb.AnyValue_IntValue:
+		return float64(value.IntValue), true
+	case *commonpb.AnyValue_DoubleValue:
+		return value.DoubleValue, true
+	case *commonpb.AnyValue_StringValue:
+		f, err := strconv.ParseFloat(value.StringValue, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,130 @@
+package ingester
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func stringAttr(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
+
+func intAttr(key string, value int64) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: value}}}
+}
+
+func doubleAttr(key string, value float64) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: value}}}
+}
+
+func TestOTLPReceiver_Export(t *testing.T) {
+	mockDB := new(MockDBProvider)
+	ingester := NewQueryIngester(mockDB, WithBufferSize(10), WithBatchSize(2), WithBatchFlushInterval(time.Hour))
+
+	inserted := make(chan []db.Query, 1)
+	mockDB.On("Insert", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		inserted <- args.Get(1).([]db.Query)
+	}).Return(nil).Once()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ingester.Run(ctx)
+
+	l := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	NewOTLPReceiver(ingester).Register(srv)
+	go func() { _ = srv.Serve(l) }()
+	defer srv.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return l.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	resp, err := collogspb.NewLogsServiceClient(conn).Export(ctx, &collogspb.ExportLogsServiceRequest{
+		ResourceLogs: []*logspb.ResourceLogs{{
+			ScopeLogs: []*logspb.ScopeLogs{{
+				LogRecords: []*logspb.LogRecord{
+					{
+						TimeUnixNano: uint64(ts.UnixNano()),
+						Attributes: []*commonpb.KeyValue{
+							stringAttr("query", `up{job="prometheus"}`),
+							stringAttr("type", "instant"),
+							doubleAttr("duration_ms", 12.5),
+							intAttr("status_code", 200),
+						},
+					},
+					{
+						TimeUnixNano: uint64(ts.UnixNano()),
+						Attributes: []*commonpb.KeyValue{
+							stringAttr("query", "rate(http_requests_total[5m])"),
+							stringAttr("type", "range"),
+							intAttr("duration_ms", 250),
+							stringAttr("status_code", "503"),
+						},
+					},
+					{
+						Attributes: []*commonpb.KeyValue{
+							stringAttr("query", "up"),
+							stringAttr("type", "exemplar"),
+							intAttr("status_code", 200),
+						},
+					},
+				},
+			}},
+		}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), resp.GetPartialSuccess().GetRejectedLogRecords())
+	assert.Contains(t, resp.GetPartialSuccess().GetErrorMessage(), "type")
+
+	select {
+	case queries := <-inserted:
+		require.Len(t, queries, 2)
+
+		assert.Equal(t, `up{job="prometheus"}`, queries[0].QueryParam)
+		assert.Equal(t, db.QueryTypeInstant, queries[0].Type)
+		assert.Equal(t, 12500*time.Microsecond, queries[0].Duration)
+		assert.Equal(t, 200, queries[0].StatusCode)
+		assert.True(t, ts.Equal(queries[0].TS))
+		assert.Equal(t, []string{"up"}, queries[0].MetricNames)
+
+		assert.Equal(t, db.QueryTypeRange, queries[1].Type)
+		assert.Equal(t, 250*time.Millisecond, queries[1].Duration)
+		assert.Equal(t, 503, queries[1].StatusCode)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for insert")
+	}
+}
+
+func TestQueryFromLogRecord_Invalid(t *testing.T) {
+	for name, attrs := range map[string][]*commonpb.KeyValue{
+		"missing query":       {stringAttr("type", "instant"), intAttr("status_code", 200)},
+		"missing type":        {stringAttr("query", "up"), intAttr("status_code", 200)},
+		"missing status code": {stringAttr("query", "up"), stringAttr("type", "instant")},
+		"invalid status code": {stringAttr("query", "up"), stringAttr("type", "instant"), intAttr("status_code", 42)},
+		"negative duration":   {stringAttr("query", "up"), stringAttr("type", "instant"), intAttr("status_code", 200), intAttr("duration_ms", -1)},
+		"invalid duration":    {stringAttr("query", "up"), stringAttr("type", "instant"), intAttr("status_code", 200), stringAttr("duration_ms", "fast")},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := queryFromLogRecord(&logspb.LogRecord{Attributes: attrs})
+			assert.Error(t, err)
+		})
+	}
+}
@@ -1,14 +1,23 @@
 package ingester
 
 import (
+	"cmp"
 	"context"
 	"crypto/md5"
 	"fmt"
 	"log/slog"
+	"math/rand"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/nicolastakashi/prom-analytics-proxy/internal/db"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql/parser"
 	"go.opentelemetry.io/otel"
 )
@@ -20,14 +29,68 @@ type QueryIngester struct {
 	mu     sync.RWMutex
 	closed bool
 
+	// readOnly suspends the writes to the database, queries are appended to
+	// the WAL when configured and dropped otherwise.
+	readOnly atomic.Bool
+
+	// pending holds the time each buffered query was accepted, oldest
+	// first, to report how far behind the ingester is.
+	pendingMu sync.Mutex
+	pending   []time.Time
+
+	// sampler is nil when every query is recorded.
+	samplerMu  sync.Mutex
+	sampler    *rand.Rand
+	sampleRate float64
+
 	shutdownGracePeriod time.Duration
 	ingestTimeout       time.Duration
 	batchSize           int
 	batchFlushInterval  time.Duration
+
+	walPath     string
+	walMaxBytes int64
+	wal         *wal
+
+	storedLabelNames map[string]struct{}
+	maxLabelMatchers int
+
+	maxQueryParamLength int
+	normalizeQueries    bool
+	fingerprintMode     FingerprintMode
+
+	registry prometheus.Registerer
+	metrics  *metrics
 }
 
 type QueryIngesterOption func(*QueryIngester)
 
+// FingerprintMode selects how the fingerprint grouping similar queries is
+// computed.
+type FingerprintMode string
+
+const (
+	// FingerprintModeLegacy hashes the parsed query with the label values
+	// masked, keeping the fingerprints of the previous releases. Queries
+	// that can not be parsed have no fingerprint.
+	FingerprintModeLegacy FingerprintMode = "legacy"
+	// FingerprintModeRaw hashes the query text as is.
+	FingerprintModeRaw FingerprintMode = "raw"
+	// FingerprintModeAST hashes the canonical form of the parsed query, with
+	// the label values masked and the label matchers sorted. It falls back
+	// to the raw mode for queries that can not be parsed.
+	FingerprintModeAST FingerprintMode = "ast"
+)
+
+// ParseFingerprintMode validates a fingerprint mode.
+func ParseFingerprintMode(mode string) (FingerprintMode, error) {
+	switch FingerprintMode(mode) {
+	case FingerprintModeLegacy, FingerprintModeRaw, FingerprintModeAST:
+		return FingerprintMode(mode), nil
+	}
+	return "", fmt.Errorf("unknown fingerprint mode %q, expected %q, %q or %q", mode, FingerprintModeLegacy, FingerprintModeRaw, FingerprintModeAST)
+}
+
 func WithBufferSize(bufferSize int) QueryIngesterOption {
 	return func(qi *QueryIngester) {
 		qi.queriesC = make(chan db.Query, bufferSize)
@@ -58,36 +121,241 @@ func WithBatchFlushInterval(interval time.Duration) QueryIngesterOption {
 	}
 }
 
+// WithWALPath enables an on-disk write-ahead file where queries that failed
+// to be persisted are kept until the database becomes available again.
+func WithWALPath(path string) QueryIngesterOption {
+	return func(qi *QueryIngester) {
+		qi.walPath = path
+	}
+}
+
+// WithWALMaxBytes bounds the size in bytes of the write-ahead file, the
+// queries that would grow it past the limit being dropped. A zero size
+// means no limit.
+func WithWALMaxBytes(maxBytes int64) QueryIngesterOption {
+	return func(qi *QueryIngester) {
+		qi.walMaxBytes = maxBytes
+	}
+}
+
+// WithStoredLabelNames restricts the label names persisted in the label
+// matchers of each query. The metric name is always kept. An empty list
+// keeps every label.
+func WithStoredLabelNames(names []string) QueryIngesterOption {
+	return func(qi *QueryIngester) {
+		if len(names) == 0 {
+			qi.storedLabelNames = nil
+			return
+		}
+		qi.storedLabelNames = make(map[string]struct{}, len(names)+1)
+		for _, name := range names {
+			qi.storedLabelNames[name] = struct{}{}
+		}
+		qi.storedLabelNames[labels.MetricName] = struct{}{}
+	}
+}
+
+// WithMaxLabelMatchers caps the number of label matchers persisted for each
+// query. Matchers beyond the limit are replaced by a truncation marker. The
+// metric name is always kept and does not count towards the limit. Zero
+// means unlimited.
+func WithMaxLabelMatchers(max int) QueryIngesterOption {
+	return func(qi *QueryIngester) {
+		qi.maxLabelMatchers = max
+	}
+}
+
+// WithMaxQueryParamLength truncates the stored query text to the given
+// number of bytes. Zero means unlimited.
+func WithMaxQueryParamLength(max int) QueryIngesterOption {
+	return func(qi *QueryIngester) {
+		qi.maxQueryParamLength = max
+	}
+}
+
+// WithNormalizeQueries replaces numeric literals, durations and string
+// literals with placeholders when computing the fingerprint, so queries
+// differing only in those group together. The stored query text is kept.
+func WithNormalizeQueries(normalize bool) QueryIngesterOption {
+	return func(qi *QueryIngester) {
+		qi.normalizeQueries = normalize
+	}
+}
+
+// WithSampleRate records only the given fraction, between 0 and 1, of the
+// successful queries. Failed queries are always recorded so the error
+// analytics stay accurate.
+func WithSampleRate(rate float64) QueryIngesterOption {
+	return func(qi *QueryIngester) {
+		qi.setSampleRate(rate)
+	}
+}
+
+// WithReadOnly starts the ingester with the writes to the database
+// suspended, see SetReadOnly.
+func WithReadOnly(readOnly bool) QueryIngesterOption {
+	return func(qi *QueryIngester) {
+		qi.readOnly.Store(readOnly)
+	}
+}
+
+// WithFingerprintMode sets how query fingerprints are computed, defaults to
+// FingerprintModeLegacy.
+func WithFingerprintMode(mode FingerprintMode) QueryIngesterOption {
+	return func(qi *QueryIngester) {
+		qi.fingerprintMode = mode
+	}
+}
+
+// WithRegisterer registers the ingester metrics against the given registry.
+func WithRegisterer(reg prometheus.Registerer) QueryIngesterOption {
+	return func(qi *QueryIngester) {
+		qi.registry = reg
+	}
+}
+
 func NewQueryIngester(dbProvider db.Provider, opts ...QueryIngesterOption) *QueryIngester {
 	qi := &QueryIngester{
 		dbProvider: dbProvider,
+		sampleRate: 1,
 	}
 
 	for _, opt := range opts {
 		opt(qi)
 	}
 
+	qi.metrics = newMetrics(qi, qi.registry)
+
+	if qi.walPath != "" {
+		w, err := newWAL(qi.walPath, qi.walMaxBytes)
+		if err != nil {
+			slog.Error("unable to open ingester wal, queries will not be buffered on failures", "err", err)
+		}
+		qi.wal = w
+	}
+
 	return qi
 }
 
+// SetReadOnly suspends or resumes the writes to the database, e.g. during
+// maintenance windows. While read-only, queries are appended to the WAL
+// when one is configured and replayed once writes resume, otherwise they
+// are dropped.
+func (i *QueryIngester) SetReadOnly(readOnly bool) {
+	if i.readOnly.Swap(readOnly) != readOnly {
+		slog.Info("query ingester mode changed", "readOnly", readOnly)
+	}
+}
+
+// ReadOnly reports whether the writes to the database are suspended.
+func (i *QueryIngester) ReadOnly() bool {
+	return i.readOnly.Load()
+}
+
 func (i *QueryIngester) Ingest(query db.Query) {
 	i.mu.RLock()
 	defer i.mu.RUnlock()
 
 	if i.closed {
-		//TODO(nicolastakashi): expose this to a metric
+		i.metrics.dropped(1)
 		slog.Error(fmt.Sprintf("closed: dropping query: %v", query))
 		return
 	}
+	if !i.sampled(query) {
+		return
+	}
+	if i.readOnly.Load() && i.wal == nil {
+		i.metrics.dropped(1)
+		slog.Debug(fmt.Sprintf("read-only: dropping query: %v", query))
+		return
+	}
+	// Hold the lock while sending so the queries are tracked in the order
+	// they are flushed.
+	i.pendingMu.Lock()
+	defer i.pendingMu.Unlock()
 	select {
 	case i.queriesC <- query:
+		i.pending = append(i.pending, time.Now())
+		i.metrics.ingested()
 	default:
-		//TODO(nicolastakashi): expose this to a metric
+		i.metrics.dropped(1)
 		slog.Error(fmt.Sprintf("blocked: dropping query: %v", query))
 	}
 }
 
+// sampled reports whether the query must be recorded.
+func (i *QueryIngester) sampled(query db.Query) bool {
+	if query.Failed() {
+		return true
+	}
+
+	i.samplerMu.Lock()
+	defer i.samplerMu.Unlock()
+	if i.sampler == nil {
+		return true
+	}
+	return i.sampler.Float64() < i.sampleRate
+}
+
+// SetSampleRate changes the fraction, between 0 and 1, of the successful
+// queries recorded, see WithSampleRate.
+func (i *QueryIngester) SetSampleRate(rate float64) {
+	i.samplerMu.Lock()
+	defer i.samplerMu.Unlock()
+	if i.sampleRate != rate {
+		slog.Info("query ingester sample rate changed", "sampleRate", rate)
+	}
+	i.setSampleRate(rate)
+}
+
+func (i *QueryIngester) setSampleRate(rate float64) {
+	i.sampleRate = rate
+	switch {
+	case rate >= 1:
+		i.sampler = nil
+	case i.sampler == nil:
+		i.sampler = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+}
+
+// SampleRate returns the fraction of the successful queries recorded.
+func (i *QueryIngester) SampleRate() float64 {
+	i.samplerMu.Lock()
+	defer i.samplerMu.Unlock()
+	return i.sampleRate
+}
+
+// IngestionLag returns how long the oldest query waiting to be persisted
+// has been buffered, and how many queries are waiting. The lag is zero when
+// nothing is buffered.
+func (i *QueryIngester) IngestionLag() (time.Duration, int) {
+	i.pendingMu.Lock()
+	defer i.pendingMu.Unlock()
+
+	if len(i.pending) == 0 {
+		return 0, 0
+	}
+	return time.Since(i.pending[0]), len(i.pending)
+}
+
+// flushed stops tracking the n oldest buffered queries, whether they were
+// persisted or not.
+func (i *QueryIngester) flushed(n int) {
+	i.pendingMu.Lock()
+	defer i.pendingMu.Unlock()
+
+	n = min(n, len(i.pending))
+	i.pending = i.pending[n:]
+	if len(i.pending) == 0 {
+		i.pending = nil
+	}
+}
+
 func (i *QueryIngester) Run(ctx context.Context) {
+	if i.wal != nil && !i.readOnly.Load() {
+		i.replayWAL(ctx)
+	}
+
 	batch := make([]db.Query, 0, i.batchSize)
 	ticker := time.NewTicker(i.batchFlushInterval)
 	defer ticker.Stop()
@@ -103,10 +371,7 @@ func (i *QueryIngester) Run(ctx context.Context) {
 			i.drainWithGracePeriod(batch)
 			return
 		case query := <-i.queriesC:
-			query.Fingerprint = fingerprintFromQuery(query.QueryParam)
-			query.LabelMatchers = labelMatchersFromQuery(query.QueryParam)
-
-			batch = append(batch, query)
+			batch = append(batch, i.prepare(query))
 			if len(batch) >= i.batchSize {
 				i.ingest(ctx, batch)
 				batch = batch[:0]
@@ -115,6 +380,9 @@ func (i *QueryIngester) Run(ctx context.Context) {
 			if len(batch) > 0 {
 				i.ingest(ctx, batch)
 				batch = batch[:0]
+			} else if i.wal != nil && !i.readOnly.Load() && i.wal.hasPending() {
+				// Writes may have resumed without any new query to flush.
+				i.replayWAL(ctx)
 			}
 		}
 	}
@@ -126,7 +394,7 @@ func (i *QueryIngester) drainWithGracePeriod(batch []db.Query) {
 	graceCtx, graceCancel := context.WithTimeout(context.Background(), i.shutdownGracePeriod)
 	defer graceCancel()
 	for query := range i.queriesC {
-		batch = append(batch, query)
+		batch = append(batch, i.prepare(query))
 		if len(batch) >= i.batchSize {
 			i.ingest(graceCtx, batch)
 			batch = batch[:0]
@@ -138,6 +406,17 @@ func (i *QueryIngester) drainWithGracePeriod(batch []db.Query) {
 }
 
 func (i *QueryIngester) ingest(ctx context.Context, queries []db.Query) {
+	defer i.flushed(len(queries))
+
+	if i.readOnly.Load() {
+		if i.wal == nil {
+			i.metrics.dropped(len(queries))
+			return
+		}
+		i.appendToWAL(queries)
+		return
+	}
+
 	ingestCtx, ingestCancel := context.WithTimeout(ctx, i.ingestTimeout)
 	defer ingestCancel()
 
@@ -147,14 +426,106 @@ func (i *QueryIngester) ingest(ctx context.Context, queries []db.Query) {
 	err := i.dbProvider.Insert(traceContext, queries)
 	if err != nil {
 		slog.Error("unable to insert query", "err", err)
+		if i.wal == nil {
+			i.metrics.dropped(len(queries))
+			return
+		}
+		i.appendToWAL(queries)
+		return
+	}
+
+	if i.wal != nil && i.wal.hasPending() {
+		i.replayWAL(ctx)
+	}
+}
+
+// metricNamesFromQuery returns the sorted, deduplicated names of every metric
+// selected by the query, so a query is attributed to all the metrics it
+// touches rather than only the first one.
+func metricNamesFromQuery(query string) []string {
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return nil
+	}
+	names := make([]string, 0)
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		if n, ok := node.(*parser.VectorSelector); ok {
+			for _, m := range n.LabelMatchers {
+				if m.Name == labels.MetricName && m.Type == labels.MatchEqual {
+					names = append(names, m.Value)
+				}
+			}
+		}
+		return nil
+	})
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// appendToWAL buffers the queries in the WAL, counting the ones it drops
+// once full.
+func (i *QueryIngester) appendToWAL(queries []db.Query) {
+	dropped, err := i.wal.append(queries)
+	if err != nil {
+		i.metrics.dropped(len(queries))
+		slog.Error("unable to append queries to wal", "err", err)
 		return
 	}
+	if dropped > 0 {
+		i.metrics.dropped(dropped)
+		slog.Warn("wal is full, dropping queries", "dropped", dropped, "maxBytes", i.walMaxBytes)
+	}
 }
 
-func fingerprintFromQuery(query string) string {
+func (i *QueryIngester) replayWAL(ctx context.Context) {
+	err := i.wal.replay(i.batchSize, func(queries []db.Query) error {
+		replayCtx, replayCancel := context.WithTimeout(ctx, i.ingestTimeout)
+		defer replayCancel()
+		return i.dbProvider.Insert(replayCtx, queries)
+	})
+	if err != nil {
+		slog.Error("unable to replay queries from wal", "err", err)
+	}
+}
+
+// prepare derives the fingerprint, label matchers and metric names of a query
+// before it is persisted, truncating its text when it exceeds the configured
+// length.
+func (i *QueryIngester) prepare(query db.Query) db.Query {
+	query.Fingerprint = fingerprintFromQuery(query.QueryParam, i.fingerprintMode, i.normalizeQueries)
+	query.LabelMatchers = labelMatchersFromQuery(query.QueryParam, i.storedLabelNames, i.maxLabelMatchers)
+	query.MetricNames = metricNamesFromQuery(query.QueryParam)
+	query.QueryParam = truncateQueryParam(query.QueryParam, i.maxQueryParamLength)
+	return query
+}
+
+// truncateQueryParam cuts the query to at most max bytes without splitting
+// a multi-byte character.
+func truncateQueryParam(query string, max int) string {
+	if max <= 0 || len(query) <= max {
+		return query
+	}
+	for max > 0 && !utf8.RuneStart(query[max]) {
+		max--
+	}
+	return query[:max]
+}
+
+func fingerprintFromQuery(query string, mode FingerprintMode, normalize bool) string {
+	if mode == FingerprintModeRaw {
+		return fmt.Sprintf("%x", md5.Sum([]byte(query)))
+	}
+
+	// Only the ast mode canonicalizes the query, the other ones keeping
+	// the fingerprints of the previous releases.
+	canonical := mode == FingerprintModeAST
+
 	expr, err := parser.ParseExpr(query)
 	if err != nil {
-		return ""
+		if !canonical {
+			return ""
+		}
+		return fmt.Sprintf("%x", md5.Sum([]byte(query)))
 	}
 
 	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
@@ -165,28 +536,77 @@ func fingerprintFromQuery(query string) string {
 					m.Value = "MASKED"
 				}
 			}
+			if canonical {
+				slices.SortFunc(n.LabelMatchers, func(a, b *labels.Matcher) int {
+					return cmp.Or(strings.Compare(a.Name, b.Name), cmp.Compare(a.Type, b.Type))
+				})
+			}
+			if normalize && n.OriginalOffset != 0 {
+				n.OriginalOffset = 0
+			}
+		case *parser.AggregateExpr:
+			if canonical {
+				slices.Sort(n.Grouping)
+			}
+		case *parser.NumberLiteral:
+			if normalize {
+				n.Val = 0
+			}
+		case *parser.StringLiteral:
+			if normalize {
+				n.Val = "MASKED"
+			}
+		case *parser.MatrixSelector:
+			if normalize {
+				n.Range = 0
+			}
+		case *parser.SubqueryExpr:
+			if normalize {
+				n.Range, n.Step, n.OriginalOffset = 0, 0, 0
+			}
 		}
 		return nil
 	})
 	return fmt.Sprintf("%x", (md5.Sum([]byte(expr.String()))))
 }
 
-func labelMatchersFromQuery(query string) []map[string]string {
+// truncatedLabelMatchersName is the label name of the marker appended to the
+// label matchers of a query when some of them were dropped. Its value is the
+// number of dropped matchers.
+const truncatedLabelMatchersName = "__truncated__"
+
+func labelMatchersFromQuery(query string, allowedNames map[string]struct{}, maxMatchers int) []map[string]string {
 	expr, err := parser.ParseExpr(query)
 	if err != nil {
 		return nil
 	}
 	res := make([]map[string]string, 0)
+	stored, truncated := 0, 0
 	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
 		switch n := node.(type) {
 		case *parser.VectorSelector:
 			v := make(map[string]string, 0)
 			for _, m := range n.LabelMatchers {
+				if allowedNames != nil {
+					if _, ok := allowedNames[m.Name]; !ok {
+						continue
+					}
+				}
+				if m.Name != labels.MetricName && maxMatchers > 0 {
+					if stored >= maxMatchers {
+						truncated++
+						continue
+					}
+					stored++
+				}
 				v[m.Name] = m.Value
 			}
 			res = append(res, v)
 		}
 		return nil
 	})
+	if truncated > 0 {
+		res = append(res, map[string]string{truncatedLabelMatchersName: strconv.Itoa(truncated)})
+	}
 	return res
 }
@@ -4,11 +4,16 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/nicolastakashi/prom-analytics-proxy/internal/db"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 type MockDBProvider struct {
@@ -25,11 +30,25 @@ func (m *MockDBProvider) Close() error {
 	return args.Error(0)
 }
 
+func (m *MockDBProvider) Stats(ctx context.Context) (*db.DBStats, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (m *MockDBProvider) Ping(ctx context.Context) error {
+	args := m.Called(ctx)
+	return args.Error(0)
+}
+
 func (m *MockDBProvider) Query(ctx context.Context, query string) (*db.QueryResult, error) {
 	args := m.Called(ctx, query)
 	return args.Get(0).(*db.QueryResult), args.Error(1)
 }
 
+func (m *MockDBProvider) Explain(ctx context.Context, query string) (*db.QueryResult, error) {
+	args := m.Called(ctx, query)
+	return args.Get(0).(*db.QueryResult), args.Error(1)
+}
+
 func (p *MockDBProvider) WithDB(f func(db *sql.DB)) {
 }
 
@@ -41,7 +60,9 @@ func (p *MockDBProvider) GetQueriesBySerieName(
 	ctx context.Context,
 	serieName string,
 	page int,
-	pageSize int) (*db.PagedResult, error) {
+	pageSize int,
+	sortBy string,
+	sortOrder string) (*db.PagedResult, error) {
 	return nil, fmt.Errorf("not implemented")
 }
 
@@ -63,6 +84,54 @@ func (p *MockDBProvider) GetDashboardUsage(ctx context.Context, serieName string
 	return nil, nil
 }
 
+func (p *MockDBProvider) GetSimilarDashboards(ctx context.Context, threshold float64) ([]db.SimilarDashboards, error) {
+	return nil, nil
+}
+
+func (p *MockDBProvider) GetQueriesSummary(ctx context.Context, startTime, endTime time.Time) (*db.QueriesSummary, error) {
+	return nil, nil
+}
+
+func (p *MockDBProvider) GetTopQueries(ctx context.Context, startTime, endTime time.Time, limit int) ([]db.TopQuery, error) {
+	return nil, nil
+}
+
+func (p *MockDBProvider) GetSlowestQueries(ctx context.Context, tr db.TimeRange, tenant string, source string, limit int) ([]db.SlowQueryRow, error) {
+	return nil, nil
+}
+
+func (p *MockDBProvider) GetLatencyRegressions(ctx context.Context, currentWindow, baselineWindow time.Duration, factor float64) ([]db.LatencyRegression, error) {
+	return nil, nil
+}
+
+func (p *MockDBProvider) GetQueryExecutionDetail(ctx context.Context, id int64) (*db.QueryExecutionDetail, error) {
+	return nil, db.ErrNotFound
+}
+
+func (p *MockDBProvider) GetQueryErrorBreakdown(ctx context.Context, tr db.TimeRange, tenant string, source string) ([]db.ErrorBreakdownRow, error) {
+	return nil, nil
+}
+
+func (p *MockDBProvider) GetMetricStatisticsBatch(ctx context.Context, names []string, tr db.TimeRange) (map[string]db.MetricUsageStatistics, error) {
+	return nil, nil
+}
+
+func (p *MockDBProvider) GetTopQueriedMetrics(ctx context.Context, tr db.TimeRange, tenant string, source string, limit int) ([]db.MetricQueryCount, error) {
+	return nil, nil
+}
+
+func (p *MockDBProvider) GetQueryThroughput(ctx context.Context, tr db.TimeRange, tenant string, source string, step time.Duration, groupBy db.ThroughputGroupBy) ([]db.ThroughputBucket, error) {
+	return nil, nil
+}
+
+func (p *MockDBProvider) GetQueriesByIP(ctx context.Context, tr db.TimeRange, tenant string, source string, limit int) ([]db.SourceIPStats, error) {
+	return nil, nil
+}
+
+func (p *MockDBProvider) DeleteQueriesBefore(ctx context.Context, cutoff time.Time, filter db.QueryFilter) (int64, error) {
+	return 0, nil
+}
+
 func TestQueryIngester_Run(t *testing.T) {
 	mockDB := new(MockDBProvider)
 	queriesC := make(chan db.Query, 10)
@@ -152,3 +221,378 @@ func TestQueryIngester_Run_BatchFlushInterval(t *testing.T) {
 
 	mockDB.AssertExpectations(t)
 }
+
+func TestQueryIngester_StoredLabelNames(t *testing.T) {
+	mockDB := new(MockDBProvider)
+	queriesC := make(chan db.Query, 10)
+	ingester := &QueryIngester{
+		dbProvider:          mockDB,
+		queriesC:            queriesC,
+		shutdownGracePeriod: 1 * time.Second,
+		ingestTimeout:       1 * time.Second,
+		batchSize:           1,
+		batchFlushInterval:  500 * time.Millisecond,
+	}
+	WithStoredLabelNames([]string{"job"})(ingester)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go ingester.Run(ctx)
+
+	inserted := make(chan []db.Query, 1)
+	mockDB.On("Insert", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		inserted <- args.Get(1).([]db.Query)
+	}).Return(nil).Once()
+
+	ingester.Ingest(db.Query{QueryParam: `up{job="prometheus", instance="localhost:9090"}`})
+
+	select {
+	case queries := <-inserted:
+		assert.Len(t, queries, 1)
+		assert.Equal(t, []map[string]string{{
+			"__name__": "up",
+			"job":      "prometheus",
+		}}, []map[string]string(queries[0].LabelMatchers))
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for insert")
+	}
+}
+
+func TestLabelMatchersFromQuery_MaxLabelMatchers(t *testing.T) {
+	matchers := make([]string, 0, 50)
+	for i := 0; i < 50; i++ {
+		matchers = append(matchers, fmt.Sprintf(`l%02d="v"`, i))
+	}
+	query := fmt.Sprintf(`up{%s}`, strings.Join(matchers, ","))
+
+	res := labelMatchersFromQuery(query, nil, 5)
+	require.Len(t, res, 2)
+
+	assert.Len(t, res[0], 6)
+	assert.Equal(t, "up", res[0]["__name__"])
+	assert.Equal(t, map[string]string{truncatedLabelMatchersName: "45"}, res[1])
+
+	// Without limit every matcher is kept.
+	res = labelMatchersFromQuery(query, nil, 0)
+	require.Len(t, res, 1)
+	assert.Len(t, res[0], 51)
+}
+
+func TestMetricNamesFromQuery(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{query: `up`, expected: []string{"up"}},
+		{query: `rate(requests_total{code="500"}[5m]) / rate(requests_total[5m])`, expected: []string{"requests_total"}},
+		{query: `sum(errors_total) / on(job) group_left sum(requests_total)`, expected: []string{"errors_total", "requests_total"}},
+		{query: `{__name__=~"node_.*"}`, expected: []string{}},
+		{query: `vector(1)`, expected: []string{}},
+		{query: `invalid(`, expected: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			assert.Equal(t, tt.expected, metricNamesFromQuery(tt.query))
+		})
+	}
+}
+
+func TestFingerprintFromQuery_Normalize(t *testing.T) {
+	assert.NotEqual(t, fingerprintFromQuery(`rate(x[5m])`, FingerprintModeAST, false), fingerprintFromQuery(`rate(x[10m])`, FingerprintModeAST, false))
+	assert.Equal(t, fingerprintFromQuery(`rate(x[5m])`, FingerprintModeAST, true), fingerprintFromQuery(`rate(x[10m])`, FingerprintModeAST, true))
+
+	assert.Equal(t, fingerprintFromQuery(`sum(up) > 5`, FingerprintModeAST, true), fingerprintFromQuery(`sum(up) > 10`, FingerprintModeAST, true))
+	assert.NotEqual(t, fingerprintFromQuery(`sum(up) > 5`, FingerprintModeAST, true), fingerprintFromQuery(`sum(down) > 5`, FingerprintModeAST, true))
+}
+
+func TestTruncateQueryParam(t *testing.T) {
+	assert.Equal(t, "up", truncateQueryParam("up", 0))
+	assert.Equal(t, "up", truncateQueryParam("up", 10))
+	assert.Equal(t, "sum(", truncateQueryParam("sum(up)", 4))
+	// Multi-byte characters are never split.
+	assert.Equal(t, `up{a="`, truncateQueryParam(`up{a="é"}`, 7))
+}
+
+func TestQueryIngester_Run_BatchBySize(t *testing.T) {
+	mockDB := new(MockDBProvider)
+	inserted := make(chan []db.Query, 10)
+	mockDB.On("Insert", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		inserted <- append([]db.Query(nil), args.Get(1).([]db.Query)...)
+	}).Return(nil)
+
+	ingester := NewQueryIngester(
+		mockDB,
+		WithBufferSize(10),
+		WithBatchSize(3),
+		WithBatchFlushInterval(time.Hour),
+		WithIngestTimeout(time.Second),
+		WithShutdownGracePeriod(time.Second),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		ingester.Run(ctx)
+		close(done)
+	}()
+
+	for range 4 {
+		ingester.Ingest(db.Query{QueryParam: "up"})
+	}
+
+	select {
+	case queries := <-inserted:
+		assert.Len(t, queries, 3)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the batch to be flushed")
+	}
+
+	// The remaining query is only flushed on shutdown.
+	select {
+	case <-inserted:
+		t.Fatal("partial batch flushed before the flush interval")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	cancel()
+	<-done
+
+	select {
+	case queries := <-inserted:
+		assert.Len(t, queries, 1)
+	default:
+		t.Fatal("partial batch not flushed on shutdown")
+	}
+}
+
+func TestQueryIngester_Run_BatchByInterval(t *testing.T) {
+	mockDB := new(MockDBProvider)
+	inserted := make(chan []db.Query, 10)
+	mockDB.On("Insert", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		inserted <- append([]db.Query(nil), args.Get(1).([]db.Query)...)
+	}).Return(nil)
+
+	ingester := NewQueryIngester(
+		mockDB,
+		WithBufferSize(10),
+		WithBatchSize(100),
+		WithBatchFlushInterval(50*time.Millisecond),
+		WithIngestTimeout(time.Second),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ingester.Run(ctx)
+
+	ingester.Ingest(db.Query{QueryParam: "up"})
+	ingester.Ingest(db.Query{QueryParam: "down"})
+
+	select {
+	case queries := <-inserted:
+		assert.Len(t, queries, 2)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the batch to be flushed")
+	}
+}
+
+func TestQueryIngester_Run_FailedFlushIsCounted(t *testing.T) {
+	mockDB := new(MockDBProvider)
+	mockDB.On("Insert", mock.Anything, mock.Anything).Return(fmt.Errorf("database is down"))
+
+	ingester := NewQueryIngester(
+		mockDB,
+		WithBufferSize(10),
+		WithBatchSize(2),
+		WithBatchFlushInterval(time.Hour),
+		WithIngestTimeout(time.Second),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ingester.Run(ctx)
+
+	ingester.Ingest(db.Query{QueryParam: "up"})
+	ingester.Ingest(db.Query{QueryParam: "down"})
+
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(ingester.metrics.droppedTotal) == 2
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestQueryIngester_ReadOnly(t *testing.T) {
+	mockDB := new(MockDBProvider)
+	inserted := make(chan []db.Query, 10)
+	mockDB.On("Insert", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		inserted <- append([]db.Query(nil), args.Get(1).([]db.Query)...)
+	}).Return(nil)
+
+	ingester := NewQueryIngester(
+		mockDB,
+		WithBufferSize(10),
+		WithBatchSize(1),
+		WithBatchFlushInterval(10*time.Millisecond),
+		WithIngestTimeout(time.Second),
+		WithReadOnly(true),
+	)
+	assert.True(t, ingester.ReadOnly())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ingester.Run(ctx)
+
+	// Writes are suspended: without a WAL the query is dropped.
+	ingester.Ingest(db.Query{QueryParam: "up"})
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingester.metrics.droppedTotal))
+	select {
+	case <-inserted:
+		t.Fatal("query inserted while read-only")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Writes resume.
+	ingester.SetReadOnly(false)
+	assert.False(t, ingester.ReadOnly())
+	ingester.Ingest(db.Query{QueryParam: "down"})
+
+	select {
+	case queries := <-inserted:
+		require.Len(t, queries, 1)
+		assert.Equal(t, "down", queries[0].QueryParam)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for insert")
+	}
+}
+
+func TestQueryIngester_IngestionLag(t *testing.T) {
+	mockDB := new(MockDBProvider)
+	mockDB.On("Insert", mock.Anything, mock.Anything).Return(nil)
+
+	reg := prometheus.NewRegistry()
+	ingester := NewQueryIngester(
+		mockDB,
+		WithBufferSize(10),
+		WithBatchSize(10),
+		WithBatchFlushInterval(time.Hour),
+		WithIngestTimeout(time.Second),
+		WithRegisterer(reg),
+	)
+
+	lag, pending := ingester.IngestionLag()
+	assert.Zero(t, lag)
+	assert.Zero(t, pending)
+
+	ingester.Ingest(db.Query{QueryParam: "up"})
+	time.Sleep(50 * time.Millisecond)
+	ingester.Ingest(db.Query{QueryParam: "down"})
+
+	// Nothing is flushed yet: the lag is the age of the oldest query.
+	lag, pending = ingester.IngestionLag()
+	assert.GreaterOrEqual(t, lag, 50*time.Millisecond)
+	assert.Equal(t, 2, pending)
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	var gauge float64
+	for _, mf := range families {
+		if mf.GetName() == "prom_analytics_proxy_ingester_lag_seconds" {
+			gauge = mf.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	assert.GreaterOrEqual(t, gauge, 0.05)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		ingester.Run(ctx)
+		close(done)
+	}()
+	cancel()
+	<-done
+
+	lag, pending = ingester.IngestionLag()
+	assert.Zero(t, lag)
+	assert.Zero(t, pending)
+	mockDB.AssertNumberOfCalls(t, "Insert", 1)
+}
+
+func TestQueryIngester_SampleRate(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	ingester := NewQueryIngester(
+		new(MockDBProvider),
+		WithBufferSize(10),
+		WithSampleRate(0),
+		WithRegisterer(reg),
+	)
+
+	ingester.Ingest(db.Query{QueryParam: "up", StatusCode: 200})
+	ingester.Ingest(db.Query{QueryParam: "up{", StatusCode: 400})
+	ingester.Ingest(db.Query{QueryParam: "up", StatusCode: 503})
+
+	// Only the failed queries are recorded, and sampling is not a drop.
+	require.Len(t, ingester.queriesC, 2)
+	assert.Equal(t, 400, (<-ingester.queriesC).StatusCode)
+	assert.Equal(t, 503, (<-ingester.queriesC).StatusCode)
+	assert.Zero(t, testutil.ToFloat64(ingester.metrics.droppedTotal))
+
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP prom_analytics_proxy_ingester_sample_rate Fraction of the successful queries recorded, failed queries are always recorded.
+# TYPE prom_analytics_proxy_ingester_sample_rate gauge
+prom_analytics_proxy_ingester_sample_rate 0
+`), "prom_analytics_proxy_ingester_sample_rate"))
+}
+
+func TestQueryIngester_SetSampleRate(t *testing.T) {
+	ingester := NewQueryIngester(new(MockDBProvider), WithBufferSize(10), WithSampleRate(0))
+
+	ingester.Ingest(db.Query{QueryParam: "up", StatusCode: 200})
+	assert.Empty(t, ingester.queriesC)
+
+	ingester.SetSampleRate(1)
+	assert.Equal(t, float64(1), ingester.SampleRate())
+	ingester.Ingest(db.Query{QueryParam: "up", StatusCode: 200})
+	assert.Len(t, ingester.queriesC, 1)
+}
+
+func TestQueryIngester_SampleRateDefaultRecordsEverything(t *testing.T) {
+	ingester := NewQueryIngester(new(MockDBProvider), WithBufferSize(100))
+
+	for range 100 {
+		ingester.Ingest(db.Query{QueryParam: "up", StatusCode: 200})
+	}
+	assert.Len(t, ingester.queriesC, 100)
+}
+
+func TestFingerprintFromQuery_Modes(t *testing.T) {
+	sorted, unsorted := `up{a="1",b="2"}`, `up{b="2", a="1"}`
+
+	assert.Equal(t, fingerprintFromQuery(sorted, FingerprintModeAST, false), fingerprintFromQuery(unsorted, FingerprintModeAST, false))
+	assert.NotEqual(t, fingerprintFromQuery(sorted, FingerprintModeRaw, false), fingerprintFromQuery(unsorted, FingerprintModeRaw, false))
+
+	// Whitespace and grouping order are canonicalized as well.
+	assert.Equal(t,
+		fingerprintFromQuery("sum by (job, instance) (rate(x[5m]))", FingerprintModeAST, false),
+		fingerprintFromQuery("sum  by(instance,job)(\n  rate(x[5m])\n)", FingerprintModeAST, false),
+	)
+
+	// Queries that can not be parsed fall back to the raw fingerprint.
+	assert.Equal(t, fingerprintFromQuery("up{", FingerprintModeRaw, false), fingerprintFromQuery("up{", FingerprintModeAST, false))
+	assert.NotEmpty(t, fingerprintFromQuery("up{", FingerprintModeAST, false))
+
+	// The legacy mode, the default, keeps the fingerprints of the previous
+	// releases.
+	for _, mode := range []FingerprintMode{FingerprintModeLegacy, ""} {
+		assert.Equal(t, "7ee426981f7a1fa1a9c53f928cad1d55", fingerprintFromQuery(`sum by (job) (up{job="api", instance="a"})`, mode, false))
+		assert.Empty(t, fingerprintFromQuery("up{", mode, false))
+	}
+}
+
+func TestParseFingerprintMode(t *testing.T) {
+	mode, err := ParseFingerprintMode("raw")
+	require.NoError(t, err)
+	assert.Equal(t, FingerprintModeRaw, mode)
+
+	_, err = ParseFingerprintMode("sha")
+	assert.Error(t, err)
+}
@@ -0,0 +1,228 @@
+package ingester
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/db"
+)
+
+// wal is an append-only file holding queries that could not be persisted,
+// so they can be replayed once the database is reachable again.
+type wal struct {
+	mu      sync.Mutex
+	path    string
+	pending bool
+	// size is the size of the file, which appends do not grow past maxSize
+	// unless it is zero.
+	size    int64
+	maxSize int64
+}
+
+func newWAL(path string, maxSize int64) (*wal, error) {
+	w := &wal{path: path, maxSize: maxSize}
+
+	fi, err := os.Stat(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("unable to stat wal file: %w", err)
+	}
+	if err == nil {
+		w.size = fi.Size()
+	}
+	w.pending = w.size > 0
+
+	return w, nil
+}
+
+func (w *wal) hasPending() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.pending
+}
+
+// append writes the queries to the WAL, dropping the ones that would grow
+// it past its maximum size. It returns the number of dropped queries.
+func (w *wal) append(queries []db.Query) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	kept := 0
+	for _, query := range queries {
+		n := buf.Len()
+		if err := enc.Encode(query); err != nil {
+			return 0, fmt.Errorf("unable to encode query: %w", err)
+		}
+		if w.maxSize > 0 && w.size+int64(buf.Len()) > w.maxSize {
+			buf.Truncate(n)
+			break
+		}
+		kept++
+	}
+	dropped := len(queries) - kept
+	if kept == 0 {
+		return dropped, nil
+	}
+
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return 0, fmt.Errorf("unable to open wal file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		return 0, fmt.Errorf("unable to write wal file: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return 0, fmt.Errorf("unable to sync wal file: %w", err)
+	}
+
+	w.size += int64(buf.Len())
+	w.pending = true
+	return dropped, nil
+}
+
+// replay streams the queries stored in the WAL to persist in chunks of
+// batchSize, so only one chunk is held in memory at a time. Persisted chunks
+// are removed from the WAL; on failure the remaining queries are kept for
+// the next attempt.
+func (w *wal) replay(batchSize int, persist func([]db.Query) error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.pending {
+		return nil
+	}
+
+	f, err := os.Open(w.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			w.pending, w.size = false, 0
+			return nil
+		}
+		return fmt.Errorf("unable to open wal file: %w", err)
+	}
+	defer f.Close()
+
+	batchSize = max(batchSize, 1)
+	br := bufio.NewReader(f)
+	dec := json.NewDecoder(br)
+	batch := make([]db.Query, 0, batchSize)
+	for {
+		more := dec.More()
+		if more {
+			var query db.Query
+			if err := dec.Decode(&query); err != nil {
+				return fmt.Errorf("unable to decode wal entry: %w", err)
+			}
+			batch = append(batch, query)
+			if len(batch) < batchSize {
+				continue
+			}
+		}
+
+		if len(batch) > 0 {
+			if err := persist(batch); err != nil {
+				// The failed chunk and the entries not read yet are kept.
+				rest := io.MultiReader(dec.Buffered(), br)
+				if rewriteErr := w.rewriteLocked(batch, rest); rewriteErr != nil {
+					return rewriteErr
+				}
+				return fmt.Errorf("unable to replay wal: %w", err)
+			}
+			batch = batch[:0]
+		}
+		if !more {
+			break
+		}
+	}
+
+	return w.truncateLocked()
+}
+
+// rewriteLocked replaces the WAL with one holding the given queries followed
+// by the rest of the entries, as written in the WAL. They are written to a
+// temporary file renamed over the WAL, so a crash meanwhile leaves either
+// the previous or the new WAL, never an empty one.
+func (w *wal) rewriteLocked(queries []db.Query, rest io.Reader) error {
+	dir := filepath.Dir(w.path)
+	f, err := os.CreateTemp(dir, filepath.Base(w.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("unable to create temporary wal file: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	size, err := writeWAL(f, queries, rest)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("unable to close temporary wal file: %w", err)
+	}
+	if err := os.Rename(f.Name(), w.path); err != nil {
+		return fmt.Errorf("unable to replace wal file: %w", err)
+	}
+
+	// Sync the directory so the rename itself survives a crash.
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		d.Close()
+	}
+
+	w.size = size
+	w.pending = size > 0
+	return nil
+}
+
+// writeWAL writes the queries followed by the rest of the entries to the
+// file, syncs it and returns the number of bytes written.
+func writeWAL(f *os.File, queries []db.Query, rest io.Reader) (int64, error) {
+	cw := &countingWriter{w: f}
+	bw := bufio.NewWriter(cw)
+	enc := json.NewEncoder(bw)
+	for _, query := range queries {
+		if err := enc.Encode(query); err != nil {
+			return 0, fmt.Errorf("unable to encode query: %w", err)
+		}
+	}
+	if _, err := io.Copy(bw, rest); err != nil {
+		return 0, fmt.Errorf("unable to write wal file: %w", err)
+	}
+
+	if err := bw.Flush(); err != nil {
+		return 0, fmt.Errorf("unable to write wal file: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return 0, fmt.Errorf("unable to sync wal file: %w", err)
+	}
+	return cw.n, nil
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (w *wal) truncateLocked() error {
+	if err := os.Truncate(w.path, 0); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("unable to truncate wal file: %w", err)
+	}
+	w.pending, w.size = false, 0
+	return nil
+}
@@ -0,0 +1,222 @@
+package ingester
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/db"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryIngester_WALBuffersDuringOutage(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "ingester.wal")
+
+	mockDB := new(MockDBProvider)
+	ingester := NewQueryIngester(
+		mockDB,
+		WithBufferSize(10),
+		WithIngestTimeout(1*time.Second),
+		WithBatchSize(10),
+		WithWALPath(walPath),
+	)
+	require.NotNil(t, ingester.wal)
+
+	ctx := context.Background()
+	outage := []db.Query{{QueryParam: "up"}, {QueryParam: "node_cpu_seconds_total"}}
+	recovered := []db.Query{{QueryParam: "process_cpu_seconds_total"}}
+
+	// Database is down: the batch must be written to the WAL.
+	mockDB.On("Insert", mock.Anything, outage).Return(errors.New("connection refused")).Once()
+	ingester.ingest(ctx, outage)
+
+	assert.True(t, ingester.wal.hasPending())
+
+	// Database recovers: the new batch is inserted and the WAL is replayed.
+	var replayed []db.Query
+	mockDB.On("Insert", mock.Anything, recovered).Return(nil).Once()
+	mockDB.On("Insert", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		replayed = append(replayed, args.Get(1).([]db.Query)...)
+	}).Return(nil).Once()
+	ingester.ingest(ctx, recovered)
+
+	mockDB.AssertExpectations(t)
+	assert.Equal(t, outage, replayed)
+	assert.False(t, ingester.wal.hasPending())
+
+	queries, err := ingester.wal.readLocked()
+	require.NoError(t, err)
+	assert.Empty(t, queries)
+}
+
+func TestWAL_ReplayKeepsRemainingOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	w, err := newWAL(filepath.Join(dir, "ingester.wal"), 0)
+	require.NoError(t, err)
+
+	queries := []db.Query{{QueryParam: "a"}, {QueryParam: "b"}, {QueryParam: "c"}, {QueryParam: "d"}, {QueryParam: "e"}}
+	_, err = w.append(queries)
+	require.NoError(t, err)
+
+	// The queries are streamed in chunks of the batch size.
+	var batches [][]db.Query
+	err = w.replay(2, func(batch []db.Query) error {
+		batches = append(batches, slices.Clone(batch))
+		if len(batches) == 2 {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	assert.Error(t, err)
+	assert.Equal(t, [][]db.Query{queries[:2], queries[2:4]}, batches)
+	assert.True(t, w.hasPending())
+
+	remaining, err := w.readLocked()
+	require.NoError(t, err)
+	assert.Equal(t, queries[2:], remaining)
+	fi, err := os.Stat(w.path)
+	require.NoError(t, err)
+	assert.Equal(t, fi.Size(), w.size)
+
+	// The remaining queries replaced the WAL through a temporary file.
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "ingester.wal", entries[0].Name())
+}
+
+func TestWAL_PendingOnRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ingester.wal")
+
+	w, err := newWAL(path, 0)
+	require.NoError(t, err)
+	_, err = w.append([]db.Query{{QueryParam: "up"}})
+	require.NoError(t, err)
+
+	restarted, err := newWAL(path, 0)
+	require.NoError(t, err)
+	assert.True(t, restarted.hasPending())
+	assert.Equal(t, w.size, restarted.size)
+}
+
+func TestWAL_MaxSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ingester.wal")
+	entry, err := json.Marshal(db.Query{QueryParam: "up"})
+	require.NoError(t, err)
+	entrySize := int64(len(entry) + 1)
+
+	// Room for two entries and a half.
+	w, err := newWAL(path, 2*entrySize+entrySize/2)
+	require.NoError(t, err)
+
+	dropped, err := w.append([]db.Query{{QueryParam: "up"}})
+	require.NoError(t, err)
+	assert.Zero(t, dropped)
+
+	dropped, err = w.append([]db.Query{{QueryParam: "up"}, {QueryParam: "up"}, {QueryParam: "up"}})
+	require.NoError(t, err)
+	assert.Equal(t, 2, dropped)
+
+	queries, err := w.readLocked()
+	require.NoError(t, err)
+	assert.Len(t, queries, 2)
+
+	// The size of the existing WAL counts after a restart.
+	restarted, err := newWAL(path, 2*entrySize+entrySize/2)
+	require.NoError(t, err)
+	dropped, err = restarted.append([]db.Query{{QueryParam: "up"}})
+	require.NoError(t, err)
+	assert.Equal(t, 1, dropped)
+
+	// Replaying the WAL makes room again.
+	require.NoError(t, restarted.replay(10, func([]db.Query) error { return nil }))
+	dropped, err = restarted.append([]db.Query{{QueryParam: "up"}})
+	require.NoError(t, err)
+	assert.Zero(t, dropped)
+}
+
+func TestQueryIngester_WALFullCountsDropped(t *testing.T) {
+	mockDB := new(MockDBProvider)
+	reg := prometheus.NewRegistry()
+	ingester := NewQueryIngester(
+		mockDB,
+		WithBufferSize(10),
+		WithIngestTimeout(1*time.Second),
+		WithWALPath(filepath.Join(t.TempDir(), "ingester.wal")),
+		WithWALMaxBytes(1),
+		WithRegisterer(reg),
+	)
+	require.NotNil(t, ingester.wal)
+
+	mockDB.On("Insert", mock.Anything, mock.Anything).Return(errors.New("connection refused")).Once()
+	ingester.ingest(context.Background(), []db.Query{{QueryParam: "up"}, {QueryParam: "down"}})
+
+	assert.False(t, ingester.wal.hasPending())
+	assert.Equal(t, 2.0, testutil.ToFloat64(ingester.metrics.droppedTotal))
+}
+
+// readLocked reads every query stored in the WAL.
+func (w *wal) readLocked() ([]db.Query, error) {
+	f, err := os.Open(w.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	queries := make([]db.Query, 0)
+	dec := json.NewDecoder(f)
+	for dec.More() {
+		var query db.Query
+		if err := dec.Decode(&query); err != nil {
+			return nil, err
+		}
+		queries = append(queries, query)
+	}
+	return queries, nil
+}
+
+func TestQueryIngester_ReadOnlyBuffersToWAL(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "ingester.wal")
+
+	mockDB := new(MockDBProvider)
+	ingester := NewQueryIngester(
+		mockDB,
+		WithBufferSize(10),
+		WithIngestTimeout(1*time.Second),
+		WithBatchSize(10),
+		WithWALPath(walPath),
+	)
+	require.NotNil(t, ingester.wal)
+
+	ctx := context.Background()
+	maintenance := []db.Query{{QueryParam: "up"}}
+	resumed := []db.Query{{QueryParam: "node_cpu_seconds_total"}}
+
+	// Writes are suspended: the database is not touched and the batch is
+	// written to the WAL.
+	ingester.SetReadOnly(true)
+	ingester.ingest(ctx, maintenance)
+	mockDB.AssertNotCalled(t, "Insert", mock.Anything, mock.Anything)
+	assert.True(t, ingester.wal.hasPending())
+
+	// Writes resume: the new batch is inserted and the WAL is replayed.
+	ingester.SetReadOnly(false)
+	mockDB.On("Insert", mock.Anything, resumed).Return(nil).Once()
+	mockDB.On("Insert", mock.Anything, maintenance).Return(nil).Once()
+	ingester.ingest(ctx, resumed)
+
+	mockDB.AssertExpectations(t)
+	assert.False(t, ingester.wal.hasPending())
+}
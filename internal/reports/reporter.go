@@ -0,0 +1,227 @@
+package reports
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/db"
+)
+
+// Report summarizes the queries recorded between From and To.
+type Report struct {
+	GeneratedAt    time.Time         `json:"generatedAt"`
+	From           time.Time         `json:"from"`
+	To             time.Time         `json:"to"`
+	Summary        ReportSummary     `json:"summary"`
+	TopQueries     []db.TopQuery     `json:"topQueries"`
+	SlowestQueries []db.SlowQueryRow `json:"slowestQueries"`
+	// NewlyUnusedMetrics are the metrics queried in the previous interval
+	// which are neither queried in this one nor used by a rule or a
+	// dashboard, with their queries of the previous interval. It is omitted
+	// when the database cannot tell the usage of the metrics.
+	NewlyUnusedMetrics []db.MetricQueryCount `json:"newlyUnusedMetrics,omitempty"`
+}
+
+type ReportSummary struct {
+	TotalQueries  int     `json:"totalQueries"`
+	FailedQueries int     `json:"failedQueries"`
+	ErrorRate     float64 `json:"errorRate"`
+	P95Duration   float64 `json:"p95Duration"` // milliseconds
+}
+
+// unusedMetricsCandidates bounds the number of metrics queried in the
+// previous interval checked for being unused, the most queried first.
+const unusedMetricsCandidates = 1000
+
+// Reporter periodically generates a Report covering the last schedule
+// interval and posts it as JSON to a webhook.
+type Reporter struct {
+	dbProvider db.Provider
+	webhookURL string
+	client     *http.Client
+
+	schedule        time.Duration
+	timeout         time.Duration
+	topQueriesLimit int
+}
+
+type ReporterOption func(*Reporter)
+
+func WithSchedule(schedule time.Duration) ReporterOption {
+	return func(r *Reporter) {
+		r.schedule = schedule
+	}
+}
+
+func WithTimeout(timeout time.Duration) ReporterOption {
+	return func(r *Reporter) {
+		r.timeout = timeout
+	}
+}
+
+func WithTopQueriesLimit(limit int) ReporterOption {
+	return func(r *Reporter) {
+		r.topQueriesLimit = limit
+	}
+}
+
+func WithHTTPClient(client *http.Client) ReporterOption {
+	return func(r *Reporter) {
+		r.client = client
+	}
+}
+
+func NewReporter(dbProvider db.Provider, webhookURL string, opts ...ReporterOption) *Reporter {
+	r := &Reporter{
+		dbProvider:      dbProvider,
+		webhookURL:      webhookURL,
+		client:          http.DefaultClient,
+		schedule:        24 * time.Hour,
+		timeout:         time.Minute,
+		topQueriesLimit: 10,
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	return r
+}
+
+func (r *Reporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.schedule)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.Report(ctx, time.Now()); err != nil {
+				slog.Error("unable to send analytics report", "err", err)
+			}
+		}
+	}
+}
+
+// Report generates the report for the schedule interval ending at now and
+// posts it to the webhook.
+func (r *Reporter) Report(ctx context.Context, now time.Time) error {
+	reportCtx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	report, err := r.Generate(reportCtx, now.Add(-r.schedule), now)
+	if err != nil {
+		return err
+	}
+
+	return r.send(reportCtx, report)
+}
+
+// Generate builds the report for the queries recorded between from and to.
+func (r *Reporter) Generate(ctx context.Context, from, to time.Time) (*Report, error) {
+	summary, err := r.dbProvider.GetQueriesSummary(ctx, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get queries summary: %w", err)
+	}
+
+	topQueries, err := r.dbProvider.GetTopQueries(ctx, from, to, r.topQueriesLimit)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get top queries: %w", err)
+	}
+
+	tr := db.TimeRange{From: from, To: to}
+	slowestQueries, err := r.dbProvider.GetSlowestQueries(ctx, tr, "", "", r.topQueriesLimit)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get slowest queries: %w", err)
+	}
+
+	unusedMetrics, err := r.newlyUnusedMetrics(ctx, tr)
+	if err != nil {
+		return nil, err
+	}
+
+	errorRate := 0.0
+	if summary.TotalQueries > 0 {
+		errorRate = float64(summary.FailedQueries) / float64(summary.TotalQueries)
+	}
+
+	return &Report{
+		GeneratedAt: time.Now(),
+		From:        from,
+		To:          to,
+		Summary: ReportSummary{
+			TotalQueries:  summary.TotalQueries,
+			FailedQueries: summary.FailedQueries,
+			ErrorRate:     errorRate,
+			P95Duration:   summary.P95Duration,
+		},
+		TopQueries:         topQueries,
+		SlowestQueries:     slowestQueries,
+		NewlyUnusedMetrics: unusedMetrics,
+	}, nil
+}
+
+// newlyUnusedMetrics returns the metrics queried in the interval preceding
+// tr which are no longer used within tr.
+func (r *Reporter) newlyUnusedMetrics(ctx context.Context, tr db.TimeRange) ([]db.MetricQueryCount, error) {
+	previous, err := r.dbProvider.GetTopQueriedMetrics(ctx, tr.Previous(), "", "", unusedMetricsCandidates)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get previously queried metrics: %w", err)
+	}
+	if len(previous) == 0 {
+		return []db.MetricQueryCount{}, nil
+	}
+
+	names := make([]string, 0, len(previous))
+	for _, metric := range previous {
+		names = append(names, metric.Name)
+	}
+	stats, err := r.dbProvider.GetMetricStatisticsBatch(ctx, names, tr)
+	if errors.Is(err, db.ErrNotSupported) {
+		slog.Debug("skipping newly unused metrics", "err", err)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to get metric statistics: %w", err)
+	}
+
+	unused := []db.MetricQueryCount{}
+	for _, metric := range previous {
+		if stats[metric.Name] == (db.MetricUsageStatistics{}) {
+			unused = append(unused, metric)
+		}
+	}
+	return unused, nil
+}
+
+func (r *Reporter) send(ctx context.Context, report *Report) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("unable to marshal report: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to create webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to post report to webhook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+
+	return nil
+}
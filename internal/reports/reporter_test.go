@@ -0,0 +1,121 @@
+package reports
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/config"
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReporter_Report(t *testing.T) {
+	ctx := context.Background()
+
+	config.DefaultConfig.Database.SQLite.DatabasePath = filepath.Join(t.TempDir(), "reports.db")
+	provider, err := db.GetDbProvider(ctx, db.SQLite)
+	require.NoError(t, err)
+	defer provider.Close()
+
+	now := time.Now()
+	queries := make([]db.Query, 0, 10)
+	for i := 1; i <= 10; i++ {
+		query := db.Query{
+			TS:          now.Add(-time.Duration(i) * time.Minute),
+			QueryParam:  "up",
+			Fingerprint: "up",
+			Duration:    100 * time.Millisecond,
+			StatusCode:  200,
+			Type:        db.QueryTypeInstant,
+			MetricNames: []string{"up"},
+		}
+		if i > 7 {
+			query.QueryParam = "rate(http_requests_total[5m])"
+			query.Fingerprint = "rate"
+			query.Duration = 300 * time.Millisecond
+			query.StatusCode = 500
+			query.MetricNames = []string{"http_requests_total"}
+		}
+		queries = append(queries, query)
+	}
+	// Queried in the previous interval only, node_load1 is still used by a
+	// rule.
+	for _, metric := range []string{"up", "node_load1", "process_cpu_seconds_total"} {
+		queries = append(queries, db.Query{
+			TS:          now.Add(-90 * time.Minute),
+			QueryParam:  metric,
+			Fingerprint: metric,
+			StatusCode:  200,
+			Type:        db.QueryTypeInstant,
+			MetricNames: []string{metric},
+		})
+	}
+	require.NoError(t, provider.Insert(ctx, queries))
+	require.NoError(t, provider.InsertRulesUsage(ctx, []db.RulesUsage{{
+		Serie:      "node_load1",
+		GroupName:  "node",
+		Name:       "HighLoad",
+		Expression: "node_load1 > 10",
+		Kind:       "alert",
+		CreatedAt:  now,
+	}}))
+
+	received := make(chan map[string]json.RawMessage, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, http.MethodPost, req.Method)
+		assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+
+		var body map[string]json.RawMessage
+		assert.NoError(t, json.NewDecoder(req.Body).Decode(&body))
+		received <- body
+	}))
+	defer webhook.Close()
+
+	reporter := NewReporter(provider, webhook.URL, WithSchedule(time.Hour))
+	require.NoError(t, reporter.Report(ctx, now))
+
+	body := <-received
+	assert.Contains(t, body, "generatedAt")
+	assert.Contains(t, body, "from")
+	assert.Contains(t, body, "to")
+
+	var summary ReportSummary
+	require.NoError(t, json.Unmarshal(body["summary"], &summary))
+	assert.Equal(t, 10, summary.TotalQueries)
+	assert.Equal(t, 3, summary.FailedQueries)
+	assert.InDelta(t, 0.3, summary.ErrorRate, 1e-9)
+
+	var topQueries []db.TopQuery
+	require.NoError(t, json.Unmarshal(body["topQueries"], &topQueries))
+	require.Len(t, topQueries, 2)
+	assert.Equal(t, "up", topQueries[0].Fingerprint)
+	assert.Equal(t, 7, topQueries[0].Executions)
+	assert.Equal(t, "rate", topQueries[1].Fingerprint)
+	assert.Equal(t, 3, topQueries[1].Executions)
+
+	var slowestQueries []db.SlowQueryRow
+	require.NoError(t, json.Unmarshal(body["slowestQueries"], &slowestQueries))
+	require.Len(t, slowestQueries, 10)
+	assert.Equal(t, "rate", slowestQueries[0].Fingerprint)
+	assert.Equal(t, int64(300), slowestQueries[0].Duration)
+
+	var unusedMetrics []db.MetricQueryCount
+	require.NoError(t, json.Unmarshal(body["newlyUnusedMetrics"], &unusedMetrics))
+	assert.Equal(t, []db.MetricQueryCount{{Name: "process_cpu_seconds_total", Queries: 1}}, unusedMetrics)
+}
+
+func TestReporter_ReportWebhookError(t *testing.T) {
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer webhook.Close()
+
+	reporter := NewReporter(&db.NoopProvider{}, webhook.URL)
+	assert.Error(t, reporter.Report(context.Background(), time.Now()))
+}
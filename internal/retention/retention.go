@@ -0,0 +1,158 @@
+package retention
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/db"
+)
+
+// Pruner periodically deletes queries older than the configured maximum age,
+// so the queries table does not grow unbounded.
+type Pruner struct {
+	dbProvider db.Provider
+
+	mu       sync.RWMutex
+	maxAge   time.Duration
+	policies []Policy
+
+	interval time.Duration
+	timeout  time.Duration
+}
+
+// Policy overrides the maximum age of the queries it matches. A zero
+// maximum age keeps the matching queries forever.
+type Policy struct {
+	Match  db.QueryMatch
+	MaxAge time.Duration
+}
+
+// NewPolicy builds a policy matching the given query type and status class,
+// empty values match every query.
+func NewPolicy(queryType, status string, maxAge time.Duration) (Policy, error) {
+	switch db.QueryType(queryType) {
+	case "", db.QueryTypeInstant, db.QueryTypeRange:
+	default:
+		return Policy{}, fmt.Errorf("unknown query type %q", queryType)
+	}
+	class, err := db.ParseStatusClass(status)
+	if err != nil {
+		return Policy{}, err
+	}
+	return Policy{
+		Match:  db.QueryMatch{Type: db.QueryType(queryType), Status: class},
+		MaxAge: maxAge,
+	}, nil
+}
+
+type PrunerOption func(*Pruner)
+
+func WithInterval(interval time.Duration) PrunerOption {
+	return func(p *Pruner) {
+		p.interval = interval
+	}
+}
+
+func WithTimeout(timeout time.Duration) PrunerOption {
+	return func(p *Pruner) {
+		p.timeout = timeout
+	}
+}
+
+// WithPolicies sets per query retention policies. A query follows the first
+// policy matching it, and the maximum age of the pruner when none does.
+func WithPolicies(policies []Policy) PrunerOption {
+	return func(p *Pruner) {
+		p.policies = policies
+	}
+}
+
+func NewPruner(dbProvider db.Provider, maxAge time.Duration, opts ...PrunerOption) *Pruner {
+	p := &Pruner{
+		dbProvider: dbProvider,
+		maxAge:     maxAge,
+		interval:   time.Hour,
+		timeout:    5 * time.Minute,
+	}
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	return p
+}
+
+// SetRetention changes the maximum age and the policies of the pruner, they
+// apply from the next pruning on.
+func (p *Pruner) SetRetention(maxAge time.Duration, policies []Policy) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.maxAge = maxAge
+	p.policies = policies
+}
+
+func (p *Pruner) retention() (time.Duration, []Policy) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.maxAge, p.policies
+}
+
+func (p *Pruner) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		deleted, err := p.Prune(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("unable to prune queries", "err", err)
+		}
+		if deleted > 0 {
+			maxAge, policies := p.retention()
+			slog.Info("pruned queries", "deleted", deleted, "maxAge", maxAge, "policies", len(policies))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Prune deletes the queries older than the maximum age of their policy and
+// returns how many were removed.
+func (p *Pruner) Prune(ctx context.Context) (int64, error) {
+	pruneCtx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	maxAge, policies := p.retention()
+	now := time.Now()
+	matched := make([]db.QueryMatch, 0, len(policies))
+	var deleted int64
+	for _, policy := range policies {
+		if policy.MaxAge > 0 {
+			// Queries matched by an earlier policy follow that one instead.
+			n, err := p.dbProvider.DeleteQueriesBefore(pruneCtx, now.Add(-policy.MaxAge), db.QueryFilter{
+				Match:   policy.Match,
+				Exclude: matched,
+			})
+			deleted += n
+			if err != nil {
+				return deleted, fmt.Errorf("unable to delete queries: %w", err)
+			}
+		}
+		matched = append(matched, policy.Match)
+	}
+
+	if maxAge > 0 {
+		n, err := p.dbProvider.DeleteQueriesBefore(pruneCtx, now.Add(-maxAge), db.QueryFilter{Exclude: matched})
+		deleted += n
+		if err != nil {
+			return deleted, fmt.Errorf("unable to delete queries: %w", err)
+		}
+	}
+	return deleted, nil
+}
@@ -0,0 +1,154 @@
+package retention
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/config"
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPruner_Prune(t *testing.T) {
+	ctx := context.Background()
+
+	config.DefaultConfig.Database.SQLite.DatabasePath = filepath.Join(t.TempDir(), "retention.db")
+	provider, err := db.GetDbProvider(ctx, db.SQLite)
+	require.NoError(t, err)
+	defer provider.Close()
+
+	now := time.Now()
+	queries := make([]db.Query, 0, 10)
+	for i := 1; i <= 10; i++ {
+		queries = append(queries, db.Query{
+			TS:         now.Add(-time.Duration(i) * time.Hour),
+			QueryParam: "up",
+			StatusCode: 200,
+			Type:       db.QueryTypeInstant,
+		})
+	}
+	require.NoError(t, provider.Insert(ctx, queries))
+
+	pruner := NewPruner(provider, 4*time.Hour+30*time.Minute)
+
+	deleted, err := pruner.Prune(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), deleted)
+
+	summary, err := provider.GetQueriesSummary(ctx, now.Add(-24*time.Hour), now)
+	require.NoError(t, err)
+	assert.Equal(t, 4, summary.TotalQueries)
+
+	deleted, err = pruner.Prune(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, deleted)
+
+	// A reloaded retention applies on the next prune.
+	pruner.SetRetention(2*time.Hour+30*time.Minute, nil)
+	deleted, err = pruner.Prune(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), deleted)
+}
+
+func TestPruner_PrunePolicies(t *testing.T) {
+	ctx := context.Background()
+
+	config.DefaultConfig.Database.SQLite.DatabasePath = filepath.Join(t.TempDir(), "retention.db")
+	provider, err := db.GetDbProvider(ctx, db.SQLite)
+	require.NoError(t, err)
+	defer provider.Close()
+
+	now := time.Now()
+	queries := make([]db.Query, 0, 40)
+	for i := 1; i <= 10; i++ {
+		ts := now.Add(-time.Duration(i) * time.Hour)
+		queries = append(queries,
+			db.Query{TS: ts, QueryParam: "instant_ok", StatusCode: 200, Type: db.QueryTypeInstant},
+			db.Query{TS: ts, QueryParam: "instant_failed", StatusCode: 422, Type: db.QueryTypeInstant},
+			db.Query{TS: ts, QueryParam: "range_ok", StatusCode: 200, Type: db.QueryTypeRange},
+			db.Query{TS: ts, QueryParam: "range_failed", StatusCode: 503, Type: db.QueryTypeRange},
+		)
+	}
+	require.NoError(t, provider.Insert(ctx, queries))
+
+	errorsPolicy, err := NewPolicy("", "error", 8*time.Hour+30*time.Minute)
+	require.NoError(t, err)
+	rangePolicy, err := NewPolicy("range", "", 2*time.Hour+30*time.Minute)
+	require.NoError(t, err)
+
+	pruner := NewPruner(provider, 5*time.Hour+30*time.Minute, WithPolicies([]Policy{errorsPolicy, rangePolicy}))
+
+	deleted, err := pruner.Prune(ctx)
+	require.NoError(t, err)
+	// Failed queries keep 8 hours, successful range queries 2 hours and
+	// the remaining instant queries 5 hours.
+	assert.Equal(t, int64(2+2+8+5), deleted)
+
+	counts := countQueriesByParam(t, provider)
+	assert.Equal(t, map[string]int{
+		"instant_ok":     5,
+		"instant_failed": 8,
+		"range_ok":       2,
+		"range_failed":   8,
+	}, counts)
+}
+
+func TestPruner_PolicyWithoutMaxAgeKeepsQueries(t *testing.T) {
+	ctx := context.Background()
+
+	config.DefaultConfig.Database.SQLite.DatabasePath = filepath.Join(t.TempDir(), "retention.db")
+	provider, err := db.GetDbProvider(ctx, db.SQLite)
+	require.NoError(t, err)
+	defer provider.Close()
+
+	old := time.Now().Add(-48 * time.Hour)
+	require.NoError(t, provider.Insert(ctx, []db.Query{
+		{TS: old, QueryParam: "instant_ok", StatusCode: 200, Type: db.QueryTypeInstant},
+		{TS: old, QueryParam: "range_ok", StatusCode: 200, Type: db.QueryTypeRange},
+	}))
+
+	keepRange, err := NewPolicy("range", "", 0)
+	require.NoError(t, err)
+
+	deleted, err := NewPruner(provider, time.Hour, WithPolicies([]Policy{keepRange})).Prune(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), deleted)
+	assert.Equal(t, map[string]int{"range_ok": 1}, countQueriesByParam(t, provider))
+}
+
+func TestNewPolicy_Invalid(t *testing.T) {
+	_, err := NewPolicy("scalar", "", time.Hour)
+	assert.Error(t, err)
+
+	_, err = NewPolicy("", "6xx", time.Hour)
+	assert.Error(t, err)
+
+	policy, err := NewPolicy("instant", "4XX", time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, db.QueryMatch{Type: db.QueryTypeInstant, Status: "4xx"}, policy.Match)
+}
+
+func countQueriesByParam(t *testing.T, provider db.Provider) map[string]int {
+	t.Helper()
+
+	counts := make(map[string]int)
+	provider.WithDB(func(conn *sql.DB) {
+		rows, err := conn.Query("SELECT queryParam, COUNT(*) FROM queries GROUP BY queryParam")
+		require.NoError(t, err)
+		defer rows.Close()
+		for rows.Next() {
+			var (
+				param string
+				count int
+			)
+			require.NoError(t, rows.Scan(&param, &count))
+			counts[param] = count
+		}
+		require.NoError(t, rows.Err())
+	})
+	return counts
+}
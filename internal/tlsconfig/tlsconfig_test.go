@@ -0,0 +1,178 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeSelfSignedCert writes a self-signed certificate valid for 127.0.0.1
+// and its key to dir, returning their paths and the parsed certificate.
+func writeSelfSignedCert(t *testing.T, dir, name string) (string, string, *x509.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile, cert
+}
+
+// serve serves a handler answering "ok" over TLS and returns its URL.
+func serve(t *testing.T, tlsConfig *tls.Config) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write([]byte("ok"))
+		}),
+	}
+	go func() { _ = srv.Serve(tls.NewListener(l, tlsConfig)) }()
+	t.Cleanup(func() { _ = srv.Close() })
+
+	return "https://" + l.Addr().String()
+}
+
+func newClient(roots *x509.CertPool, certs ...tls.Certificate) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs},
+		},
+	}
+}
+
+func TestNewServerConfig_Disabled(t *testing.T) {
+	tlsConfig, reloader, err := NewServerConfig(config.ServerTLSConfig{})
+	require.NoError(t, err)
+	assert.Nil(t, tlsConfig)
+	assert.Nil(t, reloader)
+}
+
+func TestNewServerConfig_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, _ := writeSelfSignedCert(t, dir, "server")
+
+	for name, cfg := range map[string]config.ServerTLSConfig{
+		"missing key":           {CertFile: certFile},
+		"missing cert":          {KeyFile: keyFile},
+		"client CA without key": {ClientCAFile: certFile},
+		"unreadable cert":       {CertFile: filepath.Join(dir, "missing.crt"), KeyFile: keyFile},
+		"unreadable client CA":  {CertFile: certFile, KeyFile: keyFile, ClientCAFile: filepath.Join(dir, "missing.crt")},
+		"empty client CA":       {CertFile: certFile, KeyFile: keyFile, ClientCAFile: keyFile},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := NewServerConfig(cfg)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestNewServerConfig_RoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, cert := writeSelfSignedCert(t, dir, "server")
+
+	tlsConfig, reloader, err := NewServerConfig(config.ServerTLSConfig{CertFile: certFile, KeyFile: keyFile})
+	require.NoError(t, err)
+	url := serve(t, tlsConfig)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	resp, err := newClient(roots).Get(url)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, "ok", string(body))
+	assert.Equal(t, cert.SerialNumber, resp.TLS.PeerCertificates[0].SerialNumber)
+
+	// Rotate the certificate on disk, it is only served once reloaded.
+	rotatedCert, rotatedKey, rotated := writeSelfSignedCert(t, dir, "rotated")
+	require.NoError(t, os.Rename(rotatedCert, certFile))
+	require.NoError(t, os.Rename(rotatedKey, keyFile))
+	require.NoError(t, reloader.Reload())
+
+	roots.AddCert(rotated)
+	resp, err = newClient(roots).Get(url)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, rotated.SerialNumber, resp.TLS.PeerCertificates[0].SerialNumber)
+
+	// A failed reload keeps serving the current certificate.
+	require.NoError(t, os.WriteFile(certFile, []byte("garbage"), 0o600))
+	assert.Error(t, reloader.Reload())
+	resp, err = newClient(roots).Get(url)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, rotated.SerialNumber, resp.TLS.PeerCertificates[0].SerialNumber)
+}
+
+func TestNewServerConfig_ClientCA(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, cert := writeSelfSignedCert(t, dir, "server")
+	clientCertFile, clientKeyFile, _ := writeSelfSignedCert(t, dir, "client")
+
+	tlsConfig, _, err := NewServerConfig(config.ServerTLSConfig{
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		ClientCAFile: clientCertFile,
+	})
+	require.NoError(t, err)
+	url := serve(t, tlsConfig)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	_, err = newClient(roots).Get(url)
+	assert.Error(t, err, "a client without certificate must be rejected")
+
+	clientCert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+	require.NoError(t, err)
+	resp, err := newClient(roots, clientCert).Get(url)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"embed"
 	"errors"
 	"flag"
@@ -12,20 +13,27 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/oklog/run"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
-	"github.com/rs/cors"
+	"google.golang.org/grpc"
 
 	"github.com/nicolastakashi/prom-analytics-proxy/api/routes"
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/analytics"
 	"github.com/nicolastakashi/prom-analytics-proxy/internal/config"
 	"github.com/nicolastakashi/prom-analytics-proxy/internal/db"
 	"github.com/nicolastakashi/prom-analytics-proxy/internal/ingester"
 	"github.com/nicolastakashi/prom-analytics-proxy/internal/log"
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/reports"
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/retention"
+	"github.com/nicolastakashi/prom-analytics-proxy/internal/tlsconfig"
 	"github.com/nicolastakashi/prom-analytics-proxy/internal/tracing"
 )
 
@@ -46,19 +54,106 @@ func main() {
 		flagset.PrintDefaults()
 	}
 	log.RegisterFlags(flagset)
+	flagset.BoolVar(&config.DefaultConfig.Log.AccessLog, "log-access", false, "Log a line with the duration, status and size of each proxied query.")
+	flagset.BoolVar(&config.DefaultConfig.Log.RedactQueries, "log-redact-queries", false, "Log the SHA-256 hash of the queries instead of their text in the access log.")
 
-	flagset.StringVar(&configFile, "config-file", "", "Path to the configuration file, it takes precedence over the command line flags.")
+	flagset.StringVar(&configFile, "config-file", "", "Path to the configuration file, it takes precedence over the command line flags. It is reloaded on SIGHUP and POST /api/v1/config/reload.")
 	flagset.Uint64("metadata-limit", 0, "The maximum number of metric metadata entries to retrieve from the upstream prometheus API. (default 0 which means no limit)")
 	flagset.Uint64("series-limit", 0, "The maximum number of series to retrieve from the upstream prometheus API. (default 0 which means no limit)")
 	flagset.StringVar(&config.DefaultConfig.Server.InsecureListenAddress, "insecure-listen-address", ":9091", "The address the prom-analytics-proxy proxy HTTP server should listen on.")
+	flagset.StringVar(&config.DefaultConfig.Server.InternalListenAddress, "internal-listen-address", "", "The address serving /metrics, the health checks, /api/v1/stats and the admin endpoints instead of the main listen address. (default empty which means served by the main listen address)")
+	flagset.StringVar(&config.DefaultConfig.Server.TLS.CertFile, "tls-cert-file", "", "Path to the TLS certificate served by the HTTP server, it is reloaded on SIGHUP. (default empty which means plain HTTP)")
+	flagset.StringVar(&config.DefaultConfig.Server.TLS.KeyFile, "tls-key-file", "", "Path to the private key of the TLS certificate served by the HTTP server.")
+	flagset.StringVar(&config.DefaultConfig.Server.TLS.ClientCAFile, "tls-client-ca-file", "", "Path to the CA certificates used to verify client certificates, which are then required.")
+	flagset.BoolVar(&config.DefaultConfig.Server.Compression, "server-compression", true, "Gzip the responses of the analytics API for the clients accepting it.")
+	flagset.Func("server-cors-allowed-origins", "Comma separated list of the origins, or * for all, allowed to call the analytics API from a browser. The proxied Prometheus API never sends CORS headers. (default empty which means no CORS headers)", func(v string) error {
+		config.DefaultConfig.Server.CORS.AllowedOrigins = strings.Split(v, ",")
+		return nil
+	})
+	flagset.Func("server-cors-allowed-methods", "Comma separated list of the methods allowed to the origins calling the analytics API. (default GET, POST and HEAD)", func(v string) error {
+		config.DefaultConfig.Server.CORS.AllowedMethods = strings.Split(v, ",")
+		return nil
+	})
+	flagset.BoolVar(&config.DefaultConfig.Server.CORS.AllowCredentials, "server-cors-allow-credentials", false, "Allow the origins calling the analytics API to send credentials, such as cookies or the Authorization header.")
+	flagset.Float64Var(&config.DefaultConfig.Server.AnalyticsRateLimit, "server-analytics-rate-limit", 0, "Maximum number of requests per second served by the analytics API, beyond which it answers 429. The proxied Prometheus API is never limited. (default 0 which means unlimited)")
+	flagset.IntVar(&config.DefaultConfig.Server.AnalyticsBurst, "server-analytics-burst", 20, "Number of analytics API requests served in a burst beyond the rate limit.")
+	flagset.BoolVar(&config.DefaultConfig.Server.AnalyticsRateLimitIP, "server-analytics-rate-limit-per-ip", false, "Apply the analytics API rate limit to each client IP instead of all the clients together.")
+	flagset.StringVar(&config.DefaultConfig.Server.AdminToken, "admin-token", "", "Bearer token required by the administrative endpoints, such as ?explain=true on /api/v1/queries. (default empty which means disabled)")
 	flagset.StringVar(&config.DefaultConfig.Upstream.URL, "upstream", "", "The URL of the upstream prometheus API.")
-	flagset.BoolVar(&config.DefaultConfig.Upstream.IncludeQueryStats, "include-query-stats", false, "Request query stats from the upstream prometheus API.")
+	flagset.Func("upstream-urls", "Comma separated list of upstream prometheus API URLs, each one is tried in order when the previous one is unreachable or answers with a 5xx. -upstream is a shorthand for a single URL and is tried first when both are set.", func(v string) error {
+		config.DefaultConfig.Upstream.URLs = strings.Split(v, ",")
+		return nil
+	})
+	flagset.Int64Var(&config.DefaultConfig.Upstream.MaxResponseParseBytes, "upstream-max-response-parse-bytes", 1<<20, "Maximum number of bytes of each query response decoded looking for the query stats, responses with stats beyond it are recorded without samples. 0 means no limit.")
+	flagset.BoolVar(&config.DefaultConfig.Upstream.IncludeQueryStats, "include-query-stats", false, "Request query stats from the upstream prometheus API. Clients can opt out per request with the X-Prom-Analytics-No-Stats: true header.")
+	flagset.StringVar(&config.DefaultConfig.Upstream.Auth.BasicUsername, "upstream-basic-username", "", "Username for basic authentication against the upstream prometheus API.")
+	flagset.StringVar(&config.DefaultConfig.Upstream.Auth.BasicPassword, "upstream-basic-password", "", "Password for basic authentication against the upstream prometheus API.")
+	flagset.StringVar(&config.DefaultConfig.Upstream.Auth.BearerTokenFile, "upstream-bearer-token-file", "", "Path to a file containing a bearer token to authenticate against the upstream prometheus API. The file is re-read periodically.")
+	flagset.BoolVar(&config.DefaultConfig.Upstream.IncludeHeadersSize, "include-headers-size", false, "Include request and response headers size in the total bytes recorded for each query.")
+	flagset.DurationVar(&config.DefaultConfig.Proxy.ResultCache.TTL, "proxy-result-cache-ttl", 0, "TTL for caching successful instant query results at the proxy. (default 0 which means disabled)")
+	flagset.IntVar(&config.DefaultConfig.Proxy.ResultCache.MaxSize, "proxy-result-cache-max-size", 1000, "Maximum number of instant query results kept in the proxy result cache.")
+	flagset.BoolVar(&config.DefaultConfig.Proxy.CoalesceQueries, "proxy-coalesce-queries", false, "Share a single upstream request between concurrent identical queries.")
+	flagset.DurationVar(&config.DefaultConfig.Proxy.SplitInterval, "proxy-split-interval", 0, "Split range queries into sub-ranges of this interval and cache them independently. (default 0 which means disabled)")
+	flagset.IntVar(&config.DefaultConfig.Proxy.SplitCacheMaxSize, "proxy-split-cache-max-size", 1000, "Maximum number of range query sub-ranges kept in the proxy split cache.")
+	flagset.StringVar(&config.DefaultConfig.Proxy.TenantHeader, "proxy-tenant-header", "X-Scope-OrgID", "Request header holding the tenant recorded for each query.")
+	flagset.Func("proxy-trusted-proxies", "Comma separated list of IPs and CIDRs of the proxies trusted to set the X-Forwarded-For header used to record the source IP of each query. (default empty which means the header is ignored)", func(v string) error {
+		config.DefaultConfig.Proxy.TrustedProxies = strings.Split(v, ",")
+		return nil
+	})
+	flagset.Func("proxy-strip-params", "Comma separated list of query parameters, such as org_id or panel_id, removed from the URL and the form body of the requests before they are proxied upstream.", func(v string) error {
+		config.DefaultConfig.Proxy.StripParams = strings.Split(v, ",")
+		return nil
+	})
+	flagset.Func("proxy-response-headers-strip", "Comma separated list of headers removed from the upstream responses.", func(v string) error {
+		config.DefaultConfig.Proxy.ResponseHeaders.Strip = strings.Split(v, ",")
+		return nil
+	})
+	flagset.Func("proxy-response-headers-set", "Header added to or overridden in the upstream responses, in the name=value format. Can be repeated.", func(v string) error {
+		name, value, ok := strings.Cut(v, "=")
+		if !ok || name == "" {
+			return fmt.Errorf("invalid header %q, expected name=value", v)
+		}
+		if config.DefaultConfig.Proxy.ResponseHeaders.Set == nil {
+			config.DefaultConfig.Proxy.ResponseHeaders.Set = make(map[string]string)
+		}
+		config.DefaultConfig.Proxy.ResponseHeaders.Set[name] = value
+		return nil
+	})
 	flagset.IntVar(&config.DefaultConfig.Insert.BufferSize, "insert-buffer-size", 100, "Buffer size for the insert channel.")
 	flagset.IntVar(&config.DefaultConfig.Insert.BatchSize, "insert-batch-size", 10, "Batch size for inserting queries into the database.")
 	flagset.DurationVar(&config.DefaultConfig.Insert.Timeout, "insert-timeout", 1*time.Second, "Timeout to insert a query into the database.")
 	flagset.DurationVar(&config.DefaultConfig.Insert.FlushInterval, "insert-flush-interval", 5*time.Second, "Flush interval for inserting queries into the database.")
 	flagset.DurationVar(&config.DefaultConfig.Insert.GracePeriod, "insert-grace-period", 5*time.Second, "Grace period to insert pending queries after program shutdown.")
-	flagset.StringVar(&config.DefaultConfig.Database.Provider, "database-provider", "", "The provider of database to use for storing query data. Supported values: clickhouse, postgresql, sqlite.")
+	flagset.StringVar(&config.DefaultConfig.Insert.WALPath, "insert-wal-path", "", "Path to a write-ahead file used to buffer queries while the database is unavailable. (default empty which means disabled)")
+	flagset.Int64Var(&config.DefaultConfig.Insert.WALMaxBytes, "insert-wal-max-bytes", 256<<20, "Maximum size in bytes of the write-ahead file, queries that would grow it past this size are dropped. 0 means no limit.")
+	flagset.Func("insert-stored-label-names", "Comma separated list of label names to store in the label matchers of each query, __name__ is always stored. (default empty which means all labels)", func(v string) error {
+		config.DefaultConfig.Insert.StoredLabelNames = strings.Split(v, ",")
+		return nil
+	})
+	flagset.Func("insert-rule-eval-user-agents", "Comma separated list of User-Agent substrings, such as vmalert or Thanos-Ruler, identifying the queries sent by rule evaluators. Their queries are recorded with the rule source instead of user. (default empty which means every query is attributed to users)", func(v string) error {
+		config.DefaultConfig.Insert.RuleEvalUserAgents = strings.Split(v, ",")
+		return nil
+	})
+	flagset.IntVar(&config.DefaultConfig.Insert.MaxLabelMatchers, "insert-max-label-matchers", 0, "Maximum number of label matchers stored for each query, __name__ is always stored. (default 0 which means unlimited)")
+	flagset.IntVar(&config.DefaultConfig.Insert.MaxQueryParamLength, "insert-max-query-param-length", 0, "Maximum length in bytes of the query text stored for each query, longer queries are truncated. (default 0 which means unlimited)")
+	flagset.StringVar(&config.DefaultConfig.Insert.FingerprintMode, "insert-fingerprint-mode", string(ingester.FingerprintModeLegacy), "How query fingerprints are computed: legacy hashes the parsed query with label values masked as the previous releases did, raw hashes the query text, ast hashes the parsed query with label values masked and label matchers sorted. Switching modes changes the fingerprints of the new queries, splitting the history of each expression at the switch.")
+	flagset.BoolVar(&config.DefaultConfig.Insert.NormalizeQueries, "insert-normalize-queries", false, "Replace numeric literals, durations and string literals with placeholders when computing query fingerprints, so queries differing only in those are grouped together.")
+	flagset.BoolVar(&config.DefaultConfig.Insert.ReadOnly, "insert-read-only", false, "Start with the writes to the database suspended, queries are buffered to the WAL when configured and dropped otherwise. It can be toggled with /api/v1/admin/read_only.")
+	flagset.StringVar(&config.DefaultConfig.Insert.OTLPListenAddress, "insert-otlp-listen-address", "", "The address of an OTLP logs gRPC receiver recording the queries described by the query, type, duration_ms and status_code attributes of the received log records, for queries not sent through the proxy. (default empty which means disabled)")
+	flagset.Float64Var(&config.DefaultConfig.Insert.SampleRate, "insert-sample-rate", 1, "Fraction, between 0 and 1, of the successful queries recorded. Failed queries are always recorded.")
+	flagset.DurationVar(&config.DefaultConfig.Analytics.MetricsRefreshInterval, "analytics-metrics-refresh-interval", 0, "Interval to refresh the query analytics exposed on /metrics. (default 0 which means disabled)")
+	flagset.DurationVar(&config.DefaultConfig.Analytics.MetricsWindow, "analytics-metrics-window", 1*time.Hour, "Time window of queries considered for the query analytics exposed on /metrics.")
+	flagset.DurationVar(&config.DefaultConfig.Analytics.DefaultLookback, "analytics-default-lookback", 7*24*time.Hour, "Time range of the queries considered by the analytics endpoints when their from parameter is omitted.")
+	flagset.DurationVar(&config.DefaultConfig.Analytics.UsageLookback, "analytics-usage-lookback", 7*24*time.Hour, "Time range of the rules and dashboards usage and of the queries of a serie considered by the analytics endpoints. Usage is pushed less often than queries are recorded, so it usually needs a longer lookback.")
+	flagset.DurationVar(&config.DefaultConfig.Retention.MaxAge, "retention-max-age", 0, "Maximum age of the queries kept in the database, older queries are deleted. (default 0 which means disabled)")
+	flagset.DurationVar(&config.DefaultConfig.Retention.Interval, "retention-interval", 1*time.Hour, "Interval to delete the queries older than the retention max age.")
+	flagset.DurationVar(&config.DefaultConfig.Reports.Schedule, "reports-schedule", 0, "Interval to post an analytics report covering the previous interval, e.g. 24h for a daily report. (default 0 which means disabled)")
+	flagset.StringVar(&config.DefaultConfig.Reports.Webhook, "reports-webhook", "", "The URL of the webhook the analytics reports are posted to.")
+	flagset.StringVar(&config.DefaultConfig.Database.Provider, "database-provider", "", "The provider of database to use for storing query data. Supported values: clickhouse, postgresql, sqlite, none.")
+	flagset.BoolVar(&config.DefaultConfig.Database.Cache.Enabled, "database-cache-enabled", false, "Cache the results of the analytics database queries, which may then be stale for up to the cache TTL.")
+	flagset.DurationVar(&config.DefaultConfig.Database.Cache.TTL, "database-cache-ttl", 30*time.Second, "TTL of the cached analytics database query results.")
+	flagset.IntVar(&config.DefaultConfig.Database.Cache.MaxSize, "database-cache-max-size", 1000, "Maximum number of analytics database query results kept in the cache.")
+	flagset.DurationVar(&config.DefaultConfig.Database.QueryTimeout, "database-query-timeout", 30*time.Second, "Maximum duration of the database queries run by the analytics API, also set as the PostgreSQL statement_timeout. (0 means no timeout)")
 
 	db.RegisterClickHouseFlags(flagset)
 	db.RegisterPostGreSQLFlags(flagset)
@@ -85,6 +180,16 @@ func main() {
 		}
 	}
 
+	if err := config.LoadEnv(); err != nil {
+		slog.Error("unable to load config from environment variables", "err", err)
+		os.Exit(1)
+	}
+
+	if err := config.DefaultConfig.Validate(db.RegisteredProviders()); err != nil {
+		slog.Error("invalid configuration", "err", err)
+		os.Exit(1)
+	}
+
 	if config.DefaultConfig.IsTracingEnabled() {
 		tp, err := tracing.WithTracing(context.Background(), logger, configFile)
 		if err != nil {
@@ -99,15 +204,14 @@ func main() {
 		}()
 	}
 
-	upstreamURL, err := url.Parse(config.DefaultConfig.Upstream.URL)
-	if err != nil {
-		slog.Error("unable to parse upstream", "err", err)
-		os.Exit(1)
-	}
-
-	if upstreamURL.Scheme != "http" && upstreamURL.Scheme != "https" {
-		slog.Error(fmt.Sprintf("invalid scheme for upstream URL %q, only 'http' and 'https' are supported", config.DefaultConfig.Upstream.URL))
-		os.Exit(1)
+	upstreamURLs := make([]*url.URL, 0)
+	for _, rawURL := range config.DefaultConfig.Upstream.GetURLs() {
+		upstreamURL, err := url.Parse(rawURL)
+		if err != nil {
+			slog.Error("unable to parse upstream", "err", err)
+			os.Exit(1)
+		}
+		upstreamURLs = append(upstreamURLs, upstreamURL)
 	}
 
 	reg := prometheus.NewRegistry()
@@ -124,6 +228,20 @@ func main() {
 		os.Exit(1)
 	}
 	defer dbProvider.Close()
+	reg.MustRegister(db.NewStatsCollector(dbProvider))
+
+	// The analytics API reads through the cache, while the ingester and the
+	// background jobs always use the database directly.
+	analyticsDBProvider := dbProvider
+	if cacheConfig := config.DefaultConfig.Database.Cache; cacheConfig.Enabled {
+		analyticsDBProvider = db.NewCachedProvider(dbProvider, cacheConfig.TTL, cacheConfig.MaxSize)
+	}
+
+	fingerprintMode, err := ingester.ParseFingerprintMode(config.DefaultConfig.Insert.FingerprintMode)
+	if err != nil {
+		slog.Error("invalid insert fingerprint mode", "err", err)
+		os.Exit(1)
+	}
 
 	queryIngester := ingester.NewQueryIngester(
 		dbProvider,
@@ -132,6 +250,16 @@ func main() {
 		ingester.WithShutdownGracePeriod(config.DefaultConfig.Insert.GracePeriod),
 		ingester.WithBatchSize(config.DefaultConfig.Insert.BatchSize),
 		ingester.WithBatchFlushInterval(config.DefaultConfig.Insert.FlushInterval),
+		ingester.WithWALPath(config.DefaultConfig.Insert.WALPath),
+		ingester.WithWALMaxBytes(config.DefaultConfig.Insert.WALMaxBytes),
+		ingester.WithStoredLabelNames(config.DefaultConfig.Insert.StoredLabelNames),
+		ingester.WithMaxLabelMatchers(config.DefaultConfig.Insert.MaxLabelMatchers),
+		ingester.WithMaxQueryParamLength(config.DefaultConfig.Insert.MaxQueryParamLength),
+		ingester.WithNormalizeQueries(config.DefaultConfig.Insert.NormalizeQueries),
+		ingester.WithFingerprintMode(fingerprintMode),
+		ingester.WithReadOnly(config.DefaultConfig.Insert.ReadOnly),
+		ingester.WithSampleRate(config.DefaultConfig.Insert.SampleRate),
+		ingester.WithRegisterer(reg),
 	)
 
 	// Run Ingester loop
@@ -145,7 +273,88 @@ func main() {
 		})
 	}
 
+	// Run OTLP logs receiver
+	if config.DefaultConfig.Insert.OTLPListenAddress != "" {
+		l, err := net.Listen("tcp", config.DefaultConfig.Insert.OTLPListenAddress)
+		if err != nil {
+			slog.Error("failed to listen on OTLP address", "err", err)
+			os.Exit(1)
+		}
+
+		srv := grpc.NewServer()
+		ingester.NewOTLPReceiver(queryIngester).Register(srv)
+
+		g.Add(func() error {
+			slog.Info("listening for OTLP logs", "addr", l.Addr())
+			return srv.Serve(l)
+		}, func(error) {
+			slog.Info("stopping OTLP receiver")
+			srv.GracefulStop()
+		})
+	}
+
+	// Run analytics metrics collector loop
+	if config.DefaultConfig.Analytics.MetricsRefreshInterval > 0 {
+		collector := analytics.NewCollector(
+			dbProvider,
+			reg,
+			analytics.WithRefreshInterval(config.DefaultConfig.Analytics.MetricsRefreshInterval),
+			analytics.WithWindow(config.DefaultConfig.Analytics.MetricsWindow),
+		)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			collector.Run(ctx)
+			return nil
+		}, func(err error) {
+			cancel()
+		})
+	}
+
+	// Run retention loop
+	var pruner *retention.Pruner
+	if config.DefaultConfig.Retention.MaxAge > 0 || len(config.DefaultConfig.Retention.Policies) > 0 {
+		policies, err := retentionPolicies(config.DefaultConfig)
+		if err != nil {
+			slog.Error("invalid retention policy", "err", err)
+			os.Exit(1)
+		}
+
+		pruner = retention.NewPruner(
+			dbProvider,
+			config.DefaultConfig.Retention.MaxAge,
+			retention.WithInterval(config.DefaultConfig.Retention.Interval),
+			retention.WithPolicies(policies),
+		)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			pruner.Run(ctx)
+			return nil
+		}, func(err error) {
+			cancel()
+		})
+	}
+
+	// Run analytics reports loop
+	if config.DefaultConfig.Reports.Schedule > 0 {
+		reporter := reports.NewReporter(
+			dbProvider,
+			config.DefaultConfig.Reports.Webhook,
+			reports.WithSchedule(config.DefaultConfig.Reports.Schedule),
+		)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			reporter.Run(ctx)
+			return nil
+		}, func(err error) {
+			cancel()
+		})
+	}
+
 	// Register proxy HTTP Server
+	var reloader *configReloader
 	{
 		ctx, cancel := context.WithCancel(context.Background())
 
@@ -155,31 +364,72 @@ func main() {
 			os.Exit(1)
 		}
 
-		routes, err := routes.NewRoutes(
+		trustedProxies, err := routes.ParseTrustedProxies(config.DefaultConfig.Proxy.TrustedProxies)
+		if err != nil {
+			slog.Error("unable to parse trusted proxies", "err", err)
+			os.Exit(1)
+		}
+
+		var reloadOpts []routes.Option
+		if configFile != "" {
+			reloader = &configReloader{
+				configFile:    configFile,
+				queryIngester: queryIngester,
+				pruner:        pruner,
+			}
+			reloadOpts = append(reloadOpts, routes.WithConfigReload(reloader.Reload))
+		}
+
+		routes, err := routes.NewRoutes(append([]routes.Option{
 			routes.WithIncludeQueryStats(config.DefaultConfig.Upstream.IncludeQueryStats),
-			routes.WithProxy(upstreamURL),
-			routes.WithPromAPI(upstreamURL),
-			routes.WithDBProvider(dbProvider),
+			routes.WithIncludeHeadersSize(config.DefaultConfig.Upstream.IncludeHeadersSize),
+			routes.WithMaxResponseParseBytes(config.DefaultConfig.Upstream.MaxResponseParseBytes),
+			routes.WithUpstreamAuth(
+				config.DefaultConfig.Upstream.Auth.BasicUsername,
+				config.DefaultConfig.Upstream.Auth.BasicPassword,
+				config.DefaultConfig.Upstream.Auth.BearerTokenFile,
+			),
+			routes.WithProxy(upstreamURLs...),
+			routes.WithPromAPI(upstreamURLs...),
+			routes.WithDBProvider(analyticsDBProvider),
+			routes.WithQueryTimeout(config.DefaultConfig.Database.QueryTimeout),
+			routes.WithDefaultLookback(config.DefaultConfig.Analytics.DefaultLookback),
 			routes.WithQueryIngester(queryIngester),
+			routes.WithAccessLog(config.DefaultConfig.Log.AccessLog, config.DefaultConfig.Log.RedactQueries),
 			routes.WithHandlers(uiFS, reg, config.DefaultConfig.IsTracingEnabled()),
+			routes.WithResultCache(config.DefaultConfig.Proxy.ResultCache.TTL, config.DefaultConfig.Proxy.ResultCache.MaxSize),
+			routes.WithAdminToken(config.DefaultConfig.Server.AdminToken),
+			routes.WithRuleEvalUserAgents(config.DefaultConfig.Insert.RuleEvalUserAgents),
+			routes.WithInternalListener(config.DefaultConfig.Server.InternalListenAddress != ""),
+			routes.WithCompression(config.DefaultConfig.Server.Compression),
+			routes.WithCORS(config.DefaultConfig.Server.CORS.AllowedOrigins, config.DefaultConfig.Server.CORS.AllowedMethods, config.DefaultConfig.Server.CORS.AllowCredentials),
+			routes.WithAnalyticsRateLimit(config.DefaultConfig.Server.AnalyticsRateLimit, config.DefaultConfig.Server.AnalyticsBurst, config.DefaultConfig.Server.AnalyticsRateLimitIP),
+			routes.WithTenantHeader(config.DefaultConfig.Proxy.TenantHeader),
+			routes.WithTrustedProxies(trustedProxies),
+			routes.WithResponseHeaders(config.DefaultConfig.Proxy.ResponseHeaders.Strip, config.DefaultConfig.Proxy.ResponseHeaders.Set),
+			routes.WithStripParams(config.DefaultConfig.Proxy.StripParams),
+			routes.WithQueryCoalescing(config.DefaultConfig.Proxy.CoalesceQueries),
+			routes.WithQuerySplitting(config.DefaultConfig.Proxy.SplitInterval, config.DefaultConfig.Proxy.SplitCacheMaxSize),
 			routes.WithSeriesLimit(config.DefaultConfig.SeriesLimit),
 			routes.WithMetadataLimit(config.DefaultConfig.MetadataLimit),
-		)
+		}, reloadOpts...)...)
 
 		if err != nil {
 			slog.Error("unable to create routes", "err", err)
 			os.Exit(1)
 		}
+		if reloader != nil {
+			reloader.setQueryTimeout = routes.SetQueryTimeout
+		}
 
 		mux := http.NewServeMux()
 		mux.Handle("/", routes)
 
-		corsHandler := cors.New(cors.Options{
-			AllowedOrigins:   []string{"*"}, // Allow all origins, adjust this for specific origins
-			AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-			AllowedHeaders:   []string{"Content-Type", "Authorization"},
-			AllowCredentials: true,
-		}).Handler(mux)
+		tlsConfig, certReloader, err := tlsconfig.NewServerConfig(config.DefaultConfig.Server.TLS)
+		if err != nil {
+			slog.Error("invalid TLS configuration", "err", err)
+			os.Exit(1)
+		}
 
 		l, err := net.Listen("tcp", config.DefaultConfig.Server.InsecureListenAddress)
 		if err != nil {
@@ -188,11 +438,45 @@ func main() {
 		}
 
 		srv := &http.Server{
-			Handler: corsHandler,
+			Handler: mux,
+		}
+
+		if tlsConfig != nil {
+			l = tls.NewListener(l, tlsConfig)
+		}
+
+		// Reload the certificate and the configuration on SIGHUP so they
+		// can be changed without a restart.
+		if certReloader != nil || reloader != nil {
+			hup := make(chan os.Signal, 1)
+			signal.Notify(hup, syscall.SIGHUP)
+			hupCtx, hupCancel := context.WithCancel(context.Background())
+			g.Add(func() error {
+				for {
+					select {
+					case <-hup:
+						if certReloader != nil {
+							if err := certReloader.Reload(); err != nil {
+								slog.Error("unable to reload TLS certificate", "err", err)
+							}
+						}
+						if reloader != nil {
+							if _, err := reloader.Reload(); err != nil {
+								slog.Error("unable to reload the configuration", "err", err)
+							}
+						}
+					case <-hupCtx.Done():
+						return nil
+					}
+				}
+			}, func(error) {
+				signal.Stop(hup)
+				hupCancel()
+			})
 		}
 
 		g.Add(func() error {
-			slog.Info("listening insecurely", "addr", l.Addr())
+			slog.Info("listening", "addr", l.Addr(), "tls", tlsConfig != nil)
 			if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
 				slog.Error("server stopped", "err", err)
 				return err
@@ -205,6 +489,35 @@ func main() {
 				slog.Error("error shutting down server", "err", err)
 			}
 		})
+
+		if addr := config.DefaultConfig.Server.InternalListenAddress; addr != "" {
+			il, err := net.Listen("tcp", addr)
+			if err != nil {
+				slog.Error("failed to listen on internal address", "err", err)
+				os.Exit(1)
+			}
+			if tlsConfig != nil {
+				il = tls.NewListener(il, tlsConfig)
+			}
+
+			internalSrv := &http.Server{
+				Handler: routes.InternalHandler(),
+			}
+
+			g.Add(func() error {
+				slog.Info("listening for internal endpoints", "addr", il.Addr(), "tls", tlsConfig != nil)
+				if err := internalSrv.Serve(il); err != nil && err != http.ErrServerClosed {
+					slog.Error("internal server stopped", "err", err)
+					return err
+				}
+				return nil
+			}, func(error) {
+				slog.Info("stopping internal HTTP Server")
+				if err := internalSrv.Shutdown(ctx); err != nil {
+					slog.Error("error shutting down internal server", "err", err)
+				}
+			})
+		}
 	}
 
 	// Register Signal Handler
@@ -220,3 +533,61 @@ func main() {
 		slog.Info("caught signal; exiting gracefully...")
 	}
 }
+
+// retentionPolicies builds the retention policies of the configuration.
+func retentionPolicies(cfg *config.Config) ([]retention.Policy, error) {
+	policies := make([]retention.Policy, 0, len(cfg.Retention.Policies))
+	for _, p := range cfg.Retention.Policies {
+		policy, err := retention.NewPolicy(p.Match.Type, p.Match.Status, p.MaxAge)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
+
+// configReloader reloads the configuration file and applies the settings
+// that can change at runtime.
+type configReloader struct {
+	mu              sync.Mutex
+	configFile      string
+	queryIngester   *ingester.QueryIngester
+	pruner          *retention.Pruner
+	setQueryTimeout func(time.Duration)
+}
+
+// Reload reloads the configuration, returning the changed settings which
+// require a restart to apply.
+func (c *configReloader) Reload() ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cfg, requiresRestart, err := config.Reload(c.configFile, db.RegisteredProviders())
+	if err != nil {
+		return nil, err
+	}
+	policies, err := retentionPolicies(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid retention policy: %w", err)
+	}
+
+	c.queryIngester.SetSampleRate(cfg.Insert.SampleRate)
+	if c.setQueryTimeout != nil {
+		c.setQueryTimeout(cfg.Database.QueryTimeout)
+	}
+	retentionEnabled := cfg.Retention.MaxAge > 0 || len(cfg.Retention.Policies) > 0
+	switch {
+	case c.pruner != nil:
+		c.pruner.SetRetention(cfg.Retention.MaxAge, policies)
+	case retentionEnabled:
+		// The pruner only runs when a retention was configured at startup.
+		requiresRestart = append(requiresRestart, "retention")
+	}
+	if len(requiresRestart) > 0 {
+		slog.Warn("configuration reloaded, some changed settings require a restart", "settings", requiresRestart)
+	} else {
+		slog.Info("configuration reloaded")
+	}
+	return requiresRestart, nil
+}
@@ -26,6 +26,9 @@ export interface PagedResult<T> {
     data: T[];
     total: number;
     totalPages: number;
+    page: number;
+    pageSize: number;
+    hasNext: boolean;
 }
 
 const QueryShortcuts = async () => {
@@ -83,6 +86,8 @@ export interface SerieExpression {
     avgDuration: number;
     avgPeakySamples: number;
     maxPeakSamples: number;
+    executions: number;
+    errorRatePercent: number;
     ts: string;
 }
 